@@ -0,0 +1,39 @@
+package convert
+
+import (
+	"cmp"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// activations maps the activation names of Hugging Face configs to those
+// written to GGUF
+var activations = map[string]string{
+	"silu":              "silu",
+	"swish":             "silu",
+	"gelu":              "gelu",
+	"gelu_new":          "gelu_tanh",
+	"gelu_fast":         "gelu_tanh",
+	"gelu_pytorch_tanh": "gelu_tanh",
+	"gelu_tanh":         "gelu_tanh",
+	"relu":              "relu",
+	"relu2":             "relu2",
+	"relu_squared":      "relu2",
+}
+
+// activationKV returns the feed forward activation metadata for arch. The
+// activation is read from hidden_activation, hidden_act or, in GPT-2 style
+// configs, activation_function and defaults to def, the activation of the
+// architecture. Unknown activations are written as def with a warning.
+func (p *Params) activationKV(arch, def string) llm.KV {
+	act := def
+	if name := cmp.Or(p.HiddenActivation, p.HiddenAct, p.ActivationFunction); name != "" {
+		if a, ok := activations[name]; ok {
+			act = a
+		} else {
+			p.warn("unknown activation, using default", "activation", name, "default", def)
+		}
+	}
+
+	return llm.KV{arch + ".feed_forward.activation": act}
+}
@@ -0,0 +1,55 @@
+package convert
+
+import (
+	"maps"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertActivation(t *testing.T) {
+	d := createTinyLlama(t)
+
+	cases := []struct {
+		name      string
+		config    map[string]any
+		want      string
+		wantWarns int
+	}{
+		{"default", nil, "silu", 0},
+		{"hidden_act", map[string]any{"hidden_act": "gelu"}, "gelu", 0},
+		{"activation_function", map[string]any{"activation_function": "gelu_new"}, "gelu_tanh", 0},
+		{"relu2", map[string]any{"hidden_act": "relu2"}, "relu2", 0},
+		{"unknown", map[string]any{"hidden_act": "mish"}, "silu", 1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			config := map[string]any{
+				"architectures":           []string{"LlamaForCausalLM"},
+				"vocab_size":              4,
+				"hidden_size":             8,
+				"num_hidden_layers":       1,
+				"max_position_embeddings": 128,
+				"intermediate_size":       16,
+				"num_attention_heads":     2,
+				"num_key_value_heads":     2,
+				"rms_norm_eps":            1e-5,
+				"bos_token_id":            2,
+				"eos_token_id":            3,
+			}
+
+			maps.Copy(config, tt.config)
+			createJSON(t, filepath.Join(d, "config.json"), config)
+
+			var params *Params
+			kv, _ := convertDir(t, d, func(p *Params) { params = p })
+			if got := kv["llama.feed_forward.activation"]; got != tt.want {
+				t.Fatalf("expected activation %s, got %v", tt.want, got)
+			}
+
+			if len(params.warnings) != tt.wantWarns {
+				t.Fatalf("expected %d warnings, got %v", tt.wantWarns, params.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// AyaVisionModel converts the SigLIP2 vision tower and connector of Cohere's
+// Aya Vision to a clip projector. The tower is that of SigLIP except that
+// NaFlex checkpoints embed patches with a linear layer, which is reshaped
+// here into the convolution SigLIP uses. Images are read from the output of
+// vision_feature_layer, before the post-layernorm, so later layers and the
+// post-layernorm are dropped. The connector folds each square of
+// downsample_factor patches into one, normalizes it and projects it into the
+// text model with a SwiGLU whose fused first projection is split into its
+// up and gate halves.
+type AyaVisionModel struct {
+	ModelData
+}
+
+func (m *AyaVisionModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	vision := m.Params.VisionConfig
+	if vision == nil {
+		return errors.New("aya vision: config is missing vision_config")
+	}
+
+	layers := m.Params.visionFeatureLayers()
+	for _, l := range t {
+		switch {
+		case strings.HasPrefix(l.Name, "v.head."), strings.HasPrefix(l.Name, "v.post_ln."):
+			// unused by the connector
+		case strings.HasPrefix(l.Name, "v.blk."):
+			i, err := strconv.Atoi(strings.Split(l.Name, ".")[2])
+			if err != nil {
+				return fmt.Errorf("aya vision: %s: %w", l.Name, err)
+			}
+
+			if i < layers {
+				m.Tensors = append(m.Tensors, l)
+			}
+		case l.Name == "v.patch_embd.weight" && len(l.Shape) == 2:
+			p := uint64(vision.PatchSize)
+			if p == 0 || l.Shape[1]%(p*p) != 0 {
+				return fmt.Errorf("aya vision: linear patch embedding %v doesn't hold patches of %d", l.Shape, p)
+			}
+
+			shape := []uint64{l.Shape[0], l.Shape[1] / (p * p), p, p}
+			kind, err := m.Params.tensorKind(l.Name, shape, 0)
+			if err != nil {
+				return err
+			}
+
+			m.Tensors = append(m.Tensors, repackTensor(l, l.Name, kind, shape, patchesToConv(p)))
+		case strings.HasPrefix(l.Name, "mm.ffn_gate_up."):
+			if l.Shape[0]%2 != 0 {
+				return fmt.Errorf("aya vision: %s has an odd number of rows %d", l.Name, l.Shape[0])
+			}
+
+			shape := slices.Clone(l.Shape)
+			shape[0] /= 2
+			for i, part := range []string{"ffn_up", "ffn_gate"} {
+				m.Tensors = append(m.Tensors, repackTensor(l, strings.Replace(l.Name, "ffn_gate_up", part, 1), l.Kind, shape, splitHalves(i)))
+			}
+		case strings.HasPrefix(l.Name, "v."), strings.HasPrefix(l.Name, "mm."):
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+// visionFeatureLayers returns the number of vision tower layers the image
+// features are read after. vision_feature_layer counts from the embeddings
+// when positive and from the last layer when negative.
+func (p *Params) visionFeatureLayers() int {
+	layers := p.VisionConfig.HiddenLayers
+	if p.VisionFeatureLayer == nil {
+		return layers
+	}
+
+	if i := *p.VisionFeatureLayer; i < 0 {
+		return layers + 1 + i
+	}
+
+	return *p.VisionFeatureLayer
+}
+
+// patchesToConv returns a repack function reshaping a linear patch embedding,
+// whose inputs are the pixels of a patch row by row with their channels
+// innermost, into a convolution over channels, rows and columns
+func patchesToConv(p uint64) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, shape []uint64) ([]float32, error) {
+		cols := shape[1]
+		channels := cols / (p * p)
+
+		out := make([]float32, len(data))
+		for row := range shape[0] {
+			for y := range p {
+				for x := range p {
+					for c := range channels {
+						out[row*cols+c*p*p+y*p+x] = data[row*cols+(y*p+x)*channels+c]
+					}
+				}
+			}
+		}
+
+		return out, nil
+	}
+}
+
+// splitHalves returns the ith of two equal parts of the rows of a tensor
+func splitHalves(i int) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, _ []uint64) ([]float32, error) {
+		n := len(data) / 2
+		return data[i*n : (i+1)*n], nil
+	}
+}
+
+// LoadVocab does nothing since the projector has no vocabulary of its own
+func (m *AyaVisionModel) LoadVocab() error {
+	m.Vocab = &Vocab{}
+	return nil
+}
+
+func (m *AyaVisionModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv, err := visionKV("clip", m.Params, m.FS)
+	if err != nil {
+		return err
+	}
+
+	kv["general.architecture"] = "clip"
+	kv["general.name"] = m.Name
+	kv["general.file_type"] = m.Params.fileType()
+	kv["clip.has_text_encoder"] = false
+	kv["clip.has_vision_encoder"] = true
+	kv["clip.has_llava_projector"] = false
+	kv["clip.projector_type"] = "aya_vision"
+	kv["clip.vision.block_count"] = uint32(m.Params.visionFeatureLayers())
+	kv["clip.vision.projector.scale_factor"] = uint32(cmp.Or(m.Params.DownsampleFactor, 2))
+	kv["clip.vision.projector.layer_norm_epsilon"] = float32(cmp.Or(m.Params.AdapterLayerNormEPS, 1e-6))
+
+	if m.Params.TextConfig != nil {
+		kv["clip.vision.projection_dim"] = uint32(m.Params.TextConfig.HiddenSize)
+	}
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the vision tower and every part of the connector were
+// found and vision_feature_layer is within the tower
+func (m *AyaVisionModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == "v.patch_embd.weight" }) {
+		return errors.New("aya vision: vision tower not found")
+	}
+
+	for _, name := range []string{"mm.input_norm.weight", "mm.ffn_up.weight", "mm.ffn_gate.weight", "mm.ffn_down.weight"} {
+		if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+			return fmt.Errorf("aya vision: %s not found", name)
+		}
+	}
+
+	if layers := m.Params.visionFeatureLayers(); layers < 1 || layers > m.Params.VisionConfig.HiddenLayers {
+		return fmt.Errorf("aya vision: vision_feature_layer selects %d of the %d layers of the vision tower", layers, m.Params.VisionConfig.HiddenLayers)
+	}
+
+	return nil
+}
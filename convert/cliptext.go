@@ -0,0 +1,152 @@
+package convert
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// CLIPTextModel converts a CLIP text encoder, e.g. one of the text encoders
+// of a Stable Diffusion pipeline, to a clip model with only a text encoder.
+// CLIPTextModelWithProjection also has the projection of its pooled output.
+type CLIPTextModel struct {
+	ModelData
+}
+
+func (m *CLIPTextModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, t...)
+	return nil
+}
+
+// LoadVocab reads the CLIP vocabulary from vocab.json and merges.txt. Models
+// which are part of a diffusers pipeline keep these in the tokenizer
+// directory matching the text encoder, which ConvertDiffusionTextEncoders
+// passes as the TokenizerDir option.
+func (m *CLIPTextModel) LoadVocab() error {
+	v, err := loadCLIPVocab(m.tokenizerFS())
+	if err != nil {
+		return err
+	}
+
+	// the ids in the configs of older pipelines aren't those of the vocab
+	if i := slices.Index(v.Tokens, "<|startoftext|>"); i >= 0 {
+		m.Params.BoSTokenID = i
+	}
+
+	if i := slices.Index(v.Tokens, "<|endoftext|>"); i >= 0 {
+		m.Params.EoSTokenID = i
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func loadCLIPVocab(fsys fs.FS) (*Vocab, error) {
+	f, err := fsys.Open("vocab.json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ids map[string]int
+	if err := json.NewDecoder(f).Decode(&ids); err != nil {
+		return nil, err
+	}
+
+	v := &Vocab{Model: "clip", Tokens: make([]string, len(ids)), Types: make([]int32, len(ids))}
+	for token, id := range ids {
+		if id < 0 || id >= len(ids) {
+			return nil, fmt.Errorf("vocab.json: id %d of %q is out of range", id, token)
+		}
+
+		v.Tokens[id] = token
+		v.Types[id] = tokenTypeNormal
+		if strings.HasPrefix(token, "<|") && strings.HasSuffix(token, "|>") {
+			v.Types[id] = tokenTypeControl
+		}
+	}
+
+	mf, err := fsys.Open("merges.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+
+	s := bufio.NewScanner(mf)
+	for s.Scan() {
+		// the first line is a #version header
+		if line := s.Text(); line != "" && !strings.HasPrefix(line, "#") {
+			v.Merges = append(v.Merges, line)
+		}
+	}
+
+	return v, s.Err()
+}
+
+func (m *CLIPTextModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv := llm.KV{
+		"general.architecture":                   "clip",
+		"general.name":                           m.Name,
+		"general.file_type":                      m.Params.fileType(),
+		"clip.has_text_encoder":                  true,
+		"clip.has_vision_encoder":                false,
+		"clip.has_llava_projector":               false,
+		"clip.use_gelu":                          m.Params.HiddenAct != "quick_gelu",
+		"clip.text.context_length":               uint32(m.Params.contextLength()),
+		"clip.text.embedding_length":             uint32(m.Params.HiddenSize),
+		"clip.text.feed_forward_length":          uint32(m.Params.IntermediateSize),
+		"clip.text.block_count":                  uint32(m.Params.HiddenLayers),
+		"clip.text.attention.head_count":         uint32(m.Params.AttentionHeads),
+		"clip.text.attention.layer_norm_epsilon": float32(cmp.Or(m.Params.LayerNormEPS, 1e-5)),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
+		"tokenizer.ggml.tokens":                  m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":              m.Vocab.Types,
+		"tokenizer.ggml.merges":                  m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":            uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":            uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":        uint32(m.Params.PaddingTokenID),
+	}
+
+	if slices.ContainsFunc(m.Tensors, func(t llm.Tensor) bool { return t.Name == "t.text_projection.weight" }) {
+		kv["clip.text.projection_dim"] = uint32(m.Params.ProjectionDim)
+	}
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the embeddings were found and models with a projection
+// have one matching projection_dim
+func (m *CLIPTextModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	for _, name := range []string{"t.token_embd.weight", "t.position_embd.weight"} {
+		if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+			return fmt.Errorf("clip: %s not found", name)
+		}
+	}
+
+	i := slices.IndexFunc(ts, func(t llm.Tensor) bool { return t.Name == "t.text_projection.weight" })
+	switch {
+	case i < 0 && slices.Contains(m.Params.Architectures, "CLIPTextModelWithProjection"):
+		return errors.New("clip: text_projection not found")
+	case i >= 0 && ts[i].Shape[0] != uint64(m.Params.ProjectionDim):
+		return fmt.Errorf("clip: text_projection has %d outputs but projection_dim is %d", ts[i].Shape[0], m.Params.ProjectionDim)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// CohereModel converts Cohere's Command-R. Each layer runs attention and the
+// feed forward network in parallel on the output of a single layer norm,
+// which like every other norm and projection has no bias. The rotary
+// embedding pairs adjacent dimensions so the query and key aren't repacked.
+// The output projection is tied to the token embedding and its logits are
+// scaled by logit_scale. Command R+, with use_qk_norm, normalizes each query
+// and key head with a norm of its own, stored as one tensor per layer.
+type CohereModel struct {
+	ModelData
+}
+
+func (m *CohereModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	tied := m.Params.TieWordEmbeddings == nil || *m.Params.TieWordEmbeddings
+	for _, l := range t {
+		// runtimes derive the output projection from the token embedding
+		if tied && l.Name == "output.weight" {
+			slog.Debug("skipping tied output tensor", "name", l.Name)
+			continue
+		}
+
+		m.Tensors = append(m.Tensors, l)
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+func (m *CohereModel) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *CohereModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv := llm.KV{
+		"general.architecture":                   "command-r",
+		"general.name":                           m.Name,
+		"command-r.vocab_size":                   uint32(len(m.Vocab.Tokens)),
+		"command-r.context_length":               uint32(m.Params.contextLength()),
+		"command-r.embedding_length":             uint32(m.Params.HiddenSize),
+		"command-r.block_count":                  uint32(m.Params.HiddenLayers),
+		"command-r.feed_forward_length":          uint32(m.Params.IntermediateSize),
+		"command-r.rope.freq_base":               float32(cmp.Or(m.Params.RopeFrequencyBase, 10000)),
+		"command-r.attention.head_count":         uint32(m.Params.AttentionHeads),
+		"command-r.attention.head_count_kv":      uint32(m.Params.KeyValHeads),
+		"command-r.attention.layer_norm_epsilon": float32(cmp.Or(m.Params.LayerNormEPS, 1e-5)),
+		"command-r.logit_scale":                  float32(cmp.Or(m.Params.LogitScale, 0.0625)),
+		"general.file_type":                      m.Params.fileType(),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
+		"tokenizer.ggml.pre":                     m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":                  m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":              m.Vocab.Types,
+		"tokenizer.ggml.merges":                  m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":            uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":            uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":        uint32(m.Params.PaddingTokenID),
+		"tokenizer.ggml.add_bos_token":           true,
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("command-r"))
+	maps.Copy(kv, m.Params.activationKV("command-r", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks every layer has its norm, attention and feed forward
+// network and, with use_qk_norm, the query and key norms command-r runtimes
+// expect. An untied output projection must be in the checkpoint.
+func (m *CohereModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	if m.Params.TieWordEmbeddings != nil && !*m.Params.TieWordEmbeddings && !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == "output.weight" }) {
+		return errors.New("command-r: tie_word_embeddings is false but output.weight not found")
+	}
+
+	names := []string{"attn_norm", "attn_q", "attn_k", "attn_v", "attn_output", "ffn_gate", "ffn_up", "ffn_down"}
+	if m.Params.UseQKNorm {
+		names = append(names, "attn_q_norm", "attn_k_norm")
+	}
+
+	for i := range m.Params.HiddenLayers {
+		for _, name := range names {
+			name := fmt.Sprintf("blk.%d.%s.weight", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("command-r: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package convert
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// createTinyCohere writes a single layer Command R+ model, with query and key
+// norms, of 2 query heads sharing a key value head of 4 dimensions to a
+// temporary directory
+func createTinyCohere(t *testing.T, config map[string]any) string {
+	t.Helper()
+
+	c := map[string]any{
+		"architectures":           []string{"CohereForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     1,
+		"layer_norm_eps":          1e-5,
+		"logit_scale":             0.125,
+		"rope_theta":              8000000,
+		"use_qk_norm":             true,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+	}
+
+	for k, v := range config {
+		c[k] = v
+	}
+
+	return createTinyModel(t, tinyModel{
+		config:    c,
+		tokenizer: tinyBPETokenizer("<BOS_TOKEN>", "<|END_OF_TURN_TOKEN|>"),
+		tensors: map[string][]uint64{
+			"model.embed_tokens.weight":              {4, 8},
+			"model.norm.weight":                      {8},
+			"model.layers.0.input_layernorm.weight":  {8},
+			"model.layers.0.self_attn.q_proj.weight": {8, 8},
+			"model.layers.0.self_attn.k_proj.weight": {4, 8},
+			"model.layers.0.self_attn.v_proj.weight": {4, 8},
+			"model.layers.0.self_attn.o_proj.weight": {8, 8},
+			"model.layers.0.self_attn.q_norm.weight": {2, 4},
+			"model.layers.0.self_attn.k_norm.weight": {1, 4},
+			"model.layers.0.mlp.gate_proj.weight":    {16, 8},
+			"model.layers.0.mlp.up_proj.weight":      {16, 8},
+			"model.layers.0.mlp.down_proj.weight":    {8, 16},
+		},
+	})
+}
+
+func TestConvertCohere(t *testing.T) {
+	kv, tensors := convertDir(t, createTinyCohere(t, nil), nil)
+
+	for k, want := range map[string]any{
+		"general.architecture":                   "command-r",
+		"command-r.context_length":               uint32(128),
+		"command-r.block_count":                  uint32(1),
+		"command-r.attention.head_count":         uint32(2),
+		"command-r.attention.head_count_kv":      uint32(1),
+		"command-r.attention.layer_norm_epsilon": float32(1e-5),
+		"command-r.rope.freq_base":               float32(8000000),
+		"command-r.logit_scale":                  float32(0.125),
+		"tokenizer.ggml.model":                   "gpt2",
+		"tokenizer.ggml.bos_token_id":            uint32(2),
+		"tokenizer.ggml.add_bos_token":           true,
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	layers := tensors.Layers()
+	if _, ok := layers["output"]; ok {
+		t.Error("unexpected tensor output.weight")
+	}
+
+	for name, want := range map[string][]uint64{
+		"attn_q_norm.weight": {4, 2},
+		"attn_k_norm.weight": {4, 1},
+	} {
+		tensor, ok := layers["blk.0"][name]
+		if !ok {
+			t.Fatalf("expected tensor blk.0.%s", name)
+		}
+
+		if got := tensor.Shape[:2]; !slices.Equal(got, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got)
+		}
+	}
+}
+
+func TestConvertCohereUntied(t *testing.T) {
+	d := createTinyCohere(t, map[string]any{"tie_word_embeddings": false})
+	createSafetensors(t, filepath.Join(d, "model-00002.safetensors"), map[string][]uint64{
+		"lm_head.weight": {4, 8},
+	})
+
+	if _, tensors := convertDir(t, d, nil); tensors.Layers()["output"]["weight"] == nil {
+		t.Fatal("expected tensor output.weight")
+	}
+}
@@ -1,14 +1,20 @@
 package convert
 
 import (
+	"bytes"
 	"cmp"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log/slog"
+	"math"
 	"os"
-	"path/filepath"
 	"slices"
 	"strings"
 
@@ -38,18 +44,701 @@ type Params struct {
 	AttentionHeads    int      `json:"num_attention_heads"` // n_head
 	KeyValHeads       int      `json:"num_key_value_heads"`
 	NormEPS           float64  `json:"rms_norm_eps"`
+	LayerNormEPS      float64  `json:"layer_norm_eps"`
 	BoSTokenID        int      `json:"bos_token_id"`
 	EoSTokenID        int      `json:"eos_token_id"`
 	HeadDimension     int      `json:"head_dim"`
 	PaddingTokenID    int      `json:"pad_token_id"`
 	RopeFrequencyBase float64  `json:"rope_theta"`
 
+	// attention_bias and mlp_bias are set by llama variants with biases on
+	// their attention and feed forward projections
+	AttentionBias bool `json:"attention_bias"`
+	MLPBias       bool `json:"mlp_bias"`
+
+	// the feed forward activation, see activationKV
+	HiddenAct          string `json:"hidden_act"`
+	HiddenActivation   string `json:"hidden_activation"`
+	ActivationFunction string `json:"activation_function"`
+
+	// falcon style head counts, see setHeadCounts
+	NHead                  int  `json:"n_head"`
+	NHeadKV                int  `json:"n_head_kv"`
+	MultiQuery             bool `json:"multi_query"`
+	NumKVHeads             int  `json:"num_kv_heads"`
+	NewDecoderArchitecture bool `json:"new_decoder_architecture"`
+
+	// falcon
+	FFNHiddenSize    int     `json:"ffn_hidden_size"`
+	LayerNormEpsilon float64 `json:"layer_norm_epsilon"`
+	Alibi            bool    `json:"alibi"`
+
+	RopeScaling *RopeScaling `json:"rope_scaling"`
+
+	QuantizationConfig *struct {
+		QuantMethod string `json:"quant_method"`
+	} `json:"quantization_config"`
+
+	// plamo
+	SharedHeads int `json:"n_shared_head"`
+
+	// stablelm
+	PartialRotaryFactor float64 `json:"partial_rotary_factor"`
+	UseQKVBias          bool    `json:"use_qkv_bias"`
+	QKLayerNorm         bool    `json:"qk_layernorm"`
+	UseParallelResidual bool    `json:"use_parallel_residual"`
+
 	Experts     int `json:"num_local_experts"`
 	ExpertsUsed int `json:"num_experts_per_tok"`
 
+	// phi3 keeps the context length longrope scales from outside of
+	// rope_scaling
+	OriginalContextLength int `json:"original_max_position_embeddings"`
+
+	// SlidingWindow is nil when the config has no sliding window or sets it
+	// to null
+	SlidingWindow *uint32 `json:"sliding_window"`
+
+	// LayerTypes are the attention of each layer, sliding_attention or
+	// full_attention, for models such as Ministral which only use the sliding
+	// window in some layers
+	LayerTypes []string `json:"layer_types"`
+
+	// encoder-decoder
+	DModel              int  `json:"d_model"`
+	EncoderLayers       int  `json:"encoder_layers"`
+	DecoderLayers       int  `json:"decoder_layers"`
+	EncoderHeads        int  `json:"encoder_attention_heads"`
+	EncoderFFNSize      int  `json:"encoder_ffn_dim"`
+	DecoderStartTokenID int  `json:"decoder_start_token_id"`
+	ScaleEmbedding      bool `json:"scale_embedding"`
+
+	// vision language models
+	VisionConfig    *VisionConfig    `json:"vision_config"`
+	TextConfig      *TextConfig      `json:"text_config"`
+	PerceiverConfig *PerceiverConfig `json:"perceiver_config"`
+	ScaleFactor     int              `json:"scale_factor"`
+	ProjectionDim   int              `json:"projection_dim"`
+
+	// internvl
+	LLMConfig       *TextConfig `json:"llm_config"`
+	DownsampleRatio float64     `json:"downsample_ratio"`
+
+	// aya vision
+	DownsampleFactor    int     `json:"downsample_factor"`
+	AdapterLayerNormEPS float64 `json:"adapter_layer_norm_eps"`
+	VisionFeatureLayer  *int    `json:"vision_feature_layer"`
+
+	// hymba runs attention and mamba heads side by side in each layer, see
+	// HymbaModel
+	AttnHiddenSize  int     `json:"attn_hidden_size"`
+	MambaDState     int     `json:"mamba_d_state"`
+	MambaDConv      int     `json:"mamba_d_conv"`
+	MambaExpand     int     `json:"mamba_expand"`
+	MambaDtRank     int     `json:"mamba_dt_rank"`
+	NumMemoryTokens int     `json:"num_memory_tokens"`
+	AttnWindowSize  int     `json:"attn_window_size"`
+	GlobalAttnIdx   []int   `json:"global_attn_idx"`
+	KVReuseGroup    [][]int `json:"kv_reuse_group"`
+
+	// gpt2 and gpt_bigcode name their sizes as GPT-2 does, see
+	// setGPTBigCodeSizes
+	NEmbd      int `json:"n_embd"`
+	NLayer     int `json:"n_layer"`
+	NPositions int `json:"n_positions"`
+	NInner     int `json:"n_inner"`
+
+	// gpt2
+	ScaleAttnByInverseLayerIdx bool `json:"scale_attn_by_inverse_layer_idx"`
+
+	// dbrx nests its attention and expert sizes, see setDbrxSizes
+	NHeads     int                  `json:"n_heads"`
+	NLayers    int                  `json:"n_layers"`
+	MaxSeqLen  int                  `json:"max_seq_len"`
+	AttnConfig *DbrxAttentionConfig `json:"attn_config"`
+	FFNConfig  *DbrxFFNConfig       `json:"ffn_config"`
+
+	// command-r
+	LogitScale        float64 `json:"logit_scale"`
+	UseQKNorm         bool    `json:"use_qk_norm"`
+	TieWordEmbeddings *bool   `json:"tie_word_embeddings"`
+
+	// recurrent_gemma interleaves recurrent and local attention blocks, see
+	// RecurrentGemmaModel
+	BlockTypes          []string `json:"block_types"`
+	LRUWidth            int      `json:"lru_width"`
+	Conv1DWidth         int      `json:"conv1d_width"`
+	AttentionWindowSize int      `json:"attention_window_size"`
+	LogitsSoftCap       float64  `json:"logits_soft_cap"`
+
+	// modernbert alternates global and local attention, see ModernBertModel
+	GlobalAttnEveryNLayers int     `json:"global_attn_every_n_layers"`
+	LocalAttention         int     `json:"local_attention"`
+	GlobalRopeTheta        float64 `json:"global_rope_theta"`
+	LocalRopeTheta         float64 `json:"local_rope_theta"`
+	NormEpsilon            float64 `json:"norm_eps"`
+	ClassifierPooling      string  `json:"classifier_pooling"`
+
 	PreTokenizer string
 
+	// ChatTemplate is the chat_template of tokenizer_config.json, see
+	// readChatTemplate
+	ChatTemplate string `json:"-"`
+
+	// ThinkTokenIDs are the IDs of the tokens reasoning models open and
+	// close their reasoning with, see resolveThinkTokens
+	ThinkTokenIDs []uint32 `json:"-"`
+
+	// VocabPadding is the number of tokens the vocabulary was padded with,
+	// dummies for a vocab_size larger than the tokenizer and those of the
+	// PadVocab option, see parameterCounts
+	VocabPadding int `json:"-"`
+
+	// ByteOrder is the byte order the GGUF is written in. It defaults to
+	// little endian and may be set to big endian, e.g. for s390x.
 	ByteOrder
+	Options `json:"-"`
+
+	// warnings are problems found while converting which didn't stop the
+	// conversion
+	warnings []string
+
+	// unmapped are the tensors of the checkpoint which aren't converted. With
+	// dryRun tensors without a GGUF name are added to them rather than
+	// failing, see UnmappedTensors.
+	unmapped []string
+	dryRun   bool
+
+	// ropeFactors scale the rope frequencies derived from rope_theta to those
+	// of a custom rotary_emb.inv_freq buffer
+	ropeFactors []float32
+
+	// reusedFileType is the file type of the GGUF whose tensors are reused
+	// as they are by ReimportGGUF
+	reusedFileType *uint32
+
+	// ctx cancels writing the GGUF, see ConvertFSContext
+	ctx context.Context
+
+	// consolidated is set when the params were read from Mistral's
+	// params.json. The weights are then read from consolidated.safetensors
+	// and are in Mistral's own layout rather than Hugging Face's.
+	consolidated bool
+}
+
+// Options control how a model is converted. They are not read from the
+// model's config.
+type Options struct {
+	// F32 writes every tensor as F32 instead of narrowing 2D tensors to F16.
+	// This is useful as a reference when debugging numerical issues.
+	F32 bool
+
+	// ContextLength overrides the context length from the model's config.
+	// Rope scaling is not adjusted to match.
+	ContextLength int
+
+	// NaturalOrder writes tensors with numbers in their names compared
+	// numerically so blk.2 is written before blk.10, matching llama.cpp
+	// and making dumps of the output easier to diff.
+	NaturalOrder bool
+
+	// TensorTypes override the type tensors are written as by category,
+	// e.g. to quantize the embeddings while keeping the weights at F16
+	TensorTypes TensorTypes
+
+	// RopeStyle overrides how the checkpoint pairs rotary dimensions, e.g.
+	// for a llama checkpoint which wasn't converted to Hugging Face's style
+	RopeStyle RopeStyle
+
+	// Quantize writes the tensors which would be F16 as Q8_0 or Q4_0 and
+	// sets the file type to match. Vectors such as norms stay F32 and
+	// categories with a type in TensorTypes keep it.
+	Quantize string
+
+	// TokenizerDir reads the vocabulary and special tokens from another
+	// directory, e.g. when a checkpoint's own tokenizer is missing or broken.
+	// The weights and config are still read from the model's directory.
+	// ConvertToFileWithOptions opens it as a path while ConvertFS looks for
+	// it in fsys.
+	TokenizerDir string
+
+	// TokenizerFS is like TokenizerDir for a vocabulary at the root of a
+	// filesystem and takes precedence over it
+	TokenizerFS fs.FS
+
+	// Parallel is the number of tensors repacked and quantized at once while
+	// writing, capped by GOMAXPROCS. It defaults to 1, which converts one
+	// tensor at a time with the least memory.
+	Parallel int
+
+	// PadVocab pads the vocabulary and the token embeddings to a multiple of
+	// PadVocab tokens, e.g. 64 for kernels which want aligned dimensions
+	PadVocab int
+
+	// StripPrefix is removed from the start of every tensor name before the
+	// names are mapped, e.g. base_model.model. for checkpoints which a
+	// fine-tuning framework saved with the model wrapped in its own module
+	StripPrefix string
+
+	// SourceOrder writes the tensors in the order the checkpoint stores
+	// their data, e.g. for tooling which matches them to a sidecar index,
+	// rather than sorted by name. Tensors are still repacked and their
+	// offsets recomputed, and NaturalOrder has no effect. Key-values stay
+	// sorted so the output remains deterministic.
+	SourceOrder bool
+
+	// ForceArchitecture converts the model with the converter of another
+	// architecture regardless of the config's architectures, e.g. when they
+	// are wrong or an alias of a supported model. It is either a name the
+	// config would list, such as LlamaForCausalLM, or the architecture the
+	// GGUF is written as, such as llama. The config must still have the
+	// fields the converter reads, which are validated as usual.
+	ForceArchitecture string
+
+	// ReferenceOffsets are the offsets of the tensors of a known good GGUF,
+	// relative to the start of its tensor data. Conversion fails before
+	// anything is written when a tensor would be written elsewhere, naming
+	// the first which differs, e.g. to pin down a regression in the layout.
+	ReferenceOffsets map[string]int64
+
+	// UnpaddedParameterCount writes general.unpadded_parameter_count, the
+	// number of parameters without the token embedding and output rows of
+	// the tokens the vocabulary was padded with, alongside the padded
+	// general.parameter_count. The summary reports the unpadded count.
+	UnpaddedParameterCount bool
+
+	// CheckFinite counts the NaN and infinite values of every tensor as it
+	// is written, e.g. to catch a corrupt download or a diverged fine-tune.
+	// Conversion fails naming the first tensor with more than MaxNonFinite
+	// of them while tensors with fewer are logged.
+	CheckFinite bool
+
+	// MaxNonFinite is the number of NaN and infinite values a tensor may
+	// have when CheckFinite is set
+	MaxNonFinite int
+}
+
+// forcedArchitectures are the architectures of the config which every GGUF
+// architecture the ForceArchitecture option may name is converted as
+var forcedArchitectures = map[string]string{
+	"dbrx":            "DbrxForCausalLM",
+	"falcon":          "FalconForCausalLM",
+	"gemma":           "GemmaForCausalLM",
+	"gpt-oss":         "GptOssForCausalLM",
+	"gpt2":            "GPT2LMHeadModel",
+	"hymba":           "HymbaForCausalLM",
+	"llama":           "LlamaForCausalLM",
+	"modern-bert":     "ModernBertModel",
+	"phi3":            "Phi3ForCausalLM",
+	"plamo":           "PlamoForCausalLM",
+	"qwen2":           "Qwen2ForCausalLM",
+	"recurrent_gemma": "RecurrentGemmaForCausalLM",
+	"stablelm":        "StableLmForCausalLM",
+}
+
+// forceArchitecture replaces the architectures of the config with the
+// ForceArchitecture option if it is set
+func (p *Params) forceArchitecture() {
+	if p.ForceArchitecture == "" {
+		return
+	}
+
+	arch := cmp.Or(forcedArchitectures[p.ForceArchitecture], p.ForceArchitecture)
+	if !slices.Equal(p.Architectures, []string{arch}) {
+		p.warn("converting with a forced architecture", "architectures", p.Architectures, "forced", arch)
+	}
+
+	p.Architectures = []string{arch}
+}
+
+// stripPrefix removes the StripPrefix option from the start of name. stripped
+// maps each name returned so far to the tensor it was read as so two tensors
+// which strip to the same name, e.g. base_model.model.lm_head.weight and
+// lm_head.weight, are an error rather than one replacing the other.
+func (p *Params) stripPrefix(name string, stripped map[string]string) (string, error) {
+	if p.StripPrefix == "" {
+		return name, nil
+	}
+
+	short := strings.TrimPrefix(name, p.StripPrefix)
+	if other, ok := stripped[short]; ok {
+		return "", fmt.Errorf("%s and %s are both %s once %q is stripped", other, name, short, p.StripPrefix)
+	}
+
+	stripped[short] = name
+	return short, nil
+}
+
+// contextLength returns the context length of the converted model
+func (p *Params) contextLength() int {
+	return cmp.Or(p.ContextLength, p.ContextSize)
+}
+
+// validate checks the params can be converted before any tensors are read
+func (p *Params) validate() error {
+	if p.QuantizationConfig != nil {
+		method := cmp.Or(p.QuantizationConfig.QuantMethod, "unknown")
+		if method == "mxfp4" && slices.Contains(p.Architectures, "GptOssForCausalLM") {
+			// the official gpt-oss checkpoints store their experts as mxfp4
+			// _blocks and _scales which the converter doesn't dequantize
+			return errors.New("gpt-oss: only BF16 checkpoints can be converted; dequantize the mxfp4 experts to BF16 before converting")
+		}
+
+		return fmt.Errorf("model is already quantized with %s; dequantize it to F32, F16 or BF16 before converting", method)
+	}
+
+	if p.RopeScaling != nil && p.RopeScaling.kind() == "dynamic" {
+		p.warn("dynamic rope scaling isn't supported, contexts longer than context_length may degrade", "factor", p.RopeScaling.Factor)
+	}
+
+	return nil
+}
+
+// warn logs msg with args and keeps it for the conversion summary
+func (p *Params) warn(msg string, args ...any) {
+	slog.Warn(msg, args...)
+
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", args[i], args[i+1])
+	}
+
+	p.warnings = append(p.warnings, sb.String())
+}
+
+// ErrNonFinite is returned while writing a tensor with more NaN or infinite
+// values than the MaxNonFinite option allows
+var ErrNonFinite = errors.New("too many NaN or infinite values")
+
+// checkFinite counts the NaN and infinite values of the tensor name if the
+// CheckFinite option is set. f32s is the data of the checkpoint before it is
+// repacked.
+func (p *Params) checkFinite(name string, f32s []float32) error {
+	if !p.CheckFinite {
+		return nil
+	}
+
+	var n int
+	for _, f := range f32s {
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			n++
+		}
+	}
+
+	if n > p.MaxNonFinite {
+		return fmt.Errorf("%s: %d of %d values are NaN or infinite: %w", name, n, len(f32s), ErrNonFinite)
+	} else if n > 0 {
+		slog.Warn("tensor has NaN or infinite values", "tensor", name, "count", n)
+	}
+
+	return nil
+}
+
+// skipTensor records that the tensor name of the checkpoint isn't converted
+func (p *Params) skipTensor(name string) {
+	p.unmapped = append(p.unmapped, name)
+}
+
+// setHeadCounts fills in the attention and key value head counts from the
+// falcon style n_head, n_head_kv and multi_query fields or, for the new
+// decoder architecture, num_kv_heads. The key value head count defaults to one
+// head for multi-query attention and otherwise to the attention head count.
+func (p *Params) setHeadCounts() {
+	p.AttentionHeads = cmp.Or(p.AttentionHeads, p.NHead)
+	p.KeyValHeads = cmp.Or(p.KeyValHeads, p.NHeadKV)
+	if p.KeyValHeads == 0 && p.NewDecoderArchitecture {
+		p.KeyValHeads = p.NumKVHeads
+	}
+
+	if p.KeyValHeads == 0 && p.MultiQuery {
+		p.KeyValHeads = 1
+	}
+
+	p.KeyValHeads = cmp.Or(p.KeyValHeads, p.AttentionHeads)
+}
+
+// setSpecialTokenDefaults sets the BOS and EOS token IDs the config omits to
+// the defaults of the architecture. Models decode their config over params
+// with both IDs set to -1 to detect missing entries. Defaults are only known
+// for SentencePiece tokenizers since BPE vocabularies don't have fixed IDs.
+func (p *Params) setSpecialTokenDefaults(fsys fs.FS) {
+	if p.BoSTokenID >= 0 && p.EoSTokenID >= 0 {
+		return
+	}
+
+	if p.isVision() {
+		// vision towers don't generate text
+		p.BoSTokenID, p.EoSTokenID = max(p.BoSTokenID, 0), max(p.EoSTokenID, 0)
+		return
+	}
+
+	var bos, eos int
+	var ok bool
+	if _, err := fs.Stat(fsys, "tokenizer.model"); err == nil && len(p.Architectures) > 0 {
+		switch p.Architectures[0] {
+		case "LlamaForCausalLM", "InternLM3ForCausalLM", "MistralForCausalLM", "MixtralForCausalLM", "PlamoForCausalLM":
+			bos, eos, ok = 1, 2, true
+		case "GemmaForCausalLM":
+			bos, eos, ok = 2, 1, true
+		}
+	}
+
+	if !ok {
+		p.warn("config is missing special token IDs and no defaults are known", "bos_token_id", max(p.BoSTokenID, 0), "eos_token_id", max(p.EoSTokenID, 0))
+		p.BoSTokenID, p.EoSTokenID = max(p.BoSTokenID, 0), max(p.EoSTokenID, 0)
+		return
+	}
+
+	if p.BoSTokenID < 0 {
+		p.warn("config is missing bos_token_id, using default", "id", bos)
+		p.BoSTokenID = bos
+	}
+
+	if p.EoSTokenID < 0 {
+		p.warn("config is missing eos_token_id, using default", "id", eos)
+		p.EoSTokenID = eos
+	}
+}
+
+// repackTensor returns a tensor named name with kind and shape whose data is
+// produced by calling repack on the data and shape of t. This is used to
+// split, merge or transpose tensors during conversion.
+func repackTensor(t llm.Tensor, name string, kind uint32, shape []uint64, repack func([]float32, []uint64) ([]float32, error)) llm.Tensor {
+	n := llm.Tensor{Name: name, Kind: kind, Shape: shape}
+
+	src := t.Shape
+	n.WriterTo = t.WriterTo
+	return setRepacker(n, func(_ string, data []float32, _ []uint64) ([]float32, error) {
+		return repack(data, src)
+	})
+}
+
+// setRepacker returns t with its data written through repacker, which is
+// called with the name, data and shape of t
+func setRepacker(t llm.Tensor, repacker func(string, []float32, []uint64) ([]float32, error)) llm.Tensor {
+	switch wt := t.WriterTo.(type) {
+	case safetensorWriterTo:
+		wt.t = &t
+		wt.repacker = repacker
+		t.WriterTo = wt
+	case torchWriterTo:
+		wt.t = &t
+		wt.repacker = repacker
+		t.WriterTo = wt
+	case readerWriterTo:
+		wt.t = &t
+		wt.repacker = repacker
+		t.WriterTo = wt
+	}
+
+	return t
+}
+
+// sliceRows returns a repack function selecting n rows of a 2D tensor
+// starting at row start, e.g. to split a fused projection
+func sliceRows(start, n uint64) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, shape []uint64) ([]float32, error) {
+		cols := shape[1]
+		return data[start*cols : (start+n)*cols], nil
+	}
+}
+
+// updateOffsets recomputes the offsets of ts after tensors have been added,
+// removed or resized
+func updateOffsets(ts []llm.Tensor) {
+	var offset uint64
+	for i := range ts {
+		ts[i].Offset = offset
+		offset += ts[i].Size()
+		offset += (32 - offset%32) % 32
+	}
+}
+
+// nextOffset returns the aligned offset following the last tensor in ts
+func nextOffset(ts []llm.Tensor) uint64 {
+	if len(ts) == 0 {
+		return 0
+	}
+
+	offset := ts[len(ts)-1].Offset + ts[len(ts)-1].Size()
+	return offset + (32-offset%32)%32
+}
+
+// dataComparer is implemented by the WriterTo of tensors which can compare
+// their data in the checkpoint with that of another tensor without converting
+// either
+type dataComparer interface {
+	sameData(io.WriterTo) (bool, error)
+}
+
+// equalFloats reports whether a and b hold the same bits
+func equalFloats(a, b []float32) bool {
+	return slices.EqualFunc(a, b, func(x, y float32) bool { return math.Float32bits(x) == math.Float32bits(y) })
+}
+
+// equalReaders reports whether the next n bytes of a and b are equal,
+// reading them a chunk at a time and stopping at the first chunk that differs
+func equalReaders(a, b io.Reader, n int64) (bool, error) {
+	ab, bb := make([]byte, min(n, 1<<20)), make([]byte, min(n, 1<<20))
+	for n > 0 {
+		m := min(n, int64(len(ab)))
+		if _, err := io.ReadFull(a, ab[:m]); err != nil {
+			return false, err
+		}
+
+		if _, err := io.ReadFull(b, bb[:m]); err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(ab[:m], bb[:m]) {
+			return false, nil
+		}
+
+		n -= m
+	}
+
+	return true, nil
+}
+
+// tieOutput drops output.weight from ts when its data in the checkpoint is
+// identical to token_embd.weight so the embedding is only written once.
+// Runtimes fall back to the token embedding when output.weight is missing.
+// Tensors which only share a shape, are repacked or can't be compared
+// without converting them are kept.
+func tieOutput(ts []llm.Tensor) ([]llm.Tensor, error) {
+	embd := slices.IndexFunc(ts, func(t llm.Tensor) bool { return t.Name == "token_embd.weight" })
+	output := slices.IndexFunc(ts, func(t llm.Tensor) bool { return t.Name == "output.weight" })
+	if embd < 0 || output < 0 {
+		return ts, nil
+	}
+
+	if ts[embd].Kind != ts[output].Kind || !slices.Equal(ts[embd].Shape, ts[output].Shape) {
+		return ts, nil
+	}
+
+	c, ok := ts[embd].WriterTo.(dataComparer)
+	if !ok {
+		return ts, nil
+	}
+
+	if same, err := c.sameData(ts[output].WriterTo); err != nil {
+		return nil, err
+	} else if !same {
+		return ts, nil
+	}
+
+	slog.Debug("output is tied to token embedding, skipping", "name", ts[output].Name)
+	ts = slices.Delete(ts, output, output+1)
+	updateOffsets(ts)
+	return ts, nil
+}
+
+// tieWordEmbeddings returns ts with the output projection the config asks
+// for. When the config sets tie_word_embeddings and the checkpoint has no
+// lm_head, output.weight is derived from token_embd.weight and written as
+// the output projection would have been. Otherwise an output projection
+// identical to the token embedding is dropped, see tieOutput.
+func (p *Params) tieWordEmbeddings(ts []llm.Tensor) ([]llm.Tensor, error) {
+	if p.TieWordEmbeddings == nil || !*p.TieWordEmbeddings {
+		return tieOutput(ts)
+	}
+
+	if slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == "output.weight" }) {
+		return ts, nil
+	}
+
+	embd := slices.IndexFunc(ts, func(t llm.Tensor) bool { return t.Name == "token_embd.weight" })
+	if embd < 0 {
+		return nil, errors.New("tie_word_embeddings is set but token_embd.weight not found")
+	}
+
+	var kind uint32
+	if len(ts[embd].Shape) == 2 && !p.F32 {
+		kind = 1
+	}
+
+	kind, err := p.tensorKind("output.weight", ts[embd].Shape, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	output := repackTensor(ts[embd], "output.weight", kind, slices.Clone(ts[embd].Shape), func(data []float32, _ []uint64) ([]float32, error) {
+		return data, nil
+	})
+	output.Offset = nextOffset(ts)
+	return append(ts, output), nil
+}
+
+// sortTensors sorts ts by name with naturalCompare and recomputes their
+// offsets if the NaturalOrder option is set and SourceOrder isn't
+func (p *Params) sortTensors(ts []llm.Tensor) {
+	if !p.NaturalOrder || p.SourceOrder {
+		return
+	}
+
+	slices.SortStableFunc(ts, func(a, b llm.Tensor) int {
+		return naturalCompare(a.Name, b.Name)
+	})
+
+	updateOffsets(ts)
+}
+
+// naturalCompare compares a and b like strings.Compare except runs of digits
+// are compared by their value
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da > 0 && db > 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if c := cmp.Compare(len(na), len(nb)); c != 0 {
+				return c
+			}
+
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+
+			a, b = a[da:], b[db:]
+			continue
+		}
+
+		if c := cmp.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+
+		a, b = a[1:], b[1:]
+	}
+
+	return cmp.Compare(len(a), len(b))
+}
+
+// leadingDigits returns the number of ASCII digits at the start of s
+func leadingDigits(s string) int {
+	n := 0
+	for n < len(s) && '0' <= s[n] && s[n] <= '9' {
+		n++
+	}
+
+	return n
+}
+
+// fileType returns the general.file_type of the converted model
+func (p *Params) fileType() uint32 {
+	if p.reusedFileType != nil {
+		return *p.reusedFileType
+	}
+
+	switch {
+	case p.F32:
+		return 0
+	case p.Quantize == "Q8_0":
+		return 7
+	case p.Quantize == "Q4_0":
+		return 2
+	}
+
+	return 1
 }
 
 type ByteOrder interface {
@@ -61,17 +750,27 @@ type ModelArch interface {
 	GetTensors() error
 	LoadVocab() error
 	WriteGGUF(io.WriteSeeker) error
+
+	// Validate checks the metadata and tensors of the converted model are
+	// consistent. It is called by WriteGGUF before anything is written.
+	Validate(llm.KV, []llm.Tensor) error
 }
 
+// ModelFormat reads the checkpoint of a model. Each method reads either the
+// directory at a path or, with the FS suffix, the root of an fs.FS.
 type ModelFormat interface {
 	GetLayerName(string) (string, error)
 	GetTensors(string, *Params) ([]llm.Tensor, error)
+	GetTensorsFS(fs.FS, *Params) ([]llm.Tensor, error)
 	GetParams(string) (*Params, error)
+	GetParamsFS(fs.FS) (*Params, error)
 	GetModelArch(string, string, *Params) (ModelArch, error)
+	GetModelArchFS(string, fs.FS, *Params) (ModelArch, error)
 }
 
 type ModelData struct {
-	Path    string
+	// FS is the directory of the model
+	FS      fs.FS
 	Name    string
 	Params  *Params
 	Vocab   *Vocab
@@ -79,12 +778,124 @@ type ModelData struct {
 	Format  ModelFormat
 }
 
+// Validate does nothing by default. Architectures with invariants of their
+// own should override it.
+func (ModelData) Validate(llm.KV, []llm.Tensor) error {
+	return nil
+}
+
+func (m *ModelData) modelData() *ModelData {
+	return m
+}
+
+// tokenizerFS returns the directory the vocabulary is read from
+func (m *ModelData) tokenizerFS() fs.FS {
+	if m.Params.TokenizerFS != nil {
+		return m.Params.TokenizerFS
+	}
+
+	return m.FS
+}
+
+// loadVocab loads the vocabulary of arch. A tokenizer from the TokenizerDir or
+// TokenizerFS option must exist and have as many tokens as the token embeddings have
+// rows since nothing else checks it was made for these weights. The
+// vocabulary is then padded if the PadVocab option is set.
+func loadVocab(arch ModelArch) error {
+	if err := arch.LoadVocab(); err != nil {
+		return err
+	}
+
+	md := arch.(interface{ modelData() *ModelData }).modelData()
+	template, err := readChatTemplate(md.tokenizerFS())
+	if err != nil {
+		return err
+	}
+
+	md.Params.ChatTemplate = template
+	md.resolveThinkTokens()
+	if md.Params.TokenizerFS != nil {
+		dir := cmp.Or(md.Params.TokenizerDir, "TokenizerFS")
+		if md.Vocab == nil || len(md.Vocab.Tokens) == 0 {
+			return fmt.Errorf("no tokenizer found in %s", dir)
+		}
+
+		for _, t := range md.Tensors {
+			if t.Name == "token_embd.weight" && len(t.Shape) == 2 && uint64(len(md.Vocab.Tokens)) != t.Shape[0] {
+				return fmt.Errorf("tokenizer in %s has %d tokens but the token embeddings have %d", dir, len(md.Vocab.Tokens), t.Shape[0])
+			}
+		}
+	}
+
+	if md.Params.PadVocab > 0 && md.Vocab != nil && len(md.Vocab.Tokens) > 0 {
+		return md.padVocab(md.Params.PadVocab)
+	}
+
+	return nil
+}
+
+// padVocab pads the vocabulary with unused tokens, and the token embeddings
+// and output with rows of zeros, to the next multiple of multiple. Embeddings
+// with more rows than tokens are padded from their own size. Tokens are only
+// appended so the IDs of special tokens don't change.
+func (m *ModelData) padVocab(multiple int) error {
+	n := uint64(len(m.Vocab.Tokens))
+	for _, t := range m.Tensors {
+		if (t.Name == "token_embd.weight" || t.Name == "output.weight") && len(t.Shape) == 2 {
+			n = max(n, t.Shape[0])
+		}
+	}
+
+	n += (uint64(multiple) - n%uint64(multiple)) % uint64(multiple)
+
+	for _, id := range []int{m.Params.BoSTokenID, m.Params.EoSTokenID, m.Params.PaddingTokenID} {
+		if id >= 0 && uint64(id) >= n {
+			return fmt.Errorf("special token ID %d is outside of the padded vocabulary of %d tokens", id, n)
+		}
+	}
+
+	m.Params.VocabPadding += int(n) - len(m.Vocab.Tokens)
+	for i := uint64(len(m.Vocab.Tokens)); i < n; i++ {
+		m.Vocab.Tokens = append(m.Vocab.Tokens, fmt.Sprintf("<pad%05d>", i))
+		m.Vocab.Types = append(m.Vocab.Types, tokenTypeUnused)
+		if m.Vocab.Scores != nil {
+			m.Vocab.Scores = append(m.Vocab.Scores, -1)
+		}
+	}
+
+	for i, t := range m.Tensors {
+		if (t.Name != "token_embd.weight" && t.Name != "output.weight") || len(t.Shape) != 2 || t.Shape[0] == n {
+			continue
+		}
+
+		if t.WriterTo == nil {
+			return fmt.Errorf("%s can't be padded to %d rows", t.Name, n)
+		}
+
+		m.Tensors[i] = repackTensor(t, t.Name, t.Kind, []uint64{n, t.Shape[1]}, func(data []float32, shape []uint64) ([]float32, error) {
+			return append(data, make([]float32, (n-shape[0])*shape[1])...), nil
+		})
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
 func GetModelFormat(dirname string) (ModelFormat, error) {
-	files, err := filepath.Glob(filepath.Join(dirname, "*"))
+	return GetModelFormatFS(os.DirFS(dirname))
+}
+
+// GetModelFormatFS returns the format of the model at the root of fsys
+func GetModelFormatFS(fsys fs.FS) (ModelFormat, error) {
+	files, err := fs.Glob(fsys, "*")
 	if err != nil {
 		return nil, err
 	}
 
+	if r := matchTensorReader(files); r != nil {
+		return &SafetensorFormat{reader: r}, nil
+	}
+
 	for _, fn := range files {
 		if strings.HasSuffix(fn, ".safetensors") {
 			return &SafetensorFormat{}, nil
@@ -97,18 +908,378 @@ func GetModelFormat(dirname string) (ModelFormat, error) {
 	return nil, fmt.Errorf("couldn't determine model format")
 }
 
+// ConvertToFile converts the model in dir and writes it to path. The model is
+// first written to path with a .tmp suffix and renamed once it is complete so
+// an interrupted conversion never leaves a partial file at path. The
+// temporary file is created next to path so both are on the same filesystem
+// and the rename is atomic. The returned summary is read back from path.
+func ConvertToFile(dir, path string) (*Summary, error) {
+	return ConvertToFileWithOptions(dir, path, Options{})
+}
+
+// ConvertToFileWithOptions converts the model in dir to path like
+// ConvertToFile with opts
+func ConvertToFileWithOptions(dir, path string, opts Options) (*Summary, error) {
+	if opts.TokenizerDir != "" && opts.TokenizerFS == nil {
+		opts.TokenizerFS = os.DirFS(opts.TokenizerDir)
+	}
+
+	return ConvertFS(os.DirFS(dir), path, opts)
+}
+
+// ConvertFS converts the model at the root of fsys to path like
+// ConvertToFileWithOptions, e.g. to convert a model embedded in the binary or
+// held in memory. The TokenizerDir option is a directory in fsys. Only the
+// TokenizerFS option and torch checkpoints, which can only be unpickled from a
+// file, are read from outside of fsys.
+func ConvertFS(fsys fs.FS, path string, opts Options) (*Summary, error) {
+	return ConvertFSContext(context.Background(), fsys, path, opts)
+}
+
+// ConvertFSContext converts the model at the root of fsys to path like
+// ConvertFS until ctx is done. Cancelling ctx stops the conversion between
+// steps and while tensors are written and returns ctx.Err(). Nothing is
+// left at path then; the partial file written to path.tmp is removed.
+func ConvertFSContext(ctx context.Context, fsys fs.FS, path string, opts Options) (*Summary, error) {
+	mf, err := GetModelFormatFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := mf.GetParamsFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Options = opts
+	params.ctx = ctx
+	if opts.TokenizerDir != "" && opts.TokenizerFS == nil {
+		if params.TokenizerFS, err = fs.Sub(fsys, opts.TokenizerDir); err != nil {
+			return nil, fmt.Errorf("tokenizer directory: %w", err)
+		}
+	}
+
+	arch, err := mf.GetModelArchFS("", fsys, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		return nil, err
+	}
+
+	if err := loadVocab(arch); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := writeFile(arch, path); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ggml, _, err := llm.DecodeGGML(f)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := ggml.KV()
+	tokens, _ := kv["tokenizer.ggml.tokens"].([]any)
+	parameters := kv.ParameterCount()
+	if params.UnpaddedParameterCount {
+		parameters, _ = kv.Uint("general.unpadded_parameter_count")
+	}
+
+	return &Summary{
+		Architecture:   kv.Architecture(),
+		ParameterCount: parameters,
+		TensorCount:    len(ggml.Tensors()),
+		ContextLength:  kv.ContextLength(),
+		FileType:       kv.FileType().String(),
+		VocabSize:      len(tokens),
+		Warnings:       params.warnings,
+	}, nil
+}
+
+// UnmappedTensors lists the tensors of the model at the root of fsys which
+// converting it with opts would leave out, e.g. to catch an unsupported
+// fine-tune before a long conversion. These are buffers such as
+// rotary_emb.inv_freq, the tensors of a vision tower when converting the text
+// model and the other way around, and tensors without a GGUF name, which fail
+// the conversion itself. Names are those of the checkpoint. Nothing is written
+// and only the headers of safetensors checkpoints are read.
+func UnmappedTensors(fsys fs.FS, opts Options) ([]string, error) {
+	mf, err := GetModelFormatFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := mf.GetParamsFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	params.Options = opts
+	params.dryRun = true
+
+	// the converter is chosen for the architecture checks and the defaults
+	// it fills in, but its own tensor repacking isn't run
+	if _, err := mf.GetModelArchFS("", fsys, params); err != nil {
+		return nil, err
+	}
+
+	if _, err := mf.GetTensorsFS(fsys, params); err != nil {
+		return nil, err
+	}
+
+	slices.Sort(params.unmapped)
+	return slices.Compact(params.unmapped), nil
+}
+
+// Summary describes a converted model so it can be checked at a glance
+type Summary struct {
+	Architecture   string
+	ParameterCount uint64
+	TensorCount    int
+	ContextLength  uint64
+	FileType       string
+	VocabSize      int
+
+	// Warnings are problems found while converting, such as padding the
+	// vocabulary with dummy tokens or guessing special token IDs
+	Warnings []string
+}
+
+// encodeGGUF writes a version 3 GGUF of kv and ts to ws in the byte order
+// and with the parallelism and context of the params. Models with a
+// vocabulary get the chat template of the params.
+func (p *Params) encodeGGUF(ws io.WriteSeeker, kv llm.KV, ts []llm.Tensor) error {
+	if _, ok := kv["tokenizer.ggml.tokens"]; ok && p.ChatTemplate != "" {
+		kv["tokenizer.chat_template"] = p.ChatTemplate
+	}
+
+	if _, ok := kv["tokenizer.ggml.tokens"]; ok && len(p.ThinkTokenIDs) == 2 {
+		kv["tokenizer.ggml.think_start_token_id"] = p.ThinkTokenIDs[0]
+		kv["tokenizer.ggml.think_end_token_id"] = p.ThinkTokenIDs[1]
+	}
+
+	if err := validateMerges(kv); err != nil {
+		return err
+	}
+
+	if p.UnpaddedParameterCount {
+		padded, unpadded := p.parameterCounts(kv, ts)
+		kv["general.parameter_count"] = padded
+		kv["general.unpadded_parameter_count"] = unpadded
+	}
+
+	return llm.NewGGUFV3(p.ByteOrder).SetParallel(p.Parallel).SetContext(p.ctx).SetOffsets(p.ReferenceOffsets).Encode(ws, kv, ts)
+}
+
+// validateMerges checks a BPE tokenizer has merges. Without them a model
+// can't merge its input into any token longer than a byte, which is what a
+// tokenizer.json of merges in a format that isn't parsed ends up as.
+func validateMerges(kv llm.KV) error {
+	if kv["tokenizer.ggml.model"] != "gpt2" {
+		return nil
+	}
+
+	if merges, _ := kv["tokenizer.ggml.merges"].([]string); len(merges) == 0 {
+		return errors.New("tokenizer.ggml.model is gpt2 but tokenizer.ggml.merges is empty")
+	}
+
+	return nil
+}
+
+// parameterCounts returns the number of parameters of ts and the number
+// without the rows of the token embeddings and output beyond the tokens of
+// the vocabulary in kv which aren't padding
+func (p *Params) parameterCounts(kv llm.KV, ts []llm.Tensor) (padded, unpadded uint64) {
+	for _, t := range ts {
+		n := uint64(1)
+		for _, dim := range t.Shape {
+			n *= dim
+		}
+
+		padded += n
+	}
+
+	unpadded = padded
+	tokens, ok := kv["tokenizer.ggml.tokens"].([]string)
+	if !ok || p.VocabPadding <= 0 || p.VocabPadding > len(tokens) {
+		return padded, unpadded
+	}
+
+	vocab := uint64(len(tokens) - p.VocabPadding)
+	for _, t := range ts {
+		if (t.Name == "token_embd.weight" || t.Name == "output.weight") && len(t.Shape) == 2 && t.Shape[0] > vocab {
+			unpadded -= (t.Shape[0] - vocab) * t.Shape[1]
+		}
+	}
+
+	return padded, unpadded
+}
+
+// writeFile writes arch to path.tmp then renames it to path, removing the
+// temporary file if anything fails
+func writeFile(arch ModelArch, path string) error {
+	return writeFileFunc(path, arch.WriteGGUF)
+}
+
+// writeFileFunc writes to path like writeFile with write
+func writeFileFunc(path string, write func(io.WriteSeeker) error) (err error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if err := write(f); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// ConvertWithQuantization converts the model in dir to ws with the tensors
+// which would be F16 quantized to ftype, the general.file_type of Q8_0 (7) or
+// Q4_0 (2). Vectors such as norms stay F32.
+func ConvertWithQuantization(dir string, ws io.WriteSeeker, ftype uint32) error {
+	quantize, ok := map[uint32]string{2: "Q4_0", 7: "Q8_0"}[ftype]
+	if !ok {
+		return fmt.Errorf("unsupported file type %d, expected Q8_0 (7) or Q4_0 (2)", ftype)
+	}
+
+	mf, err := GetModelFormat(dir)
+	if err != nil {
+		return err
+	}
+
+	params, err := mf.GetParams(dir)
+	if err != nil {
+		return err
+	}
+
+	params.Quantize = quantize
+	arch, err := mf.GetModelArch("", dir, params)
+	if err != nil {
+		return err
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		return err
+	}
+
+	if err := loadVocab(arch); err != nil {
+		return err
+	}
+
+	return arch.WriteGGUF(ws)
+}
+
+// WriteGGUFDigest writes the model to ws like arch.WriteGGUF and returns the
+// sha256 digest of every byte written, including padding, so the output does
+// not need to be read again to be hashed.
+func WriteGGUFDigest(arch ModelArch, ws io.WriteSeeker) (string, error) {
+	hws := &hashWriteSeeker{WriteSeeker: ws, hash: sha256.New()}
+	if err := arch.WriteGGUF(hws); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", hws.hash.Sum(nil)), nil
+}
+
+// WriteTensorsGGUF writes only the tensors of arch to ws with
+// general.architecture set to name and no other metadata. Tensors are written
+// like arch.WriteGGUF writes them so their data can be compared between runs
+// without encoding the vocabulary, e.g. while debugging a repack.
+func WriteTensorsGGUF(arch ModelArch, name string, ws io.WriteSeeker) error {
+	md := arch.(interface{ modelData() *ModelData }).modelData()
+	return md.Params.encodeGGUF(ws, llm.KV{"general.architecture": name}, md.Tensors)
+}
+
+// hashWriteSeeker hashes bytes as they are written. Only reporting the current
+// offset is supported since seeking elsewhere would invalidate the hash.
+type hashWriteSeeker struct {
+	io.WriteSeeker
+	hash   hash.Hash
+	offset int64
+}
+
+func (w *hashWriteSeeker) Write(b []byte) (int, error) {
+	n, err := w.WriteSeeker.Write(b)
+	w.hash.Write(b[:n])
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *hashWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return 0, errors.New("hashWriteSeeker: only the current offset can be read")
+	}
+
+	return w.offset, nil
+}
+
 // Details on gguf's tokenizer can be found at:
 // https://github.com/ggerganov/ggml/blob/master/docs/gguf.md#tokenizer
 type Vocab struct {
+	// Model is the tokenizer.ggml.model of the vocabulary, e.g. llama for
+	// SentencePiece or gpt2 for BPE
+	Model string
+
 	Tokens []string
 	Scores []float32
 	Types  []int32
 	Merges []string
 }
 
+// isBytePiece reports whether piece is a byte fallback piece such as <0x0A>
+func isBytePiece(piece string) bool {
+	if len(piece) != 6 || !strings.HasPrefix(piece, "<0x") || piece[5] != '>' {
+		return false
+	}
+
+	for _, c := range piece[3:5] {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func LoadSentencePieceTokens(dirpath string, params *Params) (*Vocab, error) {
-	slog.Info(fmt.Sprintf("reading vocab from %s", filepath.Join(dirpath, "tokenizer.model")))
-	in, err := os.ReadFile(filepath.Join(dirpath, "tokenizer.model"))
+	return LoadSentencePieceTokensFS(os.DirFS(dirpath), params)
+}
+
+// LoadSentencePieceTokensFS reads the tokenizer.model and any
+// added_tokens.json at the root of fsys
+func LoadSentencePieceTokensFS(fsys fs.FS, params *Params) (*Vocab, error) {
+	slog.Info("reading vocab from tokenizer.model")
+	in, err := fs.ReadFile(fsys, "tokenizer.model")
 	if err != nil {
 		return nil, err
 	}
@@ -121,11 +1292,16 @@ func LoadSentencePieceTokens(dirpath string, params *Params) (*Vocab, error) {
 	}
 
 	v := &Vocab{
+		Model:  "llama",
 		Tokens: make([]string, 0),
 		Scores: make([]float32, 0),
 		Types:  make([]int32, 0),
 	}
 
+	// unigram models trained with byte fallback encode unknown characters
+	// as their UTF-8 bytes. Some exporters mark those pieces as normal.
+	byteFallback := modelProto.GetTrainerSpec().GetByteFallback()
+
 	pieces := modelProto.GetPieces()
 	for _, p := range pieces {
 		v.Tokens = append(v.Tokens, p.GetPiece())
@@ -134,10 +1310,14 @@ func LoadSentencePieceTokens(dirpath string, params *Params) (*Vocab, error) {
 		switch t {
 		case sentencepiece.ModelProto_SentencePiece_UNKNOWN:
 		case sentencepiece.ModelProto_SentencePiece_CONTROL:
+		case sentencepiece.ModelProto_SentencePiece_USER_DEFINED:
 		case sentencepiece.ModelProto_SentencePiece_UNUSED:
 		case sentencepiece.ModelProto_SentencePiece_BYTE:
 		default:
 			t = sentencepiece.ModelProto_SentencePiece_NORMAL
+			if byteFallback && isBytePiece(p.GetPiece()) {
+				t = sentencepiece.ModelProto_SentencePiece_BYTE
+			}
 		}
 		v.Types = append(v.Types, int32(t))
 	}
@@ -145,8 +1325,8 @@ func LoadSentencePieceTokens(dirpath string, params *Params) (*Vocab, error) {
 	slog.Info(fmt.Sprintf("vocab size: %d", len(v.Tokens)))
 
 	// add any additional tokens
-	addIn, err := os.ReadFile(filepath.Join(dirpath, "added_tokens.json"))
-	if os.IsNotExist(err) {
+	addIn, err := fs.ReadFile(fsys, "added_tokens.json")
+	if errors.Is(err, fs.ErrNotExist) {
 		return v, nil
 	} else if err != nil {
 		return nil, err
@@ -155,7 +1335,7 @@ func LoadSentencePieceTokens(dirpath string, params *Params) (*Vocab, error) {
 	slog.Info("reading user defined tokens")
 
 	var extraTokenData map[string]int
-	if err := json.Unmarshal(addIn, &extraTokenData); err != nil {
+	if err := json.Unmarshal(trimBOM(addIn), &extraTokenData); err != nil {
 		return nil, err
 	}
 
@@ -188,7 +1368,8 @@ func LoadSentencePieceTokens(dirpath string, params *Params) (*Vocab, error) {
 
 	if params.VocabSize > len(v.Tokens) {
 		missingTokens := params.VocabSize - len(v.Tokens)
-		slog.Warn(fmt.Sprintf("vocab is missing %d tokens", missingTokens))
+		params.warn(fmt.Sprintf("vocab is missing %d tokens", missingTokens))
+		params.VocabPadding += missingTokens
 		for cnt := 0; cnt < missingTokens; cnt++ {
 			v.Tokens = append(v.Tokens, fmt.Sprintf("<dummy%05d>", cnt+1))
 			v.Scores = append(v.Scores, -1)
@@ -5,6 +5,7 @@ package convert
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/ollama/ollama/llm"
@@ -98,6 +99,35 @@ func TestConvertFull(t *testing.T) {
 			if len(layers) != tt.layers {
 				t.Fatalf("expected %d layers, got %d", tt.layers, len(layers))
 			}
+
+			// scores are read from the SentencePiece proto rather than faked
+			if scores, _ := kv["tokenizer.ggml.scores"].([]any); len(scores) > 0 && !slices.ContainsFunc(scores, func(s any) bool { return s != scores[0] }) {
+				t.Fatalf("expected varying scores, got all %v", scores[0])
+			}
 		})
 	}
 }
+
+func TestConvertSummary(t *testing.T) {
+	p := filepath.Join("testdata", "gemma-2b-it")
+	if _, err := os.Stat(p); err != nil {
+		t.Skipf("%s not found", p)
+	}
+
+	summary, err := ConvertToFile(p, filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Architecture != "gemma" {
+		t.Fatalf("expected gemma, got %s", summary.Architecture)
+	}
+
+	if summary.ParameterCount != 2506172416 {
+		t.Fatalf("expected 2506172416 parameters, got %d", summary.ParameterCount)
+	}
+
+	if summary.TensorCount != 164 {
+		t.Fatalf("expected 164 tensors, got %d", summary.TensorCount)
+	}
+}
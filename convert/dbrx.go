@@ -0,0 +1,201 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// DbrxAttentionConfig is the attn_config block of DBRX
+type DbrxAttentionConfig struct {
+	ClipQKV   float64 `json:"clip_qkv"`
+	KVNHeads  int     `json:"kv_n_heads"`
+	RopeTheta float64 `json:"rope_theta"`
+}
+
+// DbrxFFNConfig is the ffn_config block of DBRX
+type DbrxFFNConfig struct {
+	FFNHiddenSize int `json:"ffn_hidden_size"`
+	MoENumExperts int `json:"moe_num_experts"`
+	MoETopK       int `json:"moe_top_k"`
+}
+
+// DbrxModel converts Databricks' DBRX mixture of experts. Each layer fuses
+// the query, key and value projections into Wqkv, which is split here, and
+// clamps their outputs to clip_qkv. The experts of a layer are packed into
+// one blob per projection, w1 the gates, v1 the ups and w2 the downs, of
+// every expert's rows in turn. These become the stacked gate, up and down
+// expert tensors, with each expert's down projection transposed since w2
+// stores them as they are multiplied rather than as linear weights. The
+// layer norms have no biases.
+type DbrxModel struct {
+	ModelData
+}
+
+// setDbrxSizes fills in the sizes of the config from the names DBRX uses
+// for them, some of which are nested in attn_config and ffn_config
+func (p *Params) setDbrxSizes() {
+	p.HiddenSize = cmp.Or(p.HiddenSize, p.DModel)
+	p.HiddenLayers = cmp.Or(p.HiddenLayers, p.NLayers)
+	p.AttentionHeads = cmp.Or(p.AttentionHeads, p.NHeads)
+	p.ContextSize = cmp.Or(p.ContextSize, p.MaxSeqLen)
+
+	if a := p.AttnConfig; a != nil {
+		p.KeyValHeads = a.KVNHeads
+		p.RopeFrequencyBase = cmp.Or(p.RopeFrequencyBase, a.RopeTheta)
+	}
+
+	p.KeyValHeads = cmp.Or(p.KeyValHeads, p.AttentionHeads)
+
+	if f := p.FFNConfig; f != nil {
+		p.IntermediateSize = cmp.Or(p.IntermediateSize, f.FFNHiddenSize)
+		p.Experts = cmp.Or(p.Experts, f.MoENumExperts)
+		p.ExpertsUsed = cmp.Or(p.ExpertsUsed, f.MoETopK)
+	}
+}
+
+func (m *DbrxModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	heads, kvHeads := uint64(m.Params.AttentionHeads), uint64(m.Params.KeyValHeads)
+	hidden, experts, ff := uint64(m.Params.HiddenSize), uint64(m.Params.Experts), uint64(m.Params.IntermediateSize)
+	if heads == 0 || hidden%heads != 0 {
+		return fmt.Errorf("dbrx: %d dimensions don't split into %d heads", hidden, heads)
+	}
+
+	kind := uint32(1)
+	if m.Params.F32 {
+		kind = 0
+	}
+
+	headDim := hidden / heads
+	for _, l := range t {
+		switch {
+		case strings.HasSuffix(l.Name, ".attn_qkv.weight"):
+			if l.Shape[0] != (heads+2*kvHeads)*headDim {
+				return fmt.Errorf("dbrx: %s has %d rows, expected %d for %d query and %d key value heads", l.Name, l.Shape[0], (heads+2*kvHeads)*headDim, heads, kvHeads)
+			}
+
+			start := uint64(0)
+			for _, part := range []struct {
+				name string
+				rows uint64
+			}{{"q", heads * headDim}, {"k", kvHeads * headDim}, {"v", kvHeads * headDim}} {
+				shape := []uint64{part.rows, l.Shape[1]}
+				m.Tensors = append(m.Tensors, repackTensor(l, strings.Replace(l.Name, "qkv", part.name, 1), l.Kind, shape, sliceRows(start, part.rows)))
+				start += part.rows
+			}
+		case strings.HasSuffix(l.Name, "_exps.weight"):
+			if !slices.Equal(l.Shape, []uint64{experts * ff, hidden}) {
+				return fmt.Errorf("dbrx: %s has shape %v, expected %d experts of [%d %d]", l.Name, l.Shape, experts, ff, hidden)
+			}
+
+			shape, repack := []uint64{experts, ff, hidden}, func(data []float32, _ []uint64) ([]float32, error) {
+				return data, nil
+			}
+
+			if strings.HasSuffix(l.Name, ".ffn_down_exps.weight") {
+				shape, repack = []uint64{experts, hidden, ff}, func(data []float32, _ []uint64) ([]float32, error) {
+					return gptOssTransposeExperts(data, []uint64{experts, ff, hidden})
+				}
+			}
+
+			kind, err := m.Params.tensorKind(l.Name, shape, kind)
+			if err != nil {
+				return err
+			}
+
+			m.Tensors = append(m.Tensors, repackTensor(l, l.Name, kind, shape, repack))
+		default:
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+func (m *DbrxModel) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *DbrxModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv := llm.KV{
+		"general.architecture":              "dbrx",
+		"general.name":                      m.Name,
+		"dbrx.vocab_size":                   uint32(len(m.Vocab.Tokens)),
+		"dbrx.context_length":               uint32(m.Params.contextLength()),
+		"dbrx.embedding_length":             uint32(m.Params.HiddenSize),
+		"dbrx.block_count":                  uint32(m.Params.HiddenLayers),
+		"dbrx.feed_forward_length":          uint32(m.Params.IntermediateSize),
+		"dbrx.expert_count":                 uint32(m.Params.Experts),
+		"dbrx.expert_used_count":            uint32(m.Params.ExpertsUsed),
+		"dbrx.rope.freq_base":               float32(cmp.Or(m.Params.RopeFrequencyBase, 10000)),
+		"dbrx.attention.head_count":         uint32(m.Params.AttentionHeads),
+		"dbrx.attention.head_count_kv":      uint32(m.Params.KeyValHeads),
+		"dbrx.attention.layer_norm_epsilon": float32(1e-5),
+		"general.file_type":                 m.Params.fileType(),
+		"tokenizer.ggml.model":              m.Vocab.Model,
+		"tokenizer.ggml.pre":                m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":             m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":         m.Vocab.Types,
+		"tokenizer.ggml.merges":             m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":       uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":       uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.add_bos_token":      false,
+	}
+
+	// clamp_kqv is the name runtimes read clip_qkv as. It is left out when
+	// the config doesn't clamp.
+	if a := m.Params.AttnConfig; a != nil && a.ClipQKV > 0 {
+		kv["dbrx.attention.clamp_kqv"] = float32(a.ClipQKV)
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("dbrx"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the expert metadata is set and every layer has the split
+// query, key and value, the router and the expert tensors dbrx runtimes
+// expect
+func (m *DbrxModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	experts, _ := kv["dbrx.expert_count"].(uint32)
+	used, _ := kv["dbrx.expert_used_count"].(uint32)
+	switch {
+	case experts == 0:
+		return errors.New("dbrx: ffn_config is missing moe_num_experts")
+	case used == 0 || used > experts:
+		return fmt.Errorf("dbrx: moe_top_k %d must be between 1 and moe_num_experts %d", used, experts)
+	}
+
+	for i := range m.Params.HiddenLayers {
+		for _, name := range []string{"attn_norm", "attn_q", "attn_k", "attn_v", "attn_output", "attn_output_norm", "ffn_gate_inp", "ffn_gate_exps", "ffn_up_exps", "ffn_down_exps"} {
+			name := fmt.Sprintf("blk.%d.%s.weight", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("dbrx: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyDbrx writes a single layer DBRX model of 2 experts, each with a
+// feed forward network of 4 dimensions, and 2 query heads sharing a key value
+// head of 4 dimensions to a temporary directory. Each row of the fused query,
+// key and value holds its row number and each value of the packed down
+// projections its index.
+func createTinyDbrx(t *testing.T) string {
+	t.Helper()
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures": []string{"DbrxForCausalLM"},
+			"vocab_size":    4,
+			"d_model":       8,
+			"n_layers":      1,
+			"n_heads":       2,
+			"max_seq_len":   64,
+			"attn_config": map[string]any{
+				"clip_qkv":   8,
+				"kv_n_heads": 1,
+				"rope_theta": 500000,
+			},
+			"ffn_config": map[string]any{
+				"ffn_hidden_size": 4,
+				"moe_num_experts": 2,
+				"moe_top_k":       1,
+			},
+			"bos_token_id": 0,
+			"eos_token_id": 0,
+		},
+		tokenizer: tinyGPT2Tokenizer(),
+		tensors: map[string][]uint64{
+			"transformer.wte.weight":                                   {4, 8},
+			"lm_head.weight":                                           {4, 8},
+			"transformer.norm_f.weight":                                {8},
+			"transformer.blocks.0.norm_attn_norm.norm_1.weight":        {8},
+			"transformer.blocks.0.norm_attn_norm.attn.Wqkv.weight":     {16, 8},
+			"transformer.blocks.0.norm_attn_norm.attn.out_proj.weight": {8, 8},
+			"transformer.blocks.0.norm_attn_norm.norm_2.weight":        {8},
+			"transformer.blocks.0.ffn.router.layer.weight":             {2, 8},
+			"transformer.blocks.0.ffn.experts.mlp.w1":                  {8, 8},
+			"transformer.blocks.0.ffn.experts.mlp.v1":                  {8, 8},
+			"transformer.blocks.0.ffn.experts.mlp.w2":                  {8, 8},
+		},
+		values: map[string]func(int) float32{
+			"transformer.blocks.0.norm_attn_norm.attn.Wqkv.weight": rowNumbers(8),
+			"transformer.blocks.0.ffn.experts.mlp.w2":              rowNumbers(1),
+		},
+	})
+}
+
+func TestConvertDbrx(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyDbrx(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":              "dbrx",
+		"dbrx.context_length":               uint32(64),
+		"dbrx.embedding_length":             uint32(8),
+		"dbrx.feed_forward_length":          uint32(4),
+		"dbrx.block_count":                  uint32(1),
+		"dbrx.expert_count":                 uint32(2),
+		"dbrx.expert_used_count":            uint32(1),
+		"dbrx.rope.freq_base":               float32(500000),
+		"dbrx.attention.head_count":         uint32(2),
+		"dbrx.attention.head_count_kv":      uint32(1),
+		"dbrx.attention.clamp_kqv":          float32(8),
+		"dbrx.attention.layer_norm_epsilon": float32(1e-5),
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	for name, want := range map[string][]uint64{
+		"blk.0.attn_q.weight":        {8, 8},
+		"blk.0.attn_k.weight":        {8, 4},
+		"blk.0.attn_v.weight":        {8, 4},
+		"blk.0.ffn_gate_exps.weight": {8, 4, 2},
+		"blk.0.ffn_up_exps.weight":   {8, 4, 2},
+		"blk.0.ffn_down_exps.weight": {4, 8, 2},
+		"output.weight":              {8, 4},
+		"output_norm.weight":         {8},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := tensor.Shape[:len(want)]; !slices.Equal(got, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got)
+		}
+	}
+
+	f32s := func(name string) []float32 {
+		tensor := tensors[name]
+		f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f32s
+	}
+
+	for name, want := range map[string][]float32{
+		"blk.0.attn_q.weight": {0, 1, 2, 3, 4, 5, 6, 7},
+		"blk.0.attn_k.weight": {8, 9, 10, 11},
+		"blk.0.attn_v.weight": {12, 13, 14, 15},
+	} {
+		var rows []float32
+		for i, f := range f32s(name) {
+			if i%8 == 0 {
+				rows = append(rows, f)
+			}
+		}
+
+		if !slices.Equal(rows, want) {
+			t.Errorf("%s: expected rows %v, got %v", name, want, rows)
+		}
+	}
+
+	// w2 holds the down projection of each expert as [ff, hidden]
+	down := f32s("blk.0.ffn_down_exps.weight")
+	if want := []float32{0, 8, 16, 24, 1, 9, 17, 25}; !slices.Equal(down[:8], want) {
+		t.Errorf("expert 0 down: expected %v, got %v", want, down[:8])
+	}
+
+	if want := []float32{32, 40, 48, 56, 33, 41, 49, 57}; !slices.Equal(down[32:40], want) {
+		t.Errorf("expert 1 down: expected %v, got %v", want, down[32:40])
+	}
+
+	// pins the data of every converted tensor
+	if got, want := fmt.Sprintf("%x", sha256.Sum256(data)), "30f20bc56ab23fccec356d7074348e576ba895602136a55af3a089331c9e2fdb"; got != want {
+		t.Fatalf("expected tensor data %s, got %s", want, got)
+	}
+}
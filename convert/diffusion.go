@@ -0,0 +1,146 @@
+package convert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ConvertDiffusionTextEncoders converts the text encoders of the diffusers
+// pipeline in dir, e.g. CLIP-L and CLIP-G of Stable Diffusion XL, to one GGUF
+// each in outDir named after their directory. The returned paths are in the
+// order the pipeline concatenates the hidden states of the encoders.
+//
+// Besides its own metadata each file records the pipeline, its position
+// among the encoders, the cross attention dimension of the concatenated
+// hidden states and the dimension of the pooled projection the UNet is
+// conditioned on. These are checked against the UNet config when the
+// pipeline has one.
+func ConvertDiffusionTextEncoders(dir, outDir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "model_index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var index map[string]any
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+
+	pipeline, _ := index["_class_name"].(string)
+
+	var names []string
+	for name, component := range index {
+		// pipelines may leave out optional encoders as [null, null]
+		if c, ok := component.([]any); strings.HasPrefix(name, "text_encoder") && !(ok && len(c) == 2 && c[0] == nil) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("pipeline has no text encoders")
+	}
+
+	// text_encoder sorts before text_encoder_2
+	slices.Sort(names)
+
+	var crossAttentionDim, pooledProjectionDim int
+	for _, name := range names {
+		// components are listed as [library, class]
+		component, _ := index[name].([]any)
+		if len(component) != 2 {
+			return nil, fmt.Errorf("%s: unexpected component %v", name, index[name])
+		}
+
+		switch class, _ := component[1].(string); class {
+		case "CLIPTextModel", "CLIPTextModelWithProjection":
+		default:
+			return nil, fmt.Errorf("%s: unsupported text encoder %s", name, class)
+		}
+
+		params, err := (&SafetensorFormat{}).GetParams(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		crossAttentionDim += params.HiddenSize
+		if slices.Contains(params.Architectures, "CLIPTextModelWithProjection") {
+			pooledProjectionDim = params.ProjectionDim
+		}
+	}
+
+	if err := checkUNetConfig(filepath.Join(dir, "unet", "config.json"), crossAttentionDim); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for i, name := range names {
+		// pipelines keep the vocabulary of each encoder in the tokenizer
+		// directory matching it, e.g. tokenizer_2 for text_encoder_2
+		var opts Options
+		if _, err := os.Stat(filepath.Join(dir, name, "vocab.json")); errors.Is(err, os.ErrNotExist) {
+			opts.TokenizerDir = filepath.Join(dir, strings.Replace(name, "text_encoder", "tokenizer", 1))
+		}
+
+		path := filepath.Join(outDir, name+".gguf")
+		if _, err := ConvertToFileWithOptions(filepath.Join(dir, name), path, opts); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		patches := map[string]any{
+			"diffusion.pipeline":            pipeline,
+			"diffusion.text_encoder.index":  uint32(i),
+			"diffusion.text_encoder.count":  uint32(len(names)),
+			"diffusion.cross_attention_dim": uint32(crossAttentionDim),
+		}
+
+		if pooledProjectionDim > 0 {
+			patches["diffusion.pooled_projection_dim"] = uint32(pooledProjectionDim)
+		}
+
+		if err := FixGGUF(path, path, patches); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// checkUNetConfig checks the cross attention dimension of the UNet config at
+// p, if there is one, is crossAttentionDim
+func checkUNetConfig(p string, crossAttentionDim int) error {
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var config struct {
+		CrossAttentionDim any `json:"cross_attention_dim"`
+	}
+
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+
+	// cross_attention_dim may be one dimension or one per block
+	dims, ok := config.CrossAttentionDim.([]any)
+	if !ok {
+		dims = []any{config.CrossAttentionDim}
+	}
+
+	for _, dim := range dims {
+		if dim, ok := dim.(float64); ok && int(dim) != crossAttentionDim {
+			return fmt.Errorf("unet cross_attention_dim is %d but the text encoders have %d hidden dimensions", int(dim), crossAttentionDim)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createTinyCLIPText writes a single layer CLIP text encoder with hidden
+// dimension hidden to dir and its vocabulary to tokenizer. A non-zero
+// projection adds a text projection of that many outputs.
+func createTinyCLIPText(t *testing.T, dir, tokenizer string, hidden, projection uint64) {
+	t.Helper()
+
+	arch := "CLIPTextModel"
+	tensors := map[string][]uint64{
+		"text_model.embeddings.token_embedding.weight":    {4, hidden},
+		"text_model.embeddings.position_embedding.weight": {8, hidden},
+		"text_model.embeddings.position_ids":              {1, 8},
+		"text_model.final_layer_norm.weight":              {hidden},
+		"text_model.final_layer_norm.bias":                {hidden},
+	}
+
+	for _, name := range []string{"q_proj", "k_proj", "v_proj", "out_proj"} {
+		tensors["text_model.encoder.layers.0.self_attn."+name+".weight"] = []uint64{hidden, hidden}
+		tensors["text_model.encoder.layers.0.self_attn."+name+".bias"] = []uint64{hidden}
+	}
+
+	for _, name := range []string{"layer_norm1", "layer_norm2"} {
+		tensors["text_model.encoder.layers.0."+name+".weight"] = []uint64{hidden}
+		tensors["text_model.encoder.layers.0."+name+".bias"] = []uint64{hidden}
+	}
+
+	tensors["text_model.encoder.layers.0.mlp.fc1.weight"] = []uint64{2 * hidden, hidden}
+	tensors["text_model.encoder.layers.0.mlp.fc1.bias"] = []uint64{2 * hidden}
+	tensors["text_model.encoder.layers.0.mlp.fc2.weight"] = []uint64{hidden, 2 * hidden}
+	tensors["text_model.encoder.layers.0.mlp.fc2.bias"] = []uint64{hidden}
+
+	if projection > 0 {
+		arch = "CLIPTextModelWithProjection"
+		tensors["text_projection.weight"] = []uint64{projection, hidden}
+	}
+
+	for _, d := range []string{dir, tokenizer} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	createJSON(t, filepath.Join(dir, "config.json"), map[string]any{
+		"architectures":           []string{arch},
+		"vocab_size":              4,
+		"hidden_size":             hidden,
+		"intermediate_size":       2 * hidden,
+		"num_hidden_layers":       1,
+		"num_attention_heads":     2,
+		"max_position_embeddings": 8,
+		"projection_dim":          projection,
+		"hidden_act":              "quick_gelu",
+		"layer_norm_eps":          1e-5,
+		"bos_token_id":            0,
+		"eos_token_id":            2,
+		"pad_token_id":            1,
+	})
+
+	createSafetensors(t, filepath.Join(dir, "model.safetensors"), tensors)
+
+	createJSON(t, filepath.Join(tokenizer, "vocab.json"), map[string]int{
+		"a</w>": 0, "b</w>": 1, "<|startoftext|>": 2, "<|endoftext|>": 3,
+	})
+
+	if err := os.WriteFile(filepath.Join(tokenizer, "merges.txt"), []byte("#version: 0.2\na b</w>\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTinySDXL writes a pipeline with the two text encoders of Stable
+// Diffusion XL, the second with a projection, and a UNet config
+func createTinySDXL(t *testing.T, crossAttentionDim int) string {
+	t.Helper()
+
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "model_index.json"), map[string]any{
+		"_class_name":    "StableDiffusionXLPipeline",
+		"text_encoder":   []string{"transformers", "CLIPTextModel"},
+		"text_encoder_2": []string{"transformers", "CLIPTextModelWithProjection"},
+		"tokenizer":      []string{"transformers", "CLIPTokenizer"},
+		"tokenizer_2":    []string{"transformers", "CLIPTokenizer"},
+		"unet":           []string{"diffusers", "UNet2DConditionModel"},
+	})
+
+	createTinyCLIPText(t, filepath.Join(d, "text_encoder"), filepath.Join(d, "tokenizer"), 8, 0)
+	createTinyCLIPText(t, filepath.Join(d, "text_encoder_2"), filepath.Join(d, "tokenizer_2"), 16, 16)
+
+	if err := os.MkdirAll(filepath.Join(d, "unet"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	createJSON(t, filepath.Join(d, "unet", "config.json"), map[string]any{"cross_attention_dim": crossAttentionDim})
+	return d
+}
+
+func TestConvertDiffusionTextEncoders(t *testing.T) {
+	out := t.TempDir()
+	paths, err := ConvertDiffusionTextEncoders(createTinySDXL(t, 24), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(out, "text_encoder.gguf"), filepath.Join(out, "text_encoder_2.gguf")}
+	if len(paths) != len(want) || paths[0] != want[0] || paths[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, paths)
+	}
+
+	for i, p := range paths {
+		ggml, _ := decodeFile(t, p)
+		kv := ggml.KV()
+
+		for k, want := range map[string]any{
+			"general.architecture":            "clip",
+			"clip.has_text_encoder":           true,
+			"clip.has_vision_encoder":         false,
+			"clip.use_gelu":                   false,
+			"clip.text.embedding_length":      uint32(8 * (i + 1)),
+			"clip.text.context_length":        uint32(8),
+			"tokenizer.ggml.model":            "clip",
+			"tokenizer.ggml.bos_token_id":     uint32(2),
+			"tokenizer.ggml.eos_token_id":     uint32(3),
+			"diffusion.pipeline":              "StableDiffusionXLPipeline",
+			"diffusion.text_encoder.index":    uint32(i),
+			"diffusion.text_encoder.count":    uint32(2),
+			"diffusion.cross_attention_dim":   uint32(24),
+			"diffusion.pooled_projection_dim": uint32(16),
+		} {
+			if kv[k] != want {
+				t.Errorf("%s: %s: expected %v, got %v", p, k, want, kv[k])
+			}
+		}
+
+		if !equalValue(kv["tokenizer.ggml.merges"], []any{"a b</w>"}) {
+			t.Errorf("%s: unexpected merges %v", p, kv["tokenizer.ggml.merges"])
+		}
+
+		var projection bool
+		for _, tensor := range ggml.Tensors() {
+			if !strings.HasPrefix(tensor.Name, "t.") {
+				t.Errorf("%s: unexpected tensor %s", p, tensor.Name)
+			}
+
+			projection = projection || tensor.Name == "t.text_projection.weight"
+		}
+
+		// 20 tensors of the encoder, without position_ids
+		if n := len(ggml.Tensors()); n != 20+i {
+			t.Errorf("%s: expected %d tensors, got %d", p, 20+i, n)
+		}
+
+		if projection != (i == 1) {
+			t.Errorf("%s: expected text projection %v", p, i == 1)
+		}
+
+		if _, ok := kv["clip.text.projection_dim"]; ok != (i == 1) {
+			t.Errorf("%s: expected clip.text.projection_dim %v", p, i == 1)
+		}
+	}
+}
+
+func TestConvertDiffusionTextEncodersInvalid(t *testing.T) {
+	t.Run("cross attention", func(t *testing.T) {
+		// CLIP-L and CLIP-G concatenate to 24 dimensions
+		if _, err := ConvertDiffusionTextEncoders(createTinySDXL(t, 2048), t.TempDir()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("t5", func(t *testing.T) {
+		d := createTinySDXL(t, 24)
+		createJSON(t, filepath.Join(d, "model_index.json"), map[string]any{
+			"_class_name":    "StableDiffusion3Pipeline",
+			"text_encoder":   []string{"transformers", "CLIPTextModelWithProjection"},
+			"text_encoder_3": []string{"transformers", "T5EncoderModel"},
+		})
+
+		if _, err := ConvertDiffusionTextEncoders(d, t.TempDir()); err == nil || !strings.Contains(err.Error(), "T5EncoderModel") {
+			t.Fatalf("expected unsupported text encoder error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// FalconModel converts TII's Falcon. Each layer fuses the query, key and
+// value projections into query_key_value, which is split here, and has no
+// feed forward gate. Falcon 40B and 180B, the new decoder architecture,
+// normalize the input of the attention and of the feed forward network with
+// separate norms. Like qwen2 the query and key aren't repacked.
+type FalconModel struct {
+	ModelData
+}
+
+func (m *FalconModel) GetTensors() error {
+	if m.Params.Alibi {
+		return errors.New("falcon: alibi isn't supported, only rotary embeddings are")
+	}
+
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	if m.Params.KeyValHeads == 0 || m.Params.AttentionHeads%m.Params.KeyValHeads != 0 {
+		return fmt.Errorf("falcon: %d attention heads can't share %d key value heads", m.Params.AttentionHeads, m.Params.KeyValHeads)
+	}
+
+	heads, kvHeads := uint64(m.Params.AttentionHeads), uint64(m.Params.KeyValHeads)
+	for _, l := range t {
+		if !strings.Contains(l.Name, ".attn_qkv.") {
+			m.Tensors = append(m.Tensors, l)
+			continue
+		}
+
+		rows := heads + 2*kvHeads
+		if l.Shape[0]%rows != 0 {
+			return fmt.Errorf("falcon: %s has %d rows which aren't %d heads", l.Name, l.Shape[0], rows)
+		}
+
+		headDim := l.Shape[0] / rows
+		for _, part := range []string{"q", "k", "v"} {
+			shape := slices.Clone(l.Shape)
+			shape[0] = headDim * kvHeads
+			if part == "q" {
+				shape[0] = headDim * heads
+			}
+
+			m.Tensors = append(m.Tensors, repackTensor(l, strings.Replace(l.Name, "qkv", part, 1), l.Kind, shape, splitFalconQKV(part, heads, kvHeads)))
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	if m.Tensors, err = tieOutput(m.Tensors); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// splitFalconQKV returns a repack function selecting the query, key or value
+// heads of a fused query_key_value weight or bias. The heads are grouped by
+// key value head with the query heads sharing it first, then its key and then
+// its value. This covers every Falcon layout: multi-query attention is a
+// single group and the interleaved heads of multi-head attention are groups
+// of one query head each.
+func splitFalconQKV(part string, heads, kvHeads uint64) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, shape []uint64) ([]float32, error) {
+		cols := uint64(1)
+		if len(shape) > 1 {
+			cols = shape[1]
+		}
+
+		group := heads / kvHeads
+		headSize := uint64(len(data)) / (heads + 2*kvHeads)
+
+		var out []float32
+		for g := range kvHeads {
+			start := g * (group + 2)
+			var n uint64
+			switch part {
+			case "q":
+				n = group
+			case "k":
+				start, n = start+group, 1
+			case "v":
+				start, n = start+group+1, 1
+			}
+
+			out = append(out, data[start*headSize:(start+n)*headSize]...)
+		}
+
+		if uint64(len(out))%cols != 0 {
+			return nil, fmt.Errorf("falcon: %s heads don't split into rows of %d", part, cols)
+		}
+
+		return out, nil
+	}
+}
+
+func (m *FalconModel) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *FalconModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv := llm.KV{
+		"general.architecture":                "falcon",
+		"general.name":                        m.Name,
+		"falcon.vocab_size":                   uint32(len(m.Vocab.Tokens)),
+		"falcon.context_length":               uint32(cmp.Or(m.Params.contextLength(), 2048)),
+		"falcon.embedding_length":             uint32(m.Params.HiddenSize),
+		"falcon.block_count":                  uint32(m.Params.HiddenLayers),
+		"falcon.feed_forward_length":          uint32(cmp.Or(m.Params.FFNHiddenSize, 4*m.Params.HiddenSize)),
+		"falcon.attention.head_count":         uint32(m.Params.AttentionHeads),
+		"falcon.attention.head_count_kv":      uint32(m.Params.KeyValHeads),
+		"falcon.attention.layer_norm_epsilon": float32(cmp.Or(m.Params.LayerNormEpsilon, 1e-5)),
+		"general.file_type":                   m.Params.fileType(),
+		"tokenizer.ggml.model":                m.Vocab.Model,
+		"tokenizer.ggml.pre":                  m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":               m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":           m.Vocab.Types,
+		"tokenizer.ggml.merges":               m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":         uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":         uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.add_bos_token":        false,
+	}
+
+	if m.Params.RopeFrequencyBase > 0 {
+		kv["falcon.rope.freq_base"] = float32(m.Params.RopeFrequencyBase)
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("falcon"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks every layer has the attention norm and the split query, key
+// and value falcon runtimes expect
+func (m *FalconModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	for i := range m.Params.HiddenLayers {
+		for _, name := range []string{"attn_norm", "attn_q", "attn_k", "attn_v"} {
+			name := fmt.Sprintf("blk.%d.%s.weight", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("falcon: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
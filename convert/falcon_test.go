@@ -0,0 +1,190 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyFalcon writes a single layer falcon model of the new decoder
+// architecture with 4 query heads sharing 2 key value heads of 2 dimensions
+// to a temporary directory. Each row of the fused query, key and value holds
+// its row number.
+func createTinyFalcon(t *testing.T) string {
+	t.Helper()
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":            []string{"FalconForCausalLM"},
+			"vocab_size":               4,
+			"hidden_size":              8,
+			"num_hidden_layers":        1,
+			"num_attention_heads":      4,
+			"num_kv_heads":             2,
+			"new_decoder_architecture": true,
+			"layer_norm_epsilon":       1e-5,
+			"bos_token_id":             2,
+			"eos_token_id":             3,
+		},
+		tokenizer: tinyBPETokenizer(">>ABSTRACT<<", "<|endoftext|>"),
+		tensors: map[string][]uint64{
+			"transformer.word_embeddings.weight":                    {4, 8},
+			"transformer.ln_f.weight":                               {8},
+			"transformer.ln_f.bias":                                 {8},
+			"transformer.h.0.ln_attn.weight":                        {8},
+			"transformer.h.0.ln_attn.bias":                          {8},
+			"transformer.h.0.ln_mlp.weight":                         {8},
+			"transformer.h.0.ln_mlp.bias":                           {8},
+			"transformer.h.0.self_attention.query_key_value.weight": {16, 8},
+			"transformer.h.0.self_attention.dense.weight":           {8, 8},
+			"transformer.h.0.mlp.dense_h_to_4h.weight":              {32, 8},
+			"transformer.h.0.mlp.dense_4h_to_h.weight":              {8, 32},
+		},
+		values: map[string]func(int) float32{
+			"transformer.h.0.self_attention.query_key_value.weight": rowNumbers(8),
+		},
+	})
+}
+
+func TestConvertFalcon(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyFalcon(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":                "falcon",
+		"falcon.context_length":               uint32(2048),
+		"falcon.embedding_length":             uint32(8),
+		"falcon.feed_forward_length":          uint32(32),
+		"falcon.block_count":                  uint32(1),
+		"falcon.attention.head_count":         uint32(4),
+		"falcon.attention.head_count_kv":      uint32(2),
+		"falcon.attention.layer_norm_epsilon": float32(1e-5),
+		"tokenizer.ggml.model":                "gpt2",
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	if _, ok := tensors["blk.0.attn_qkv.weight"]; ok {
+		t.Error("unexpected tensor blk.0.attn_qkv.weight")
+	}
+
+	// each group of the fused tensor is two query heads, a key head and a
+	// value head, two rows apiece
+	for name, want := range map[string][]float32{
+		"blk.0.attn_q.weight": {0, 1, 2, 3, 8, 9, 10, 11},
+		"blk.0.attn_k.weight": {4, 5, 12, 13},
+		"blk.0.attn_v.weight": {6, 7, 14, 15},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := tensor.Shape[:2]; !slices.Equal(got, []uint64{8, uint64(len(want))}) {
+			t.Fatalf("%s: expected shape [8 %d], got %v", name, len(want), got)
+		}
+
+		f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rows []float32
+		for i := 0; i < len(f32s); i += 8 {
+			rows = append(rows, f32s[i])
+		}
+
+		if !slices.Equal(rows, want) {
+			t.Errorf("%s: expected rows %v, got %v", name, want, rows)
+		}
+	}
+
+	for _, name := range []string{"blk.0.attn_norm.weight", "blk.0.attn_norm_2.bias", "blk.0.ffn_up.weight", "blk.0.ffn_down.weight", "output_norm.bias"} {
+		if _, ok := tensors[name]; !ok {
+			t.Errorf("expected tensor %s", name)
+		}
+	}
+
+	// pins the data of every converted tensor
+	if got, want := fmt.Sprintf("%x", sha256.Sum256(data)), "2a6d4f962a023d9d24a8186c18620a6d7fa500ce4bbd2beee081a05692726ca9"; got != want {
+		t.Fatalf("expected tensor data %s, got %s", want, got)
+	}
+}
+
+func TestSplitFalconQKV(t *testing.T) {
+	cases := []struct {
+		name           string
+		heads, kvHeads uint64
+		want           map[string][]float32
+	}{
+		{
+			// falcon 7b: every query head shares one key and one value
+			name: "multi-query", heads: 3, kvHeads: 1,
+			want: map[string][]float32{"q": {0, 1, 2}, "k": {3}, "v": {4}},
+		},
+		{
+			// falcon rw: the query, key and value of each head are interleaved
+			name: "multi-head", heads: 2, kvHeads: 2,
+			want: map[string][]float32{"q": {0, 3}, "k": {1, 4}, "v": {2, 5}},
+		},
+		{
+			name: "grouped-query", heads: 4, kvHeads: 2,
+			want: map[string][]float32{"q": {0, 1, 4, 5}, "k": {2, 6}, "v": {3, 7}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			// one dimension per head so each value is its head number
+			data := make([]float32, tt.heads+2*tt.kvHeads)
+			for i := range data {
+				data[i] = float32(i)
+			}
+
+			for _, part := range []string{"q", "k", "v"} {
+				got, err := splitFalconQKV(part, tt.heads, tt.kvHeads)(data, []uint64{uint64(len(data))})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !slices.Equal(got, tt.want[part]) {
+					t.Errorf("%s: expected %v, got %v", part, tt.want[part], got)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertFalconAlibi(t *testing.T) {
+	d := createTinyFalcon(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":       []string{"FalconForCausalLM"},
+		"vocab_size":          4,
+		"hidden_size":         8,
+		"num_hidden_layers":   1,
+		"num_attention_heads": 4,
+		"multi_query":         false,
+		"alibi":               true,
+	})
+
+	if _, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf")); err == nil || !strings.Contains(err.Error(), "alibi") {
+		t.Fatalf("expected alibi error, got %v", err)
+	}
+}
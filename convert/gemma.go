@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"strings"
 
 	"github.com/pdevine/tensor"
@@ -35,31 +36,40 @@ func addOnes(data []float32, vectorSize int) ([]float32, error) {
 		f32s = append(f32s, t...)
 	}
 
-
 	return f32s, nil
 }
 
 func (m *GemmaModel) GetTensors() error {
-	t, err := m.Format.GetTensors(m.Path, m.Params)
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
 	if err != nil {
 		return err
 	}
 
 	slog.Debug(fmt.Sprintf("Total tensors: %d", len(t)))
 	for _, l := range t {
-		if strings.HasSuffix(l.Name, "norm.weight") {
-			wt := l.WriterTo.(safetensorWriterTo)
-			wt.repacker = m.Repack
-			l.WriterTo = wt
+		if name := l.Name; strings.HasSuffix(name, "norm.weight") {
+			// gemma scales by one plus the norm weight. The weight is upcast
+			// to F32 exactly, including from BF16, before one is added and the
+			// sum stays F32 whatever type norms are otherwise written as since
+			// F16 and BF16 keep too few bits of a small weight once one is
+			// added to it.
+			l = repackTensor(l, name, 0, l.Shape, func(data []float32, shape []uint64) ([]float32, error) {
+				return m.Repack(name, data, shape)
+			})
 		}
 		m.Tensors = append(m.Tensors, l)
 	}
 
+	updateOffsets(m.Tensors)
+	if m.Tensors, err = m.Params.tieWordEmbeddings(m.Tensors); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (m *GemmaModel) LoadVocab() error {
-	v, err := LoadSentencePieceTokens(m.Path, m.Params)
+	v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
 	if err != nil {
 		return err
 	}
@@ -75,7 +85,7 @@ func (m *GemmaModel) WriteGGUF(ws io.WriteSeeker) error {
 	kv := llm.KV{
 		"general.architecture":                   "gemma",
 		"general.name":                           m.Name,
-		"gemma.context_length":                   uint32(m.Params.ContextSize),
+		"gemma.context_length":                   uint32(m.Params.contextLength()),
 		"gemma.embedding_length":                 uint32(m.Params.HiddenSize),
 		"gemma.block_count":                      uint32(m.Params.HiddenLayers),
 		"gemma.feed_forward_length":              uint32(m.Params.IntermediateSize),
@@ -84,7 +94,7 @@ func (m *GemmaModel) WriteGGUF(ws io.WriteSeeker) error {
 		"gemma.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
 		"gemma.attention.key_length":             uint32(m.Params.HeadDimension),
 		"gemma.attention.value_length":           uint32(m.Params.HeadDimension),
-		"general.file_type":                      uint32(1),
+		"general.file_type":                      m.Params.fileType(),
 		"tokenizer.ggml.model":                   "llama",
 
 		"tokenizer.ggml.tokens":     m.Vocab.Tokens,
@@ -99,5 +109,20 @@ func (m *GemmaModel) WriteGGUF(ws io.WriteSeeker) error {
 		"tokenizer.ggml.add_eos_token":    false,
 	}
 
-	return llm.NewGGUFV3(m.Params.ByteOrder).Encode(ws, kv, m.Tensors)
+	maps.Copy(kv, m.Params.RopeScaling.KV("gemma"))
+
+	// like transformers, only hidden_activation is read since older configs
+	// set hidden_act to gelu rather than the tanh approximation gemma was
+	// trained with
+	if m.Params.HiddenActivation != "" {
+		maps.Copy(kv, m.Params.activationKV("gemma", "gelu_tanh"))
+	} else {
+		kv["gemma.feed_forward.activation"] = "gelu_tanh"
+	}
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
 }
@@ -0,0 +1,111 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/d4l3k/go-bfloat16"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+)
+
+func TestGemmaLoadVocabScores(t *testing.T) {
+	d := t.TempDir()
+	createSentencePiece(t, filepath.Join(d, "tokenizer.model"),
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<pad>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<eos>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("▁the"), Score: proto.Float32(-4.25)},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("▁a"), Score: proto.Float32(-7.5)},
+	)
+
+	// gemma also ships a tokenizer.json which has no scores of its own
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{"type": "BPE", "vocab": map[string]int{"a": 0}},
+	})
+
+	m := GemmaModel{ModelData{FS: os.DirFS(d), Params: &Params{VocabSize: 4}}}
+	if err := m.LoadVocab(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"<pad>", "<eos>", "▁the", "▁a"}; !slices.Equal(m.Vocab.Tokens, want) {
+		t.Fatalf("expected tokens %v, got %v", want, m.Vocab.Tokens)
+	}
+
+	if want := []float32{0, 0, -4.25, -7.5}; !slices.Equal(m.Vocab.Scores, want) {
+		t.Fatalf("expected scores %v, got %v", want, m.Vocab.Scores)
+	}
+}
+
+func TestGemmaNormsFromBF16(t *testing.T) {
+	// small weights lose the most once one is added to them
+	weights := []float32{-0.0123, 0.000732, 0.5, -0.99, 3.3, 1e-5, 0, 0.0625}
+
+	var data bytes.Buffer
+	for _, w := range weights {
+		data.Write(bfloat16.EncodeFloat32([]float32{w}))
+	}
+
+	header, err := json.Marshal(map[string]safetensorMetadata{
+		"model.norm.weight": {Type: "BF16", Shape: []uint64{uint64(len(weights))}, Offsets: []int64{0, int64(data.Len())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f bytes.Buffer
+	if err := binary.Write(&f, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(header)
+	f.Write(data.Bytes())
+
+	d := t.TempDir()
+	if err := os.WriteFile(filepath.Join(d, "model.safetensors"), f.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{"architectures": []string{"GemmaForCausalLM"}})
+
+	mf := &SafetensorFormat{}
+	params, err := mf.GetParams(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sum stays F32 even when norms are otherwise narrowed
+	params.TensorTypes.Norms = "F16"
+	m := GemmaModel{ModelData{FS: os.DirFS(d), Params: params, Format: mf}}
+	if err := m.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Tensors) != 1 || m.Tensors[0].Kind != 0 {
+		t.Fatalf("expected one F32 norm, got %+v", m.Tensors)
+	}
+
+	var b bytes.Buffer
+	if _, err := m.Tensors[0].WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]float32, len(weights))
+	if err := binary.Read(&b, binary.LittleEndian, got); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reference adds one to the F32 value of each BF16 weight
+	for i, w := range bfloat16.DecodeFloat32(data.Bytes()) {
+		if want := w + 1; math.Abs(float64(got[i]-want)) > 1e-7 {
+			t.Errorf("%d: expected %v, got %v", i, want, got[i])
+		}
+	}
+}
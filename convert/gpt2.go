@@ -0,0 +1,123 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// GPT2Model converts OpenAI's GPT-2 and its fine-tunes. The layers are those
+// of GPTBigCodeModel with every head having its own key and value, but the
+// projections are Conv1D layers which store their weights input dimension
+// first, so they are transposed to the layout of a linear layer. Fine-tunes
+// with scale_attn_by_inverse_layer_idx additionally scale the attention
+// scores of the layer of index i by 1/(i+1).
+type GPT2Model struct {
+	ModelData
+}
+
+func (m *GPT2Model) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		if len(l.Shape) == 2 && strings.HasSuffix(l.Name, ".weight") && strings.HasPrefix(l.Name, "blk.") && !strings.Contains(l.Name, "_norm.") {
+			l = repackTensor(l, l.Name, l.Kind, []uint64{l.Shape[1], l.Shape[0]}, func(data []float32, shape []uint64) ([]float32, error) {
+				return gptOssTransposeExperts(data, []uint64{1, shape[0], shape[1]})
+			})
+		}
+
+		m.Tensors = append(m.Tensors, l)
+	}
+
+	updateOffsets(m.Tensors)
+	if m.Tensors, err = tieOutput(m.Tensors); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *GPT2Model) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *GPT2Model) WriteGGUF(ws io.WriteSeeker) error {
+	kv := llm.KV{
+		"general.architecture":              "gpt2",
+		"general.name":                      m.Name,
+		"gpt2.vocab_size":                   uint32(len(m.Vocab.Tokens)),
+		"gpt2.context_length":               uint32(m.Params.contextLength()),
+		"gpt2.embedding_length":             uint32(m.Params.HiddenSize),
+		"gpt2.block_count":                  uint32(m.Params.HiddenLayers),
+		"gpt2.feed_forward_length":          uint32(m.Params.IntermediateSize),
+		"gpt2.attention.head_count":         uint32(m.Params.AttentionHeads),
+		"gpt2.attention.layer_norm_epsilon": float32(cmp.Or(m.Params.LayerNormEpsilon, 1e-5)),
+		"general.file_type":                 m.Params.fileType(),
+		"tokenizer.ggml.model":              m.Vocab.Model,
+		"tokenizer.ggml.pre":                m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":             m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":         m.Vocab.Types,
+		"tokenizer.ggml.merges":             m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":       uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":       uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.add_bos_token":      false,
+	}
+
+	// the scale of each layer applies on top of that of the head dimension
+	if m.Params.ScaleAttnByInverseLayerIdx {
+		scales := make([]float32, m.Params.HiddenLayers)
+		for i := range scales {
+			scales[i] = 1 / float32(i+1)
+		}
+
+		kv["gpt2.attention.layer_scales"] = scales
+	}
+
+	maps.Copy(kv, m.Params.activationKV("gpt2", "gelu_tanh"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the position embeddings cover the context length and
+// every layer has the norms, fused attention and feed forward network gpt2
+// runtimes expect
+func (m *GPT2Model) Validate(kv llm.KV, ts []llm.Tensor) error {
+	pos := slices.IndexFunc(ts, func(t llm.Tensor) bool { return t.Name == "position_embd.weight" })
+	if pos < 0 {
+		return errors.New("gpt2: position_embd.weight not found")
+	}
+
+	if n := uint64(m.Params.contextLength()); n > ts[pos].Shape[0] {
+		return fmt.Errorf("gpt2: context length %d is longer than the %d learned positions", n, ts[pos].Shape[0])
+	}
+
+	for i := range m.Params.HiddenLayers {
+		for _, name := range []string{"attn_norm", "attn_qkv", "attn_output", "ffn_norm", "ffn_up", "ffn_down"} {
+			name := fmt.Sprintf("blk.%d.%s.weight", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("gpt2: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
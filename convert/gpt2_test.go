@@ -0,0 +1,145 @@
+package convert
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyGPT2 writes a GPT-2 model of 2 layers of 4 heads of 2 dimensions
+// and 16 learned positions to a temporary directory, saved with the causal
+// mask buffers of older checkpoints. Each column of the Conv1D c_attn weights
+// holds its column number.
+func createTinyGPT2(t *testing.T, scaleByLayer bool) string {
+	t.Helper()
+
+	tensors := map[string][]uint64{
+		"transformer.wte.weight":  {4, 8},
+		"transformer.wpe.weight":  {16, 8},
+		"transformer.ln_f.weight": {8},
+		"transformer.ln_f.bias":   {8},
+	}
+
+	for i := range 2 {
+		for name, shape := range map[string][]uint64{
+			"ln_1.weight":        {8},
+			"ln_1.bias":          {8},
+			"attn.bias":          {1, 1, 16, 16},
+			"attn.masked_bias":   {},
+			"attn.c_attn.weight": {8, 24},
+			"attn.c_attn.bias":   {24},
+			"attn.c_proj.weight": {8, 8},
+			"attn.c_proj.bias":   {8},
+			"ln_2.weight":        {8},
+			"ln_2.bias":          {8},
+			"mlp.c_fc.weight":    {8, 32},
+			"mlp.c_fc.bias":      {32},
+			"mlp.c_proj.weight":  {32, 8},
+			"mlp.c_proj.bias":    {8},
+		} {
+			tensors[fmt.Sprintf("transformer.h.%d.%s", i, name)] = shape
+		}
+	}
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":                   []string{"GPT2LMHeadModel"},
+			"vocab_size":                      4,
+			"n_embd":                          8,
+			"n_layer":                         2,
+			"n_head":                          4,
+			"n_positions":                     16,
+			"n_inner":                         nil,
+			"layer_norm_epsilon":              1e-5,
+			"activation_function":             "gelu_new",
+			"scale_attn_by_inverse_layer_idx": scaleByLayer,
+			"bos_token_id":                    0,
+			"eos_token_id":                    0,
+		},
+		tokenizer: tinyGPT2Tokenizer(),
+		tensors:   tensors,
+		values: map[string]func(int) float32{
+			"transformer.h.0.attn.c_attn.weight": func(i int) float32 { return float32(i % 24) },
+		},
+	})
+}
+
+func TestConvertGPT2(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyGPT2(t, false), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":              "gpt2",
+		"gpt2.context_length":               uint32(16),
+		"gpt2.embedding_length":             uint32(8),
+		"gpt2.feed_forward_length":          uint32(32),
+		"gpt2.block_count":                  uint32(2),
+		"gpt2.attention.head_count":         uint32(4),
+		"gpt2.attention.layer_norm_epsilon": float32(1e-5),
+		"gpt2.feed_forward.activation":      "gelu_tanh",
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	if _, ok := kv["gpt2.attention.layer_scales"]; ok {
+		t.Error("unexpected gpt2.attention.layer_scales")
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	// Conv1D weights are transposed to their output dimension first, which
+	// decodes innermost first as [input, output]
+	for name, want := range map[string][]uint64{
+		"blk.0.attn_qkv.weight":    {8, 24},
+		"blk.0.attn_output.weight": {8, 8},
+		"blk.1.ffn_up.weight":      {8, 32},
+		"blk.1.ffn_down.weight":    {32, 8},
+		"position_embd.weight":     {8, 16},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := tensor.Shape[:2]; !slices.Equal(got, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got)
+		}
+	}
+
+	qkv := tensors["blk.0.attn_qkv.weight"]
+	f32s, err := llm.DequantizeTensor(qkv.Kind, data[qkv.Offset:qkv.Offset+qkv.Size()], qkv.Shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, f := range f32s {
+		if want := float32(i / 8); f != want {
+			t.Fatalf("blk.0.attn_qkv.weight[%d]: expected %v, got %v", i, want, f)
+		}
+	}
+}
+
+func TestConvertGPT2ScaleByLayer(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyGPT2(t, true), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _ := decodeFile(t, p)
+	if got, want := ggml.KV()["gpt2.attention.layer_scales"], []any{float32(1), float32(0.5)}; !equalValue(got, want) {
+		t.Errorf("gpt2.attention.layer_scales: expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,168 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// GPTBigCodeModel converts BigCode's GPTBigCode, the architecture of
+// StarCoder and StarCoderBase. Like GPT-2 it adds learned absolute position
+// embeddings to the token embeddings, has biases on every projection and
+// norm, and fuses the query, key and value projections into c_attn. With
+// multi_query every query head shares a single key and value head, which
+// follow the query heads in c_attn. Without it the fused projection
+// interleaves the query, key and value of each head, which are regrouped
+// here into all of the queries followed by the keys and then the values, the
+// order starcoder runtimes split attn_qkv in.
+type GPTBigCodeModel struct {
+	ModelData
+}
+
+func (m *GPTBigCodeModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	hidden := uint64(m.Params.HiddenSize)
+	heads, kvHeads := uint64(m.Params.AttentionHeads), uint64(m.Params.KeyValHeads)
+	if heads == 0 || hidden%heads != 0 {
+		return fmt.Errorf("gpt_bigcode: %d dimensions don't split into %d heads", hidden, heads)
+	}
+
+	rows := hidden + 2*kvHeads*(hidden/heads)
+	for _, l := range t {
+		if !strings.Contains(l.Name, ".attn_qkv.") {
+			m.Tensors = append(m.Tensors, l)
+			continue
+		}
+
+		if l.Shape[0] != rows {
+			return fmt.Errorf("gpt_bigcode: %s has %d rows, expected %d for %d query and %d key value heads", l.Name, l.Shape[0], rows, heads, kvHeads)
+		}
+
+		// a single key value head already follows every query head
+		if kvHeads == 1 {
+			m.Tensors = append(m.Tensors, l)
+			continue
+		}
+
+		m.Tensors = append(m.Tensors, repackTensor(l, l.Name, l.Kind, l.Shape, groupGPTBigCodeQKV(heads, kvHeads)))
+	}
+
+	updateOffsets(m.Tensors)
+	if m.Tensors, err = tieOutput(m.Tensors); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// groupGPTBigCodeQKV returns a repack function regrouping the heads of a
+// fused c_attn weight or bias into the queries, keys and values of every head
+func groupGPTBigCodeQKV(heads, kvHeads uint64) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, shape []uint64) ([]float32, error) {
+		out := make([]float32, 0, len(data))
+		for _, part := range []string{"q", "k", "v"} {
+			split, err := splitFalconQKV(part, heads, kvHeads)(data, shape)
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, split...)
+		}
+
+		return out, nil
+	}
+}
+
+// setGPTBigCodeSizes fills in the sizes of the config from the GPT-2 style
+// names GPT-2 and GPTBigCode configs use for them
+func (p *Params) setGPTBigCodeSizes() {
+	p.HiddenSize = cmp.Or(p.HiddenSize, p.NEmbd)
+	p.HiddenLayers = cmp.Or(p.HiddenLayers, p.NLayer)
+	p.ContextSize = cmp.Or(p.ContextSize, p.NPositions)
+	p.IntermediateSize = cmp.Or(p.IntermediateSize, p.NInner, 4*p.HiddenSize)
+}
+
+func (m *GPTBigCodeModel) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	// StarCoder's pre-tokenizer is detected by its Digits step, but
+	// tokenizers saved without a pre_tokenizer still split as StarCoder does
+	if m.Params.PreTokenizer == "default" {
+		m.Params.PreTokenizer = "starcoder"
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *GPTBigCodeModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv := llm.KV{
+		"general.architecture":                   "starcoder",
+		"general.name":                           m.Name,
+		"starcoder.vocab_size":                   uint32(len(m.Vocab.Tokens)),
+		"starcoder.context_length":               uint32(m.Params.contextLength()),
+		"starcoder.embedding_length":             uint32(m.Params.HiddenSize),
+		"starcoder.block_count":                  uint32(m.Params.HiddenLayers),
+		"starcoder.feed_forward_length":          uint32(m.Params.IntermediateSize),
+		"starcoder.attention.head_count":         uint32(m.Params.AttentionHeads),
+		"starcoder.attention.head_count_kv":      uint32(m.Params.KeyValHeads),
+		"starcoder.attention.layer_norm_epsilon": float32(cmp.Or(m.Params.LayerNormEpsilon, 1e-5)),
+		"general.file_type":                      m.Params.fileType(),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
+		"tokenizer.ggml.pre":                     m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":                  m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":              m.Vocab.Types,
+		"tokenizer.ggml.merges":                  m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":            uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":            uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.add_bos_token":           false,
+	}
+
+	maps.Copy(kv, m.Params.activationKV("starcoder", "gelu_tanh"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the position embeddings cover the context length and
+// every layer has the norms, fused attention and feed forward network
+// starcoder runtimes expect
+func (m *GPTBigCodeModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	pos := slices.IndexFunc(ts, func(t llm.Tensor) bool { return t.Name == "position_embd.weight" })
+	if pos < 0 {
+		return errors.New("gpt_bigcode: position_embd.weight not found")
+	}
+
+	// learned positions can't be extended past those the model was trained
+	// with
+	if n := uint64(m.Params.contextLength()); n > ts[pos].Shape[0] {
+		return fmt.Errorf("gpt_bigcode: context length %d is longer than the %d learned positions", n, ts[pos].Shape[0])
+	}
+
+	for i := range m.Params.HiddenLayers {
+		for _, name := range []string{"attn_norm", "attn_qkv", "attn_output", "ffn_norm", "ffn_up", "ffn_down"} {
+			name := fmt.Sprintf("blk.%d.%s.weight", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("gpt_bigcode: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package convert
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyGPTBigCode writes a single layer GPTBigCode model of 4 heads of 2
+// dimensions and 16 learned positions to a temporary directory. With
+// multiQuery the heads share a key value head. Each row of the fused query,
+// key and value holds its row number.
+func createTinyGPTBigCode(t *testing.T, multiQuery bool) string {
+	t.Helper()
+
+	qkv := uint64(12)
+	if !multiQuery {
+		qkv = 24
+	}
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":       []string{"GPTBigCodeForCausalLM"},
+			"vocab_size":          4,
+			"n_embd":              8,
+			"n_layer":             1,
+			"n_head":              4,
+			"n_positions":         16,
+			"n_inner":             nil,
+			"multi_query":         multiQuery,
+			"layer_norm_epsilon":  1e-5,
+			"activation_function": "gelu_pytorch_tanh",
+			"bos_token_id":        0,
+			"eos_token_id":        0,
+		},
+		tokenizer: tinyGPT2Tokenizer(),
+		tensors: map[string][]uint64{
+			"transformer.wte.weight":             {4, 8},
+			"transformer.wpe.weight":             {16, 8},
+			"transformer.ln_f.weight":            {8},
+			"transformer.ln_f.bias":              {8},
+			"transformer.h.0.ln_1.weight":        {8},
+			"transformer.h.0.ln_1.bias":          {8},
+			"transformer.h.0.attn.c_attn.weight": {qkv, 8},
+			"transformer.h.0.attn.c_attn.bias":   {qkv},
+			"transformer.h.0.attn.c_proj.weight": {8, 8},
+			"transformer.h.0.attn.c_proj.bias":   {8},
+			"transformer.h.0.ln_2.weight":        {8},
+			"transformer.h.0.ln_2.bias":          {8},
+			"transformer.h.0.mlp.c_fc.weight":    {32, 8},
+			"transformer.h.0.mlp.c_fc.bias":      {32},
+			"transformer.h.0.mlp.c_proj.weight":  {8, 32},
+			"transformer.h.0.mlp.c_proj.bias":    {8},
+		},
+		values: map[string]func(int) float32{
+			"transformer.h.0.attn.c_attn.weight": rowNumbers(8),
+			"transformer.h.0.attn.c_attn.bias":   rowNumbers(1),
+		},
+	})
+}
+
+func TestConvertGPTBigCode(t *testing.T) {
+	cases := []struct {
+		name       string
+		multiQuery bool
+		kvHeads    uint32
+		rows       []float32
+	}{
+		{"multi-query", true, 1, []float32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		// the query, key and value of each head are interleaved
+		{"multi-head", false, 4, []float32{0, 1, 6, 7, 12, 13, 18, 19, 2, 3, 8, 9, 14, 15, 20, 21, 4, 5, 10, 11, 16, 17, 22, 23}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "model.gguf")
+			if _, err := ConvertToFile(createTinyGPTBigCode(t, tt.multiQuery), p); err != nil {
+				t.Fatal(err)
+			}
+
+			ggml, data := decodeFile(t, p)
+			kv := ggml.KV()
+
+			for k, want := range map[string]any{
+				"general.architecture":                   "starcoder",
+				"starcoder.context_length":               uint32(16),
+				"starcoder.embedding_length":             uint32(8),
+				"starcoder.feed_forward_length":          uint32(32),
+				"starcoder.block_count":                  uint32(1),
+				"starcoder.attention.head_count":         uint32(4),
+				"starcoder.attention.head_count_kv":      tt.kvHeads,
+				"starcoder.attention.layer_norm_epsilon": float32(1e-5),
+				"starcoder.feed_forward.activation":      "gelu_tanh",
+				"tokenizer.ggml.pre":                     "starcoder",
+			} {
+				if !equalValue(kv[k], want) {
+					t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+				}
+			}
+
+			tensors := make(map[string]*llm.Tensor)
+			for _, tensor := range ggml.Tensors() {
+				tensors[tensor.Name] = tensor
+			}
+
+			if tensor, ok := tensors["position_embd.weight"]; !ok {
+				t.Error("expected tensor position_embd.weight")
+			} else if got := tensor.Shape[:2]; !slices.Equal(got, []uint64{8, 16}) {
+				t.Errorf("position_embd.weight: expected shape [8 16], got %v", got)
+			}
+
+			for _, name := range []string{"blk.0.attn_qkv.weight", "blk.0.attn_qkv.bias"} {
+				tensor, ok := tensors[name]
+				if !ok {
+					t.Fatalf("expected tensor %s", name)
+				}
+
+				f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rows := f32s
+				if strings.HasSuffix(name, ".weight") {
+					rows = nil
+					for i := 0; i < len(f32s); i += 8 {
+						rows = append(rows, f32s[i])
+					}
+				}
+
+				if !slices.Equal(rows, tt.rows) {
+					t.Errorf("%s: expected rows %v, got %v", name, tt.rows, rows)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertGPTBigCodeContextLength(t *testing.T) {
+	d := createTinyGPTBigCode(t, true)
+	_, err := ConvertToFileWithOptions(d, filepath.Join(t.TempDir(), "model.gguf"), Options{ContextLength: 32})
+	if err == nil || !strings.Contains(err.Error(), "16 learned positions") {
+		t.Fatalf("expected learned positions error, got %v", err)
+	}
+}
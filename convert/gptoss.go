@@ -0,0 +1,206 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// GptOssModel converts OpenAI's gpt-oss mixture of experts models. Experts
+// are stored as one fused gate and up projection per layer which is split
+// into separate expert tensors. Only BF16 checkpoints are supported; the
+// official checkpoints quantize their experts to MXFP4 and must be
+// dequantized first.
+type GptOssModel struct {
+	ModelData
+}
+
+func (m *GptOssModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	kind := uint32(1)
+	if m.Params.F32 {
+		kind = 0
+	}
+
+	for _, l := range t {
+		prefix, _, _ := strings.Cut(strings.TrimPrefix(l.Name, "blk."), ".")
+		switch {
+		case strings.HasSuffix(l.Name, "ffn_gate_up_exps.weight"):
+			// [experts, hidden, 2*ff] with gate and up interleaved
+			experts, hidden, ff := l.Shape[0], l.Shape[1], l.Shape[2]/2
+			shape := []uint64{experts, ff, hidden}
+			kind, err := m.Params.tensorKind(l.Name, shape, kind)
+			if err != nil {
+				return err
+			}
+
+			m.Tensors = append(m.Tensors,
+				repackTensor(l, "blk."+prefix+".ffn_gate_exps.weight", kind, shape, gptOssSplitExperts(0)),
+				repackTensor(l, "blk."+prefix+".ffn_up_exps.weight", kind, shape, gptOssSplitExperts(1)),
+			)
+		case strings.HasSuffix(l.Name, "ffn_gate_up_exps.bias"):
+			shape := []uint64{l.Shape[0], l.Shape[1] / 2}
+			m.Tensors = append(m.Tensors,
+				repackTensor(l, "blk."+prefix+".ffn_gate_exps.bias", 0, shape, gptOssSplitBias(0)),
+				repackTensor(l, "blk."+prefix+".ffn_up_exps.bias", 0, shape, gptOssSplitBias(1)),
+			)
+		case strings.HasSuffix(l.Name, "ffn_down_exps.weight"):
+			// [experts, ff, hidden]
+			shape := []uint64{l.Shape[0], l.Shape[2], l.Shape[1]}
+			kind, err := m.Params.tensorKind(l.Name, shape, kind)
+			if err != nil {
+				return err
+			}
+
+			m.Tensors = append(m.Tensors, repackTensor(l, l.Name, kind, shape, gptOssTransposeExperts))
+		case strings.HasSuffix(l.Name, "ffn_down_exps.bias"):
+			m.Tensors = append(m.Tensors, repackTensor(l, l.Name, 0, l.Shape, func(data []float32, _ []uint64) ([]float32, error) {
+				return data, nil
+			}))
+		case strings.HasSuffix(l.Name, "ffn_norm.weight"):
+			// gpt-oss normalizes the attention output rather than the ffn input
+			l.Name = strings.Replace(l.Name, "ffn_norm", "post_attention_norm", 1)
+			m.Tensors = append(m.Tensors, l)
+		default:
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+// gptOssSplitExperts selects the interleaved gate (0) or up (1) projection of
+// each expert, transposing it from [hidden, ff] to [ff, hidden]
+func gptOssSplitExperts(part uint64) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, shape []uint64) ([]float32, error) {
+		experts, hidden, ff := shape[0], shape[1], shape[2]
+		if uint64(len(data)) != experts*hidden*ff {
+			return nil, fmt.Errorf("unexpected expert tensor size %d for shape %v", len(data), shape)
+		}
+
+		out := make([]float32, 0, len(data)/2)
+		for e := range experts {
+			for i := part; i < ff; i += 2 {
+				for h := range hidden {
+					out = append(out, data[e*hidden*ff+h*ff+i])
+				}
+			}
+		}
+
+		return out, nil
+	}
+}
+
+// gptOssSplitBias selects the interleaved gate (0) or up (1) bias of each
+// expert
+func gptOssSplitBias(part uint64) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, shape []uint64) ([]float32, error) {
+		out := make([]float32, 0, len(data)/2)
+		for i := part; i < uint64(len(data)); i += 2 {
+			out = append(out, data[i])
+		}
+
+		return out, nil
+	}
+}
+
+// gptOssTransposeExperts transposes each expert's down projection from
+// [ff, hidden] to [hidden, ff]
+func gptOssTransposeExperts(data []float32, shape []uint64) ([]float32, error) {
+	experts, rows, cols := shape[0], shape[1], shape[2]
+
+	out := make([]float32, 0, len(data))
+	for e := range experts {
+		for c := range cols {
+			for r := range rows {
+				out = append(out, data[e*rows*cols+r*cols+c])
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// Validate checks the expert metadata matches the expert tensors
+func (m *GptOssModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return strings.Contains(t.Name, "_exps.") }) {
+		return nil
+	}
+
+	experts, _ := kv["gpt-oss.expert_count"].(uint32)
+	used, _ := kv["gpt-oss.expert_used_count"].(uint32)
+	switch {
+	case experts == 0:
+		return errors.New("gpt-oss: expert tensors found but num_local_experts is not set")
+	case used == 0 || used > experts:
+		return fmt.Errorf("gpt-oss: num_experts_per_tok %d must be between 1 and num_local_experts %d", used, experts)
+	}
+
+	return nil
+}
+
+func (m *GptOssModel) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *GptOssModel) WriteGGUF(ws io.WriteSeeker) error {
+	headDim := cmp.Or(m.Params.HeadDimension, m.Params.HiddenSize/m.Params.AttentionHeads)
+
+	kv := llm.KV{
+		"general.architecture":                     "gpt-oss",
+		"general.name":                             m.Name,
+		"gpt-oss.vocab_size":                       uint32(len(m.Vocab.Tokens)),
+		"gpt-oss.context_length":                   uint32(m.Params.contextLength()),
+		"gpt-oss.embedding_length":                 uint32(m.Params.HiddenSize),
+		"gpt-oss.block_count":                      uint32(m.Params.HiddenLayers),
+		"gpt-oss.feed_forward_length":              uint32(m.Params.IntermediateSize),
+		"gpt-oss.expert_feed_forward_length":       uint32(m.Params.IntermediateSize),
+		"gpt-oss.expert_count":                     uint32(m.Params.Experts),
+		"gpt-oss.expert_used_count":                uint32(m.Params.ExpertsUsed),
+		"gpt-oss.rope.freq_base":                   float32(m.Params.RopeFrequencyBase),
+		"gpt-oss.rope.dimension_count":             uint32(headDim),
+		"gpt-oss.attention.head_count":             uint32(m.Params.AttentionHeads),
+		"gpt-oss.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
+		"gpt-oss.attention.key_length":             uint32(headDim),
+		"gpt-oss.attention.value_length":           uint32(headDim),
+		"gpt-oss.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
+		"general.file_type":                        m.Params.fileType(),
+		"tokenizer.ggml.model":                     m.Vocab.Model,
+		"tokenizer.ggml.pre":                       m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":                    m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":                m.Vocab.Types,
+		"tokenizer.ggml.merges":                    m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":              uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":              uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":          uint32(m.Params.PaddingTokenID),
+	}
+
+	if m.Params.SlidingWindow != nil {
+		kv["gpt-oss.attention.sliding_window"] = *m.Params.SlidingWindow
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("gpt-oss"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
@@ -0,0 +1,216 @@
+package convert
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyGptOss writes a single layer gpt-oss model with 2 experts to a
+// temporary directory
+func createTinyGptOss(t *testing.T, config map[string]any) string {
+	t.Helper()
+
+	c := map[string]any{
+		"architectures":           []string{"GptOssForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       4,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     1,
+		"head_dim":                4,
+		"num_local_experts":       2,
+		"num_experts_per_tok":     1,
+		"rms_norm_eps":            1e-5,
+		"rope_theta":              150000.0,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+	}
+	maps.Copy(c, config)
+
+	return createTinyModel(t, tinyModel{
+		config:    c,
+		tokenizer: tinyBPETokenizer("<|startoftext|>", "<|return|>"),
+		tensors: map[string][]uint64{
+			"model.embed_tokens.weight":                      {4, 8},
+			"model.norm.weight":                              {8},
+			"lm_head.weight":                                 {4, 8},
+			"model.layers.0.input_layernorm.weight":          {8},
+			"model.layers.0.post_attention_layernorm.weight": {8},
+			"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+			"model.layers.0.self_attn.k_proj.weight":         {4, 8},
+			"model.layers.0.self_attn.v_proj.weight":         {4, 8},
+			"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+			"model.layers.0.self_attn.sinks":                 {2},
+			"model.layers.0.mlp.router.weight":               {2, 8},
+			"model.layers.0.mlp.router.bias":                 {2},
+			// [experts, hidden, 2*ff] with gate and up interleaved
+			"model.layers.0.mlp.experts.gate_up_proj":      {2, 8, 8},
+			"model.layers.0.mlp.experts.gate_up_proj_bias": {2, 8},
+			// [experts, ff, hidden]
+			"model.layers.0.mlp.experts.down_proj":      {2, 4, 8},
+			"model.layers.0.mlp.experts.down_proj_bias": {2, 8},
+		},
+		values: map[string]func(int) float32{
+			"model.layers.0.mlp.experts.gate_up_proj":      func(i int) float32 { return float32(i) },
+			"model.layers.0.mlp.experts.gate_up_proj_bias": func(i int) float32 { return float32(i) },
+		},
+	})
+}
+
+func TestConvertGptOss(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyGptOss(t, nil), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":         "gpt-oss",
+		"gpt-oss.block_count":          uint32(1),
+		"gpt-oss.expert_count":         uint32(2),
+		"gpt-oss.expert_used_count":    uint32(1),
+		"gpt-oss.attention.key_length": uint32(4),
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	// shapes are innermost first
+	for name, want := range map[string][]uint64{
+		"blk.0.attn_sinks.weight":          {2},
+		"blk.0.ffn_gate_inp.weight":        {8, 2},
+		"blk.0.ffn_gate_inp.bias":          {2},
+		"blk.0.post_attention_norm.weight": {8},
+		"blk.0.ffn_gate_exps.weight":       {8, 4, 2},
+		"blk.0.ffn_up_exps.weight":         {8, 4, 2},
+		"blk.0.ffn_gate_exps.bias":         {4, 2},
+		"blk.0.ffn_up_exps.bias":           {4, 2},
+		"blk.0.ffn_down_exps.weight":       {4, 8, 2},
+		"blk.0.ffn_down_exps.bias":         {8, 2},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := slices.DeleteFunc(slices.Clone(tensor.Shape), func(dim uint64) bool { return dim == 1 }); !slices.Equal(got, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got)
+		}
+	}
+
+	for _, name := range []string{"blk.0.ffn_norm.weight", "blk.0.ffn_gate_up_exps.weight", "blk.0.ffn_gate_up_exps.bias"} {
+		if _, ok := tensors[name]; ok {
+			t.Errorf("unexpected tensor %s", name)
+		}
+	}
+
+	read := func(name string) []float32 {
+		tensor := tensors[name]
+		f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f32s
+	}
+
+	// the first row of each expert's gate is the even columns of its fused
+	// projection, which hold their index, transposed
+	if got, want := read("blk.0.ffn_gate_exps.weight")[:8], []float32{0, 8, 16, 24, 32, 40, 48, 56}; !slices.Equal(got, want) {
+		t.Errorf("expected gate %v, got %v", want, got)
+	}
+
+	if got, want := read("blk.0.ffn_up_exps.weight")[:8], []float32{1, 9, 17, 25, 33, 41, 49, 57}; !slices.Equal(got, want) {
+		t.Errorf("expected up %v, got %v", want, got)
+	}
+
+	if got, want := read("blk.0.ffn_up_exps.bias"), []float32{1, 3, 5, 7, 9, 11, 13, 15}; !slices.Equal(got, want) {
+		t.Errorf("expected up bias %v, got %v", want, got)
+	}
+}
+
+func TestConvertGptOssMXFP4(t *testing.T) {
+	d := createTinyGptOss(t, map[string]any{
+		"quantization_config": map[string]any{"quant_method": "mxfp4"},
+	})
+
+	if _, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf")); err == nil || !strings.Contains(err.Error(), "only BF16 checkpoints") {
+		t.Fatalf("expected an mxfp4 error, got %v", err)
+	}
+}
+
+func TestGptOssSplitExperts(t *testing.T) {
+	// 1 expert, hidden 2, ff 2 with gate and up interleaved along ff
+	//   h0: g0 u0 g1 u1
+	//   h1: g2 u2 g3 u3
+	data := []float32{0, 10, 1, 11, 2, 12, 3, 13}
+	shape := []uint64{1, 2, 4}
+
+	gate, err := gptOssSplitExperts(0)(data, shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transposed to [ff, hidden]
+	if want := []float32{0, 2, 1, 3}; !slices.Equal(gate, want) {
+		t.Fatalf("expected gate %v, got %v", want, gate)
+	}
+
+	up, err := gptOssSplitExperts(1)(data, shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []float32{10, 12, 11, 13}; !slices.Equal(up, want) {
+		t.Fatalf("expected up %v, got %v", want, up)
+	}
+
+	down, err := gptOssTransposeExperts([]float32{0, 1, 2, 3, 4, 5}, []uint64{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []float32{0, 3, 1, 4, 2, 5}; !slices.Equal(down, want) {
+		t.Fatalf("expected down %v, got %v", want, down)
+	}
+}
+
+func TestGptOssValidate(t *testing.T) {
+	ts := []llm.Tensor{{Name: "blk.0.ffn_gate_exps.weight"}}
+
+	cases := []struct {
+		name    string
+		kv      llm.KV
+		tensors []llm.Tensor
+		wantErr bool
+	}{
+		{"ok", llm.KV{"gpt-oss.expert_count": uint32(4), "gpt-oss.expert_used_count": uint32(2)}, ts, false},
+		{"no experts", llm.KV{"gpt-oss.expert_count": uint32(0), "gpt-oss.expert_used_count": uint32(2)}, ts, true},
+		{"too many used", llm.KV{"gpt-oss.expert_count": uint32(4), "gpt-oss.expert_used_count": uint32(8)}, ts, true},
+		{"dense", llm.KV{"gpt-oss.expert_count": uint32(0)}, []llm.Tensor{{Name: "blk.0.ffn_gate.weight"}}, false},
+	}
+
+	var m GptOssModel
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.Validate(tt.kv, tt.tensors); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
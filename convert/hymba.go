@@ -0,0 +1,258 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// HymbaModel converts NVIDIA's Hymba. Unlike hybrid models which interleave
+// attention and mamba layers, each Hymba layer runs attention heads and a
+// mamba head side by side on the same input. One input projection feeds
+// both and is split here into the attention query, key and value and the
+// mamba input and gate. The outputs of both heads are normalized, averaged
+// and share one output projection. Layers listed after the first in a
+// kv_reuse_group have no key and value of their own and attend with those of
+// the first layer of their group. Learned meta tokens are prepended to every
+// prompt.
+type HymbaModel struct {
+	ModelData
+}
+
+// dims returns the size of the mamba inner state, of the attention queries
+// and of the attention keys and values
+func (m *HymbaModel) dims() (inner, attn, kv uint64) {
+	inner = uint64(cmp.Or(m.Params.MambaExpand, 2) * m.Params.HiddenSize)
+	attn = inner
+	if m.Params.AttnHiddenSize > 0 {
+		attn = uint64(m.Params.AttnHiddenSize)
+	}
+
+	return inner, attn, attn / uint64(m.Params.AttentionHeads) * uint64(m.Params.KeyValHeads)
+}
+
+// kvSources returns the layer each layer takes its keys and values from
+func (m *HymbaModel) kvSources() []uint32 {
+	sources := make([]uint32, m.Params.HiddenLayers)
+	for i := range sources {
+		sources[i] = uint32(i)
+	}
+
+	for _, group := range m.Params.KVReuseGroup {
+		if len(group) == 0 || group[0] < 0 || group[0] >= len(sources) {
+			continue
+		}
+
+		for _, layer := range group {
+			if layer >= 0 && layer < len(sources) {
+				sources[layer] = uint32(group[0])
+			}
+		}
+	}
+
+	return sources
+}
+
+func (m *HymbaModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	kind := uint32(1)
+	if m.Params.F32 {
+		kind = 0
+	}
+
+	inner, attn, kvDim := m.dims()
+	sources := m.kvSources()
+
+	for _, l := range t {
+		prefix, _, _ := strings.Cut(strings.TrimPrefix(l.Name, "blk."), ".")
+		switch {
+		case strings.HasSuffix(l.Name, ".hymba_in_proj.weight"):
+			layer, err := strconv.Atoi(prefix)
+			if err != nil || layer >= len(sources) {
+				return fmt.Errorf("hymba: unexpected layer %s", l.Name)
+			}
+
+			// rows are the query, the key and value when the layer has its
+			// own, then the mamba input and gate
+			type part struct {
+				name string
+				rows uint64
+			}
+
+			parts := []part{{"attn_q", attn}}
+			if sources[layer] == uint32(layer) {
+				parts = append(parts, part{"attn_k", kvDim}, part{"attn_v", kvDim})
+			}
+
+			parts = append(parts, part{"ssm_in", 2 * inner})
+
+			var rows uint64
+			for _, part := range parts {
+				rows += part.rows
+			}
+
+			if rows != l.Shape[0] {
+				return fmt.Errorf("hymba: %s has %d rows, expected %d", l.Name, l.Shape[0], rows)
+			}
+
+			var start uint64
+			for _, part := range parts {
+				name := "blk." + prefix + "." + part.name + ".weight"
+				shape := []uint64{part.rows, l.Shape[1]}
+				kind, err := m.Params.tensorKind(name, shape, kind)
+				if err != nil {
+					return err
+				}
+
+				m.Tensors = append(m.Tensors, repackTensor(l, name, kind, shape, sliceRows(start, part.rows)))
+				start += part.rows
+			}
+		case strings.HasSuffix(l.Name, ".ssm_a"):
+			m.Tensors = append(m.Tensors, repackTensor(l, l.Name, 0, l.Shape, hymbaNegExp))
+		case strings.HasSuffix(l.Name, ".ssm_conv1d.weight"):
+			// drop the single channel per group from [inner, 1, kernel]
+			m.Tensors = append(m.Tensors, repackTensor(l, l.Name, 0, []uint64{l.Shape[0], l.Shape[len(l.Shape)-1]}, func(data []float32, _ []uint64) ([]float32, error) {
+				return data, nil
+			}))
+		default:
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	if m.Tensors, err = tieOutput(m.Tensors); err != nil {
+		return err
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+// hymbaNegExp converts mamba's A_log to A = -exp(A_log)
+func hymbaNegExp(data []float32, _ []uint64) ([]float32, error) {
+	for i := range data {
+		data[i] = -float32(math.Exp(float64(data[i])))
+	}
+
+	return data, nil
+}
+
+func (m *HymbaModel) LoadVocab() error {
+	v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *HymbaModel) WriteGGUF(ws io.WriteSeeker) error {
+	inner, attn, _ := m.dims()
+	headDim := attn / uint64(m.Params.AttentionHeads)
+
+	kv := llm.KV{
+		"general.architecture":                   "hymba",
+		"general.name":                           m.Name,
+		"hymba.vocab_size":                       uint32(len(m.Vocab.Tokens)),
+		"hymba.context_length":                   uint32(m.Params.contextLength()),
+		"hymba.embedding_length":                 uint32(m.Params.HiddenSize),
+		"hymba.block_count":                      uint32(m.Params.HiddenLayers),
+		"hymba.feed_forward_length":              uint32(m.Params.IntermediateSize),
+		"hymba.rope.freq_base":                   float32(cmp.Or(m.Params.RopeFrequencyBase, 10000)),
+		"hymba.rope.dimension_count":             uint32(headDim),
+		"hymba.attention.head_count":             uint32(m.Params.AttentionHeads),
+		"hymba.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
+		"hymba.attention.key_length":             uint32(headDim),
+		"hymba.attention.value_length":           uint32(headDim),
+		"hymba.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
+		"hymba.attention.kv_source_layers":       m.kvSources(),
+		"hymba.ssm.inner_size":                   uint32(inner),
+		"hymba.ssm.state_size":                   uint32(cmp.Or(m.Params.MambaDState, 16)),
+		"hymba.ssm.conv_kernel":                  uint32(cmp.Or(m.Params.MambaDConv, 4)),
+		"hymba.ssm.time_step_rank":               uint32(m.Params.MambaDtRank),
+		"general.file_type":                      m.Params.fileType(),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
+		"tokenizer.ggml.tokens":                  m.Vocab.Tokens,
+		"tokenizer.ggml.scores":                  m.Vocab.Scores,
+		"tokenizer.ggml.token_type":              m.Vocab.Types,
+		"tokenizer.ggml.bos_token_id":            uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":            uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":        uint32(m.Params.PaddingTokenID),
+	}
+
+	// layers other than the global attention layers attend within a sliding
+	// window
+	if m.Params.AttnWindowSize > 0 {
+		kv["hymba.attention.sliding_window"] = uint32(m.Params.AttnWindowSize)
+
+		global := make([]uint32, len(m.Params.GlobalAttnIdx))
+		for i, layer := range m.Params.GlobalAttnIdx {
+			global[i] = uint32(layer)
+		}
+
+		kv["hymba.attention.global_layers"] = global
+	}
+
+	if m.Params.NumMemoryTokens > 0 {
+		kv["hymba.meta_token_count"] = uint32(m.Params.NumMemoryTokens)
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("hymba"))
+	maps.Copy(kv, m.Params.activationKV("hymba", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks every layer has both its attention and mamba heads, layers
+// reuse keys and values of an earlier layer which has its own and the meta
+// tokens match num_memory_tokens
+func (m *HymbaModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	has := func(name string) bool {
+		return slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name })
+	}
+
+	sources := m.kvSources()
+	for i, source := range sources {
+		prefix := fmt.Sprintf("blk.%d.", i)
+		switch {
+		case !has(prefix + "attn_q.weight"):
+			return fmt.Errorf("hymba: layer %d has no attention heads", i)
+		case !has(prefix + "ssm_in.weight"):
+			return fmt.Errorf("hymba: layer %d has no mamba head", i)
+		case int(source) > i || sources[source] != source:
+			return fmt.Errorf("hymba: layer %d reuses the keys and values of layer %d which has none of its own", i, source)
+		}
+	}
+
+	for _, layer := range m.Params.GlobalAttnIdx {
+		if layer < 0 || layer >= len(sources) {
+			return fmt.Errorf("hymba: global attention layer %d out of range", layer)
+		}
+	}
+
+	i := slices.IndexFunc(ts, func(t llm.Tensor) bool { return t.Name == "token_meta.weight" })
+	switch {
+	case i < 0 && m.Params.NumMemoryTokens > 0:
+		return errors.New("hymba: num_memory_tokens is set but the meta tokens weren't found")
+	case i >= 0 && ts[i].Shape[0] != uint64(m.Params.NumMemoryTokens):
+		return fmt.Errorf("hymba: expected %d meta tokens, got %d", m.Params.NumMemoryTokens, ts[i].Shape[0])
+	}
+
+	return nil
+}
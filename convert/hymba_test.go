@@ -0,0 +1,227 @@
+package convert
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyHymba writes a two layer hymba model to a temporary directory.
+// The second layer reuses the keys and values of the first. Each row of the
+// input projection of the first layer holds its row number.
+func createTinyHymba(t *testing.T) string {
+	t.Helper()
+
+	tensors := map[string][]uint64{
+		"model.embed_tokens.weight":    {4, 8},
+		"model.final_layernorm.weight": {8},
+		"model.memory_tokens":          {2, 8},
+	}
+
+	// the query, key and value, then the mamba input and gate
+	inProj := map[string]uint64{"0": 16 + 8 + 8 + 32, "1": 16 + 32}
+	for layer, rows := range inProj {
+		prefix := "model.layers." + layer + "."
+		tensors[prefix+"input_layernorm.weight"] = []uint64{8}
+		tensors[prefix+"pre_moe_layernorm.weight"] = []uint64{8}
+		tensors[prefix+"mamba.in_proj.weight"] = []uint64{rows, 8}
+		tensors[prefix+"mamba.out_proj.weight"] = []uint64{8, 16}
+		tensors[prefix+"mamba.conv1d.weight"] = []uint64{16, 1, 4}
+		tensors[prefix+"mamba.conv1d.bias"] = []uint64{16}
+		tensors[prefix+"mamba.x_proj.0.weight"] = []uint64{2 + 2*4, 16}
+		tensors[prefix+"mamba.dt_proj.0.weight"] = []uint64{16, 2}
+		tensors[prefix+"mamba.dt_proj.0.bias"] = []uint64{16}
+		tensors[prefix+"mamba.A_log.0"] = []uint64{16, 4}
+		tensors[prefix+"mamba.D.0"] = []uint64{16}
+		tensors[prefix+"mamba.dt_layernorm.weight"] = []uint64{2}
+		tensors[prefix+"mamba.B_layernorm.weight"] = []uint64{4}
+		tensors[prefix+"mamba.C_layernorm.weight"] = []uint64{4}
+		tensors[prefix+"mamba.pre_avg_layernorm1.weight"] = []uint64{16}
+		tensors[prefix+"mamba.pre_avg_layernorm2.weight"] = []uint64{16}
+		tensors[prefix+"moe.experts.0.gate_proj.weight"] = []uint64{16, 8}
+		tensors[prefix+"moe.experts.0.up_proj.weight"] = []uint64{16, 8}
+		tensors[prefix+"moe.experts.0.down_proj.weight"] = []uint64{8, 16}
+	}
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":           []string{"HymbaForCausalLM"},
+			"vocab_size":              4,
+			"hidden_size":             8,
+			"num_hidden_layers":       2,
+			"max_position_embeddings": 128,
+			"intermediate_size":       16,
+			"num_attention_heads":     2,
+			"num_key_value_heads":     1,
+			"rms_norm_eps":            1e-6,
+			"bos_token_id":            1,
+			"eos_token_id":            2,
+			"mamba_d_state":           4,
+			"mamba_d_conv":            4,
+			"mamba_expand":            2,
+			"mamba_dt_rank":           2,
+			"num_memory_tokens":       2,
+			"attn_window_size":        16,
+			"global_attn_idx":         []int{0},
+			"kv_reuse_group":          [][]int{{0, 1}},
+		},
+		pieces: []*sentencepiece.ModelProto_SentencePiece{
+			{Piece: proto.String("<unk>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_UNKNOWN.Enum()},
+			{Piece: proto.String("<s>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			{Piece: proto.String("</s>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			{Piece: proto.String("▁a"), Score: proto.Float32(-1)},
+		},
+		tensors: tensors,
+		values: map[string]func(int) float32{
+			"model.layers.0.mamba.in_proj.weight": rowNumbers(8),
+		},
+	})
+}
+
+func TestConvertHymba(t *testing.T) {
+	d := createTinyHymba(t)
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":             "hymba",
+		"hymba.block_count":                uint32(2),
+		"hymba.attention.head_count_kv":    uint32(1),
+		"hymba.attention.key_length":       uint32(8),
+		"hymba.attention.sliding_window":   uint32(16),
+		"hymba.ssm.inner_size":             uint32(16),
+		"hymba.ssm.state_size":             uint32(4),
+		"hymba.ssm.conv_kernel":            uint32(4),
+		"hymba.ssm.time_step_rank":         uint32(2),
+		"hymba.meta_token_count":           uint32(2),
+		"hymba.feed_forward.activation":    "silu",
+		"hymba.attention.kv_source_layers": []any{uint32(0), uint32(0)},
+		"hymba.attention.global_layers":    []any{uint32(0)},
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	// shapes are innermost first
+	for name, want := range map[string][]uint64{
+		"blk.0.attn_q.weight":        {8, 16},
+		"blk.0.attn_k.weight":        {8, 8},
+		"blk.0.attn_v.weight":        {8, 8},
+		"blk.0.ssm_in.weight":        {8, 32},
+		"blk.1.attn_q.weight":        {8, 16},
+		"blk.1.ssm_in.weight":        {8, 32},
+		"blk.0.ssm_conv1d.weight":    {4, 16},
+		"blk.0.ssm_a":                {4, 16},
+		"blk.0.ssm_out.weight":       {16, 8},
+		"blk.0.attn_avg_norm.weight": {16},
+		"blk.0.ssm_avg_norm.weight":  {16},
+		"blk.0.ffn_gate.weight":      {8, 16},
+		"token_meta.weight":          {8, 2},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := slices.DeleteFunc(slices.Clone(tensor.Shape), func(dim uint64) bool { return dim == 1 }); !slices.Equal(got, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got)
+		}
+	}
+
+	for _, name := range []string{"blk.1.attn_k.weight", "blk.1.attn_v.weight", "output.weight"} {
+		if _, ok := tensors[name]; ok {
+			t.Errorf("unexpected tensor %s", name)
+		}
+	}
+
+	read := func(name string) []float32 {
+		tensor := tensors[name]
+		f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f32s
+	}
+
+	// the value follows the query and key of the first layer
+	if got := read("blk.0.attn_v.weight"); got[0] != 24 || got[len(got)-1] != 31 {
+		t.Fatalf("expected rows 24 to 31, got %v", got)
+	}
+
+	if got := read("blk.0.ssm_in.weight"); got[0] != 32 || got[len(got)-1] != 63 {
+		t.Fatalf("expected rows 32 to 63, got %v", got)
+	}
+
+	if got, want := read("blk.0.ssm_a")[1], -float32(math.Exp(0.125)); math.Abs(float64(got-want)) > 1e-6 {
+		t.Fatalf("expected A = -exp(A_log) %v, got %v", want, got)
+	}
+}
+
+func TestConvertHymbaInvalid(t *testing.T) {
+	d := createTinyHymba(t)
+
+	cases := []struct {
+		name string
+		fn   func(*Params)
+	}{
+		// the input projection of the second layer has no key and value
+		{"no kv reuse", func(p *Params) { p.KVReuseGroup = nil }},
+		{"reuse later layer", func(p *Params) { p.KVReuseGroup = [][]int{{1, 0}} }},
+		{"global layer", func(p *Params) { p.GlobalAttnIdx = []int{2} }},
+		{"meta tokens", func(p *Params) { p.NumMemoryTokens = 4 }},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mf := &SafetensorFormat{}
+			params, err := mf.GetParams(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.fn(params)
+
+			arch, err := mf.GetModelArch("", d, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := arch.LoadVocab(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := arch.GetTensors(); err != nil {
+				return
+			}
+
+			f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			if err := arch.WriteGGUF(f); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package convert
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// ImageEmbeddingModel converts standalone SigLIP and CLIP checkpoints to a
+// vision encoder which embeds images on its own, e.g. for image similarity.
+// The text tower is dropped. Unlike the projector written for a vision
+// language model, the pooling head is kept: the attention pooling head for
+// SigLIP and the visual projection for CLIP.
+type ImageEmbeddingModel struct {
+	ModelData
+}
+
+func (m *ImageEmbeddingModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		if strings.HasPrefix(l.Name, "v.") {
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+// LoadVocab does nothing since images aren't tokenized
+func (m *ImageEmbeddingModel) LoadVocab() error {
+	m.Vocab = &Vocab{}
+	return nil
+}
+
+func (m *ImageEmbeddingModel) WriteGGUF(ws io.WriteSeeker) error {
+	arch, pooling := "siglip", "attention"
+	if strings.HasPrefix(m.Params.Architectures[0], "CLIP") {
+		arch, pooling = "clip", "cls"
+	}
+
+	kv, err := visionKV(arch, m.Params, m.FS)
+	if err != nil {
+		return err
+	}
+
+	kv["general.architecture"] = arch
+	kv["general.type"] = "image_embedding"
+	kv["general.name"] = m.Name
+	kv["general.file_type"] = m.Params.fileType()
+	kv[arch+".pooling_type"] = pooling
+
+	if arch == "clip" {
+		kv[arch+".vision.projection_dim"] = uint32(m.Params.ProjectionDim)
+	} else {
+		kv[arch+".vision.projection_dim"] = uint32(m.Params.VisionConfig.HiddenSize)
+	}
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the vision tower and its pooling head were both found
+func (m *ImageEmbeddingModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == "v.patch_embd.weight" }) {
+		return errors.New("image embedding: vision tower not found")
+	}
+
+	head := "v.head.probe"
+	if kv.Architecture() == "clip" {
+		head = "v.proj.weight"
+	}
+
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == head }) {
+		return errors.New("image embedding: pooling head not found")
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// InternVLModel converts the InternViT vision tower and pixel shuffle
+// connector of InternVL to a clip projector. InternViT fuses the query, key
+// and value projections, which are split here, scales the output of each
+// attention and feed forward block with a learned layer scale and, in its
+// larger variants, normalizes queries and keys. The connector folds each
+// square of 1/downsample_ratio patches into one before its MLP.
+type InternVLModel struct {
+	ModelData
+}
+
+func (m *InternVLModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		switch {
+		case strings.Contains(l.Name, ".attn_qkv."):
+			shape := slices.Clone(l.Shape)
+			shape[0] /= 3
+			for i, part := range []string{"q", "k", "v"} {
+				m.Tensors = append(m.Tensors, repackTensor(l, strings.Replace(l.Name, "qkv", part, 1), l.Kind, shape, splitThirds(i)))
+			}
+		case strings.HasPrefix(l.Name, "v."), strings.HasPrefix(l.Name, "mm."):
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+// splitThirds returns the ith of three equal parts of the rows of a tensor
+func splitThirds(i int) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, _ []uint64) ([]float32, error) {
+		n := len(data) / 3
+		return data[i*n : (i+1)*n], nil
+	}
+}
+
+// LoadVocab does nothing since the projector has no vocabulary of its own
+func (m *InternVLModel) LoadVocab() error {
+	m.Vocab = &Vocab{}
+	return nil
+}
+
+func (m *InternVLModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv, err := visionKV("clip", m.Params, m.FS)
+	if err != nil {
+		return err
+	}
+
+	kv["general.architecture"] = "clip"
+	kv["general.name"] = m.Name
+	kv["general.file_type"] = m.Params.fileType()
+	kv["clip.has_text_encoder"] = false
+	kv["clip.has_vision_encoder"] = true
+	kv["clip.has_llava_projector"] = false
+	kv["clip.projector_type"] = "internvl"
+
+	if m.Params.LLMConfig != nil {
+		kv["clip.vision.projection_dim"] = uint32(m.Params.LLMConfig.HiddenSize)
+	}
+
+	if m.Params.DownsampleRatio > 0 {
+		kv["clip.vision.projector.scale_factor"] = uint32(math.Round(1 / m.Params.DownsampleRatio))
+	}
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the vision tower and connector were both found and the
+// downsample ratio folds a whole number of patches
+func (m *InternVLModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == "v.patch_embd.weight" }) {
+		return errors.New("internvl: vision tower not found")
+	}
+
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return strings.HasPrefix(t.Name, "mm.") }) {
+		return errors.New("internvl: connector not found")
+	}
+
+	ratio := m.Params.DownsampleRatio
+	if scale := math.Round(1 / ratio); ratio <= 0 || math.Abs(scale*ratio-1) > 1e-6 {
+		return fmt.Errorf("internvl: downsample_ratio %v isn't the inverse of a whole number", ratio)
+	}
+
+	return nil
+}
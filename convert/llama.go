@@ -5,8 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"maps"
 	"regexp"
 	"strings"
 
@@ -21,53 +21,77 @@ type LlamaModel struct {
 }
 
 func (m *LlamaModel) GetTensors() error {
-	t, err := m.Format.GetTensors(m.Path, m.Params)
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
 	if err != nil {
 		return err
 	}
 
-	pattern := `^blk\.[0-9]+\.attn_(?P<layer>q|k)\.weight$`
+	pattern := `^blk\.[0-9]+\.attn_(?P<layer>q|k)\.(weight|bias)$`
 	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return err
 	}
 
+	var attnBias, mlpBias bool
 	for _, l := range t {
+		switch {
+		case strings.HasPrefix(l.Name, "blk.") && strings.Contains(l.Name, ".attn_") && strings.HasSuffix(l.Name, ".bias"):
+			attnBias = true
+		case strings.HasPrefix(l.Name, "blk.") && strings.Contains(l.Name, ".ffn_") && strings.HasSuffix(l.Name, ".bias"):
+			mlpBias = true
+		}
+
 		matches := re.FindAllStringSubmatch(l.Name, -1)
-		if len(matches) > 0 {
-			switch m.Format.(type) {
-			case *TorchFormat:
-				wt := l.WriterTo.(torchWriterTo)
-				wt.repacker = m.Repack
-				l.WriterTo = wt
-			case *SafetensorFormat:
-				wt := l.WriterTo.(safetensorWriterTo)
-				wt.repacker = m.Repack
-				l.WriterTo = wt
-			}
+		if len(matches) > 0 && m.Params.ropeStyle() != RopeStyleGPTJ {
+			l = setRepacker(l, m.Repack)
 		}
 		m.Tensors = append(m.Tensors, l)
 	}
 
+	// the biases are converted either way since the weights were trained
+	// with them
+	if attnBias && !m.Params.AttentionBias {
+		m.Params.warn("weights have attention biases but the config doesn't set attention_bias")
+	}
+
+	if mlpBias && !m.Params.MLPBias {
+		m.Params.warn("weights have feed forward biases but the config doesn't set mlp_bias")
+	}
+
+	if m.Tensors, err = m.Params.tieWordEmbeddings(m.Tensors); err != nil {
+		return err
+	}
+
+	rope, err := m.Params.RopeScaling.Tensors(m.Params, nextOffset(m.Tensors))
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, rope...)
 	return nil
 }
 
 func (m *LlamaModel) LoadVocab() (err error) {
-	pre, ts, merges, err := parseTokens(filepath.Join(m.Path, "tokenizer.json"))
-	if errors.Is(err, os.ErrNotExist) {
+	// llama2 ships a sentencepiece tokenizer.model alongside tokenizer.json
+	// while llama3 only has a bpe tokenizer.json
+	if _, err := fs.Stat(m.tokenizerFS(), "tokenizer.model"); err == nil {
+		v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
+		if err != nil {
+			return err
+		}
+
+		m.Vocab = v
 		return nil
-	} else if err != nil {
-		return err
 	}
 
-	m.Vocab = &Vocab{}
-	for _, t := range ts {
-		m.Vocab.Tokens = append(m.Vocab.Tokens, t.Content)
-		m.Vocab.Types = append(m.Vocab.Types, t.Type())
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	m.Vocab.Merges = merges
-	m.Params.PreTokenizer = pre
+	m.Vocab = v
 	return nil
 }
 
@@ -76,7 +100,7 @@ func (m *LlamaModel) WriteGGUF(ws io.WriteSeeker) error {
 		"general.architecture":                   "llama",
 		"general.name":                           m.Name,
 		"llama.vocab_size":                       uint32(len(m.Vocab.Tokens)),
-		"llama.context_length":                   uint32(m.Params.ContextSize),
+		"llama.context_length":                   uint32(m.Params.contextLength()),
 		"llama.embedding_length":                 uint32(m.Params.HiddenSize),
 		"llama.block_count":                      uint32(m.Params.HiddenLayers),
 		"llama.feed_forward_length":              uint32(m.Params.IntermediateSize),
@@ -85,10 +109,9 @@ func (m *LlamaModel) WriteGGUF(ws io.WriteSeeker) error {
 		"llama.attention.head_count":             uint32(m.Params.AttentionHeads),
 		"llama.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
 		"llama.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
-		"general.file_type":                      uint32(1),
-		"tokenizer.ggml.model":                   "gpt2",
+		"general.file_type":                      m.Params.fileType(),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
 
-		"tokenizer.ggml.pre":        m.Params.PreTokenizer,
 		"tokenizer.ggml.tokens":     m.Vocab.Tokens,
 		"tokenizer.ggml.token_type": m.Vocab.Types,
 
@@ -97,20 +120,40 @@ func (m *LlamaModel) WriteGGUF(ws io.WriteSeeker) error {
 		"tokenizer.ggml.unknown_token_id": uint32(0),
 	}
 
-	if len(m.Vocab.Merges) > 0 {
+	if m.Vocab.Model == "gpt2" {
+		kv["tokenizer.ggml.pre"] = m.Params.PreTokenizer
 		kv["tokenizer.ggml.merges"] = m.Vocab.Merges
 	} else {
 		kv["tokenizer.ggml.scores"] = m.Vocab.Scores
 	}
 
-	return llm.NewGGUFV3(m.Params.ByteOrder).Encode(ws, kv, m.Tensors)
+	maps.Copy(kv, m.Params.RopeScaling.KV("llama"))
+	maps.Copy(kv, m.Params.activationKV("llama", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
 }
 
 func (m *LlamaModel) Repack(name string, data []float32, shape []uint64) ([]float32, error) {
 	return llamaRepack(name, m.Params, data, shape)
 }
 
+// llamaRepack permutes the rows of each query or key head from pairing each
+// dimension with the one half a head away to pairing adjacent dimensions.
+// The head dimension is the rows divided by the number of heads of the
+// tensor so grouped key heads are permuted like query heads.
 func llamaRepack(name string, params *Params, data []float32, shape []uint64) ([]float32, error) {
+	switch style := params.ropeStyle(); style {
+	case RopeStyleGPTJ:
+		return data, nil
+	case RopeStyleNeoX:
+	default:
+		return nil, fmt.Errorf("unknown rope style: %s", style)
+	}
+
 	var dims []int
 	for _, dim := range shape {
 		if dim != 0 {
@@ -118,10 +161,15 @@ func llamaRepack(name string, params *Params, data []float32, shape []uint64) ([
 		}
 	}
 
+	// biases are permuted like a weight of one column
+	if len(dims) == 1 {
+		dims = append(dims, 1)
+	}
+
 	var heads int
-	if strings.HasSuffix(name, "attn_q.weight") {
+	if strings.HasSuffix(name, "attn_q.weight") || strings.HasSuffix(name, "attn_q.bias") {
 		heads = params.AttentionHeads
-	} else if strings.HasSuffix(name, "attn_k.weight") {
+	} else if strings.HasSuffix(name, "attn_k.weight") || strings.HasSuffix(name, "attn_k.bias") {
 		heads = cmp.Or(params.KeyValHeads, params.AttentionHeads)
 	} else {
 		return nil, fmt.Errorf("unknown tensor name: %s", name)
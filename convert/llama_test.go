@@ -0,0 +1,210 @@
+package convert
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func TestLlamaRepackRopeStyle(t *testing.T) {
+	// two heads of four rows with two columns, each value is 10*row+column
+	data := make([]float32, 16)
+	for i := range data {
+		data[i] = float32(i/2*10 + i%2)
+	}
+
+	rows := func(order ...int) []float32 {
+		var f32s []float32
+		for _, r := range order {
+			f32s = append(f32s, float32(r*10), float32(r*10+1))
+		}
+		return f32s
+	}
+
+	cases := []struct {
+		name  string
+		style RopeStyle
+		heads int
+		want  []float32
+	}{
+		// each row is paired with the one half a head away
+		{"neox", RopeStyleNeoX, 2, rows(0, 2, 1, 3, 4, 6, 5, 7)},
+		// rows are already paired with their neighbor
+		{"gptj", RopeStyleGPTJ, 2, rows(0, 1, 2, 3, 4, 5, 6, 7)},
+		// a single head of eight rows
+		{"neox head dim", RopeStyleNeoX, 1, rows(0, 4, 1, 5, 2, 6, 3, 7)},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			params := &Params{AttentionHeads: tt.heads, Options: Options{RopeStyle: tt.style}}
+
+			got, err := llamaRepack("blk.0.attn_q.weight", params, slices.Clone(data), []uint64{8, 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("key heads", func(t *testing.T) {
+		params := &Params{AttentionHeads: 4, KeyValHeads: 2}
+
+		got, err := llamaRepack("blk.0.attn_k.weight", params, slices.Clone(data), []uint64{8, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := rows(0, 2, 1, 3, 4, 6, 5, 7); !slices.Equal(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("bias", func(t *testing.T) {
+		bias := []float32{0, 1, 2, 3, 4, 5, 6, 7}
+		params := &Params{AttentionHeads: 2}
+
+		got, err := llamaRepack("blk.0.attn_q.bias", params, bias, []uint64{8})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := []float32{0, 2, 1, 3, 4, 6, 5, 7}; !slices.Equal(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		params := &Params{AttentionHeads: 2, Options: Options{RopeStyle: "glm"}}
+		if _, err := llamaRepack("blk.0.attn_q.weight", params, slices.Clone(data), []uint64{8, 2}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestConvertLlamaBias(t *testing.T) {
+	d := createTinyLlama(t)
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"lm_head.weight":                                 {4, 8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.q_proj.bias":           {8},
+		"model.layers.0.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.bias":           {8},
+		"model.layers.0.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.v_proj.bias":           {8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.o_proj.bias":           {8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.gate_proj.bias":              {16},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.up_proj.bias":                {16},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+		"model.layers.0.mlp.down_proj.bias":              {8},
+	})
+
+	biases := []string{
+		"blk.0.attn_q.bias",
+		"blk.0.attn_k.bias",
+		"blk.0.attn_v.bias",
+		"blk.0.attn_output.bias",
+		"blk.0.ffn_gate.bias",
+		"blk.0.ffn_up.bias",
+		"blk.0.ffn_down.bias",
+	}
+
+	cases := []struct {
+		name      string
+		bias      bool
+		wantWarns int
+	}{
+		{"attention_bias", true, 0},
+		// the biases are converted but the config is inconsistent
+		{"no attention_bias", false, 2},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+				"architectures":           []string{"LlamaForCausalLM"},
+				"vocab_size":              4,
+				"hidden_size":             8,
+				"num_hidden_layers":       1,
+				"max_position_embeddings": 128,
+				"intermediate_size":       16,
+				"num_attention_heads":     2,
+				"num_key_value_heads":     2,
+				"rms_norm_eps":            1e-5,
+				"bos_token_id":            2,
+				"eos_token_id":            3,
+				"attention_bias":          tt.bias,
+				"mlp_bias":                tt.bias,
+			})
+
+			var params *Params
+			_, tensors := convertDir(t, d, func(p *Params) { params = p })
+
+			for _, name := range biases {
+				i := slices.IndexFunc(tensors, func(t *llm.Tensor) bool { return t.Name == name })
+				if i < 0 {
+					t.Fatalf("expected tensor %s", name)
+				}
+
+				if tensors[i].Kind != 0 {
+					t.Fatalf("%s: expected kind 0, got %d", name, tensors[i].Kind)
+				}
+			}
+
+			if len(params.warnings) != tt.wantWarns {
+				t.Fatalf("expected %d warnings, got %v", tt.wantWarns, params.warnings)
+			}
+		})
+	}
+}
+
+func TestConvertInternLM3(t *testing.T) {
+	d := createTinyLlama(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"InternLM3ForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+		"rope_theta":              50000000.0,
+		"rope_scaling":            map[string]any{"factor": 6.0, "rope_type": "dynamic"},
+	})
+
+	var params *Params
+	kv, _ := convertDir(t, d, func(p *Params) { params = p })
+	if len(params.warnings) != 1 {
+		t.Fatalf("expected a warning about dynamic scaling, got %v", params.warnings)
+	}
+
+	for k, want := range map[string]any{
+		"general.architecture": "llama",
+		"llama.context_length": uint32(128),
+		"llama.rope.freq_base": float32(50000000),
+		// dynamic NTK scaling has no GGUF equivalent
+		"llama.rope.scaling.type":                    nil,
+		"llama.rope.scaling.factor":                  nil,
+		"llama.rope.scaling.original_context_length": nil,
+	} {
+		if got := kv[k]; got != want {
+			t.Errorf("%s: expected %v, got %v", k, want, got)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package convert
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// MarianModel converts Marian MT and NLLB (M2M100) translation models.
+// Both are encoder-decoder transformers sharing one vocabulary between the
+// encoder and decoder where target languages are selected with language code
+// tokens.
+type MarianModel struct {
+	ModelData
+}
+
+// languageCode matches the language code tokens used by Marian (>>fra<<),
+// NLLB (fra_Latn) and M2M100 (__fr__)
+var languageCode = regexp.MustCompile(`^(>>[a-z_]+<<|[a-z]{3}_[A-Z][a-z]{3}|__[a-z_]+__)$`)
+
+func (m *MarianModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		// the shared embedding may also be stored as the encoder and decoder
+		// embeddings; only keep the first copy
+		if slices.ContainsFunc(m.Tensors, func(t llm.Tensor) bool { return t.Name == l.Name }) {
+			slog.Debug("skipping duplicate tensor", "name", l.Name)
+			continue
+		}
+
+		m.Tensors = append(m.Tensors, l)
+	}
+
+	return nil
+}
+
+func (m *MarianModel) LoadVocab() error {
+	v := &Vocab{Model: "llama"}
+	if _, err := fs.Stat(m.tokenizerFS(), "tokenizer.json"); err == nil {
+		// nllb
+		_, ts, merges, err := parseTokens(m.tokenizerFS())
+		if err != nil {
+			return err
+		}
+
+		for _, t := range ts {
+			v.Tokens = append(v.Tokens, t.Content)
+			v.Types = append(v.Types, t.Type())
+		}
+
+		v.Model = "gpt2"
+		v.Merges = merges
+	} else {
+		// marian stores its shared vocabulary as a token to id mapping
+		b, err := fs.ReadFile(m.tokenizerFS(), "vocab.json")
+		if err != nil {
+			return err
+		}
+
+		var vocab map[string]int
+		if err := json.Unmarshal(b, &vocab); err != nil {
+			return err
+		}
+
+		v.Tokens = make([]string, len(vocab))
+		v.Types = make([]int32, len(vocab))
+		for k, id := range vocab {
+			if id >= len(vocab) {
+				return fmt.Errorf("token ID '%d' for '%s' doesn't match total token size", id, k)
+			}
+
+			v.Tokens[id] = k
+			v.Types[id] = tokenTypeNormal
+		}
+	}
+
+	for i, t := range v.Tokens {
+		if languageCode.MatchString(t) {
+			v.Types[i] = tokenTypeControl
+		}
+	}
+
+	if len(v.Merges) == 0 {
+		v.Scores = make([]float32, len(v.Tokens))
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *MarianModel) WriteGGUF(ws io.WriteSeeker) error {
+	arch := "marian"
+	if m.Params.Architectures[0] == "M2M100ForConditionalGeneration" {
+		arch = "m2m100"
+	}
+
+	var languageTokenIDs []int32
+	for i, t := range m.Vocab.Tokens {
+		if languageCode.MatchString(t) {
+			languageTokenIDs = append(languageTokenIDs, int32(i))
+		}
+	}
+
+	slog.Debug("found language codes", "count", len(languageTokenIDs))
+
+	kv := llm.KV{
+		"general.architecture":                 arch,
+		"general.name":                         m.Name,
+		arch + ".vocab_size":                   uint32(len(m.Vocab.Tokens)),
+		arch + ".context_length":               uint32(m.Params.contextLength()),
+		arch + ".embedding_length":             uint32(m.Params.DModel),
+		arch + ".block_count":                  uint32(m.Params.EncoderLayers),
+		arch + ".decoder_block_count":          uint32(m.Params.DecoderLayers),
+		arch + ".feed_forward_length":          uint32(m.Params.EncoderFFNSize),
+		arch + ".attention.head_count":         uint32(m.Params.EncoderHeads),
+		arch + ".attention.layer_norm_epsilon": float32(1e-5),
+		arch + ".decoder_start_token_id":       uint32(cmp.Or(m.Params.DecoderStartTokenID, m.Params.EoSTokenID)),
+		"general.file_type":                    m.Params.fileType(),
+		"tokenizer.ggml.model":                 m.Vocab.Model,
+		"tokenizer.ggml.tokens":                m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":            m.Vocab.Types,
+		"tokenizer.ggml.bos_token_id":          uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":          uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":      uint32(m.Params.PaddingTokenID),
+		"tokenizer.ggml.add_bos_token":         false,
+		"tokenizer.ggml.add_eos_token":         true,
+		"tokenizer.ggml.language_token_ids":    languageTokenIDs,
+	}
+
+	// marian defaults to swish
+	maps.Copy(kv, m.Params.activationKV(arch, "silu"))
+
+	if m.Params.ScaleEmbedding {
+		kv[arch+".embedding_scale"] = float32(math.Sqrt(float64(m.Params.DModel)))
+	}
+
+	if m.Vocab.Model == "gpt2" {
+		kv["tokenizer.ggml.merges"] = m.Vocab.Merges
+	} else {
+		kv["tokenizer.ggml.scores"] = m.Vocab.Scores
+	}
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
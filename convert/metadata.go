@@ -0,0 +1,152 @@
+package convert
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// Metadata is the typed metadata of a GGUF of one architecture, the inverse
+// of the KV its converter writes. Each field is read from the key of its gguf
+// tag, which is under the prefix of the architecture unless it is a general
+// or tokenizer key.
+type Metadata interface {
+	General() *GeneralMetadata
+}
+
+// GeneralMetadata are the keys every converter writes
+type GeneralMetadata struct {
+	Architecture string `gguf:"general.architecture"`
+	Name         string `gguf:"general.name"`
+	FileType     uint32 `gguf:"general.file_type"`
+
+	TokenizerModel string `gguf:"tokenizer.ggml.model"`
+	BOSTokenID     uint32 `gguf:"tokenizer.ggml.bos_token_id"`
+	EOSTokenID     uint32 `gguf:"tokenizer.ggml.eos_token_id"`
+	AddBOSToken    bool   `gguf:"tokenizer.ggml.add_bos_token"`
+	AddEOSToken    bool   `gguf:"tokenizer.ggml.add_eos_token"`
+}
+
+// General returns the keys of m shared by every architecture
+func (m *GeneralMetadata) General() *GeneralMetadata {
+	return m
+}
+
+// LlamaMetadata is the metadata of llama, see LlamaModel
+type LlamaMetadata struct {
+	GeneralMetadata
+
+	VocabSize          uint32  `gguf:"vocab_size"`
+	ContextLength      uint32  `gguf:"context_length"`
+	EmbeddingLength    uint32  `gguf:"embedding_length"`
+	BlockCount         uint32  `gguf:"block_count"`
+	FeedForwardLength  uint32  `gguf:"feed_forward_length"`
+	RopeFreqBase       float32 `gguf:"rope.freq_base"`
+	RopeDimensionCount uint32  `gguf:"rope.dimension_count"`
+	HeadCount          uint32  `gguf:"attention.head_count"`
+	HeadCountKV        uint32  `gguf:"attention.head_count_kv"`
+	RMSNormEpsilon     float32 `gguf:"attention.layer_norm_rms_epsilon"`
+}
+
+// GemmaMetadata is the metadata of gemma, see GemmaModel
+type GemmaMetadata struct {
+	GeneralMetadata
+
+	ContextLength     uint32  `gguf:"context_length"`
+	EmbeddingLength   uint32  `gguf:"embedding_length"`
+	BlockCount        uint32  `gguf:"block_count"`
+	FeedForwardLength uint32  `gguf:"feed_forward_length"`
+	HeadCount         uint32  `gguf:"attention.head_count"`
+	HeadCountKV       uint32  `gguf:"attention.head_count_kv"`
+	RMSNormEpsilon    float32 `gguf:"attention.layer_norm_rms_epsilon"`
+	KeyLength         uint32  `gguf:"attention.key_length"`
+	ValueLength       uint32  `gguf:"attention.value_length"`
+	Activation        string  `gguf:"feed_forward.activation"`
+}
+
+// metadataTypes are the metadata of each architecture DecodeMetadata reads
+var metadataTypes = map[string]func() Metadata{
+	"llama": func() Metadata { return &LlamaMetadata{} },
+	"gemma": func() Metadata { return &GemmaMetadata{} },
+}
+
+// DecodeMetadata reads kv into the metadata of its general.architecture.
+// Keys kv doesn't have are left as zero values.
+func DecodeMetadata(kv llm.KV) (Metadata, error) {
+	arch, _ := kv.String("general.architecture")
+	fn, ok := metadataTypes[arch]
+	if !ok {
+		return nil, fmt.Errorf("no metadata for architecture %q", arch)
+	}
+
+	m := fn()
+	if err := decodeMetadata(kv, arch, reflect.ValueOf(m).Elem()); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func decodeMetadata(kv llm.KV, arch string, v reflect.Value) error {
+	for i := range v.NumField() {
+		f, field := v.Type().Field(i), v.Field(i)
+		if f.Anonymous {
+			if err := decodeMetadata(kv, arch, field); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		key, ok := f.Tag.Lookup("gguf")
+		if !ok {
+			continue
+		}
+
+		if !strings.HasPrefix(key, "general.") && !strings.HasPrefix(key, "tokenizer.") {
+			key = arch + "." + key
+		}
+
+		if _, ok := kv[key]; !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Uint32:
+			n, ok := kv.Uint(key)
+			if !ok || n > math.MaxUint32 {
+				return fmt.Errorf("%s: expected a uint32, got %v", key, kv[key])
+			}
+
+			field.SetUint(n)
+		case reflect.Float32:
+			n, ok := kv.Float(key)
+			if !ok {
+				return fmt.Errorf("%s: expected a float32, got %T", key, kv[key])
+			}
+
+			field.SetFloat(n)
+		case reflect.String:
+			s, ok := kv.String(key)
+			if !ok {
+				return fmt.Errorf("%s: expected a string, got %T", key, kv[key])
+			}
+
+			field.SetString(s)
+		case reflect.Bool:
+			b, ok := kv[key].(bool)
+			if !ok {
+				return fmt.Errorf("%s: expected a bool, got %T", key, kv[key])
+			}
+
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("%s: unsupported field %s of %s", key, f.Name, field.Kind())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package convert
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestDecodeMetadataGemma(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"GemmaForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 256,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     1,
+		"head_dim":                4,
+		"rms_norm_eps":            1e-6,
+		"hidden_activation":       "gelu_pytorch_tanh",
+		"bos_token_id":            2,
+		"eos_token_id":            1,
+	})
+
+	createSentencePiece(t, filepath.Join(d, "tokenizer.model"),
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<pad>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<eos>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<bos>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<unk>"), Type: sentencepiece.ModelProto_SentencePiece_UNKNOWN.Enum()},
+	)
+
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {4, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {4, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+	})
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _ := decodeFile(t, p)
+	m, err := DecodeMetadata(ggml.KV())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gemma, ok := m.(*GemmaMetadata)
+	if !ok {
+		t.Fatalf("expected *GemmaMetadata, got %T", m)
+	}
+
+	want := GemmaMetadata{
+		GeneralMetadata: GeneralMetadata{
+			Architecture:   "gemma",
+			FileType:       1,
+			TokenizerModel: "llama",
+			BOSTokenID:     2,
+			EOSTokenID:     1,
+			AddBOSToken:    true,
+		},
+		ContextLength:     256,
+		EmbeddingLength:   8,
+		BlockCount:        1,
+		FeedForwardLength: 16,
+		HeadCount:         2,
+		HeadCountKV:       1,
+		RMSNormEpsilon:    1e-6,
+		KeyLength:         4,
+		ValueLength:       4,
+		Activation:        "gelu_tanh",
+	}
+
+	if *gemma != want {
+		t.Fatalf("expected %+v, got %+v", want, *gemma)
+	}
+
+	if got := m.General(); got.Architecture != "gemma" {
+		t.Fatalf("expected architecture gemma, got %s", got.Architecture)
+	}
+}
+
+func TestDecodeMetadataErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		kv   llm.KV
+		want string
+	}{
+		{"unknown architecture", llm.KV{"general.architecture": "rwkv"}, `no metadata for architecture "rwkv"`},
+		{"wrong type", llm.KV{"general.architecture": "llama", "llama.block_count": "32"}, "llama.block_count: expected a uint32"},
+		{"overflow", llm.KV{"general.architecture": "llama", "llama.block_count": uint64(1 << 32)}, "llama.block_count: expected a uint32"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeMetadata(tt.kv); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
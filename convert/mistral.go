@@ -1,8 +1,16 @@
 package convert
 
 import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"regexp"
+	"slices"
 
 	"github.com/ollama/ollama/llm"
 )
@@ -12,7 +20,7 @@ type MistralModel struct {
 }
 
 func (m *MistralModel) GetTensors() error {
-	t, err := m.Format.GetTensors(m.Path, m.Params)
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
 	if err != nil {
 		return err
 	}
@@ -25,19 +33,39 @@ func (m *MistralModel) GetTensors() error {
 
 	for _, l := range t {
 		matches := re.FindAllStringSubmatch(l.Name, -1)
-		if len(matches) > 0 {
-			wt := l.WriterTo.(safetensorWriterTo)
-			wt.repacker = m.Repack
-			l.WriterTo = wt
+		if len(matches) > 0 && m.Params.ropeStyle() != RopeStyleGPTJ {
+			l = setRepacker(l, m.Repack)
 		}
 		m.Tensors = append(m.Tensors, l)
 	}
 
+	if m.Tensors, err = m.Params.tieWordEmbeddings(m.Tensors); err != nil {
+		return err
+	}
+
+	rope, err := m.Params.RopeScaling.Tensors(m.Params, nextOffset(m.Tensors))
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, rope...)
 	return nil
 }
 
 func (m *MistralModel) LoadVocab() error {
-	v, err := LoadSentencePieceTokens(m.Path, m.Params)
+	// Ministral only ships the bpe tokenizer.json of Mistral's tekken
+	// tokenizer
+	if _, err := fs.Stat(m.tokenizerFS(), "tokenizer.model"); errors.Is(err, fs.ErrNotExist) {
+		v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+		if err != nil {
+			return err
+		}
+
+		m.Vocab = v
+		return nil
+	}
+
+	v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
 	if err != nil {
 		return err
 	}
@@ -49,19 +77,18 @@ func (m *MistralModel) WriteGGUF(ws io.WriteSeeker) error {
 	kv := llm.KV{
 		"general.architecture":                   "llama",
 		"general.name":                           m.Name,
-		"llama.context_length":                   uint32(m.Params.ContextSize),
+		"llama.context_length":                   uint32(m.Params.contextLength()),
 		"llama.embedding_length":                 uint32(m.Params.HiddenSize),
 		"llama.block_count":                      uint32(m.Params.HiddenLayers),
 		"llama.feed_forward_length":              uint32(m.Params.IntermediateSize),
-		"llama.rope.dimension_count":             uint32(m.Params.HiddenSize / m.Params.AttentionHeads),
+		"llama.rope.dimension_count":             uint32(cmp.Or(m.Params.HeadDimension, m.Params.HiddenSize/m.Params.AttentionHeads)),
 		"llama.attention.head_count":             uint32(m.Params.AttentionHeads),
 		"llama.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
 		"llama.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
-		"general.file_type":                      uint32(1),
-		"tokenizer.ggml.model":                   "llama",
+		"general.file_type":                      m.Params.fileType(),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
 
 		"tokenizer.ggml.tokens":     m.Vocab.Tokens,
-		"tokenizer.ggml.scores":     m.Vocab.Scores,
 		"tokenizer.ggml.token_type": m.Vocab.Types,
 
 		"tokenizer.ggml.bos_token_id":     uint32(m.Params.BoSTokenID),
@@ -71,9 +98,165 @@ func (m *MistralModel) WriteGGUF(ws io.WriteSeeker) error {
 		"tokenizer.ggml.unknown_token_id": uint32(0),
 	}
 
-	return llm.NewGGUFV3(m.Params.ByteOrder).Encode(ws, kv, m.Tensors)
+	if m.Params.RopeFrequencyBase > 0 {
+		kv["llama.rope.freq_base"] = float32(m.Params.RopeFrequencyBase)
+	}
+
+	if m.Vocab.Model == "gpt2" {
+		kv["tokenizer.ggml.pre"] = m.Params.PreTokenizer
+		kv["tokenizer.ggml.merges"] = m.Vocab.Merges
+	} else {
+		kv["tokenizer.ggml.scores"] = m.Vocab.Scores
+	}
+
+	if m.Params.SlidingWindow != nil {
+		kv["llama.attention.sliding_window"] = *m.Params.SlidingWindow
+
+		layers, err := m.Params.slidingWindowLayers()
+		if err != nil {
+			return err
+		} else if layers != nil {
+			kv["llama.attention.sliding_window_pattern"] = layers
+		}
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("llama"))
+	maps.Copy(kv, m.Params.activationKV("llama", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// slidingWindowLayers returns whether each layer attends within the sliding
+// window, or nil if every layer does as in Mistral 7B
+func (p *Params) slidingWindowLayers() ([]bool, error) {
+	if len(p.LayerTypes) == 0 {
+		return nil, nil
+	}
+
+	if len(p.LayerTypes) != p.HiddenLayers {
+		return nil, fmt.Errorf("layer_types has %d layers, expected %d", len(p.LayerTypes), p.HiddenLayers)
+	}
+
+	layers := make([]bool, len(p.LayerTypes))
+	for i, t := range p.LayerTypes {
+		switch t {
+		case "sliding_attention":
+			layers[i] = true
+		case "full_attention":
+		default:
+			return nil, fmt.Errorf("unknown layer type %q", t)
+		}
+	}
+
+	if !slices.Contains(layers, false) {
+		return nil, nil
+	}
+
+	return layers, nil
 }
 
 func (m *MistralModel) Repack(name string, data []float32, shape []uint64) ([]float32, error) {
 	return llamaRepack(name, m.Params, data, shape)
 }
+
+// getMistralParams reads the params.json of Mistral's own releases, which
+// use their own names for the hyperparameters
+func getMistralParams(fsys fs.FS) (*Params, error) {
+	f, err := fsys.Open("params.json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mp struct {
+		Dim       int     `json:"dim"`
+		Layers    int     `json:"n_layers"`
+		HeadDim   int     `json:"head_dim"`
+		HiddenDim int     `json:"hidden_dim"`
+		Heads     int     `json:"n_heads"`
+		KVHeads   int     `json:"n_kv_heads"`
+		NormEPS   float64 `json:"norm_eps"`
+		VocabSize int     `json:"vocab_size"`
+		RopeTheta float64 `json:"rope_theta"`
+		// a number, or a window per layer repeated over the layers
+		SlidingWindow json.RawMessage `json:"sliding_window"`
+	}
+
+	if err := json.NewDecoder(f).Decode(&mp); err != nil {
+		return nil, err
+	}
+
+	params := &Params{
+		Architectures:     []string{"MistralForCausalLM"},
+		VocabSize:         mp.VocabSize,
+		HiddenSize:        mp.Dim,
+		HiddenLayers:      mp.Layers,
+		HeadDimension:     mp.HeadDim,
+		IntermediateSize:  mp.HiddenDim,
+		AttentionHeads:    mp.Heads,
+		KeyValHeads:       mp.KVHeads,
+		NormEPS:           mp.NormEPS,
+		RopeFrequencyBase: mp.RopeTheta,
+		// params.json has no context length so use Mistral 7B's
+		ContextSize:  32768,
+		BoSTokenID:   -1,
+		EoSTokenID:   -1,
+		consolidated: true,
+	}
+
+	if err := params.setMistralSlidingWindow(mp.SlidingWindow); err != nil {
+		return nil, err
+	}
+
+	params.setHeadCounts()
+	params.setSpecialTokenDefaults(fsys)
+	params.ByteOrder = binary.LittleEndian
+	return params, nil
+}
+
+// setMistralSlidingWindow sets the sliding window from params.json. Ministral
+// lists a window per layer which repeats over the layers. Layers with the
+// larger of two windows use full attention.
+func (p *Params) setMistralSlidingWindow(raw json.RawMessage) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+
+	var window uint32
+	if err := json.Unmarshal(raw, &window); err == nil {
+		p.SlidingWindow = &window
+		return nil
+	}
+
+	var windows []uint32
+	if err := json.Unmarshal(raw, &windows); err != nil || len(windows) == 0 {
+		return fmt.Errorf("sliding_window must be a number or a list of numbers, got %s", raw)
+	}
+
+	sizes := slices.Clone(windows)
+	slices.Sort(sizes)
+	sizes = slices.Compact(sizes)
+	if len(sizes) > 2 {
+		return fmt.Errorf("sliding_window has %d different windows, expected a window and full attention", len(sizes))
+	}
+
+	window = sizes[0]
+	p.SlidingWindow = &window
+	if len(sizes) == 1 {
+		return nil
+	}
+
+	p.LayerTypes = make([]string, p.HiddenLayers)
+	for i := range p.LayerTypes {
+		p.LayerTypes[i] = "sliding_attention"
+		if windows[i%len(windows)] != window {
+			p.LayerTypes[i] = "full_attention"
+		}
+	}
+
+	return nil
+}
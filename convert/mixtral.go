@@ -2,6 +2,7 @@ package convert
 
 import (
 	"io"
+	"maps"
 	"regexp"
 
 	"github.com/ollama/ollama/llm"
@@ -12,7 +13,7 @@ type MixtralModel struct {
 }
 
 func (m *MixtralModel) GetTensors() error {
-	t, err := m.Format.GetTensors(m.Path, m.Params)
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
 	if err != nil {
 		return err
 	}
@@ -25,19 +26,27 @@ func (m *MixtralModel) GetTensors() error {
 
 	for _, l := range t {
 		matches := re.FindAllStringSubmatch(l.Name, -1)
-		if len(matches) > 0 {
-			wt := l.WriterTo.(safetensorWriterTo)
-			wt.repacker = m.Repack
-			l.WriterTo = wt
+		if len(matches) > 0 && m.Params.ropeStyle() != RopeStyleGPTJ {
+			l = setRepacker(l, m.Repack)
 		}
 		m.Tensors = append(m.Tensors, l)
 	}
 
+	if m.Tensors, err = m.Params.tieWordEmbeddings(m.Tensors); err != nil {
+		return err
+	}
+
+	rope, err := m.Params.RopeScaling.Tensors(m.Params, nextOffset(m.Tensors))
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, rope...)
 	return nil
 }
 
 func (m *MixtralModel) LoadVocab() error {
-	v, err := LoadSentencePieceTokens(m.Path, m.Params)
+	v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
 	if err != nil {
 		return err
 	}
@@ -50,7 +59,7 @@ func (m *MixtralModel) WriteGGUF(ws io.WriteSeeker) error {
 		"general.architecture":          "llama",
 		"general.name":                  m.Name,
 		"llama.block_count":             uint32(m.Params.HiddenLayers),
-		"llama.context_length":          uint32(m.Params.ContextSize),
+		"llama.context_length":          uint32(m.Params.contextLength()),
 		"llama.embedding_length":        uint32(m.Params.HiddenSize),
 		"llama.feed_forward_length":     uint32(m.Params.IntermediateSize),
 		"llama.attention.head_count":    uint32(m.Params.AttentionHeads),
@@ -65,7 +74,7 @@ func (m *MixtralModel) WriteGGUF(ws io.WriteSeeker) error {
 		"llama.vocab_size":           uint32(len(m.Vocab.Tokens)),
 		"llama.rope.dimension_count": uint32(m.Params.HiddenSize / m.Params.AttentionHeads),
 
-		"general.file_type":    uint32(1),
+		"general.file_type":    m.Params.fileType(),
 		"tokenizer.ggml.model": "llama",
 
 		"tokenizer.ggml.tokens":     m.Vocab.Tokens,
@@ -79,7 +88,14 @@ func (m *MixtralModel) WriteGGUF(ws io.WriteSeeker) error {
 		"tokenizer.ggml.add_eos_token":    false,
 	}
 
-	return llm.NewGGUFV3(m.Params.ByteOrder).Encode(ws, kv, m.Tensors)
+	maps.Copy(kv, m.Params.RopeScaling.KV("llama"))
+	maps.Copy(kv, m.Params.activationKV("llama", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
 }
 
 func (m *MixtralModel) Repack(name string, data []float32, shape []uint64) ([]float32, error) {
@@ -0,0 +1,186 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// ModernBertModel converts Answer.AI's ModernBERT to an embedding model. The
+// encoder has rotary embeddings and no biases by default. Its layers
+// alternate between global attention, every global_attn_every_n_layers
+// layers starting with the first, and local attention over a sliding window
+// of local_attention tokens, half on each side, with a rope base of its own.
+// The first projection of the GeGLU feed forward network fuses the activated
+// input and the gate, which are split here into the gate and up projections.
+// The first layer has no attention norm since the embeddings are already
+// normalized. The masked language modeling head is dropped.
+type ModernBertModel struct {
+	ModelData
+}
+
+func (m *ModernBertModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		switch {
+		case strings.HasPrefix(l.Name, "mlm."):
+			slog.Debug("skipping masked language modeling head tensor", "name", l.Name)
+		case strings.Contains(l.Name, ".ffn_gate_up."):
+			if l.Shape[0]%2 != 0 {
+				return fmt.Errorf("modernbert: %s has an odd number of rows %d", l.Name, l.Shape[0])
+			}
+
+			shape := slices.Clone(l.Shape)
+			shape[0] /= 2
+			for i, part := range []string{"ffn_gate", "ffn_up"} {
+				m.Tensors = append(m.Tensors, repackTensor(l, strings.Replace(l.Name, "ffn_gate_up", part, 1), l.Kind, shape, splitHalves(i)))
+			}
+		default:
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+// modernBertSlidingWindowLayers returns whether each layer attends over the
+// sliding window. The layers are read from layer_types when the config has
+// them and otherwise every global_attn_every_n_layers layers, starting with
+// the first, are global.
+func (p *Params) modernBertSlidingWindowLayers() ([]bool, error) {
+	if len(p.LayerTypes) > 0 {
+		layers, err := p.slidingWindowLayers()
+		if err != nil {
+			return nil, err
+		}
+
+		// slidingWindowLayers leaves out the pattern when every layer is
+		// local
+		if layers == nil {
+			layers = make([]bool, p.HiddenLayers)
+			for i := range layers {
+				layers[i] = true
+			}
+		}
+
+		return layers, nil
+	}
+
+	n := cmp.Or(p.GlobalAttnEveryNLayers, 3)
+	if n < 1 {
+		return nil, fmt.Errorf("global_attn_every_n_layers must be positive, got %d", n)
+	}
+
+	layers := make([]bool, p.HiddenLayers)
+	for i := range layers {
+		layers[i] = i%n != 0
+	}
+
+	return layers, nil
+}
+
+// modernBertPooling maps the classifier_pooling of the config to the pooling
+// types of llama.cpp
+var modernBertPooling = map[string]uint32{
+	"mean": 1,
+	"cls":  2,
+}
+
+func (m *ModernBertModel) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *ModernBertModel) WriteGGUF(ws io.WriteSeeker) error {
+	layers, err := m.Params.modernBertSlidingWindowLayers()
+	if err != nil {
+		return fmt.Errorf("modernbert: %w", err)
+	}
+
+	pooling, ok := modernBertPooling[cmp.Or(m.Params.ClassifierPooling, "cls")]
+	if !ok {
+		m.Params.warn("unknown classifier pooling, using cls", "pooling", m.Params.ClassifierPooling)
+		pooling = modernBertPooling["cls"]
+	}
+
+	kv := llm.KV{
+		"general.architecture":                         "modern-bert",
+		"general.name":                                 m.Name,
+		"modern-bert.vocab_size":                       uint32(len(m.Vocab.Tokens)),
+		"modern-bert.context_length":                   uint32(cmp.Or(m.Params.contextLength(), 8192)),
+		"modern-bert.embedding_length":                 uint32(m.Params.HiddenSize),
+		"modern-bert.block_count":                      uint32(m.Params.HiddenLayers),
+		"modern-bert.feed_forward_length":              uint32(m.Params.IntermediateSize),
+		"modern-bert.rope.dimension_count":             uint32(m.Params.HiddenSize / m.Params.AttentionHeads),
+		"modern-bert.rope.freq_base":                   float32(cmp.Or(m.Params.GlobalRopeTheta, m.Params.RopeFrequencyBase, 160000)),
+		"modern-bert.rope.freq_base_swa":               float32(cmp.Or(m.Params.LocalRopeTheta, 10000)),
+		"modern-bert.attention.head_count":             uint32(m.Params.AttentionHeads),
+		"modern-bert.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
+		"modern-bert.attention.layer_norm_epsilon":     float32(cmp.Or(m.Params.NormEpsilon, 1e-5)),
+		"modern-bert.attention.causal":                 false,
+		"modern-bert.attention.sliding_window":         uint32(cmp.Or(m.Params.LocalAttention, 128)),
+		"modern-bert.attention.sliding_window_pattern": layers,
+		"modern-bert.pooling_type":                     pooling,
+		"general.file_type":                            m.Params.fileType(),
+		"tokenizer.ggml.model":                         m.Vocab.Model,
+		"tokenizer.ggml.pre":                           m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":                        m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":                    m.Vocab.Types,
+		"tokenizer.ggml.merges":                        m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":                  uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":                  uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":              uint32(m.Params.PaddingTokenID),
+		"tokenizer.ggml.add_bos_token":                 true,
+		"tokenizer.ggml.add_eos_token":                 true,
+	}
+
+	maps.Copy(kv, m.Params.activationKV("modern-bert", "gelu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the embedding norm and every layer's attention and split
+// feed forward network were found, along with the attention norm of every
+// layer but the first
+func (m *ModernBertModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == "token_embd_norm.weight" }) {
+		return errors.New("modernbert: token_embd_norm.weight not found")
+	}
+
+	for i := range m.Params.HiddenLayers {
+		names := []string{"attn_qkv", "attn_output", "ffn_norm", "ffn_gate", "ffn_up", "ffn_down"}
+		if i > 0 {
+			names = append(names, "attn_norm")
+		}
+
+		for _, name := range names {
+			name := fmt.Sprintf("blk.%d.%s.weight", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("modernbert: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package convert
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyModernBert writes a three layer ModernBERT masked language model
+// with global attention every other layer to a temporary directory. Each row
+// of the fused GeGLU input projection holds its row number.
+func createTinyModernBert(t *testing.T) string {
+	t.Helper()
+
+	tensors := map[string][]uint64{
+		"model.embeddings.tok_embeddings.weight": {4, 8},
+		"model.embeddings.norm.weight":           {8},
+		"model.final_norm.weight":                {8},
+		"head.dense.weight":                      {8, 8},
+		"head.norm.weight":                       {8},
+		"decoder.bias":                           {4},
+	}
+
+	values := make(map[string]func(int) float32)
+	for i := range 3 {
+		if i > 0 {
+			tensors[fmt.Sprintf("model.layers.%d.attn_norm.weight", i)] = []uint64{8}
+		}
+
+		tensors[fmt.Sprintf("model.layers.%d.attn.Wqkv.weight", i)] = []uint64{24, 8}
+		tensors[fmt.Sprintf("model.layers.%d.attn.Wo.weight", i)] = []uint64{8, 8}
+		tensors[fmt.Sprintf("model.layers.%d.mlp_norm.weight", i)] = []uint64{8}
+		tensors[fmt.Sprintf("model.layers.%d.mlp.Wi.weight", i)] = []uint64{8, 8}
+		tensors[fmt.Sprintf("model.layers.%d.mlp.Wo.weight", i)] = []uint64{8, 4}
+		values[fmt.Sprintf("model.layers.%d.mlp.Wi.weight", i)] = rowNumbers(8)
+	}
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":              []string{"ModernBertForMaskedLM"},
+			"vocab_size":                 4,
+			"hidden_size":                8,
+			"num_hidden_layers":          3,
+			"num_attention_heads":        2,
+			"intermediate_size":          4,
+			"max_position_embeddings":    512,
+			"global_attn_every_n_layers": 2,
+			"local_attention":            64,
+			"global_rope_theta":          160000,
+			"local_rope_theta":           10000,
+			"norm_eps":                   1e-5,
+			"hidden_activation":          "gelu",
+			"classifier_pooling":         "mean",
+			"bos_token_id":               2,
+			"eos_token_id":               3,
+			"pad_token_id":               1,
+		},
+		tokenizer: tinyBPETokenizer("[CLS]", "[SEP]"),
+		tensors:   tensors,
+		values:    values,
+	})
+}
+
+func TestConvertModernBert(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyModernBert(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":                         "modern-bert",
+		"modern-bert.context_length":                   uint32(512),
+		"modern-bert.block_count":                      uint32(3),
+		"modern-bert.feed_forward_length":              uint32(4),
+		"modern-bert.rope.dimension_count":             uint32(4),
+		"modern-bert.rope.freq_base":                   float32(160000),
+		"modern-bert.rope.freq_base_swa":               float32(10000),
+		"modern-bert.attention.causal":                 false,
+		"modern-bert.attention.sliding_window":         uint32(64),
+		"modern-bert.attention.sliding_window_pattern": []any{false, true, false},
+		"modern-bert.pooling_type":                     uint32(1),
+		"modern-bert.feed_forward.activation":          "gelu",
+		"tokenizer.ggml.model":                         "gpt2",
+		"tokenizer.ggml.bos_token_id":                  uint32(2),
+		"tokenizer.ggml.eos_token_id":                  uint32(3),
+		"tokenizer.ggml.add_eos_token":                 true,
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	for name := range tensors {
+		if strings.HasPrefix(name, "mlm.") || strings.Contains(name, "ffn_gate_up") {
+			t.Errorf("unexpected tensor %s", name)
+		}
+	}
+
+	for _, name := range []string{"token_embd.weight", "token_embd_norm.weight", "output_norm.weight", "blk.0.attn_qkv.weight", "blk.1.attn_norm.weight", "blk.2.ffn_down.weight"} {
+		if _, ok := tensors[name]; !ok {
+			t.Errorf("expected tensor %s", name)
+		}
+	}
+
+	// the activated input is the first half of the fused projection
+	for name, want := range map[string][]float32{
+		"blk.0.ffn_gate.weight": {0, 1, 2, 3},
+		"blk.0.ffn_up.weight":   {4, 5, 6, 7},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := tensor.Shape[:2]; !slices.Equal(got, []uint64{8, 4}) {
+			t.Fatalf("%s: expected shape [8 4], got %v", name, got)
+		}
+
+		f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rows []float32
+		for i := 0; i < len(f32s); i += 8 {
+			rows = append(rows, f32s[i])
+		}
+
+		if !slices.Equal(rows, want) {
+			t.Errorf("%s: expected rows %v, got %v", name, want, rows)
+		}
+	}
+}
+
+func TestModernBertSlidingWindowLayers(t *testing.T) {
+	cases := []struct {
+		name   string
+		params Params
+		want   []bool
+	}{
+		{"default", Params{HiddenLayers: 4}, []bool{false, true, true, false}},
+		{"every layer", Params{HiddenLayers: 2, GlobalAttnEveryNLayers: 1}, []bool{false, false}},
+		{"layer types", Params{HiddenLayers: 2, LayerTypes: []string{"sliding_attention", "full_attention"}}, []bool{true, false}},
+		{"all local", Params{HiddenLayers: 2, LayerTypes: []string{"sliding_attention", "sliding_attention"}}, []bool{true, true}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.params.modernBertSlidingWindowLayers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// Phi3Model converts Microsoft's Phi-3. The query, key and value and the
+// feed forward gate and up projections are fused into one tensor each and
+// are split here. Models with a context longer than they were trained on use
+// longrope scaling whose factors are written as tensors.
+type Phi3Model struct {
+	ModelData
+}
+
+func (m *Phi3Model) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	kind := uint32(1)
+	if m.Params.F32 {
+		kind = 0
+	}
+
+	headDim := uint64(m.Params.HiddenSize / m.Params.AttentionHeads)
+	q := uint64(m.Params.AttentionHeads) * headDim
+	kv := uint64(m.Params.KeyValHeads) * headDim
+	ff := uint64(m.Params.IntermediateSize)
+
+	for _, l := range t {
+		var parts []string
+		var rows []uint64
+		switch {
+		case strings.HasSuffix(l.Name, ".attn_qkv.weight"):
+			parts, rows = []string{"attn_q", "attn_k", "attn_v"}, []uint64{q, kv, kv}
+		case strings.HasSuffix(l.Name, ".ffn_gate_up.weight"):
+			parts, rows = []string{"ffn_gate", "ffn_up"}, []uint64{ff, ff}
+		default:
+			m.Tensors = append(m.Tensors, l)
+			continue
+		}
+
+		var total uint64
+		for _, n := range rows {
+			total += n
+		}
+
+		if len(l.Shape) != 2 || l.Shape[0] != total {
+			return fmt.Errorf("phi3: %s has shape %v, expected %d rows", l.Name, l.Shape, total)
+		}
+
+		prefix, _, _ := strings.Cut(l.Name, ".attn_qkv.")
+		prefix, _, _ = strings.Cut(prefix, ".ffn_gate_up.")
+
+		var start uint64
+		for i, part := range parts {
+			name := prefix + "." + part + ".weight"
+			shape := []uint64{rows[i], l.Shape[1]}
+			kind, err := m.Params.tensorKind(name, shape, kind)
+			if err != nil {
+				return err
+			}
+
+			m.Tensors = append(m.Tensors, repackTensor(l, name, kind, shape, sliceRows(start, rows[i])))
+			start += rows[i]
+		}
+	}
+
+	if m.Tensors, err = tieOutput(m.Tensors); err != nil {
+		return err
+	}
+
+	updateOffsets(m.Tensors)
+	rope, err := m.Params.RopeScaling.Tensors(m.Params, nextOffset(m.Tensors))
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, rope...)
+	return nil
+}
+
+func (m *Phi3Model) LoadVocab() error {
+	if _, err := fs.Stat(m.tokenizerFS(), "tokenizer.model"); err == nil {
+		v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
+		if err != nil {
+			return err
+		}
+
+		m.Vocab = v
+		return nil
+	}
+
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("phi3: no tokenizer.model or tokenizer.json: %w", fs.ErrNotExist)
+	} else if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *Phi3Model) WriteGGUF(ws io.WriteSeeker) error {
+	// phi3 configs set the original context length next to rope_scaling
+	// rather than in it
+	if r := m.Params.RopeScaling; r != nil && r.OriginalMaxPositionEmbeddings == 0 {
+		r.OriginalMaxPositionEmbeddings = m.Params.OriginalContextLength
+	}
+
+	kv := llm.KV{
+		"general.architecture":                  "phi3",
+		"general.name":                          m.Name,
+		"phi3.vocab_size":                       uint32(len(m.Vocab.Tokens)),
+		"phi3.context_length":                   uint32(m.Params.contextLength()),
+		"phi3.embedding_length":                 uint32(m.Params.HiddenSize),
+		"phi3.block_count":                      uint32(m.Params.HiddenLayers),
+		"phi3.feed_forward_length":              uint32(m.Params.IntermediateSize),
+		"phi3.rope.freq_base":                   float32(cmp.Or(m.Params.RopeFrequencyBase, 10000)),
+		"phi3.rope.dimension_count":             uint32(m.Params.HiddenSize / m.Params.AttentionHeads),
+		"phi3.attention.head_count":             uint32(m.Params.AttentionHeads),
+		"phi3.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
+		"phi3.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
+		"general.file_type":                     m.Params.fileType(),
+		"tokenizer.ggml.model":                  m.Vocab.Model,
+		"tokenizer.ggml.tokens":                 m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":             m.Vocab.Types,
+		"tokenizer.ggml.bos_token_id":           uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":           uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":       uint32(m.Params.PaddingTokenID),
+		"tokenizer.ggml.unknown_token_id":       uint32(0),
+	}
+
+	if m.Vocab.Model == "gpt2" {
+		kv["tokenizer.ggml.pre"] = m.Params.PreTokenizer
+		kv["tokenizer.ggml.merges"] = m.Vocab.Merges
+	} else {
+		kv["tokenizer.ggml.scores"] = m.Vocab.Scores
+	}
+
+	if m.Params.SlidingWindow != nil {
+		kv["phi3.attention.sliding_window"] = *m.Params.SlidingWindow
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("phi3"))
+	maps.Copy(kv, m.Params.activationKV("phi3", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
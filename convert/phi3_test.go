@@ -0,0 +1,173 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyPhi3 writes a single layer phi3 model with longrope scaling to a
+// temporary directory. Each row of the fused projections holds its row
+// number.
+func createTinyPhi3(t *testing.T) string {
+	t.Helper()
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":                    []string{"Phi3ForCausalLM"},
+			"vocab_size":                       4,
+			"hidden_size":                      8,
+			"num_hidden_layers":                1,
+			"max_position_embeddings":          128,
+			"original_max_position_embeddings": 32,
+			"intermediate_size":                16,
+			"num_attention_heads":              2,
+			"num_key_value_heads":              1,
+			"rms_norm_eps":                     1e-5,
+			"bos_token_id":                     1,
+			"eos_token_id":                     2,
+			"rope_theta":                       10000.0,
+			"sliding_window":                   64,
+			"hidden_act":                       "silu",
+			"rope_scaling": map[string]any{
+				"type":         "longrope",
+				"long_factor":  []float32{1, 2},
+				"short_factor": []float32{1, 1},
+			},
+		},
+		pieces: []*sentencepiece.ModelProto_SentencePiece{
+			{Piece: proto.String("<unk>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_UNKNOWN.Enum()},
+			{Piece: proto.String("<s>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			{Piece: proto.String("</s>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			{Piece: proto.String("▁a"), Score: proto.Float32(-1)},
+		},
+		tensors: map[string][]uint64{
+			"model.embed_tokens.weight":                      {4, 8},
+			"model.norm.weight":                              {8},
+			"lm_head.weight":                                 {4, 8},
+			"model.layers.0.input_layernorm.weight":          {8},
+			"model.layers.0.post_attention_layernorm.weight": {8},
+			"model.layers.0.self_attn.qkv_proj.weight":       {8 + 4 + 4, 8},
+			"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+			"model.layers.0.mlp.gate_up_proj.weight":         {2 * 16, 8},
+			"model.layers.0.mlp.down_proj.weight":            {8, 16},
+		},
+		values: map[string]func(int) float32{
+			"model.layers.0.self_attn.qkv_proj.weight": rowNumbers(8),
+			"model.layers.0.mlp.gate_up_proj.weight":   rowNumbers(8),
+		},
+	})
+}
+
+func TestConvertPhi3(t *testing.T) {
+	d := createTinyPhi3(t)
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":                      "phi3",
+		"phi3.context_length":                       uint32(128),
+		"phi3.embedding_length":                     uint32(8),
+		"phi3.block_count":                          uint32(1),
+		"phi3.feed_forward_length":                  uint32(16),
+		"phi3.attention.head_count":                 uint32(2),
+		"phi3.attention.head_count_kv":              uint32(1),
+		"phi3.attention.sliding_window":             uint32(64),
+		"phi3.rope.dimension_count":                 uint32(4),
+		"phi3.rope.scaling.type":                    "longrope",
+		"phi3.rope.scaling.original_context_length": uint32(32),
+		"phi3.feed_forward.activation":              "silu",
+		"tokenizer.ggml.model":                      "llama",
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	// shapes are innermost first
+	for name, want := range map[string][]uint64{
+		"blk.0.attn_q.weight":       {8, 8},
+		"blk.0.attn_k.weight":       {8, 4},
+		"blk.0.attn_v.weight":       {8, 4},
+		"blk.0.ffn_gate.weight":     {8, 16},
+		"blk.0.ffn_up.weight":       {8, 16},
+		"rope_factors_long.weight":  {2},
+		"rope_factors_short.weight": {2},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := slices.DeleteFunc(slices.Clone(tensor.Shape), func(dim uint64) bool { return dim == 1 }); !slices.Equal(got, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got)
+		}
+	}
+
+	for _, name := range []string{"blk.0.attn_qkv.weight", "blk.0.ffn_gate_up.weight"} {
+		if _, ok := tensors[name]; ok {
+			t.Errorf("unexpected tensor %s", name)
+		}
+	}
+
+	read := func(name string) []float32 {
+		tensor := tensors[name]
+		f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f32s
+	}
+
+	// the query isn't permuted like llama's
+	for name, rows := range map[string][2]float32{
+		"blk.0.attn_q.weight":   {0, 7},
+		"blk.0.attn_k.weight":   {8, 11},
+		"blk.0.attn_v.weight":   {12, 15},
+		"blk.0.ffn_gate.weight": {0, 15},
+		"blk.0.ffn_up.weight":   {16, 31},
+	} {
+		if got := read(name); got[0] != rows[0] || got[len(got)-1] != rows[1] {
+			t.Errorf("%s: expected rows %v to %v, got %v", name, rows[0], rows[1], got)
+		}
+	}
+
+	// pins the data of every converted tensor
+	if got, want := fmt.Sprintf("%x", sha256.Sum256(data)), "7b1c3f88aba98314c21417b6d0a012ab15396af0bffc6ba68bd1e3e4a1da3c1b"; got != want {
+		t.Fatalf("expected tensor data %s, got %s", want, got)
+	}
+}
+
+func TestConvertPhi3MissingTokenizer(t *testing.T) {
+	d := createTinyPhi3(t)
+	if err := os.Remove(filepath.Join(d, "tokenizer.model")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf"))
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "no tokenizer.model or tokenizer.json") {
+		t.Fatalf("expected missing tokenizer error, got %v", err)
+	}
+}
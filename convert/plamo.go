@@ -0,0 +1,123 @@
+package convert
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// PlamoModel converts Preferred Networks' PLaMo models. PLaMo is llama-like
+// but computes attention and the feed forward network in parallel from a
+// single norm and shares each key and value head between n_shared_head
+// query heads.
+type PlamoModel struct {
+	ModelData
+}
+
+func (m *PlamoModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		switch {
+		case strings.HasSuffix(l.Name, "attn_q.weight"):
+			l = repackTensor(l, l.Name, l.Kind, l.Shape, m.permuteHeads(true))
+		case strings.HasSuffix(l.Name, "attn_output.weight"):
+			l = repackTensor(l, l.Name, l.Kind, l.Shape, m.permuteHeads(false))
+		}
+
+		m.Tensors = append(m.Tensors, l)
+	}
+
+	return nil
+}
+
+// permuteHeads reorders query heads, the rows of attn_q or the columns of
+// attn_output, from [n_shared_head, kv_heads] to [kv_heads, n_shared_head]
+// so the heads sharing a key and value head are adjacent. This lets ggml
+// broadcast the key and value heads in its matrix multiplication.
+func (m *PlamoModel) permuteHeads(rows bool) func([]float32, []uint64) ([]float32, error) {
+	return func(data []float32, shape []uint64) ([]float32, error) {
+		heads := uint64(m.Params.AttentionHeads)
+		shared := uint64(m.Params.SharedHeads)
+		kv := heads / shared
+
+		headDim := shape[1] / heads
+		if rows {
+			headDim = shape[0] / heads
+		}
+
+		permute := func(h uint64) uint64 {
+			s, k, e := h/(kv*headDim), h/headDim%kv, h%headDim
+			return (k*shared+s)*headDim + e
+		}
+
+		cols := shape[1]
+		out := make([]float32, len(data))
+		for i := range shape[0] {
+			for j := range cols {
+				if rows {
+					out[permute(i)*cols+j] = data[i*cols+j]
+				} else {
+					out[i*cols+permute(j)] = data[i*cols+j]
+				}
+			}
+		}
+
+		return out, nil
+	}
+}
+
+func (m *PlamoModel) LoadVocab() error {
+	v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *PlamoModel) WriteGGUF(ws io.WriteSeeker) error {
+	if m.Params.SharedHeads == 0 || m.Params.AttentionHeads%m.Params.SharedHeads != 0 {
+		return fmt.Errorf("plamo: num_attention_heads %d is not divisible by n_shared_head %d", m.Params.AttentionHeads, m.Params.SharedHeads)
+	}
+
+	kv := llm.KV{
+		"general.architecture":                   "plamo",
+		"general.name":                           m.Name,
+		"plamo.vocab_size":                       uint32(len(m.Vocab.Tokens)),
+		"plamo.context_length":                   uint32(cmp.Or(m.Params.contextLength(), 4096)),
+		"plamo.embedding_length":                 uint32(m.Params.HiddenSize),
+		"plamo.block_count":                      uint32(m.Params.HiddenLayers),
+		"plamo.feed_forward_length":              uint32(m.Params.IntermediateSize),
+		"plamo.rope.freq_base":                   float32(cmp.Or(m.Params.RopeFrequencyBase, 10000)),
+		"plamo.rope.dimension_count":             uint32(m.Params.HiddenSize / m.Params.AttentionHeads),
+		"plamo.attention.head_count":             uint32(m.Params.AttentionHeads),
+		"plamo.attention.head_count_kv":          uint32(m.Params.AttentionHeads / m.Params.SharedHeads),
+		"plamo.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
+		"general.file_type":                      m.Params.fileType(),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
+		"tokenizer.ggml.tokens":                  m.Vocab.Tokens,
+		"tokenizer.ggml.scores":                  m.Vocab.Scores,
+		"tokenizer.ggml.token_type":              m.Vocab.Types,
+		"tokenizer.ggml.bos_token_id":            uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":            uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":        uint32(m.Params.PaddingTokenID),
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("plamo"))
+	maps.Copy(kv, m.Params.activationKV("plamo", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
@@ -0,0 +1,31 @@
+package convert
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPlamoPermuteHeads(t *testing.T) {
+	// 4 query heads of 1 dimension sharing 2 key and value heads, stored as
+	// [n_shared_head, kv_heads]: s0k0 s0k1 s1k0 s1k1
+	m := PlamoModel{ModelData{Params: &Params{AttentionHeads: 4, SharedHeads: 2}}}
+
+	q, err := m.permuteHeads(true)([]float32{0, 1, 2, 3, 4, 5, 6, 7}, []uint64{4, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows become s0k0 s1k0 s0k1 s1k1
+	if want := []float32{0, 1, 4, 5, 2, 3, 6, 7}; !slices.Equal(q, want) {
+		t.Fatalf("expected q %v, got %v", want, q)
+	}
+
+	o, err := m.permuteHeads(false)([]float32{0, 1, 2, 3, 4, 5, 6, 7}, []uint64{2, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []float32{0, 2, 1, 3, 4, 6, 5, 7}; !slices.Equal(o, want) {
+		t.Fatalf("expected output %v, got %v", want, o)
+	}
+}
@@ -0,0 +1,100 @@
+package convert
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// Qwen2Model converts Alibaba's Qwen2. The layers are those of llama with
+// biases on the query, key and value projections. Unlike llama checkpoints
+// the rotary embedding already pairs dimensions half a head apart so the
+// query and key aren't repacked. Qwen2-VL converts to its text model, whose
+// mrope rope_scaling is kept, without the visual tower.
+type Qwen2Model struct {
+	ModelData
+}
+
+func (m *Qwen2Model) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, t...)
+	if m.Tensors, err = tieOutput(m.Tensors); err != nil {
+		return err
+	}
+
+	rope, err := m.Params.RopeScaling.Tensors(m.Params, nextOffset(m.Tensors))
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, rope...)
+	return nil
+}
+
+func (m *Qwen2Model) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *Qwen2Model) WriteGGUF(ws io.WriteSeeker) error {
+	kv := llm.KV{
+		"general.architecture":                   "qwen2",
+		"general.name":                           m.Name,
+		"qwen2.vocab_size":                       uint32(len(m.Vocab.Tokens)),
+		"qwen2.context_length":                   uint32(m.Params.contextLength()),
+		"qwen2.embedding_length":                 uint32(m.Params.HiddenSize),
+		"qwen2.block_count":                      uint32(m.Params.HiddenLayers),
+		"qwen2.feed_forward_length":              uint32(m.Params.IntermediateSize),
+		"qwen2.rope.freq_base":                   float32(cmp.Or(m.Params.RopeFrequencyBase, 1000000)),
+		"qwen2.attention.head_count":             uint32(m.Params.AttentionHeads),
+		"qwen2.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
+		"qwen2.attention.layer_norm_rms_epsilon": float32(m.Params.NormEPS),
+		"general.file_type":                      m.Params.fileType(),
+		"tokenizer.ggml.model":                   m.Vocab.Model,
+		"tokenizer.ggml.pre":                     m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":                  m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":              m.Vocab.Types,
+		"tokenizer.ggml.merges":                  m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":            uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":            uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":        uint32(m.Params.PaddingTokenID),
+		"tokenizer.ggml.add_bos_token":           false,
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("qwen2"))
+	maps.Copy(kv, m.Params.activationKV("qwen2", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks every layer has the query, key and value biases qwen2
+// runtimes expect
+func (m *Qwen2Model) Validate(kv llm.KV, ts []llm.Tensor) error {
+	for i := range m.Params.HiddenLayers {
+		for _, name := range []string{"attn_q", "attn_k", "attn_v"} {
+			name := fmt.Sprintf("blk.%d.%s.bias", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("qwen2: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package convert
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyQwen2 writes a single layer qwen2 model to a temporary directory
+func createTinyQwen2(t *testing.T) string {
+	t.Helper()
+
+	tokenizer := tinyBPETokenizer("<|endoftext|>", "<|im_end|>")
+	tokenizer["pre_tokenizer"] = map[string]any{
+		"type": "Sequence",
+		"pretokenizers": []map[string]any{
+			{"type": "Split", "pattern": map[string]any{"Regex": `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`}},
+			{"type": "ByteLevel"},
+		},
+	}
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":           []string{"Qwen2ForCausalLM"},
+			"vocab_size":              4,
+			"hidden_size":             8,
+			"num_hidden_layers":       1,
+			"max_position_embeddings": 128,
+			"intermediate_size":       16,
+			"num_attention_heads":     2,
+			"num_key_value_heads":     1,
+			"rms_norm_eps":            1e-6,
+			"bos_token_id":            2,
+			"eos_token_id":            3,
+			"rope_theta":              1000000.0,
+		},
+		tokenizer: tokenizer,
+		tensors: map[string][]uint64{
+			"model.embed_tokens.weight":                      {4, 8},
+			"model.norm.weight":                              {8},
+			"lm_head.weight":                                 {4, 8},
+			"model.layers.0.input_layernorm.weight":          {8},
+			"model.layers.0.post_attention_layernorm.weight": {8},
+			"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+			"model.layers.0.self_attn.q_proj.bias":           {8},
+			"model.layers.0.self_attn.k_proj.weight":         {4, 8},
+			"model.layers.0.self_attn.k_proj.bias":           {4},
+			"model.layers.0.self_attn.v_proj.weight":         {4, 8},
+			"model.layers.0.self_attn.v_proj.bias":           {4},
+			"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+			"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+			"model.layers.0.mlp.up_proj.weight":              {16, 8},
+			"model.layers.0.mlp.down_proj.weight":            {8, 16},
+		},
+		// each row of the query holds its row number
+		values: map[string]func(int) float32{
+			"model.layers.0.self_attn.q_proj.weight": rowNumbers(8),
+			"model.layers.0.self_attn.q_proj.bias":   rowNumbers(1),
+		},
+	})
+}
+
+func TestConvertQwen2(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyQwen2(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":          "qwen2",
+		"qwen2.block_count":             uint32(1),
+		"qwen2.attention.head_count":    uint32(2),
+		"qwen2.attention.head_count_kv": uint32(1),
+		"qwen2.rope.freq_base":          float32(1000000),
+		"tokenizer.ggml.model":          "gpt2",
+		"tokenizer.ggml.pre":            "qwen2",
+		"tokenizer.ggml.add_bos_token":  false,
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	read := func(name string) []float32 {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		f32s, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f32s
+	}
+
+	for name, want := range map[string]uint64{"blk.0.attn_q.bias": 8, "blk.0.attn_k.bias": 4, "blk.0.attn_v.bias": 4} {
+		if got := read(name); uint64(len(got)) != want || tensors[name].Kind != 0 {
+			t.Errorf("%s: expected %d F32 values, got %d of kind %d", name, want, len(got), tensors[name].Kind)
+		}
+	}
+
+	if got, want := read("blk.0.attn_q.bias"), []float32{0, 1, 2, 3, 4, 5, 6, 7}; !slices.Equal(got, want) {
+		t.Fatalf("expected the query bias not to be permuted, got %v", got)
+	}
+
+	if got := read("blk.0.attn_q.weight"); got[8] != 1 || got[16] != 2 {
+		t.Fatalf("expected the query not to be permuted, got %v", got)
+	}
+}
+
+func TestConvertQwen2MissingBias(t *testing.T) {
+	d := createTinyQwen2(t)
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":              {4, 8},
+		"model.norm.weight":                      {8},
+		"model.layers.0.self_attn.q_proj.weight": {8, 8},
+		"model.layers.0.self_attn.k_proj.weight": {4, 8},
+		"model.layers.0.self_attn.v_proj.weight": {4, 8},
+	})
+
+	if _, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf")); err == nil || !strings.Contains(err.Error(), "attn_q.bias") {
+		t.Fatalf("expected missing bias error, got %v", err)
+	}
+}
+
+func TestConvertQwen2VL(t *testing.T) {
+	d := createTinyQwen2(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"Qwen2VLForConditionalGeneration"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     1,
+		"rms_norm_eps":            1e-6,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+		"rope_theta":              1000000.0,
+		// transformers saves the mrope type as default
+		"rope_scaling": map[string]any{"type": "default", "rope_type": "default", "mrope_section": []int{1, 1, 0}},
+	})
+
+	createSafetensors(t, filepath.Join(d, "model-00002-of-00002.safetensors"), map[string][]uint64{
+		"visual.patch_embed.proj.weight": {8, 3, 2, 14, 14},
+		"visual.merger.ln_q.weight":      {8},
+	})
+
+	kv, tensors := convertDir(t, d, nil)
+	for k, want := range map[string]any{
+		"general.architecture":    "qwen2",
+		"qwen2.rope.scaling.type": "mrope",
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	if got := fmt.Sprint(kv["qwen2.rope.dimension_sections"]); got != "[1 1 0 0]" {
+		t.Errorf("expected the mrope sections padded to four, got %s", got)
+	}
+
+	for _, tensor := range tensors {
+		if strings.HasPrefix(tensor.Name, "v.") || strings.Contains(tensor.Name, "visual") {
+			t.Errorf("unexpected vision tensor %s", tensor.Name)
+		}
+	}
+}
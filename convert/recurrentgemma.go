@@ -0,0 +1,174 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// RecurrentGemmaModel converts Google's RecurrentGemma, the Griffin
+// architecture. Its layers follow the repeating schedule of block_types,
+// each either a recurrent block or a local attention block attending within
+// attention_window_size. A recurrent block projects its input twice, to the
+// gelu gate of linear_y and to the branch of linear_x which runs through a
+// short depthwise convolution and the RG-LRU. The RG-LRU gates its input and
+// its recurrence with block diagonal weights of one block per head, and the
+// recurrence decays by the learned a, recurrent_param, which is kept as it
+// is stored since runtimes take its softplus. The gated product is projected
+// back by linear_out. Like gemma, every norm scales by one plus its weight.
+type RecurrentGemmaModel struct {
+	ModelData
+}
+
+// recurrentGemmaLayers returns whether each layer is a recurrent block
+// rather than local attention. block_types repeats for as many layers as
+// there are.
+func (p *Params) recurrentGemmaLayers() ([]bool, error) {
+	if len(p.BlockTypes) == 0 {
+		return nil, errors.New("recurrent_gemma: block_types not found")
+	}
+
+	layers := make([]bool, p.HiddenLayers)
+	for i := range layers {
+		switch t := p.BlockTypes[i%len(p.BlockTypes)]; t {
+		case "recurrent":
+			layers[i] = true
+		case "attention":
+		default:
+			return nil, fmt.Errorf("recurrent_gemma: unknown block type %q", t)
+		}
+	}
+
+	return layers, nil
+}
+
+func (m *RecurrentGemmaModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		switch {
+		case strings.HasSuffix(l.Name, "norm.weight"):
+			// see GemmaModel
+			l = repackTensor(l, l.Name, 0, l.Shape, func(data []float32, shape []uint64) ([]float32, error) {
+				return addOnes(data, int(shape[0]))
+			})
+		case strings.HasSuffix(l.Name, ".ssm_conv1d.weight"):
+			// drop the single channel per group from [width, 1, kernel]
+			l = repackTensor(l, l.Name, 0, []uint64{l.Shape[0], l.Shape[len(l.Shape)-1]}, func(data []float32, _ []uint64) ([]float32, error) {
+				return data, nil
+			})
+		}
+
+		m.Tensors = append(m.Tensors, l)
+	}
+
+	updateOffsets(m.Tensors)
+	if m.Tensors, err = m.Params.tieWordEmbeddings(m.Tensors); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *RecurrentGemmaModel) LoadVocab() error {
+	v, err := LoadSentencePieceTokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *RecurrentGemmaModel) WriteGGUF(ws io.WriteSeeker) error {
+	layers, err := m.Params.recurrentGemmaLayers()
+	if err != nil {
+		return err
+	}
+
+	headDim := cmp.Or(m.Params.HeadDimension, m.Params.HiddenSize/max(m.Params.AttentionHeads, 1))
+
+	// configs have no max_position_embeddings since only the local attention
+	// is bounded. The checkpoints were trained on sequences of 8192 tokens.
+	contextLength := cmp.Or(m.Params.contextLength(), 8192)
+
+	kv := llm.KV{
+		"general.architecture":                             "recurrent_gemma",
+		"general.name":                                     m.Name,
+		"recurrent_gemma.vocab_size":                       uint32(len(m.Vocab.Tokens)),
+		"recurrent_gemma.context_length":                   uint32(contextLength),
+		"recurrent_gemma.embedding_length":                 uint32(m.Params.HiddenSize),
+		"recurrent_gemma.block_count":                      uint32(m.Params.HiddenLayers),
+		"recurrent_gemma.feed_forward_length":              uint32(m.Params.IntermediateSize / 2),
+		"recurrent_gemma.final_logit_softcapping":          float32(cmp.Or(m.Params.LogitsSoftCap, 30)),
+		"recurrent_gemma.recurrent_layer_pattern":          layers,
+		"recurrent_gemma.rope.freq_base":                   float32(cmp.Or(m.Params.RopeFrequencyBase, 10000)),
+		"recurrent_gemma.rope.dimension_count":             uint32(float64(headDim) * cmp.Or(m.Params.PartialRotaryFactor, 0.5)),
+		"recurrent_gemma.attention.head_count":             uint32(m.Params.AttentionHeads),
+		"recurrent_gemma.attention.head_count_kv":          uint32(m.Params.KeyValHeads),
+		"recurrent_gemma.attention.key_length":             uint32(headDim),
+		"recurrent_gemma.attention.value_length":           uint32(headDim),
+		"recurrent_gemma.attention.layer_norm_rms_epsilon": float32(cmp.Or(m.Params.NormEPS, 1e-6)),
+		"recurrent_gemma.attention.sliding_window":         uint32(cmp.Or(m.Params.AttentionWindowSize, 2048)),
+		"recurrent_gemma.ssm.inner_size":                   uint32(cmp.Or(m.Params.LRUWidth, m.Params.HiddenSize)),
+		"recurrent_gemma.ssm.conv_kernel":                  uint32(cmp.Or(m.Params.Conv1DWidth, 4)),
+		"general.file_type":                                m.Params.fileType(),
+		"tokenizer.ggml.model":                             "llama",
+		"tokenizer.ggml.tokens":                            m.Vocab.Tokens,
+		"tokenizer.ggml.scores":                            m.Vocab.Scores,
+		"tokenizer.ggml.token_type":                        m.Vocab.Types,
+		"tokenizer.ggml.bos_token_id":                      uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":                      uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":                  uint32(m.Params.PaddingTokenID),
+		"tokenizer.ggml.unknown_token_id":                  uint32(3),
+		"tokenizer.ggml.add_bos_token":                     true,
+		"tokenizer.ggml.add_eos_token":                     false,
+	}
+
+	maps.Copy(kv, m.Params.activationKV("recurrent_gemma", "gelu_tanh"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks every layer has the norms and feed forward network of
+// each block and the recurrent or attention tensors its place in the
+// schedule calls for
+func (m *RecurrentGemmaModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	layers, err := m.Params.recurrentGemmaLayers()
+	if err != nil {
+		return err
+	}
+
+	recurrent := []string{"rglru_x", "rglru_y", "rglru_out", "ssm_conv1d", "rglru_input_gate", "rglru_a_gate", "rglru_a"}
+	attention := []string{"attn_q", "attn_k", "attn_v", "attn_output"}
+	for i, isRecurrent := range layers {
+		names := []string{"attn_norm", "ffn_norm", "ffn_gate", "ffn_up", "ffn_down"}
+		if isRecurrent {
+			names = append(names, recurrent...)
+		} else {
+			names = append(names, attention...)
+		}
+
+		for _, name := range names {
+			name := fmt.Sprintf("blk.%d.%s.weight", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("recurrent_gemma: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
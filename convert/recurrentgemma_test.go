@@ -0,0 +1,186 @@
+package convert
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyRecurrentGemma writes a RecurrentGemma model of 3 layers, 2
+// recurrent blocks around a local attention block, to a temporary directory.
+// The attention has 2 query heads sharing a key value head of 4 dimensions
+// and the RG-LRU 2 heads of 4 dimensions. The final norm is zeros.
+func createTinyRecurrentGemma(t *testing.T) string {
+	t.Helper()
+
+	tensors := map[string][]uint64{
+		"model.embed_tokens.weight": {4, 8},
+		"model.final_norm.weight":   {8},
+	}
+
+	for _, layer := range []string{"0", "1", "2"} {
+		prefix := "model.layers." + layer + "."
+		for name, shape := range map[string][]uint64{
+			"temporal_pre_norm.weight":   {8},
+			"channel_pre_norm.weight":    {8},
+			"mlp_block.gate_proj.weight": {16, 8},
+			"mlp_block.gate_proj.bias":   {16},
+			"mlp_block.up_proj.weight":   {16, 8},
+			"mlp_block.up_proj.bias":     {16},
+			"mlp_block.down_proj.weight": {8, 16},
+			"mlp_block.down_proj.bias":   {8},
+		} {
+			tensors[prefix+name] = shape
+		}
+
+		block := map[string][]uint64{
+			"temporal_block.linear_x.weight":              {8, 8},
+			"temporal_block.linear_x.bias":                {8},
+			"temporal_block.linear_y.weight":              {8, 8},
+			"temporal_block.linear_y.bias":                {8},
+			"temporal_block.linear_out.weight":            {8, 8},
+			"temporal_block.linear_out.bias":              {8},
+			"temporal_block.conv_1d.weight":               {8, 1, 4},
+			"temporal_block.conv_1d.bias":                 {8},
+			"temporal_block.rg_lru.input_gate_weight":     {2, 4, 4},
+			"temporal_block.rg_lru.input_gate_bias":       {2, 4},
+			"temporal_block.rg_lru.recurrent_gate_weight": {2, 4, 4},
+			"temporal_block.rg_lru.recurrent_gate_bias":   {2, 4},
+			"temporal_block.rg_lru.recurrent_param":       {8},
+		}
+
+		if layer == "1" {
+			block = map[string][]uint64{
+				"temporal_block.q_proj.weight": {8, 8},
+				"temporal_block.k_proj.weight": {4, 8},
+				"temporal_block.v_proj.weight": {4, 8},
+				"temporal_block.o_proj.weight": {8, 8},
+				"temporal_block.o_proj.bias":   {8},
+			}
+		}
+
+		for name, shape := range block {
+			tensors[prefix+name] = shape
+		}
+	}
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":         []string{"RecurrentGemmaForCausalLM"},
+			"vocab_size":            4,
+			"hidden_size":           8,
+			"num_hidden_layers":     3,
+			"intermediate_size":     32,
+			"num_attention_heads":   2,
+			"num_key_value_heads":   1,
+			"head_dim":              4,
+			"lru_width":             8,
+			"conv1d_width":          4,
+			"attention_window_size": 16,
+			"logits_soft_cap":       30.0,
+			"partial_rotary_factor": 0.5,
+			"rms_norm_eps":          1e-6,
+			"hidden_activation":     "gelu_pytorch_tanh",
+			"block_types":           []string{"recurrent", "attention"},
+			"bos_token_id":          2,
+			"eos_token_id":          1,
+			"pad_token_id":          0,
+		},
+		pieces: []*sentencepiece.ModelProto_SentencePiece{
+			{Piece: proto.String("<pad>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			{Piece: proto.String("<eos>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			{Piece: proto.String("<bos>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			{Piece: proto.String("<unk>"), Type: sentencepiece.ModelProto_SentencePiece_UNKNOWN.Enum()},
+		},
+		tensors: tensors,
+		values: map[string]func(int) float32{
+			"model.final_norm.weight": func(int) float32 { return 0 },
+		},
+	})
+}
+
+func TestConvertRecurrentGemma(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyRecurrentGemma(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":                             "recurrent_gemma",
+		"recurrent_gemma.context_length":                   uint32(8192),
+		"recurrent_gemma.embedding_length":                 uint32(8),
+		"recurrent_gemma.block_count":                      uint32(3),
+		"recurrent_gemma.feed_forward_length":              uint32(16),
+		"recurrent_gemma.feed_forward.activation":          "gelu_tanh",
+		"recurrent_gemma.final_logit_softcapping":          float32(30),
+		"recurrent_gemma.recurrent_layer_pattern":          []any{true, false, true},
+		"recurrent_gemma.rope.dimension_count":             uint32(2),
+		"recurrent_gemma.attention.head_count":             uint32(2),
+		"recurrent_gemma.attention.head_count_kv":          uint32(1),
+		"recurrent_gemma.attention.key_length":             uint32(4),
+		"recurrent_gemma.attention.layer_norm_rms_epsilon": float32(1e-6),
+		"recurrent_gemma.attention.sliding_window":         uint32(16),
+		"recurrent_gemma.ssm.inner_size":                   uint32(8),
+		"recurrent_gemma.ssm.conv_kernel":                  uint32(4),
+		"tokenizer.ggml.model":                             "llama",
+		"tokenizer.ggml.add_bos_token":                     true,
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	for name, want := range map[string][]uint64{
+		"blk.0.ssm_conv1d.weight":       {4, 8},
+		"blk.0.rglru_input_gate.weight": {4, 4, 2},
+		"blk.0.rglru_a_gate.bias":       {4, 2},
+		"blk.0.rglru_a.weight":          {8},
+		"blk.0.rglru_x.weight":          {8, 8},
+		"blk.0.rglru_y.bias":            {8},
+		"blk.0.rglru_out.weight":        {8, 8},
+		"blk.1.attn_k.weight":           {8, 4},
+		"blk.1.attn_output.bias":        {8},
+		"blk.2.ffn_gate.bias":           {16},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if got := tensor.Shape[:len(want)]; !slices.Equal(got, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got)
+		}
+	}
+
+	for _, name := range []string{"blk.1.rglru_x.weight", "blk.0.attn_q.weight", "output.weight"} {
+		if _, ok := tensors[name]; ok {
+			t.Errorf("unexpected tensor %s", name)
+		}
+	}
+
+	// norms scale by one plus their weight
+	norm := tensors["output_norm.weight"]
+	f32s, err := llm.DequantizeTensor(norm.Kind, data[norm.Offset:norm.Offset+norm.Size()], norm.Shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, f := range f32s {
+		if f != 1 {
+			t.Errorf("output_norm.weight[%d]: expected 1, got %v", i, f)
+		}
+	}
+}
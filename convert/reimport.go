@@ -0,0 +1,264 @@
+package convert
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// ReimportGGUF rewrites the GGUF at src to dst with its metadata regenerated
+// from the config in dir, e.g. to fix a wrong value without converting the
+// weights again. The architecture is chosen from the config like
+// ConvertToFile. Tensors and the vocabulary are taken from src and the
+// tensor data is copied verbatim, so the tensors must already be in the layout
+// the architecture writes. Metadata the architecture doesn't write is
+// dropped. src and dst may be the same file.
+func ReimportGGUF(src, dir, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ggml, end, err := llm.DecodeGGML(f)
+	if err != nil {
+		return err
+	}
+
+	mf, err := GetModelFormat(dir)
+	if err != nil {
+		// only the config is needed so the weights may be missing
+		mf = &SafetensorFormat{}
+	}
+
+	params, err := mf.GetParams(dir)
+	if err != nil {
+		return err
+	}
+
+	kv := ggml.KV()
+	name, _ := kv["general.name"].(string)
+	arch, err := mf.GetModelArch(name, dir, params)
+	if err != nil {
+		return err
+	}
+
+	md := arch.(interface{ modelData() *ModelData }).modelData()
+	md.Tensors = reusedTensors(f, end, kv, ggml.Tensors())
+	md.Vocab = &Vocab{
+		Model:  stringValue(kv["tokenizer.ggml.model"]),
+		Tokens: arrayValue[string](kv["tokenizer.ggml.tokens"]),
+		Scores: arrayValue[float32](kv["tokenizer.ggml.scores"]),
+		Types:  arrayValue[int32](kv["tokenizer.ggml.token_type"]),
+		Merges: arrayValue[string](kv["tokenizer.ggml.merges"]),
+	}
+
+	params.PreTokenizer = stringValue(kv["tokenizer.ggml.pre"])
+	params.ChatTemplate = stringValue(kv["tokenizer.chat_template"])
+	if start, ok := kv["tokenizer.ggml.think_start_token_id"].(uint32); ok {
+		if end, ok := kv["tokenizer.ggml.think_end_token_id"].(uint32); ok {
+			params.ThinkTokenIDs = []uint32{start, end}
+		}
+	}
+
+	// the reused tensor data stays in the byte order of src
+	if bo, ok := ggml.ByteOrder().(ByteOrder); ok {
+		params.ByteOrder = bo
+	}
+
+	ft := kv.FileType()
+	if _, ok := kv["general.file_type"]; !ok {
+		ft = ggml.Tensors().FileType()
+	} else if err := llm.CheckFileType(kv, ggml.Tensors()); err != nil {
+		// a mislabeled file type is replaced by the one of its tensors
+		params.warn(err.Error())
+		ft = ggml.Tensors().FileType()
+	}
+
+	params.reusedFileType = new(uint32)
+	*params.reusedFileType = ft.Value()
+
+	return writeFile(arch, dst)
+}
+
+// FixGGUF rewrites the GGUF at in to out with patches applied to its
+// metadata, e.g. to replace a broken tokenizer.chat_template. A nil patch
+// removes the key. Tensor data is copied verbatim and aligned like in unless
+// general.alignment is patched. in and out may be the same file.
+func FixGGUF(in, out string, patches map[string]any) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ggml, end, err := llm.DecodeGGML(f)
+	if err != nil {
+		return err
+	}
+
+	kv := make(llm.KV)
+	for k, v := range ggml.KV() {
+		if k == "general.parameter_count" {
+			// added by DecodeGGML
+			continue
+		}
+
+		v, err := encodableValue(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+
+		kv[k] = v
+	}
+
+	for k, v := range patches {
+		if v == nil {
+			delete(kv, k)
+		} else {
+			kv[k] = v
+		}
+	}
+
+	tensors := reusedTensors(f, end, ggml.KV(), ggml.Tensors())
+	return writeFileFunc(out, func(ws io.WriteSeeker) error {
+		// tensor data is copied in the byte order of in
+		return llm.NewGGUFV3(ggml.ByteOrder()).Encode(ws, kv, tensors)
+	})
+}
+
+// encodableValue converts a decoded GGUF value to a type Encode writes.
+// Decoded arrays are untyped so their type is taken from their first element
+// and empty arrays are written as strings. Arrays of arrays are written as
+// they were decoded.
+func encodableValue(v any) (any, error) {
+	switch v := v.(type) {
+	case uint32, uint64, float32, bool, string:
+		return v, nil
+	case []any:
+		if len(v) == 0 {
+			return []string{}, nil
+		}
+
+		switch v[0].(type) {
+		case string:
+			return arrayValue[string](v), nil
+		case float32:
+			return arrayValue[float32](v), nil
+		case int32:
+			return arrayValue[int32](v), nil
+		case uint32:
+			return arrayValue[uint32](v), nil
+		case bool:
+			return arrayValue[bool](v), nil
+		case []any:
+			return v, nil
+		default:
+			return nil, fmt.Errorf("unsupported array of %T", v[0])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+// reusedTensors returns ts with writers copying their data from r. The data
+// section is found by counting back from end, the offset DecodeGGML stopped
+// at. Offsets are recomputed since the alignment of r may differ from the
+// one ts are written with.
+func reusedTensors(r io.ReaderAt, end int64, kv llm.KV, ts llm.Tensors) []llm.Tensor {
+	alignment := int64(32)
+	if a, ok := kv["general.alignment"].(uint32); ok {
+		alignment = int64(a)
+	}
+
+	start := end
+	for _, t := range ts {
+		size := int64(t.Size())
+		start -= size + (alignment-size%alignment)%alignment
+	}
+
+	tensors := make([]llm.Tensor, len(ts))
+	for i, t := range ts {
+		// decoded shapes are padded with ones and in the reverse order of
+		// the shapes given to Encode
+		var shape []uint64
+		for j := len(t.Shape) - 1; j >= 0; j-- {
+			if t.Shape[j] > 1 || len(shape) > 0 || j == 0 {
+				shape = append(shape, t.Shape[j])
+			}
+		}
+
+		tensors[i] = llm.Tensor{
+			Name:     t.Name,
+			Kind:     t.Kind,
+			Shape:    shape,
+			WriterTo: sectionWriterTo{r, start + int64(t.Offset), int64(t.Size())},
+		}
+	}
+
+	updateOffsets(tensors)
+	return tensors
+}
+
+// GGUFTensor returns the tensor called name of the GGUF in r with a writer
+// streaming its data from r, e.g. to assemble a GGUF from the tensors of
+// others without holding their data in memory. The data is copied verbatim
+// so it must be encoded in the byte order of r, and r must stay open until
+// the tensor has been written.
+func GGUFTensor(r readSeekerAt, name string) (llm.Tensor, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return llm.Tensor{}, err
+	}
+
+	ggml, end, err := llm.DecodeGGML(r)
+	if err != nil {
+		return llm.Tensor{}, err
+	}
+
+	for _, t := range reusedTensors(r, end, ggml.KV(), ggml.Tensors()) {
+		if t.Name == name {
+			t.Offset = 0
+			return t, nil
+		}
+	}
+
+	return llm.Tensor{}, fmt.Errorf("tensor %q not found", name)
+}
+
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// sectionWriterTo writes n bytes of r starting at off
+type sectionWriterTo struct {
+	r      io.ReaderAt
+	off, n int64
+}
+
+func (w sectionWriterTo) WriteTo(ww io.Writer) (int64, error) {
+	return io.Copy(ww, io.NewSectionReader(w.r, w.off, w.n))
+}
+
+func stringValue(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+// arrayValue converts a decoded GGUF array to a typed slice. Elements of
+// another type are left as the zero value.
+func arrayValue[T any](v any) []T {
+	a, ok := v.([]any)
+	if !ok {
+		return nil
+	}
+
+	s := make([]T, len(a))
+	for i := range a {
+		s[i], _ = a[i].(T)
+	}
+
+	return s
+}
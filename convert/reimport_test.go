@@ -0,0 +1,247 @@
+package convert
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// decodeFile decodes the GGUF at p and returns it with its tensor data, the
+// aligned section after the tensor infos
+func decodeFile(t *testing.T, p string) (*llm.GGML, []byte) {
+	t.Helper()
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ggml, end, err := llm.DecodeGGML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alignment := int64(32)
+	if a, ok := ggml.KV()["general.alignment"].(uint32); ok {
+		alignment = int64(a)
+	}
+
+	var n int64
+	for _, t := range ggml.Tensors() {
+		n += int64(t.Size())
+		n += (alignment - n%alignment) % alignment
+	}
+
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, end-n); err != nil {
+		t.Fatal(err)
+	}
+
+	return ggml, data
+}
+
+func TestReimportGGUF(t *testing.T) {
+	d := createTinyLlama(t)
+	src := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, src); err != nil {
+		t.Fatal(err)
+	}
+
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"LlamaForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+		"rope_theta":              500000.0,
+	})
+
+	// the weights aren't needed to reimport
+	if err := os.Remove(filepath.Join(d, "model.safetensors")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "model.gguf")
+	if err := ReimportGGUF(src, d, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	before, beforeData := decodeFile(t, src)
+	after, afterData := decodeFile(t, dst)
+
+	if got := after.KV()["llama.rope.freq_base"]; got != float32(500000) {
+		t.Fatalf("expected llama.rope.freq_base 500000, got %v", got)
+	}
+
+	for _, k := range []string{"general.file_type", "tokenizer.ggml.model", "tokenizer.ggml.pre", "tokenizer.ggml.tokens", "tokenizer.ggml.merges", "llama.embedding_length"} {
+		if !equalValue(before.KV()[k], after.KV()[k]) {
+			t.Fatalf("expected %s %v, got %v", k, before.KV()[k], after.KV()[k])
+		}
+	}
+
+	if len(before.Tensors()) != len(after.Tensors()) {
+		t.Fatalf("expected %d tensors, got %d", len(before.Tensors()), len(after.Tensors()))
+	}
+
+	for i, want := range before.Tensors() {
+		got := after.Tensors()[i]
+		if got.Name != want.Name || got.Kind != want.Kind || !slices.Equal(got.Shape, want.Shape) || got.Offset != want.Offset {
+			t.Fatalf("expected tensor %+v, got %+v", *want, *got)
+		}
+	}
+
+	if !bytes.Equal(beforeData, afterData) {
+		t.Fatal("expected tensor data to be unchanged")
+	}
+}
+
+func TestFixGGUF(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyLlama(t), src); err != nil {
+		t.Fatal(err)
+	}
+
+	before, beforeData := decodeFile(t, src)
+
+	t.Run("patch", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "model.gguf")
+		err := FixGGUF(src, dst, map[string]any{
+			"tokenizer.chat_template":      "{{ .Prompt }}",
+			"tokenizer.ggml.pre":           nil,
+			"tokenizer.ggml.add_bos_token": true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		after, afterData := decodeFile(t, dst)
+		kv := after.KV()
+		if kv["tokenizer.chat_template"] != "{{ .Prompt }}" || kv["tokenizer.ggml.add_bos_token"] != true {
+			t.Fatalf("expected patched kv, got %v", kv)
+		}
+
+		if _, ok := kv["tokenizer.ggml.pre"]; ok {
+			t.Fatal("expected tokenizer.ggml.pre to be removed")
+		}
+
+		for k, v := range before.KV() {
+			if k != "tokenizer.ggml.pre" && !equalValue(v, kv[k]) {
+				t.Fatalf("expected %s %v, got %v", k, v, kv[k])
+			}
+		}
+
+		if len(after.Tensors()) != len(before.Tensors()) || !bytes.Equal(beforeData, afterData) {
+			t.Fatal("expected tensors to be unchanged")
+		}
+	})
+
+	t.Run("alignment", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "model.gguf")
+		if err := FixGGUF(src, dst, map[string]any{"general.alignment": uint32(64)}); err != nil {
+			t.Fatal(err)
+		}
+
+		after, afterData := decodeFile(t, dst)
+		if got := after.KV()["general.alignment"]; got != uint32(64) {
+			t.Fatalf("expected general.alignment 64, got %v", got)
+		}
+
+		for i, tensor := range after.Tensors() {
+			want := before.Tensors()[i]
+			if tensor.Offset%64 != 0 || !bytes.Equal(afterData[tensor.Offset:tensor.Offset+tensor.Size()], beforeData[want.Offset:want.Offset+want.Size()]) {
+				t.Fatalf("%s: expected data copied to a 64 byte aligned offset, got offset %d", tensor.Name, tensor.Offset)
+			}
+		}
+
+		// the alignment is kept when fixing again
+		again := filepath.Join(t.TempDir(), "model.gguf")
+		if err := FixGGUF(dst, again, map[string]any{"tokenizer.chat_template": "{{ .Prompt }}"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, againData := decodeFile(t, again); !bytes.Equal(afterData, againData) {
+			t.Fatal("expected tensor data to be unchanged")
+		}
+	})
+
+	t.Run("in place", func(t *testing.T) {
+		if err := FixGGUF(src, src, map[string]any{"tokenizer.chat_template": "{{ .Prompt }}"}); err != nil {
+			t.Fatal(err)
+		}
+
+		after, afterData := decodeFile(t, src)
+		if after.KV()["tokenizer.chat_template"] != "{{ .Prompt }}" || !bytes.Equal(beforeData, afterData) {
+			t.Fatal("expected only the chat template to change")
+		}
+	})
+}
+
+func TestGGUFTensor(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyLlama(t), src); err != nil {
+		t.Fatal(err)
+	}
+
+	// the source is aligned differently than the GGUF the tensor is copied to
+	aligned := filepath.Join(t.TempDir(), "model.gguf")
+	if err := FixGGUF(src, aligned, map[string]any{"general.alignment": uint32(64)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, aligned)
+	want := ggml.Tensors()[len(ggml.Tensors())-1]
+
+	f, err := os.Open(aligned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tensor, err := GGUFTensor(f, want.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "model.gguf")
+	if err := writeFileFunc(dst, func(ws io.WriteSeeker) error {
+		return llm.NewGGUFV3(ggml.ByteOrder()).Encode(ws, llm.KV{"general.architecture": "llama"}, []llm.Tensor{tensor})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, afterData := decodeFile(t, dst)
+	got := after.Tensors()[0]
+	if got.Name != want.Name || got.Kind != want.Kind || !slices.Equal(got.Shape, want.Shape) {
+		t.Fatalf("expected tensor %+v, got %+v", *want, *got)
+	}
+
+	if !bytes.Equal(afterData[:got.Size()], data[want.Offset:want.Offset+want.Size()]) {
+		t.Fatal("expected the tensor data to be copied")
+	}
+
+	if _, err := GGUFTensor(f, "missing.weight"); err == nil {
+		t.Fatal("expected an error for a missing tensor")
+	}
+}
+
+func equalValue(a, b any) bool {
+	as, aok := a.([]any)
+	bs, bok := b.([]any)
+	if aok && bok {
+		return slices.Equal(as, bs)
+	}
+
+	return a == b
+}
@@ -0,0 +1,232 @@
+package convert
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// RopeScaling is the rope_scaling block of a Hugging Face config
+type RopeScaling struct {
+	Type     string `json:"type"`
+	RopeType string `json:"rope_type"`
+
+	Factor                        float64 `json:"factor"`
+	OriginalMaxPositionEmbeddings int     `json:"original_max_position_embeddings"`
+
+	// yarn and longrope
+	AttentionFactor float64 `json:"attention_factor"`
+
+	// llama3
+	LowFreqFactor  float64 `json:"low_freq_factor"`
+	HighFreqFactor float64 `json:"high_freq_factor"`
+
+	// longrope
+	ShortFactor []float32 `json:"short_factor"`
+	LongFactor  []float32 `json:"long_factor"`
+
+	// mrope splits the rotary dimensions of each head between the temporal,
+	// height and width positions of multimodal inputs
+	MropeSection []int32 `json:"mrope_section"`
+}
+
+// kind returns the scaling type. Newer configs use rope_type while older
+// configs use type. Configs with an mrope_section are mrope whatever their
+// type, since transformers rewrites the mrope type to default when saving.
+func (r *RopeScaling) kind() string {
+	if r == nil {
+		return ""
+	}
+
+	if len(r.MropeSection) > 0 {
+		return "mrope"
+	}
+
+	return cmp.Or(r.RopeType, r.Type)
+}
+
+// KV returns the rope scaling metadata for arch. GGUF only knows the none,
+// linear, yarn, longrope and mrope scaling types; llama3 scaling is stored as a
+// rope_freqs tensor instead. Dynamic NTK scaling has no GGUF equivalent and is
+// dropped, which leaves positions within the original context unchanged.
+func (r *RopeScaling) KV(arch string) llm.KV {
+	kv := llm.KV{}
+	switch r.kind() {
+	case "", "default":
+	case "linear":
+		kv[arch+".rope.scaling.type"] = "linear"
+		kv[arch+".rope.scaling.factor"] = float32(r.Factor)
+	case "yarn":
+		kv[arch+".rope.scaling.type"] = "yarn"
+		kv[arch+".rope.scaling.factor"] = float32(r.Factor)
+		kv[arch+".rope.scaling.original_context_length"] = uint32(r.OriginalMaxPositionEmbeddings)
+		if r.AttentionFactor > 0 {
+			kv[arch+".rope.scaling.attn_factor"] = float32(r.AttentionFactor)
+		}
+	case "longrope", "su":
+		kv[arch+".rope.scaling.type"] = "longrope"
+		kv[arch+".rope.scaling.original_context_length"] = uint32(r.OriginalMaxPositionEmbeddings)
+		if r.AttentionFactor > 0 {
+			kv[arch+".rope.scaling.attn_factor"] = float32(r.AttentionFactor)
+		}
+	case "mrope":
+		// runtimes read four sections, the last of which is unused by
+		// text and image positions
+		sections := make([]int32, max(4, len(r.MropeSection)))
+		copy(sections, r.MropeSection)
+		kv[arch+".rope.scaling.type"] = "mrope"
+		kv[arch+".rope.dimension_sections"] = sections
+	case "dynamic":
+		// see Params.validate
+	case "llama3":
+		kv[arch+".rope.scaling.type"] = "none"
+	default:
+		slog.Warn("unknown rope scaling type, ignoring", "type", r.kind())
+	}
+
+	return kv
+}
+
+// Tensors returns any tensors needed to represent the rope scaling, such as
+// the frequency factors of llama3 and longrope scaling. The first tensor is
+// placed at offset.
+func (r *RopeScaling) Tensors(params *Params, offset uint64) ([]llm.Tensor, error) {
+	var ts []llm.Tensor
+	switch r.kind() {
+	case "llama3":
+		factors, err := r.llama3Factors(params)
+		if err != nil {
+			return nil, err
+		}
+
+		ts = append(ts, llm.Tensor{Name: "rope_freqs.weight", WriterTo: f32sWriterTo{factors, params.ByteOrder}})
+	case "longrope", "su":
+		ts = append(ts,
+			llm.Tensor{Name: "rope_factors_long.weight", WriterTo: f32sWriterTo{r.LongFactor, params.ByteOrder}},
+			llm.Tensor{Name: "rope_factors_short.weight", WriterTo: f32sWriterTo{r.ShortFactor, params.ByteOrder}},
+		)
+	default:
+		if params.ropeFactors != nil {
+			ts = append(ts, llm.Tensor{Name: "rope_freqs.weight", WriterTo: f32sWriterTo{params.ropeFactors, params.ByteOrder}})
+		}
+	}
+
+	for i := range ts {
+		ts[i].Shape = []uint64{uint64(len(ts[i].WriterTo.(f32sWriterTo).data))}
+		ts[i].Offset = offset
+		offset += ts[i].Size()
+		offset += (32 - offset%32) % 32
+	}
+
+	return ts, nil
+}
+
+// setInvFreq keeps the frequencies of a rotary_emb.inv_freq buffer as factors
+// of the frequencies derived from rope_theta, like the rope_freqs of llama3.
+// Most buffers match the derived frequencies and are dropped.
+func (p *Params) setInvFreq(invFreq []float32) {
+	base := cmp.Or(p.RopeFrequencyBase, 10000)
+	dims := 2 * len(invFreq)
+
+	var custom bool
+	factors := make([]float32, len(invFreq))
+	for i, freq := range invFreq {
+		if freq <= 0 {
+			p.warn("ignoring invalid rotary_emb.inv_freq", "index", i, "value", freq)
+			return
+		}
+
+		factors[i] = float32(math.Pow(base, -float64(2*i)/float64(dims)) / float64(freq))
+		if math.Abs(float64(factors[i])-1) > 1e-4 {
+			custom = true
+		}
+	}
+
+	if custom {
+		slog.Info("model has custom rope frequencies")
+		p.ropeFactors = factors
+	}
+}
+
+// llama3Factors computes the per dimension frequency factors used by llama3
+// rope scaling
+func (r *RopeScaling) llama3Factors(params *Params) ([]float32, error) {
+	base := cmp.Or(params.RopeFrequencyBase, 10000)
+	dims := params.HeadDimension
+	if dims == 0 {
+		if params.AttentionHeads == 0 {
+			return nil, errors.New("llama3 rope scaling: config is missing head_dim and num_attention_heads")
+		}
+
+		dims = params.HiddenSize / params.AttentionHeads
+	}
+
+	factor := cmp.Or(r.Factor, 8)
+	lowFreqFactor := cmp.Or(r.LowFreqFactor, 1)
+	highFreqFactor := cmp.Or(r.HighFreqFactor, 4)
+	original := float64(cmp.Or(r.OriginalMaxPositionEmbeddings, 8192))
+
+	lowFreqWavelen := original / lowFreqFactor
+	highFreqWavelen := original / highFreqFactor
+
+	var factors []float32
+	for i := 0; i < dims; i += 2 {
+		freq := 1 / math.Pow(base, float64(i)/float64(dims))
+		switch wavelen := 2 * math.Pi / freq; {
+		case wavelen < highFreqWavelen:
+			factors = append(factors, 1)
+		case wavelen > lowFreqWavelen:
+			factors = append(factors, float32(factor))
+		default:
+			smooth := (original/wavelen - lowFreqFactor) / (highFreqFactor - lowFreqFactor)
+			factors = append(factors, float32(1/((1-smooth)/factor+smooth)))
+		}
+	}
+
+	return factors, nil
+}
+
+// f32sWriterTo writes float32 values computed during conversion
+type f32sWriterTo struct {
+	data []float32
+	bo   ByteOrder
+}
+
+func (w f32sWriterTo) WriteTo(ww io.Writer) (int64, error) {
+	return 0, binary.Write(ww, w.bo, w.data)
+}
+
+// sameData reports whether o holds the same values as w
+func (w f32sWriterTo) sameData(o io.WriterTo) (bool, error) {
+	v, ok := o.(f32sWriterTo)
+	return ok && equalFloats(w.data, v.data), nil
+}
+
+// RopeStyle is how a checkpoint pairs the rotary dimensions of each query and
+// key head. ggml's llama pairs adjacent dimensions like GPT-J so checkpoints
+// pairing each dimension with the one half a head away like GPT-NeoX, which
+// includes Hugging Face's llama, have their heads permuted when converted.
+type RopeStyle string
+
+const (
+	RopeStyleNeoX RopeStyle = "neox"
+	RopeStyleGPTJ RopeStyle = "gptj"
+)
+
+// ropeStyle returns the RopeStyle option or detects the style from the
+// format. Only Mistral's own checkpoints are known to be paired like GPT-J.
+func (p *Params) ropeStyle() RopeStyle {
+	switch {
+	case p.RopeStyle != "":
+		return p.RopeStyle
+	case p.consolidated:
+		return RopeStyleGPTJ
+	default:
+		return RopeStyleNeoX
+	}
+}
@@ -0,0 +1,118 @@
+package convert
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func TestRopeScalingKV(t *testing.T) {
+	cases := []struct {
+		scaling *RopeScaling
+		kind    any
+	}{
+		{nil, nil},
+		{&RopeScaling{Type: "linear", Factor: 4}, "linear"},
+		{&RopeScaling{RopeType: "dynamic", Factor: 2}, nil},
+		{&RopeScaling{RopeType: "yarn", Factor: 4, OriginalMaxPositionEmbeddings: 32768}, "yarn"},
+		{&RopeScaling{RopeType: "llama3", Factor: 8}, "none"},
+		{&RopeScaling{Type: "longrope", OriginalMaxPositionEmbeddings: 4096}, "longrope"},
+		{&RopeScaling{Type: "su", OriginalMaxPositionEmbeddings: 4096}, "longrope"},
+		{&RopeScaling{Type: "default", MropeSection: []int32{16, 24, 24}}, "mrope"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.scaling.kind(), func(t *testing.T) {
+			kv := tt.scaling.KV("llama")
+			if kind := kv["llama.rope.scaling.type"]; kind != tt.kind {
+				t.Fatalf("expected %v, got %v", tt.kind, kind)
+			}
+		})
+	}
+}
+
+func TestRopeScalingTensors(t *testing.T) {
+	params := &Params{HiddenSize: 4096, AttentionHeads: 32, RopeFrequencyBase: 500000}
+
+	r := &RopeScaling{RopeType: "llama3", Factor: 8, LowFreqFactor: 1, HighFreqFactor: 4, OriginalMaxPositionEmbeddings: 8192}
+	ts, err := r.Tensors(params, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts) != 1 || ts[0].Name != "rope_freqs.weight" {
+		t.Fatalf("expected rope_freqs.weight, got %v", ts)
+	}
+
+	if ts[0].Offset != 64 {
+		t.Fatalf("expected offset 64, got %d", ts[0].Offset)
+	}
+
+	factors := ts[0].WriterTo.(f32sWriterTo).data
+	if len(factors) != 64 {
+		t.Fatalf("expected 64 factors, got %d", len(factors))
+	}
+
+	// high frequencies are unscaled while low frequencies are scaled by factor
+	if factors[0] != 1 || factors[63] != 8 {
+		t.Fatalf("unexpected factors: %v", factors)
+	}
+
+	// the head dimension is preferred over the hidden size per head
+	ts, err = r.Tensors(&Params{HeadDimension: 64, HiddenSize: 4096, AttentionHeads: 32}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if factors := ts[0].WriterTo.(f32sWriterTo).data; len(factors) != 32 {
+		t.Fatalf("expected 32 factors, got %d", len(factors))
+	}
+
+	if _, err := r.Tensors(&Params{HiddenSize: 4096}, 0); err == nil {
+		t.Fatal("expected an error without head_dim or num_attention_heads")
+	}
+}
+
+func TestConvertInvFreq(t *testing.T) {
+	// the tiny llama has 2 heads of 4 dimensions so rope_theta 10000 gives
+	// frequencies of 1 and 0.01
+	cases := []struct {
+		name    string
+		invFreq []float32
+		factors []float32
+	}{
+		{"default", []float32{1, 0.01}, nil},
+		{"custom", []float32{0.5, 0.01}, []float32{2, 1}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := createTinyLlama(t)
+			writeSafetensors(t, filepath.Join(d, "rope.safetensors"),
+				map[string][]uint64{"model.layers.0.self_attn.rotary_emb.inv_freq": {2}},
+				map[string][]float32{"model.layers.0.self_attn.rotary_emb.inv_freq": tt.invFreq},
+			)
+
+			var params *Params
+			_, tensors := convertDir(t, d, func(p *Params) { params = p })
+
+			hasFreqs := slices.ContainsFunc(tensors, func(t *llm.Tensor) bool { return t.Name == "rope_freqs.weight" })
+			if hasFreqs != (tt.factors != nil) {
+				t.Fatalf("expected rope_freqs %t, got %t", tt.factors != nil, hasFreqs)
+			}
+
+			if len(params.ropeFactors) != len(tt.factors) {
+				t.Fatalf("expected factors %v, got %v", tt.factors, params.ropeFactors)
+			}
+
+			for i := range tt.factors {
+				if math.Abs(float64(params.ropeFactors[i]-tt.factors[i])) > 1e-5 {
+					t.Fatalf("expected factors %v, got %v", tt.factors, params.ropeFactors)
+				}
+			}
+		})
+	}
+}
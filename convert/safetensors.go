@@ -1,13 +1,19 @@
 package convert
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"math"
 	"os"
-	"path/filepath"
+	"path"
 	"regexp"
 	"slices"
 	"strings"
@@ -24,6 +30,7 @@ type safetensorWriterTo struct {
 	params *Params
 	bo     ByteOrder
 
+	fsys     fs.FS
 	filename string
 	dtype    string
 
@@ -37,31 +44,120 @@ type safetensorMetadata struct {
 	Offsets []int64  `json:"data_offsets"`
 }
 
-type SafetensorFormat struct{}
+// dataOffset returns the offset of the tensor's data in the data of its file
+func (m safetensorMetadata) dataOffset() int64 {
+	if len(m.Offsets) == 0 {
+		return 0
+	}
+
+	return m.Offsets[0]
+}
 
+// safetensorsDTypeSize is the size of an element of each dtype tensors are
+// converted from
+var safetensorsDTypeSize = map[string]int64{"F32": 4, "F16": 2, "BF16": 2}
+
+// SafetensorFormat reads Hugging Face checkpoints, from safetensors files or,
+// when reader is set, the weight format of a registered TensorReader
+type SafetensorFormat struct {
+	reader TensorReader
+}
+
+// GetTensors reads the tensors of the model in the directory dirpath
 func (m *SafetensorFormat) GetTensors(dirpath string, params *Params) ([]llm.Tensor, error) {
+	return m.GetTensorsFS(os.DirFS(dirpath), params)
+}
+
+func (m *SafetensorFormat) GetTensorsFS(fsys fs.FS, params *Params) ([]llm.Tensor, error) {
+	if m.reader != nil {
+		return m.readerTensors(fsys, params)
+	}
+
 	var tensors []llm.Tensor
-	matches, err := filepath.Glob(filepath.Join(dirpath, "*.safetensors"))
+	matches, err := fs.Glob(fsys, "*.safetensors")
 	if err != nil {
 		return nil, err
 	}
 
+	// Mistral releases may hold the same weights in both formats so only the
+	// files of the format the params were read from are converted
+	matches = slices.DeleteFunc(matches, func(match string) bool {
+		return strings.HasPrefix(match, "consolidated") != params.consolidated
+	})
+
+	// diffusers may store a variant such as model.fp16.safetensors next to
+	// the full precision weights
+	if slices.Contains(matches, "model.safetensors") {
+		matches = slices.DeleteFunc(matches, func(match string) bool {
+			return match != "model.safetensors" && strings.HasPrefix(match, "model.") && strings.Count(match, ".") == 2
+		})
+	}
+
+	// sharded checkpoints name the shard of every tensor in an index. Only
+	// those shards are read so stray files such as an interrupted download of
+	// another revision aren't converted and a missing shard is an error rather
+	// than a model missing some of its tensors.
+	if !params.consolidated {
+		shards, err := readSafetensorsIndex(fsys)
+		if err != nil {
+			return nil, err
+		} else if shards != nil {
+			matches = shards
+		}
+	}
+
 	var offset uint64
+	stripped := make(map[string]string)
 	for _, f := range matches {
 		var t []llm.Tensor
 		var err error
-		t, offset, err = m.readTensors(f, offset, params)
+		t, offset, err = m.readTensors(fsys, f, offset, params, stripped)
 		if err != nil {
 			return nil, err
 		}
 
 		tensors = append(tensors, t...)
 	}
+
+	params.sortTensors(tensors)
 	return tensors, nil
 }
 
-func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params) ([]llm.Tensor, uint64, error) {
-	f, err := os.Open(fn)
+// readSafetensorsIndex returns the sorted names of the shards the weight map
+// of model.safetensors.index.json in fsys names, or nil if there is no index.
+// The tensors of a shard are only read when they are written so a shard is
+// never held in memory as a whole.
+func readSafetensorsIndex(fsys fs.FS) ([]string, error) {
+	const p = "model.safetensors.index.json"
+	b, err := fs.ReadFile(fsys, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var index struct {
+		WeightMap map[string]string `json:"weight_map"`
+	}
+
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	var shards []string
+	for _, shard := range index.WeightMap {
+		shard = path.Clean(shard)
+		if !slices.Contains(shards, shard) {
+			shards = append(shards, shard)
+		}
+	}
+
+	slices.Sort(shards)
+	return shards, nil
+}
+
+func (m *SafetensorFormat) readTensors(fsys fs.FS, fn string, offset uint64, params *Params, stripped map[string]string) ([]llm.Tensor, uint64, error) {
+	f, err := fsys.Open(fn)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -83,13 +179,56 @@ func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params)
 	}
 
 	var keys []string
+	names := make(map[string]string)
 	for key := range headers {
-		if !strings.HasSuffix(key, "self_attn.rotary_embd.inv_freq") {
-			keys = append(keys, key)
+		name, err := params.stripPrefix(key, stripped)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if strings.HasSuffix(key, "self_attn.rotary_embd.inv_freq") || strings.HasSuffix(key, "self_attn.rotary_emb.inv_freq") {
+			if err := m.readInvFreq(fsys, fn, 8+n, headers[key], params); err != nil {
+				return nil, 0, err
+			}
+
+			params.skipTensor(key)
+			continue
+		}
+
+		// position_ids is an integer buffer of the positions 0 to
+		// max_position_embeddings
+		if strings.HasSuffix(key, "embeddings.position_ids") {
+			params.skipTensor(key)
+			continue
+		}
+
+		// older GPT-2 checkpoints save the causal mask of each layer's
+		// attention as attn.bias and attn.masked_bias
+		if strings.HasSuffix(key, ".attn.bias") || strings.HasSuffix(key, ".attn.masked_bias") {
+			params.skipTensor(key)
+			continue
+		}
+
+		// vision models only convert the vision tower and text models only
+		// convert the text model
+		if isVisionTensor(name) != params.isVision() {
+			slog.Debug("skipping tensor", "name", key)
+			params.skipTensor(key)
+			continue
 		}
+
+		keys = append(keys, key)
+		names[key] = name
 	}
 
 	slices.Sort(keys)
+	if params.SourceOrder {
+		// the header is an object so only the data keeps the order the
+		// checkpoint was written in
+		slices.SortStableFunc(keys, func(a, b string) int {
+			return cmp.Compare(headers[a].dataOffset(), headers[b].dataOffset())
+		})
+	}
 
 	var tensors []llm.Tensor
 	for _, key := range keys {
@@ -99,19 +238,46 @@ func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params)
 		switch len(value.Shape) {
 		case 0:
 			// valuedata
+			params.skipTensor(key)
 			continue
 		case 2:
-			kind = 1
+			if !params.F32 {
+				kind = 1
+			}
 		}
 
-		name, err := m.GetLayerName(key)
-		if err != nil {
+		// every tensor declares its own dtype, e.g. F32 norms next to F16
+		// weights, so each is checked against the size of its data
+		size, ok := safetensorsDTypeSize[value.Type]
+		if !ok {
+			return nil, 0, fmt.Errorf("%s: unsupported dtype %s", key, value.Type)
+		}
+
+		elems := int64(1)
+		for _, dim := range value.Shape {
+			elems *= int64(dim)
+		}
+
+		if len(value.Offsets) != 2 || value.Offsets[1]-value.Offsets[0] != elems*size {
+			return nil, 0, fmt.Errorf("%s: data offsets %v don't hold %d %s values", key, value.Offsets, elems, value.Type)
+		}
+
+		name, err := m.GetLayerName(names[key])
+		if err != nil && params.dryRun {
+			params.skipTensor(key)
+			continue
+		} else if err != nil {
 			return nil, 0, err
 		}
 
 		shape := make([]uint64, len(value.Shape))
 		copy(shape, value.Shape)
 
+		kind, err = params.tensorKind(name, shape, kind)
+		if err != nil {
+			return nil, 0, err
+		}
+
 		pad := func(s int64) int64 {
 			return 8 + n + s
 		}
@@ -127,6 +293,7 @@ func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params)
 			t:        &t,
 			params:   params,
 			bo:       params.ByteOrder,
+			fsys:     fsys,
 			filename: fn,
 			dtype:    value.Type,
 			offset:   pad(value.Offsets[0]),
@@ -140,28 +307,220 @@ func (m *SafetensorFormat) readTensors(fn string, offset uint64, params *Params)
 	return tensors, offset, nil
 }
 
+// readInvFreq reads a rotary_emb.inv_freq buffer stored at offset in fn into
+// params. Every layer has the same buffer so only the first is read.
+func (m *SafetensorFormat) readInvFreq(fsys fs.FS, fn string, offset int64, value safetensorMetadata, params *Params) error {
+	if params.ropeFactors != nil {
+		return nil
+	}
+
+	t := llm.Tensor{Shape: value.Shape}
+	wt := safetensorWriterTo{
+		t:        &t,
+		params:   params,
+		bo:       params.ByteOrder,
+		fsys:     fsys,
+		filename: fn,
+		dtype:    value.Type,
+		offset:   offset + value.Offsets[0],
+		size:     value.Offsets[1] - value.Offsets[0],
+	}
+
+	var b bytes.Buffer
+	if _, err := wt.WriteTo(&b); err != nil {
+		return err
+	}
+
+	invFreq := make([]float32, b.Len()/4)
+	if err := binary.Read(&b, params.ByteOrder, invFreq); err != nil {
+		return err
+	}
+
+	params.setInvFreq(invFreq)
+	return nil
+}
+
+// GetParams reads the config of the model in the directory dirpath
 func (m *SafetensorFormat) GetParams(dirpath string) (*Params, error) {
-	f, err := os.Open(filepath.Join(dirpath, "config.json"))
-	if err != nil {
+	return m.GetParamsFS(os.DirFS(dirpath))
+}
+
+func (m *SafetensorFormat) GetParamsFS(fsys fs.FS) (*Params, error) {
+	f, err := fsys.Open("config.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		// try Mistral's params.json instead
+		return getMistralParams(fsys)
+	} else if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	var params Params
+	params := Params{BoSTokenID: -1, EoSTokenID: -1}
 
 	if err := json.NewDecoder(f).Decode(&params); err != nil {
 		return nil, err
 	}
 
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	params.setHeadCounts()
+	params.setSpecialTokenDefaults(fsys)
+
 	params.ByteOrder = binary.LittleEndian
 	return &params, nil
 }
 
+// tensorPrefixes are the wrappers multimodal and standalone vision checkpoints
+// put around their tensors and the prefix each is normalized to
+var tensorPrefixes = [][2]string{
+	{"model.language_model.", "model."},
+	{"language_model.model.", "model."},
+	{"language_model.lm_head.", "lm_head."},
+	{"model.text_model.", "model."},
+	{"vision_model.", "model.vision_model."},
+	{"vision_tower.vision_model.", "model.vision_model."},
+	{"model.vision_tower.vision_model.", "model.vision_model."},
+	{"multi_modal_projector.", "model.multi_modal_projector."},
+}
+
+// visionPrefixes are the tensors of multimodal checkpoints which aren't part
+// of the text model
+var visionPrefixes = []string{
+	"vision_tower.",
+	"vision_model.",
+	"visual_projection.",
+	"multi_modal_projector.",
+	"model.vision_tower.",
+	"model.vision_model.",
+	"model.multi_modal_projector.",
+	"model.connector.",
+	"mlp1.",
+	"visual.",
+	"model.visual.",
+}
+
+// isVisionTensor reports whether name is part of a vision tower or connector
+func isVisionTensor(name string) bool {
+	return slices.ContainsFunc(visionPrefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) })
+}
+
+// visionMap renames the tensors of SigLIP and CLIP vision towers and the
+// connectors projecting them into the text model of a vision language model
+var visionMap = map[string]string{
+	`^model\.vision_model\.embeddings\.patch_embedding\.(weight|bias)$`:                     "v.patch_embd.$1",
+	`^model\.vision_model\.embeddings\.position_embedding\.weight$`:                         "v.position_embd.weight",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.self_attn\.(q|k|v)_proj\.(weight|bias)$`: "v.blk.$1.attn_$2.$3",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.self_attn\.out_proj\.(weight|bias)$`:     "v.blk.$1.attn_out.$2",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.layer_norm(1|2)\.(weight|bias)$`:         "v.blk.$1.ln$2.$3",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.mlp\.fc1\.(weight|bias)$`:                "v.blk.$1.ffn_up.$2",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.mlp\.fc2\.(weight|bias)$`:                "v.blk.$1.ffn_down.$2",
+	`^model\.vision_model\.post_layernorm\.(weight|bias)$`:                                  "v.post_ln.$1",
+
+	// clip
+	`^model\.vision_model\.embeddings\.class_embedding$`: "v.class_embd",
+	`^model\.vision_model\.pre_layrnorm\.(weight|bias)$`: "v.pre_ln.$1",
+	`^visual_projection\.weight$`:                        "v.proj.weight",
+
+	// siglip attention pooling head
+	`^model\.vision_model\.head\.probe$`:                              "v.head.probe",
+	`^model\.vision_model\.head\.attention\.in_proj_(weight|bias)$`:   "v.head.attn_qkv.$1",
+	`^model\.vision_model\.head\.attention\.out_proj\.(weight|bias)$`: "v.head.attn_out.$1",
+	`^model\.vision_model\.head\.layernorm\.(weight|bias)$`:           "v.head.ln.$1",
+	`^model\.vision_model\.head\.mlp\.fc1\.(weight|bias)$`:            "v.head.ffn_up.$1",
+	`^model\.vision_model\.head\.mlp\.fc2\.(weight|bias)$`:            "v.head.ffn_down.$1",
+
+	// internvit
+	`^model\.vision_model\.embeddings\.position_embedding$`:                    "v.position_embd.weight",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.attn\.qkv\.(weight|bias)$`:  "v.blk.$1.attn_qkv.$2",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.attn\.(q|k)_norm\.weight$`:  "v.blk.$1.attn_${2}_norm.weight",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.attn\.proj\.(weight|bias)$`: "v.blk.$1.attn_out.$2",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.norm(1|2)\.(weight|bias)$`:  "v.blk.$1.ln$2.$3",
+	`^model\.vision_model\.encoder\.layers\.(\d+)\.ls(1|2)$`:                   "v.blk.$1.ls$2.weight",
+
+	// internvl pixel shuffle projection
+	`^mlp1\.0\.(weight|bias)$`:     "mm.input_norm.$1",
+	`^mlp1\.(1|3)\.(weight|bias)$`: "mm.model.mlp.$1.$2",
+
+	// aya vision pixel shuffle projection
+	`^model\.multi_modal_projector\.layernorm\.(weight|bias)$`: "mm.input_norm.$1",
+	`^model\.multi_modal_projector\.linear_1\.(weight|bias)$`:  "mm.ffn_gate_up.$1",
+	`^model\.multi_modal_projector\.linear_2\.(weight|bias)$`:  "mm.ffn_down.$1",
+
+	// idefics3 pixel shuffle projection
+	`^model\.connector\.modality_projection\.proj\.weight$`: "mm.model.fc.weight",
+
+	// idefics2 perceiver resampler
+	`^model\.connector\.modality_projection\.(gate|up|down)_proj\.weight$`:                     "mm.ffn_$1.weight",
+	`^model\.connector\.perceiver_resampler\.latents$`:                                         "mm.perceiver.latents",
+	`^model\.connector\.perceiver_resampler\.norm\.weight$`:                                    "mm.perceiver.norm.weight",
+	`^model\.connector\.perceiver_resampler\.layers\.(\d+)\.input_latents_norm\.weight$`:       "mm.perceiver.blk.$1.latents_norm.weight",
+	`^model\.connector\.perceiver_resampler\.layers\.(\d+)\.input_context_norm\.weight$`:       "mm.perceiver.blk.$1.context_norm.weight",
+	`^model\.connector\.perceiver_resampler\.layers\.(\d+)\.self_attn\.(q|k|v)_proj\.weight$`:  "mm.perceiver.blk.$1.attn_$2.weight",
+	`^model\.connector\.perceiver_resampler\.layers\.(\d+)\.self_attn\.o_proj\.weight$`:        "mm.perceiver.blk.$1.attn_output.weight",
+	`^model\.connector\.perceiver_resampler\.layers\.(\d+)\.post_attention_layernorm\.weight$`: "mm.perceiver.blk.$1.ffn_norm.weight",
+	`^model\.connector\.perceiver_resampler\.layers\.(\d+)\.mlp\.(gate|up|down)_proj\.weight$`: "mm.perceiver.blk.$1.ffn_$2.weight",
+}
+
+// clipTextMap renames the tensors of CLIP text encoders such as those of
+// Stable Diffusion pipelines
+var clipTextMap = map[string]string{
+	`^text_model\.embeddings\.token_embedding\.weight$`:                            "t.token_embd.weight",
+	`^text_model\.embeddings\.position_embedding\.weight$`:                         "t.position_embd.weight",
+	`^text_model\.encoder\.layers\.(\d+)\.self_attn\.(q|k|v)_proj\.(weight|bias)$`: "t.blk.$1.attn_$2.$3",
+	`^text_model\.encoder\.layers\.(\d+)\.self_attn\.out_proj\.(weight|bias)$`:     "t.blk.$1.attn_out.$2",
+	`^text_model\.encoder\.layers\.(\d+)\.layer_norm(1|2)\.(weight|bias)$`:         "t.blk.$1.ln$2.$3",
+	`^text_model\.encoder\.layers\.(\d+)\.mlp\.fc1\.(weight|bias)$`:                "t.blk.$1.ffn_up.$2",
+	`^text_model\.encoder\.layers\.(\d+)\.mlp\.fc2\.(weight|bias)$`:                "t.blk.$1.ffn_down.$2",
+	`^text_model\.final_layer_norm\.(weight|bias)$`:                                "t.post_ln.$1",
+	`^text_projection\.weight$`:                                                    "t.text_projection.weight",
+}
+
 func (m *SafetensorFormat) GetLayerName(n string) (string, error) {
+	// checkpoints nesting everything else under a prefix may still keep the
+	// output projection at the top level
+	if n == "lm_head.weight" {
+		return "output.weight", nil
+	}
+
+	for _, prefix := range tensorPrefixes {
+		if rest, ok := strings.CutPrefix(n, prefix[0]); ok {
+			n = prefix[1] + rest
+			break
+		}
+	}
+
 	directMap := map[string]string{
 		"model.embed_tokens.weight": "token_embd.weight",
 		"lm_head.weight":            "output.weight",
 		"model.norm.weight":         "output_norm.weight",
+		"model.norm.bias":           "output_norm.bias",
+
+		"model.final_layernorm.weight": "output_norm.weight",
+		"model.memory_tokens":          "token_meta.weight",
+
+		"tok_embeddings.weight": "token_embd.weight",
+		"output.weight":         "output.weight",
+		"norm.weight":           "output_norm.weight",
+
+		"model.shared.weight":                  "token_embd.weight",
+		"model.encoder.embed_tokens.weight":    "token_embd.weight",
+		"model.decoder.embed_tokens.weight":    "token_embd.weight",
+		"model.encoder.embed_positions.weight": "enc.position_embd.weight",
+		"model.decoder.embed_positions.weight": "dec.position_embd.weight",
+		"model.encoder.layer_norm.weight":      "enc.output_norm.weight",
+		"model.encoder.layer_norm.bias":        "enc.output_norm.bias",
+		"model.decoder.layer_norm.weight":      "dec.output_norm.weight",
+		"model.decoder.layer_norm.bias":        "dec.output_norm.bias",
+		"final_logits_bias":                    "output.bias",
+
+		"transformer.word_embeddings.weight": "token_embd.weight",
+		"transformer.ln_f.weight":            "output_norm.weight",
+		"transformer.ln_f.bias":              "output_norm.bias",
+		"transformer.wte.weight":             "token_embd.weight",
+		"transformer.wpe.weight":             "position_embd.weight",
+		"transformer.norm_f.weight":          "output_norm.weight",
 	}
 
 	tMap := map[string]string{
@@ -178,6 +537,121 @@ func (m *SafetensorFormat) GetLayerName(n string) (string, error) {
 		"model.layers.(\\d+).block_sparse_moe.experts.(\\d+).w1.weight": "blk.$1.ffn_gate.$2.weight",
 		"model.layers.(\\d+).block_sparse_moe.experts.(\\d+).w2.weight": "blk.$1.ffn_down.$2.weight",
 		"model.layers.(\\d+).block_sparse_moe.experts.(\\d+).w3.weight": "blk.$1.ffn_up.$2.weight",
+		"model.layers.(\\d+).self_attn.q_proj.bias":                     "blk.$1.attn_q.bias",
+		"model.layers.(\\d+).self_attn.k_proj.bias":                     "blk.$1.attn_k.bias",
+		"model.layers.(\\d+).self_attn.v_proj.bias":                     "blk.$1.attn_v.bias",
+		"model.layers.(\\d+).self_attn.o_proj.bias":                     "blk.$1.attn_output.bias",
+		"model.layers.(\\d+).mlp.(gate|up|down)_proj.bias":              "blk.$1.ffn_$2.bias",
+		"model.layers.(\\d+).self_attn.sinks$":                          "blk.$1.attn_sinks.weight",
+		"model.layers.(\\d+).mlp.router.(weight|bias)":                  "blk.$1.ffn_gate_inp.$2",
+		"model.layers.(\\d+).mlp.experts.gate_up_proj$":                 "blk.$1.ffn_gate_up_exps.weight",
+		"model.layers.(\\d+).mlp.experts.gate_up_proj_bias$":            "blk.$1.ffn_gate_up_exps.bias",
+		"model.layers.(\\d+).mlp.experts.down_proj$":                    "blk.$1.ffn_down_exps.weight",
+		"model.layers.(\\d+).mlp.experts.down_proj_bias$":               "blk.$1.ffn_down_exps.bias",
+		"model.layers.(\\d+).self_attn.qkv_proj.weight":                 "blk.$1.attn_qkv.weight",
+		"model.layers.(\\d+).mlp.gate_up_proj.weight":                   "blk.$1.ffn_gate_up.weight",
+
+		"^model\\.layers\\.(\\d+)\\.self_attn\\.(q|k)_norm\\.weight$":       "blk.$1.attn_${2}_norm.weight",
+		"model.layers.(\\d+).input_layernorm.bias":                          "blk.$1.attn_norm.bias",
+		"model.layers.(\\d+).post_attention_layernorm.bias":                 "blk.$1.ffn_norm.bias",
+		"model.layers.(\\d+).self_attn.(q|k)_layernorm.norms.(\\d+).weight": "blk.$1.attn_${2}_norm.$3.weight",
+
+		"model.layers.(\\d+).pre_moe_layernorm.weight":                 "blk.$1.ffn_norm.weight",
+		"model.layers.(\\d+).moe.experts.0.(gate|up|down)_proj.weight": "blk.$1.ffn_$2.weight",
+		"model.layers.(\\d+).mamba.in_proj.weight":                     "blk.$1.hymba_in_proj.weight",
+		"model.layers.(\\d+).mamba.out_proj.weight":                    "blk.$1.ssm_out.weight",
+		"model.layers.(\\d+).mamba.conv1d.(weight|bias)":               "blk.$1.ssm_conv1d.$2",
+		"model.layers.(\\d+).mamba.x_proj.0.weight":                    "blk.$1.ssm_x.weight",
+		"model.layers.(\\d+).mamba.dt_proj.0.(weight|bias)":            "blk.$1.ssm_dt.$2",
+		"model.layers.(\\d+).mamba.A_log.0$":                           "blk.$1.ssm_a",
+		"model.layers.(\\d+).mamba.D.0$":                               "blk.$1.ssm_d",
+		"model.layers.(\\d+).mamba.dt_layernorm.weight":                "blk.$1.ssm_dt_norm.weight",
+		"model.layers.(\\d+).mamba.B_layernorm.weight":                 "blk.$1.ssm_b_norm.weight",
+		"model.layers.(\\d+).mamba.C_layernorm.weight":                 "blk.$1.ssm_c_norm.weight",
+		"model.layers.(\\d+).mamba.pre_avg_layernorm1.weight":          "blk.$1.attn_avg_norm.weight",
+		"model.layers.(\\d+).mamba.pre_avg_layernorm2.weight":          "blk.$1.ssm_avg_norm.weight",
+
+		"^layers.(\\d+).attention_norm.weight$":     "blk.$1.attn_norm.weight",
+		"^layers.(\\d+).attention.w(q|k|v).weight$": "blk.$1.attn_$2.weight",
+		"^layers.(\\d+).attention.wo.weight$":       "blk.$1.attn_output.weight",
+		"^layers.(\\d+).ffn_norm.weight$":           "blk.$1.ffn_norm.weight",
+		"^layers.(\\d+).feed_forward.w1.weight$":    "blk.$1.ffn_gate.weight",
+		"^layers.(\\d+).feed_forward.w2.weight$":    "blk.$1.ffn_down.weight",
+		"^layers.(\\d+).feed_forward.w3.weight$":    "blk.$1.ffn_up.weight",
+
+		"^transformer.h.(\\d+).self_attention.query_key_value.(weight|bias)$": "blk.$1.attn_qkv.$2",
+		"^transformer.h.(\\d+).self_attention.dense.(weight|bias)$":           "blk.$1.attn_output.$2",
+		"^transformer.h.(\\d+).mlp.dense_h_to_4h.(weight|bias)$":              "blk.$1.ffn_up.$2",
+		"^transformer.h.(\\d+).mlp.dense_4h_to_h.(weight|bias)$":              "blk.$1.ffn_down.$2",
+		"^transformer.h.(\\d+).(input_layernorm|ln_attn).(weight|bias)$":      "blk.$1.attn_norm.$3",
+		"^transformer.h.(\\d+).ln_mlp.(weight|bias)$":                         "blk.$1.attn_norm_2.$2",
+		"^transformer.h.(\\d+).post_attention_layernorm.(weight|bias)$":       "blk.$1.ffn_norm.$2",
+
+		"^(?:model\\.)?embeddings\\.tok_embeddings\\.weight$":          "token_embd.weight",
+		"^(?:model\\.)?embeddings\\.norm\\.(weight|bias)$":             "token_embd_norm.$1",
+		"^(?:model\\.)?layers\\.(\\d+)\\.attn_norm\\.(weight|bias)$":   "blk.$1.attn_norm.$2",
+		"^(?:model\\.)?layers\\.(\\d+)\\.attn\\.Wqkv\\.(weight|bias)$": "blk.$1.attn_qkv.$2",
+		"^(?:model\\.)?layers\\.(\\d+)\\.attn\\.Wo\\.(weight|bias)$":   "blk.$1.attn_output.$2",
+		"^(?:model\\.)?layers\\.(\\d+)\\.mlp_norm\\.(weight|bias)$":    "blk.$1.ffn_norm.$2",
+		"^(?:model\\.)?layers\\.(\\d+)\\.mlp\\.Wi\\.(weight|bias)$":    "blk.$1.ffn_gate_up.$2",
+		"^(?:model\\.)?layers\\.(\\d+)\\.mlp\\.Wo\\.(weight|bias)$":    "blk.$1.ffn_down.$2",
+		"^(?:model\\.)?final_norm\\.(weight|bias)$":                    "output_norm.$1",
+		"^head\\.(dense|norm)\\.(weight|bias)$":                        "mlm.$1.$2",
+		"^decoder\\.(weight|bias)$":                                    "mlm.output.$1",
+
+		"^transformer.h.(\\d+).ln_1.(weight|bias)$":        "blk.$1.attn_norm.$2",
+		"^transformer.h.(\\d+).ln_2.(weight|bias)$":        "blk.$1.ffn_norm.$2",
+		"^transformer.h.(\\d+).attn.c_attn.(weight|bias)$": "blk.$1.attn_qkv.$2",
+		"^transformer.h.(\\d+).attn.c_proj.(weight|bias)$": "blk.$1.attn_output.$2",
+		"^transformer.h.(\\d+).mlp.c_fc.(weight|bias)$":    "blk.$1.ffn_up.$2",
+		"^transformer.h.(\\d+).mlp.c_proj.(weight|bias)$":  "blk.$1.ffn_down.$2",
+
+		"^model\\.layers\\.(\\d+)\\.temporal_pre_norm\\.weight$":                             "blk.$1.attn_norm.weight",
+		"^model\\.layers\\.(\\d+)\\.channel_pre_norm\\.weight$":                              "blk.$1.ffn_norm.weight",
+		"^model\\.layers\\.(\\d+)\\.mlp_block\\.(gate|up|down)_proj\\.(weight|bias)$":        "blk.$1.ffn_$2.$3",
+		"^model\\.layers\\.(\\d+)\\.temporal_block\\.(q|k|v)_proj\\.weight$":                 "blk.$1.attn_$2.weight",
+		"^model\\.layers\\.(\\d+)\\.temporal_block\\.o_proj\\.(weight|bias)$":                "blk.$1.attn_output.$2",
+		"^model\\.layers\\.(\\d+)\\.temporal_block\\.linear_(x|y|out)\\.(weight|bias)$":      "blk.$1.rglru_$2.$3",
+		"^model\\.layers\\.(\\d+)\\.temporal_block\\.conv_1d\\.(weight|bias)$":               "blk.$1.ssm_conv1d.$2",
+		"^model\\.layers\\.(\\d+)\\.temporal_block\\.rg_lru\\.input_gate_(weight|bias)$":     "blk.$1.rglru_input_gate.$2",
+		"^model\\.layers\\.(\\d+)\\.temporal_block\\.rg_lru\\.recurrent_gate_(weight|bias)$": "blk.$1.rglru_a_gate.$2",
+		"^model\\.layers\\.(\\d+)\\.temporal_block\\.rg_lru\\.recurrent_param$":              "blk.$1.rglru_a.weight",
+
+		"^transformer\\.blocks\\.(\\d+)\\.norm_attn_norm\\.norm_1\\.weight$":          "blk.$1.attn_norm.weight",
+		"^transformer\\.blocks\\.(\\d+)\\.norm_attn_norm\\.norm_2\\.weight$":          "blk.$1.attn_output_norm.weight",
+		"^transformer\\.blocks\\.(\\d+)\\.norm_attn_norm\\.attn\\.Wqkv\\.weight$":     "blk.$1.attn_qkv.weight",
+		"^transformer\\.blocks\\.(\\d+)\\.norm_attn_norm\\.attn\\.out_proj\\.weight$": "blk.$1.attn_output.weight",
+		"^transformer\\.blocks\\.(\\d+)\\.ffn\\.router\\.layer\\.weight$":             "blk.$1.ffn_gate_inp.weight",
+		"^transformer\\.blocks\\.(\\d+)\\.ffn\\.experts\\.mlp\\.w1$":                  "blk.$1.ffn_gate_exps.weight",
+		"^transformer\\.blocks\\.(\\d+)\\.ffn\\.experts\\.mlp\\.v1$":                  "blk.$1.ffn_up_exps.weight",
+		"^transformer\\.blocks\\.(\\d+)\\.ffn\\.experts\\.mlp\\.w2$":                  "blk.$1.ffn_down_exps.weight",
+
+		"model.layers.layers.(\\d+).norm.weight":                    "blk.$1.attn_norm.weight",
+		"model.layers.layers.(\\d+).self_attn.(q|k|v)_proj.weight":  "blk.$1.attn_$2.weight",
+		"model.layers.layers.(\\d+).self_attn.o_proj.weight":        "blk.$1.attn_output.weight",
+		"model.layers.layers.(\\d+).mlp.(gate|up|down)_proj.weight": "blk.$1.ffn_$2.weight",
+
+		"model.encoder.layers.(\\d+).self_attn.q_proj.(weight|bias)":        "enc.blk.$1.attn_q.$2",
+		"model.encoder.layers.(\\d+).self_attn.k_proj.(weight|bias)":        "enc.blk.$1.attn_k.$2",
+		"model.encoder.layers.(\\d+).self_attn.v_proj.(weight|bias)":        "enc.blk.$1.attn_v.$2",
+		"model.encoder.layers.(\\d+).self_attn.out_proj.(weight|bias)":      "enc.blk.$1.attn_o.$2",
+		"model.encoder.layers.(\\d+).self_attn_layer_norm.(weight|bias)":    "enc.blk.$1.attn_norm.$2",
+		"model.encoder.layers.(\\d+).fc1.(weight|bias)":                     "enc.blk.$1.ffn_up.$2",
+		"model.encoder.layers.(\\d+).fc2.(weight|bias)":                     "enc.blk.$1.ffn_down.$2",
+		"model.encoder.layers.(\\d+).final_layer_norm.(weight|bias)":        "enc.blk.$1.ffn_norm.$2",
+		"model.decoder.layers.(\\d+).self_attn.q_proj.(weight|bias)":        "dec.blk.$1.attn_q.$2",
+		"model.decoder.layers.(\\d+).self_attn.k_proj.(weight|bias)":        "dec.blk.$1.attn_k.$2",
+		"model.decoder.layers.(\\d+).self_attn.v_proj.(weight|bias)":        "dec.blk.$1.attn_v.$2",
+		"model.decoder.layers.(\\d+).self_attn.out_proj.(weight|bias)":      "dec.blk.$1.attn_o.$2",
+		"model.decoder.layers.(\\d+).self_attn_layer_norm.(weight|bias)":    "dec.blk.$1.attn_norm.$2",
+		"model.decoder.layers.(\\d+).encoder_attn.q_proj.(weight|bias)":     "dec.blk.$1.cross_attn_q.$2",
+		"model.decoder.layers.(\\d+).encoder_attn.k_proj.(weight|bias)":     "dec.blk.$1.cross_attn_k.$2",
+		"model.decoder.layers.(\\d+).encoder_attn.v_proj.(weight|bias)":     "dec.blk.$1.cross_attn_v.$2",
+		"model.decoder.layers.(\\d+).encoder_attn.out_proj.(weight|bias)":   "dec.blk.$1.cross_attn_o.$2",
+		"model.decoder.layers.(\\d+).encoder_attn_layer_norm.(weight|bias)": "dec.blk.$1.cross_attn_norm.$2",
+		"model.decoder.layers.(\\d+).fc1.(weight|bias)":                     "dec.blk.$1.ffn_up.$2",
+		"model.decoder.layers.(\\d+).fc2.(weight|bias)":                     "dec.blk.$1.ffn_down.$2",
+		"model.decoder.layers.(\\d+).final_layer_norm.(weight|bias)":        "dec.blk.$1.ffn_norm.$2",
 	}
 
 	v, ok := directMap[n]
@@ -185,6 +659,17 @@ func (m *SafetensorFormat) GetLayerName(n string) (string, error) {
 		return v, nil
 	}
 
+	// vision and CLIP text tensors are matched first since their names
+	// contain those of the text and encoder-decoder layers above
+	for _, m := range []map[string]string{visionMap, clipTextMap} {
+		for k, v := range m {
+			re := regexp.MustCompile(k)
+			if re.MatchString(n) {
+				return re.ReplaceAllString(n, v), nil
+			}
+		}
+	}
+
 	// quick hack to rename the layers to gguf format
 	for k, v := range tMap {
 		re := regexp.MustCompile(k)
@@ -197,37 +682,92 @@ func (m *SafetensorFormat) GetLayerName(n string) (string, error) {
 	return "", fmt.Errorf("couldn't find a layer name for '%s'", n)
 }
 
+// skip moves past the first n bytes of f, which is just opened. Files which
+// can't seek, e.g. those of an archive, are read up to n.
+func skip(f fs.File, n int64) error {
+	if s, ok := f.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekStart)
+		return err
+	}
+
+	_, err := io.CopyN(io.Discard, f, n)
+	return err
+}
+
+// open returns the file of the tensor positioned at its data
+func (r safetensorWriterTo) open() (fs.File, error) {
+	f, err := r.fsys.Open(r.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := skip(f, r.offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// sameData reports whether o reads the same bytes as r from the
+// checkpoint. Repacked tensors are never the same.
+func (r safetensorWriterTo) sameData(o io.WriterTo) (bool, error) {
+	s, ok := o.(safetensorWriterTo)
+	if !ok || r.repacker != nil || s.repacker != nil || r.dtype != s.dtype || r.size != s.size {
+		return false, nil
+	}
+
+	a, err := r.open()
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+
+	b, err := s.open()
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	return equalReaders(a, b, r.size)
+}
+
 func (r safetensorWriterTo) WriteTo(w io.Writer) (n int64, err error) {
-	f, err := os.Open(r.filename)
+	f, err := r.open()
 	if err != nil {
 		return 0, err
 	}
 	defer f.Close()
 
-	if _, err = f.Seek(r.offset, io.SeekStart); err != nil {
-		return 0, err
+	// tensors written as they are read are quantized a block at a time
+	// rather than read whole
+	if (r.t.Kind == 2 || r.t.Kind == 8) && r.repacker == nil && !r.params.CheckFinite {
+		return 0, r.quantizeTo(w, f)
 	}
 
+	// safetensors are always little endian while r.bo is the byte order of
+	// the output
 	var f32s []float32
 	switch r.dtype {
 	case "F32":
 		f32s = make([]float32, r.size/4)
-		if err = binary.Read(f, r.bo, f32s); err != nil {
+		if err = binary.Read(f, binary.LittleEndian, f32s); err != nil {
 			return 0, err
 		}
 	case "F16":
 		u16s := make([]uint16, r.size/2)
-		if err = binary.Read(f, r.bo, u16s); err != nil {
+		if err = binary.Read(f, binary.LittleEndian, u16s); err != nil {
 			return 0, err
 		}
 
-		for _, b := range u16s {
-			f32s = append(f32s, float16.Frombits(b).Float32())
+		f32s = make([]float32, len(u16s))
+		for i, b := range u16s {
+			f32s[i] = float16.Frombits(b).Float32()
 		}
 
 	case "BF16":
 		u8s := make([]uint8, r.size)
-		if err = binary.Read(f, r.bo, u8s); err != nil {
+		if err = binary.Read(f, binary.LittleEndian, u8s); err != nil {
 			return 0, err
 		}
 
@@ -236,6 +776,10 @@ func (r safetensorWriterTo) WriteTo(w io.Writer) (n int64, err error) {
 		return 0, fmt.Errorf("unknown data type: %s", r.dtype)
 	}
 
+	if err := r.params.checkFinite(r.t.Name, f32s); err != nil {
+		return 0, err
+	}
+
 	if r.repacker != nil {
 		f32s, err = r.repacker(r.t.Name, f32s, r.t.Shape)
 		if err != nil {
@@ -243,22 +787,56 @@ func (r safetensorWriterTo) WriteTo(w io.Writer) (n int64, err error) {
 		}
 	}
 
-	switch r.t.Kind {
-	case 0:
-		return 0, binary.Write(w, r.bo, f32s)
-	case 1:
-		f16s := make([]uint16, len(f32s))
-		for i := range f32s {
-			f16s[i] = float16.Fromfloat32(f32s[i]).Bits()
-		}
+	return 0, writeTensorData(w, r.bo, r.t.Kind, f32s)
+}
 
-		return 0, binary.Write(w, r.bo, f16s)
-	default:
-		return 0, fmt.Errorf("unknown storage type: %d", r.t.Kind)
+// quantizeTo writes the tensor read from f as its quantized kind, decoding
+// and quantizing one block of values before reading the next
+func (r safetensorWriterTo) quantizeTo(w io.Writer, f io.Reader) error {
+	size, ok := safetensorsDTypeSize[r.dtype]
+	if !ok {
+		return fmt.Errorf("unknown data type: %s", r.dtype)
 	}
+
+	br := bufio.NewReader(f)
+	b := make([]byte, q8_0BlockSize*size)
+	blocks := r.size / int64(len(b))
+	return writeQuantized(w, r.bo, r.t.Kind, func(values []float32) error {
+		if blocks == 0 {
+			return io.EOF
+		}
+
+		blocks--
+		if _, err := io.ReadFull(br, b); errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		// safetensors are always little endian
+		for i := range values {
+			switch r.dtype {
+			case "F32":
+				values[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+			case "F16":
+				values[i] = float16.Frombits(binary.LittleEndian.Uint16(b[2*i:])).Float32()
+			case "BF16":
+				values[i] = math.Float32frombits(uint32(binary.LittleEndian.Uint16(b[2*i:])) << 16)
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetModelArch returns the architecture of the model in the directory
+// dirpath
+func (m *SafetensorFormat) GetModelArch(name, dirpath string, params *Params) (ModelArch, error) {
+	return m.GetModelArchFS(name, os.DirFS(dirpath), params)
 }
 
-func (m *SafetensorFormat) GetModelArch(name, dirPath string, params *Params) (ModelArch, error) {
+func (m *SafetensorFormat) GetModelArchFS(name string, fsys fs.FS, params *Params) (ModelArch, error) {
+	params.forceArchitecture()
 	switch len(params.Architectures) {
 	case 0:
 		return nil, fmt.Errorf("No architecture specified to convert")
@@ -268,16 +846,34 @@ func (m *SafetensorFormat) GetModelArch(name, dirPath string, params *Params) (M
 			return &LlamaModel{
 				ModelData{
 					Name:   name,
-					Path:   dirPath,
+					FS:     fsys,
 					Params: params,
 					Format: m,
 				},
 			}, nil
-		case "MistralForCausalLM":
+		case "InternLM3ForCausalLM":
+			return &LlamaModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "PlamoForCausalLM":
+			return &PlamoModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "MistralForCausalLM", "MinistralForCausalLM":
 			return &MistralModel{
 				ModelData{
 					Name:   name,
-					Path:   dirPath,
+					FS:     fsys,
 					Params: params,
 					Format: m,
 				},
@@ -286,7 +882,7 @@ func (m *SafetensorFormat) GetModelArch(name, dirPath string, params *Params) (M
 			return &MixtralModel{
 				ModelData{
 					Name:   name,
-					Path:   dirPath,
+					FS:     fsys,
 					Params: params,
 					Format: m,
 				},
@@ -295,7 +891,172 @@ func (m *SafetensorFormat) GetModelArch(name, dirPath string, params *Params) (M
 			return &GemmaModel{
 				ModelData{
 					Name:   name,
-					Path:   dirPath,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "GptOssForCausalLM":
+			return &GptOssModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "GPT2LMHeadModel":
+			params.setGPTBigCodeSizes()
+			return &GPT2Model{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "GPTBigCodeForCausalLM":
+			params.setGPTBigCodeSizes()
+			return &GPTBigCodeModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "DbrxForCausalLM":
+			params.setDbrxSizes()
+			return &DbrxModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "RecurrentGemmaForCausalLM":
+			return &RecurrentGemmaModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "CohereForCausalLM":
+			return &CohereModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "ModernBertModel", "ModernBertForMaskedLM":
+			return &ModernBertModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "AyaVisionForConditionalGeneration":
+			return &AyaVisionModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "Idefics2ForConditionalGeneration", "Idefics3ForConditionalGeneration":
+			return &SiglipModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "FalconForCausalLM":
+			return &FalconModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "StableLmForCausalLM":
+			return &StableLMModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "Qwen2ForCausalLM", "Qwen2VLForConditionalGeneration":
+			return &Qwen2Model{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "Phi3ForCausalLM":
+			return &Phi3Model{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "HymbaForCausalLM":
+			return &HymbaModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "CLIPTextModel", "CLIPTextModelWithProjection":
+			return &CLIPTextModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "InternVLChatModel":
+			return &InternVLModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "SiglipModel", "SiglipVisionModel", "CLIPModel", "CLIPVisionModelWithProjection":
+			return &ImageEmbeddingModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
+					Params: params,
+					Format: m,
+				},
+			}, nil
+		case "MarianMTModel", "M2M100ForConditionalGeneration":
+			return &MarianModel{
+				ModelData{
+					Name:   name,
+					FS:     fsys,
 					Params: params,
 					Format: m,
 				},
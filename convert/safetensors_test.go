@@ -0,0 +1,1868 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/x448/float16"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+	"github.com/ollama/ollama/llm"
+)
+
+// createSafetensors writes tensors to a safetensors file at p. Each tensor is
+// stored as F32 and filled with a deterministic ramp starting from its offset
+// so tensors of the same shape hold different values.
+func createSafetensors(t *testing.T, p string, tensors map[string][]uint64) {
+	t.Helper()
+
+	var names []string
+	for name := range tensors {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	values := make(map[string][]float32)
+
+	var offset uint64
+	for _, name := range names {
+		n := uint64(1)
+		for _, dim := range tensors[name] {
+			n *= dim
+		}
+
+		for i := range n {
+			values[name] = append(values[name], float32((offset+i)%7)/8)
+		}
+
+		offset += n
+	}
+
+	writeSafetensors(t, p, tensors, values)
+}
+
+// writeSafetensors writes tensors with the given shapes and values to a
+// safetensors file at p
+func writeSafetensors(t *testing.T, p string, tensors map[string][]uint64, values map[string][]float32) {
+	t.Helper()
+
+	var names []string
+	for name := range tensors {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	headers := make(map[string]safetensorMetadata)
+
+	var data bytes.Buffer
+	for _, name := range names {
+		offset := int64(data.Len())
+		if err := binary.Write(&data, binary.LittleEndian, values[name]); err != nil {
+			t.Fatal(err)
+		}
+
+		headers[name] = safetensorMetadata{
+			Type:    "F32",
+			Shape:   tensors[name],
+			Offsets: []int64{offset, int64(data.Len())},
+		}
+	}
+
+	b, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f bytes.Buffer
+	if err := binary.Write(&f, binary.LittleEndian, int64(len(b))); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(b)
+	f.Write(data.Bytes())
+
+	if err := os.WriteFile(p, f.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createJSON(t *testing.T, p string, v any) {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tinyModel is a checkpoint of a tiny model for createTinyModel to write
+type tinyModel struct {
+	config map[string]any
+
+	// tokenizer is written to tokenizer.json and pieces, if any, to a
+	// sentencepiece tokenizer.model
+	tokenizer map[string]any
+	pieces    []*sentencepiece.ModelProto_SentencePiece
+
+	// tensors are the shapes of the tensors of model.safetensors. Each value
+	// of a tensor is its index modulo 7 over 8 unless values fills it.
+	tensors map[string][]uint64
+	values  map[string]func(i int) float32
+}
+
+// createTinyModel writes m to a temporary directory
+func createTinyModel(t *testing.T, m tinyModel) string {
+	t.Helper()
+
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "config.json"), m.config)
+	if m.tokenizer != nil {
+		createJSON(t, filepath.Join(d, "tokenizer.json"), m.tokenizer)
+	}
+
+	if m.pieces != nil {
+		createSentencePiece(t, filepath.Join(d, "tokenizer.model"), m.pieces...)
+	}
+
+	values := make(map[string][]float32)
+	for name, shape := range m.tensors {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		fill := m.values[name]
+		if fill == nil {
+			fill = func(i int) float32 { return float32(i%7) / 8 }
+		}
+
+		values[name] = make([]float32, n)
+		for i := range values[name] {
+			values[name][i] = fill(i)
+		}
+	}
+
+	writeSafetensors(t, filepath.Join(d, "model.safetensors"), m.tensors, values)
+	return d
+}
+
+// rowNumbers fills a tensor of rows of cols values with the row number of each
+func rowNumbers(cols int) func(int) float32 {
+	return func(i int) float32 { return float32(i / cols) }
+}
+
+// tinyBPETokenizer is a BPE tokenizer.json of two tokens and the special
+// tokens bos and eos with the IDs 2 and 3
+func tinyBPETokenizer(bos, eos string) map[string]any {
+	return map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"a": 0, "b": 1},
+			"merges": []string{"a b"},
+		},
+		"added_tokens": []map[string]any{
+			{"id": 2, "content": bos, "special": true},
+			{"id": 3, "content": eos, "special": true},
+		},
+	}
+}
+
+// tinyGPT2Tokenizer is a BPE tokenizer.json like GPT-2's with
+// <|endoftext|> as its first token
+func tinyGPT2Tokenizer() map[string]any {
+	return map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"<|endoftext|>": 0, "a": 1, "b": 2, "ab": 3},
+			"merges": []string{"a b"},
+		},
+		"added_tokens": []map[string]any{
+			{"id": 0, "content": "<|endoftext|>", "special": true},
+		},
+	}
+}
+
+// createTinyLlama writes a single layer llama model to a temporary directory
+func createTinyLlama(t *testing.T) string {
+	t.Helper()
+
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"LlamaForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+		"rope_theta":              10000.0,
+	})
+
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"a": 0, "b": 1},
+			"merges": []string{"a b"},
+		},
+		"added_tokens": []map[string]any{
+			{"id": 2, "content": "<s>", "special": true},
+			{"id": 3, "content": "</s>", "special": true},
+		},
+	})
+
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"lm_head.weight":                                 {4, 8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+	})
+
+	return d
+}
+
+// convertDir converts the model in p, calling fn to adjust its params before
+// the conversion starts
+func convertDir(t *testing.T, p string, fn func(*Params)) (llm.KV, llm.Tensors) {
+	t.Helper()
+
+	mf, err := GetModelFormat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := mf.GetParams(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fn != nil {
+		fn(params)
+	}
+
+	arch, err := mf.GetModelArch("", p, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.LoadVocab(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := arch.WriteGGUF(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	m, _, err := llm.DecodeGGML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m.KV(), m.Tensors()
+}
+
+func TestConvertF32(t *testing.T) {
+	d := createTinyLlama(t)
+
+	kv, _ := convertDir(t, d, nil)
+	if kv.FileType().String() != "F16" {
+		t.Fatalf("expected F16, got %s", kv.FileType())
+	}
+
+	kv, tensors := convertDir(t, d, func(p *Params) { p.F32 = true })
+	if kv.FileType().String() != "F32" {
+		t.Fatalf("expected F32, got %s", kv.FileType())
+	}
+
+	if len(tensors) != 12 {
+		t.Fatalf("expected 12 tensors, got %d", len(tensors))
+	}
+
+	for _, tensor := range tensors {
+		if tensor.Kind != 0 {
+			t.Errorf("%s: expected kind 0, got %d", tensor.Name, tensor.Kind)
+		}
+	}
+}
+
+func TestGetParamsQuantized(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures": []string{"LlamaForCausalLM"},
+		"quantization_config": map[string]any{
+			"quant_method": "gptq",
+			"bits":         4,
+		},
+	})
+
+	var mf SafetensorFormat
+	if _, err := mf.GetParams(d); err == nil || !strings.Contains(err.Error(), "gptq") {
+		t.Fatalf("expected gptq error, got %v", err)
+	}
+}
+
+func TestWriteGGUFDigest(t *testing.T) {
+	d := createTinyLlama(t)
+
+	var mf SafetensorFormat
+	params, err := mf.GetParams(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch, err := mf.GetModelArch("", d, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.LoadVocab(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	digest, err := WriteGGUFDigest(arch, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256(b)); digest != want {
+		t.Fatalf("expected %s, got %s", want, digest)
+	}
+}
+
+func TestWriteTensorsGGUF(t *testing.T) {
+	d := createTinyLlama(t)
+	full := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, full); err != nil {
+		t.Fatal(err)
+	}
+
+	var mf SafetensorFormat
+	params, err := mf.GetParams(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch, err := mf.GetModelArch("", d, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(t.TempDir(), "tensors.gguf")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := WriteTensorsGGUF(arch, "llama", f); err != nil {
+		t.Fatal(err)
+	}
+
+	want, wantData := decodeFile(t, full)
+	got, gotData := decodeFile(t, p)
+
+	// DecodeGGML adds general.parameter_count
+	if kv := got.KV(); len(kv) != 2 || kv.Architecture() != "llama" {
+		t.Fatalf("expected only general.architecture, got %v", kv)
+	}
+
+	if len(got.Tensors()) != len(want.Tensors()) {
+		t.Fatalf("expected %d tensors, got %d", len(want.Tensors()), len(got.Tensors()))
+	}
+
+	for i, tensor := range got.Tensors() {
+		if w := want.Tensors()[i]; tensor.Name != w.Name || tensor.Kind != w.Kind || !slices.Equal(tensor.Shape, w.Shape) {
+			t.Fatalf("expected tensor %+v, got %+v", *w, *tensor)
+		}
+	}
+
+	if !bytes.Equal(gotData, wantData) {
+		t.Fatal("expected the tensor data of the full conversion")
+	}
+}
+
+func TestConvertBigEndian(t *testing.T) {
+	d := createTinyLlama(t)
+
+	convert := func(bo ByteOrder) (*llm.GGML, []byte) {
+		mf, err := GetModelFormat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params, err := mf.GetParams(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params.ByteOrder = bo
+		arch, err := mf.GetModelArch("", d, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := arch.LoadVocab(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := arch.GetTensors(); err != nil {
+			t.Fatal(err)
+		}
+
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if err := writeFile(arch, p); err != nil {
+			t.Fatal(err)
+		}
+
+		// fixing a file keeps its byte order
+		if err := FixGGUF(p, p, map[string]any{"tokenizer.chat_template": "{{ .Prompt }}"}); err != nil {
+			t.Fatal(err)
+		}
+
+		return decodeFile(t, p)
+	}
+
+	le, leData := convert(binary.LittleEndian)
+	be, beData := convert(binary.BigEndian)
+
+	if be.ByteOrder() != binary.ByteOrder(binary.BigEndian) {
+		t.Fatalf("expected big endian, got %v", be.ByteOrder())
+	}
+
+	for _, k := range []string{"llama.embedding_length", "llama.rope.freq_base", "tokenizer.chat_template"} {
+		if !equalValue(le.KV()[k], be.KV()[k]) {
+			t.Fatalf("%s: expected %v, got %v", k, le.KV()[k], be.KV()[k])
+		}
+	}
+
+	// every element of the F32 and F16 tensors is swapped
+	for i, tensor := range be.Tensors() {
+		want := leData[le.Tensors()[i].Offset : le.Tensors()[i].Offset+tensor.Size()]
+		got := beData[tensor.Offset : tensor.Offset+tensor.Size()]
+
+		size := 4
+		if tensor.Kind == 1 {
+			size = 2
+		}
+
+		for j := 0; j < len(got); j += size {
+			element := slices.Clone(want[j : j+size])
+			slices.Reverse(element)
+			if !slices.Equal(got[j:j+size], element) {
+				t.Fatalf("%s: expected %v at %d, got %v", tensor.Name, element, j, got[j:j+size])
+			}
+		}
+	}
+}
+
+// createSentencePiece writes a sentencepiece tokenizer.model with pieces to p
+func createSentencePiece(t *testing.T, p string, pieces ...*sentencepiece.ModelProto_SentencePiece) {
+	t.Helper()
+
+	b, err := proto.Marshal(&sentencepiece.ModelProto{Pieces: pieces})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLlamaTokenizerModel(t *testing.T) {
+	t.Run("bpe", func(t *testing.T) {
+		kv, _ := convertDir(t, createTinyLlama(t), nil)
+		if kv["tokenizer.ggml.model"] != "gpt2" {
+			t.Fatalf("expected gpt2, got %v", kv["tokenizer.ggml.model"])
+		}
+
+		if _, ok := kv["tokenizer.ggml.merges"]; !ok {
+			t.Fatal("expected merges")
+		}
+	})
+
+	t.Run("sentencepiece", func(t *testing.T) {
+		d := createTinyLlama(t)
+		createSentencePiece(t, filepath.Join(d, "tokenizer.model"),
+			&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<unk>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_UNKNOWN.Enum()},
+			&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<s>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("</s>"), Score: proto.Float32(0), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+			&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("▁a"), Score: proto.Float32(-1)},
+		)
+
+		kv, _ := convertDir(t, d, nil)
+		if kv["tokenizer.ggml.model"] != "llama" {
+			t.Fatalf("expected llama, got %v", kv["tokenizer.ggml.model"])
+		}
+
+		if _, ok := kv["tokenizer.ggml.scores"]; !ok {
+			t.Fatal("expected scores")
+		}
+	})
+}
+
+func TestConvertContextLength(t *testing.T) {
+	d := createTinyLlama(t)
+
+	kv, _ := convertDir(t, d, nil)
+	if kv.ContextLength() != 128 {
+		t.Fatalf("expected 128, got %d", kv.ContextLength())
+	}
+
+	kv, _ = convertDir(t, d, func(p *Params) { p.ContextLength = 64 })
+	if kv.ContextLength() != 64 {
+		t.Fatalf("expected 64, got %d", kv.ContextLength())
+	}
+}
+
+func TestTieOutput(t *testing.T) {
+	tensor := func(name string, data ...float32) llm.Tensor {
+		return llm.Tensor{Name: name, Shape: []uint64{uint64(len(data))}, WriterTo: f32sWriterTo{data, binary.LittleEndian}}
+	}
+
+	cases := []struct {
+		name    string
+		tensors []llm.Tensor
+		want    []string
+	}{
+		{
+			name:    "identical",
+			tensors: []llm.Tensor{tensor("token_embd.weight", 1, 2, 3, 4), tensor("output.weight", 1, 2, 3, 4), tensor("output_norm.weight", 1)},
+			want:    []string{"token_embd.weight", "output_norm.weight"},
+		},
+		{
+			name:    "same shape",
+			tensors: []llm.Tensor{tensor("token_embd.weight", 1, 2, 3, 4), tensor("output.weight", 4, 3, 2, 1)},
+			want:    []string{"token_embd.weight", "output.weight"},
+		},
+		{
+			name:    "different shape",
+			tensors: []llm.Tensor{tensor("token_embd.weight", 1, 2, 3, 4), tensor("output.weight", 1, 2)},
+			want:    []string{"token_embd.weight", "output.weight"},
+		},
+		{
+			name:    "untied",
+			tensors: []llm.Tensor{tensor("token_embd.weight", 1, 2, 3, 4)},
+			want:    []string{"token_embd.weight"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := tieOutput(tt.tensors)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, t := range ts {
+				names = append(names, t.Name)
+			}
+
+			if !slices.Equal(names, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, names)
+			}
+		})
+	}
+}
+
+func TestConvertTieOutput(t *testing.T) {
+	cases := []struct {
+		name  string
+		delta float32
+		tied  bool
+	}{
+		{"identical", 0, true},
+		// written as F16 both are the same but the checkpoint's aren't
+		{"below f16 precision", 1e-7, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := createTinyLlama(t)
+			tensors := map[string][]uint64{
+				"model.embed_tokens.weight": {4, 8},
+				"lm_head.weight":            {4, 8},
+				"model.norm.weight":         {8},
+			}
+
+			values := map[string][]float32{}
+			for name, shape := range tensors {
+				n := uint64(1)
+				for _, d := range shape {
+					n *= d
+				}
+
+				values[name] = make([]float32, n)
+				for i := range values[name] {
+					values[name][i] = float32(i%7) / 8
+				}
+			}
+			values["lm_head.weight"][1] += tt.delta
+
+			writeSafetensors(t, filepath.Join(d, "model.safetensors"), tensors, values)
+
+			_, ts := convertDir(t, d, nil)
+			if tied := !slices.ContainsFunc(ts, func(t *llm.Tensor) bool { return t.Name == "output.weight" }); tied != tt.tied {
+				t.Fatalf("expected tied %t, got %t", tt.tied, tied)
+			}
+		})
+	}
+}
+
+func TestConvertTiedWordEmbeddings(t *testing.T) {
+	d := createTinyLlama(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"LlamaForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+		"tie_word_embeddings":     true,
+	})
+
+	// the checkpoint leaves out lm_head
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+	})
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	embd, output := tensors["token_embd.weight"], tensors["output.weight"]
+	if output == nil {
+		t.Fatal("expected tensor output.weight")
+	}
+
+	if output.Kind != embd.Kind || !slices.Equal(output.Shape, embd.Shape) {
+		t.Fatalf("expected output.weight of kind %d and shape %v, got %d and %v", embd.Kind, embd.Shape, output.Kind, output.Shape)
+	}
+
+	if !bytes.Equal(data[output.Offset:output.Offset+output.Size()], data[embd.Offset:embd.Offset+embd.Size()]) {
+		t.Fatal("expected output.weight to hold the token embeddings")
+	}
+
+	// an lm_head of the checkpoint is kept even when it is identical to the
+	// token embeddings
+	createSafetensors(t, filepath.Join(d, "model-00002.safetensors"), map[string][]uint64{
+		"lm_head.weight": {4, 8},
+	})
+
+	if _, tensors := convertDir(t, d, nil); len(tensors) != 12 {
+		t.Fatalf("expected 12 tensors, got %d", len(tensors))
+	}
+}
+
+// failingArch writes part of a model then fails
+type failingArch struct {
+	ModelData
+}
+
+func (failingArch) GetTensors() error { return nil }
+
+func (failingArch) LoadVocab() error { return nil }
+
+func (failingArch) WriteGGUF(ws io.WriteSeeker) error {
+	if _, err := ws.Write([]byte("GGUF")); err != nil {
+		return err
+	}
+
+	return errors.New("interrupted")
+}
+
+func TestConvertToFile(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		summary, err := ConvertToFile(createTinyLlama(t), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := Summary{
+			Architecture:   "llama",
+			ParameterCount: 728,
+			TensorCount:    12,
+			ContextLength:  128,
+			FileType:       "F16",
+			VocabSize:      4,
+		}
+
+		if !reflect.DeepEqual(*summary, want) {
+			t.Fatalf("expected %+v, got %+v", want, *summary)
+		}
+
+		if _, err := os.Stat(p + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected no temporary file, got %v", err)
+		}
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if err := writeFile(failingArch{}, p); err == nil {
+			t.Fatal("expected error")
+		}
+
+		for _, name := range []string{p, p + ".tmp"} {
+			if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected %s to not exist, got %v", name, err)
+			}
+		}
+	})
+}
+
+func TestConvertFS(t *testing.T) {
+	d := createTinyLlama(t)
+	want := filepath.Join(t.TempDir(), "want.gguf")
+	if _, err := ConvertToFile(d, want); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(d, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fsys[e.Name()] = &fstest.MapFile{Data: b}
+	}
+
+	// nothing may be read from the directory once the model is in memory
+	if err := os.RemoveAll(d); err != nil {
+		t.Fatal(err)
+	}
+
+	got := filepath.Join(t.TempDir(), "got.gguf")
+	if _, err := ConvertFS(fsys, got, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	wantb, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotb, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(gotb, wantb) {
+		t.Fatal("expected the model converted from memory to match the one converted from disk")
+	}
+}
+
+func TestConvertForceArchitecture(t *testing.T) {
+	d := createTinyLlama(t)
+	b, err := os.ReadFile(filepath.Join(d, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config map[string]any
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	config["architectures"] = []string{"MyLlamaForCausalLM"}
+	createJSON(t, filepath.Join(d, "config.json"), config)
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err == nil || !strings.Contains(err.Error(), "MyLlamaForCausalLM") {
+		t.Fatalf("expected unsupported architecture error, got %v", err)
+	}
+
+	for _, arch := range []string{"llama", "LlamaForCausalLM"} {
+		summary, err := ConvertToFileWithOptions(d, p, Options{ForceArchitecture: arch})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if summary.Architecture != "llama" {
+			t.Errorf("%s: expected architecture llama, got %s", arch, summary.Architecture)
+		}
+
+		if !slices.ContainsFunc(summary.Warnings, func(w string) bool { return strings.Contains(w, "forced") }) {
+			t.Errorf("%s: expected a warning about the forced architecture, got %q", arch, summary.Warnings)
+		}
+	}
+
+	// the forced converter still checks the model has what it expects
+	if _, err := ConvertToFileWithOptions(d, p, Options{ForceArchitecture: "stablelm"}); err == nil || !strings.Contains(err.Error(), "attn_norm.bias") {
+		t.Fatalf("expected missing attn_norm.bias error, got %v", err)
+	}
+}
+
+// cancelFS cancels a conversion once model.safetensors has been opened
+// cancelAt times. The first open reads the header and each later one the
+// data of a tensor.
+type cancelFS struct {
+	fs.FS
+	cancel   context.CancelFunc
+	cancelAt int
+	opens    int
+}
+
+func (fsys *cancelFS) Open(name string) (fs.File, error) {
+	if name == "model.safetensors" {
+		fsys.opens++
+		if fsys.opens == fsys.cancelAt {
+			fsys.cancel()
+		}
+	}
+
+	return fsys.FS.Open(name)
+}
+
+func TestConvertFSContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancelled while the second tensor is written
+	fsys := &cancelFS{FS: os.DirFS(createTinyLlama(t)), cancel: cancel, cancelAt: 3}
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertFSContext(ctx, fsys, p, Options{Parallel: 1}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	if fsys.opens != fsys.cancelAt {
+		t.Errorf("expected no tensor to be read once cancelled, read %d", fsys.opens-fsys.cancelAt)
+	}
+
+	for _, name := range []string{p, p + ".tmp"} {
+		if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected no %s, got %v", filepath.Base(name), err)
+		}
+	}
+
+	// a context cancelled up front stops the conversion before it writes
+	if _, err := ConvertFSContext(ctx, os.DirFS(createTinyLlama(t)), p, Options{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestGetParamsSpecialTokenDefaults(t *testing.T) {
+	cases := []struct {
+		name         string
+		architecture string
+		config       map[string]any
+		spm          bool
+		bos, eos     int
+	}{
+		{"llama", "LlamaForCausalLM", nil, true, 1, 2},
+		{"gemma", "GemmaForCausalLM", nil, true, 2, 1},
+		{"bos only", "LlamaForCausalLM", map[string]any{"bos_token_id": 3}, true, 3, 2},
+		{"explicit", "LlamaForCausalLM", map[string]any{"bos_token_id": 0, "eos_token_id": 0}, true, 0, 0},
+		{"bpe", "LlamaForCausalLM", nil, false, 0, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := t.TempDir()
+
+			config := map[string]any{"architectures": []string{tt.architecture}}
+			maps.Copy(config, tt.config)
+			createJSON(t, filepath.Join(d, "config.json"), config)
+
+			if tt.spm {
+				createSentencePiece(t, filepath.Join(d, "tokenizer.model"))
+			}
+
+			var mf SafetensorFormat
+			p, err := mf.GetParams(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p.BoSTokenID != tt.bos || p.EoSTokenID != tt.eos {
+				t.Fatalf("expected bos %d eos %d, got bos %d eos %d", tt.bos, tt.eos, p.BoSTokenID, p.EoSTokenID)
+			}
+		})
+	}
+}
+
+func TestConvertToFileWarnings(t *testing.T) {
+	d := createTinyLlama(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"LlamaForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+	})
+
+	summary, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summary.Warnings) != 1 || !strings.Contains(summary.Warnings[0], "special token") {
+		t.Fatalf("expected a special token warning, got %v", summary.Warnings)
+	}
+}
+
+func TestSafetensorsGetLayerName(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"model.embed_tokens.weight", "token_embd.weight"},
+		{"model.layers.0.self_attn.q_proj.weight", "blk.0.attn_q.weight"},
+		{"model.language_model.embed_tokens.weight", "token_embd.weight"},
+		{"model.language_model.layers.1.mlp.down_proj.weight", "blk.1.ffn_down.weight"},
+		{"language_model.model.layers.2.input_layernorm.weight", "blk.2.attn_norm.weight"},
+		{"language_model.model.norm.weight", "output_norm.weight"},
+		{"language_model.lm_head.weight", "output.weight"},
+		{"lm_head.weight", "output.weight"},
+		{"model.language_modeling.weight", ""},
+	}
+
+	var mf SafetensorFormat
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mf.GetLayerName(tt.name)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("expected error, got %s", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConvertTopLevelLMHead(t *testing.T) {
+	cases := []struct {
+		name   string
+		prefix string
+	}{
+		{"model", "model."},
+		{"language model", "language_model.model."},
+		{"multimodal", "model.language_model."},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := createTinyLlama(t)
+			createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+				tt.prefix + "embed_tokens.weight":                      {4, 8},
+				tt.prefix + "norm.weight":                              {8},
+				tt.prefix + "layers.0.input_layernorm.weight":          {8},
+				tt.prefix + "layers.0.post_attention_layernorm.weight": {8},
+				tt.prefix + "layers.0.self_attn.q_proj.weight":         {8, 8},
+				tt.prefix + "layers.0.self_attn.k_proj.weight":         {8, 8},
+				tt.prefix + "layers.0.self_attn.v_proj.weight":         {8, 8},
+				tt.prefix + "layers.0.self_attn.o_proj.weight":         {8, 8},
+				tt.prefix + "layers.0.mlp.gate_proj.weight":            {16, 8},
+				tt.prefix + "layers.0.mlp.up_proj.weight":              {16, 8},
+				tt.prefix + "layers.0.mlp.down_proj.weight":            {8, 16},
+				"lm_head.weight": {4, 8},
+			})
+
+			_, tensors := convertDir(t, d, nil)
+
+			var embd, output bool
+			for _, tensor := range tensors {
+				embd = embd || tensor.Name == "token_embd.weight"
+				output = output || tensor.Name == "output.weight"
+			}
+
+			if len(tensors) != 12 || !embd || !output {
+				t.Fatalf("expected token_embd.weight and output.weight in 12 tensors, got %d", len(tensors))
+			}
+		})
+	}
+}
+
+func TestConvertStripPrefix(t *testing.T) {
+	// the shapes of createTinyLlama under the prefix peft saves adapters
+	// merged into a model with
+	shapes := map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"lm_head.weight":                                 {4, 8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+	}
+
+	prefixed := make(map[string][]uint64)
+	for name, shape := range shapes {
+		prefixed["base_model.model."+name] = shape
+	}
+
+	d := createTinyLlama(t)
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), prefixed)
+
+	_, tensors := convertDir(t, d, func(p *Params) { p.StripPrefix = "base_model.model." })
+
+	var names []string
+	for _, tensor := range tensors {
+		names = append(names, tensor.Name)
+	}
+
+	if len(names) != len(shapes) || !slices.Contains(names, "token_embd.weight") || !slices.Contains(names, "blk.0.attn_q.weight") {
+		t.Fatalf("expected the stripped names to be mapped, got %v", names)
+	}
+
+	// a tensor outside the prefix which the stripped names collide with
+	prefixed["lm_head.weight"] = []uint64{4, 8}
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), prefixed)
+
+	_, err := ConvertToFileWithOptions(d, filepath.Join(t.TempDir(), "model.gguf"), Options{StripPrefix: "base_model.model."})
+	if err == nil || !strings.Contains(err.Error(), "are both lm_head.weight") {
+		t.Fatalf("expected a collision error, got %v", err)
+	}
+}
+
+func TestUnmappedTensors(t *testing.T) {
+	d := createTinyLlama(t)
+	if unmapped, err := UnmappedTensors(os.DirFS(d), Options{}); err != nil {
+		t.Fatal(err)
+	} else if len(unmapped) != 0 {
+		t.Fatalf("expected no unmapped tensors, got %v", unmapped)
+	}
+
+	// a fine-tune with the rotary buffers and position IDs of older
+	// checkpoints and an adapter the converter doesn't know
+	createSafetensors(t, filepath.Join(d, "extra.safetensors"), map[string][]uint64{
+		"model.layers.0.self_attn.rotary_emb.inv_freq": {2},
+		"model.embeddings.position_ids":                {128},
+		"model.layers.0.mlp.adapter.weight":            {8, 8},
+	})
+
+	unmapped, err := UnmappedTensors(os.DirFS(d), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"model.embeddings.position_ids", "model.layers.0.mlp.adapter.weight", "model.layers.0.self_attn.rotary_emb.inv_freq"}
+	if !slices.Equal(unmapped, want) {
+		t.Errorf("expected unmapped tensors %v, got %v", want, unmapped)
+	}
+
+	// converting still fails on the tensor without a name
+	_, err = ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf"))
+	if err == nil || !strings.Contains(err.Error(), "model.layers.0.mlp.adapter.weight") {
+		t.Fatalf("expected a layer name error, got %v", err)
+	}
+}
+
+func TestConvertReferenceOffsets(t *testing.T) {
+	d := createTinyLlama(t)
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _ := decodeFile(t, p)
+	offsets := make(map[string]int64)
+	for _, tensor := range ggml.Tensors() {
+		offsets[tensor.Name] = int64(tensor.Offset)
+	}
+
+	if _, err := ConvertToFileWithOptions(d, p, Options{ReferenceOffsets: offsets}); err != nil {
+		t.Fatal(err)
+	}
+
+	// F32 doubles the size of the 2D tensors, moving those after the first
+	if _, err := ConvertToFileWithOptions(d, p, Options{F32: true, ReferenceOffsets: offsets}); !errors.Is(err, llm.ErrOffsetMismatch) {
+		t.Fatalf("expected %v, got %v", llm.ErrOffsetMismatch, err)
+	}
+}
+
+func TestConvertSourceOrder(t *testing.T) {
+	d := createTinyLlama(t)
+
+	// rewrite the checkpoint with the data of its tensors in reverse order
+	st := filepath.Join(d, "model.safetensors")
+	b, err := os.ReadFile(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := binary.LittleEndian.Uint64(b)
+	var headers map[string]safetensorMetadata
+	if err := json.Unmarshal(b[8:8+n], &headers); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for key := range headers {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+	slices.Reverse(keys)
+
+	var data bytes.Buffer
+	for _, key := range keys {
+		h := headers[key]
+		offset := int64(data.Len())
+		data.Write(b[8+n+uint64(h.Offsets[0]) : 8+n+uint64(h.Offsets[1])])
+		h.Offsets = []int64{offset, int64(data.Len())}
+		headers[key] = h
+	}
+
+	header, err := json.Marshal(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f bytes.Buffer
+	if err := binary.Write(&f, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(header)
+	f.Write(data.Bytes())
+	if err := os.WriteFile(st, f.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	convert := func(opts Options) (llm.KV, []string, map[string][]byte) {
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if _, err := ConvertToFileWithOptions(d, p, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, data := decodeFile(t, p)
+		var names []string
+		contents := make(map[string][]byte)
+		for _, tensor := range ggml.Tensors() {
+			names = append(names, tensor.Name)
+			contents[tensor.Name] = data[tensor.Offset : tensor.Offset+tensor.Size()]
+		}
+
+		return ggml.KV(), names, contents
+	}
+
+	sortedKV, sorted, sortedContents := convert(Options{})
+	orderedKV, ordered, orderedContents := convert(Options{SourceOrder: true, NaturalOrder: true})
+
+	want := slices.Clone(sorted)
+	slices.Reverse(want)
+	if !slices.Equal(ordered, want) {
+		t.Fatalf("expected tensors in the reverse of the sorted order %v, got %v", want, ordered)
+	}
+
+	if !reflect.DeepEqual(orderedContents, sortedContents) {
+		t.Error("expected tensors with the same data in either order")
+	}
+
+	if !reflect.DeepEqual(orderedKV, sortedKV) {
+		t.Error("expected the same key-values in either order")
+	}
+}
+
+func TestNaturalOrder(t *testing.T) {
+	names := []string{
+		"output.weight",
+		"blk.10.attn_q.weight",
+		"token_embd.weight",
+		"blk.2.attn_q.weight",
+		"blk.2.ffn_down.weight",
+		"output_norm.weight",
+		"blk.1.attn_q.weight",
+	}
+
+	ts := make([]llm.Tensor, len(names))
+	for i, name := range names {
+		ts[i] = llm.Tensor{Name: name, Shape: []uint64{8}}
+	}
+
+	(&Params{Options: Options{NaturalOrder: true}}).sortTensors(ts)
+
+	var got []string
+	for _, t := range ts {
+		got = append(got, t.Name)
+	}
+
+	want := []string{
+		"blk.1.attn_q.weight",
+		"blk.2.attn_q.weight",
+		"blk.2.ffn_down.weight",
+		"blk.10.attn_q.weight",
+		"output.weight",
+		"output_norm.weight",
+		"token_embd.weight",
+	}
+
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	for i, tensor := range ts {
+		if tensor.Offset != uint64(i)*32 {
+			t.Errorf("%s: expected offset %d, got %d", tensor.Name, i*32, tensor.Offset)
+		}
+	}
+}
+
+func TestConvertSlidingWindow(t *testing.T) {
+	cases := []struct {
+		name   string
+		config map[string]any
+		want   any
+	}{
+		{"absent", map[string]any{}, nil},
+		{"null", map[string]any{"sliding_window": nil}, nil},
+		{"number", map[string]any{"sliding_window": 4096}, uint32(4096)},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := createTinyLlama(t)
+			createSentencePiece(t, filepath.Join(d, "tokenizer.model"),
+				&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<unk>"), Type: sentencepiece.ModelProto_SentencePiece_UNKNOWN.Enum()},
+				&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<s>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+				&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("</s>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+				&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("▁a")},
+			)
+
+			b, err := os.ReadFile(filepath.Join(d, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var config map[string]any
+			if err := json.Unmarshal(b, &config); err != nil {
+				t.Fatal(err)
+			}
+
+			config["architectures"] = []string{"MistralForCausalLM"}
+			maps.Copy(config, tt.config)
+			createJSON(t, filepath.Join(d, "config.json"), config)
+
+			kv, _ := convertDir(t, d, nil)
+			if got, ok := kv["llama.attention.sliding_window"]; got != tt.want || ok != (tt.want != nil) {
+				t.Fatalf("expected sliding_window %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConvertMinistral(t *testing.T) {
+	d := createTinyLlama(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"MinistralForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             8,
+		"num_hidden_layers":       2,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+		"sliding_window":          32,
+		"layer_types":             []string{"full_attention", "sliding_attention"},
+	})
+
+	createSafetensors(t, filepath.Join(d, "model-00002.safetensors"), map[string][]uint64{
+		"model.layers.1.input_layernorm.weight":          {8},
+		"model.layers.1.post_attention_layernorm.weight": {8},
+		"model.layers.1.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.1.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.1.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.1.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.1.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.1.mlp.up_proj.weight":              {16, 8},
+		"model.layers.1.mlp.down_proj.weight":            {8, 16},
+	})
+
+	kv, tensors := convertDir(t, d, nil)
+	for k, want := range map[string]any{
+		"general.architecture":                   "llama",
+		"llama.block_count":                      uint32(2),
+		"llama.attention.sliding_window":         uint32(32),
+		"llama.attention.sliding_window_pattern": []any{false, true},
+		"tokenizer.ggml.model":                   "gpt2",
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	if len(tensors) != 21 {
+		t.Fatalf("expected 21 tensors, got %d", len(tensors))
+	}
+}
+
+func TestSetMistralSlidingWindow(t *testing.T) {
+	cases := []struct {
+		name       string
+		raw        string
+		window     any
+		layerTypes []string
+		err        bool
+	}{
+		{"absent", "", nil, nil, false},
+		{"null", "null", nil, nil, false},
+		{"number", "4096", uint32(4096), nil, false},
+		{"uniform", "[4096, 4096]", uint32(4096), nil, false},
+		{"interleaved", "[131072, 32768, 32768]", uint32(32768), []string{"full_attention", "sliding_attention", "sliding_attention", "full_attention"}, false},
+		{"three windows", "[1024, 2048, 4096]", nil, nil, true},
+		{"empty", "[]", nil, nil, true},
+		{"invalid", `"4096"`, nil, nil, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Params{HiddenLayers: 4}
+			err := p.setMistralSlidingWindow(json.RawMessage(tt.raw))
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var window any
+			if p.SlidingWindow != nil {
+				window = *p.SlidingWindow
+			}
+
+			if window != tt.window || !slices.Equal(p.LayerTypes, tt.layerTypes) {
+				t.Fatalf("expected window %v and layers %v, got %v and %v", tt.window, tt.layerTypes, window, p.LayerTypes)
+			}
+		})
+	}
+}
+
+func TestGetParamsHeadCounts(t *testing.T) {
+	cases := []struct {
+		name           string
+		config         map[string]any
+		heads, headsKV int
+	}{
+		{"llama", map[string]any{"num_attention_heads": 8, "num_key_value_heads": 2}, 8, 2},
+		{"mha", map[string]any{"num_attention_heads": 8}, 8, 8},
+		{"n_head_kv", map[string]any{"n_head": 8, "n_head_kv": 2}, 8, 2},
+		{"multi_query", map[string]any{"n_head": 8, "multi_query": true}, 8, 1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := t.TempDir()
+
+			config := map[string]any{"architectures": []string{"LlamaForCausalLM"}}
+			maps.Copy(config, tt.config)
+			createJSON(t, filepath.Join(d, "config.json"), config)
+
+			var mf SafetensorFormat
+			p, err := mf.GetParams(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p.AttentionHeads != tt.heads || p.KeyValHeads != tt.headsKV {
+				t.Fatalf("expected %d heads and %d kv heads, got %d and %d", tt.heads, tt.headsKV, p.AttentionHeads, p.KeyValHeads)
+			}
+		})
+	}
+}
+
+func TestConvertMistralConsolidated(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "params.json"), map[string]any{
+		"dim":            8,
+		"n_layers":       1,
+		"head_dim":       4,
+		"hidden_dim":     16,
+		"n_heads":        2,
+		"n_kv_heads":     1,
+		"norm_eps":       1e-5,
+		"sliding_window": 4096,
+		"vocab_size":     4,
+		"rope_theta":     1000000.0,
+	})
+
+	createSentencePiece(t, filepath.Join(d, "tokenizer.model"),
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<unk>"), Type: sentencepiece.ModelProto_SentencePiece_UNKNOWN.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("<s>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("</s>"), Type: sentencepiece.ModelProto_SentencePiece_CONTROL.Enum()},
+		&sentencepiece.ModelProto_SentencePiece{Piece: proto.String("▁a")},
+	)
+
+	createSafetensors(t, filepath.Join(d, "consolidated.safetensors"), map[string][]uint64{
+		"tok_embeddings.weight":           {4, 8},
+		"norm.weight":                     {8},
+		"output.weight":                   {4, 8},
+		"layers.0.attention_norm.weight":  {8},
+		"layers.0.ffn_norm.weight":        {8},
+		"layers.0.attention.wq.weight":    {8, 8},
+		"layers.0.attention.wk.weight":    {4, 8},
+		"layers.0.attention.wv.weight":    {4, 8},
+		"layers.0.attention.wo.weight":    {8, 8},
+		"layers.0.feed_forward.w1.weight": {16, 8},
+		"layers.0.feed_forward.w2.weight": {8, 16},
+		"layers.0.feed_forward.w3.weight": {16, 8},
+	})
+
+	// the same weights in Hugging Face's format are ignored
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight": {4, 8},
+	})
+
+	mf, err := GetModelFormat(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := mf.GetParams(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch, err := mf.GetModelArch("", d, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tensor := range arch.(*MistralModel).Tensors {
+		if wt, ok := tensor.WriterTo.(safetensorWriterTo); ok && wt.repacker != nil {
+			t.Errorf("%s: expected consolidated weights not to be repacked", tensor.Name)
+		}
+	}
+
+	kv, tensors := convertDir(t, d, nil)
+
+	want := llm.KV{
+		"general.architecture":           "llama",
+		"llama.embedding_length":         uint32(8),
+		"llama.block_count":              uint32(1),
+		"llama.feed_forward_length":      uint32(16),
+		"llama.rope.dimension_count":     uint32(4),
+		"llama.rope.freq_base":           float32(1000000),
+		"llama.attention.head_count":     uint32(2),
+		"llama.attention.head_count_kv":  uint32(1),
+		"llama.attention.sliding_window": uint32(4096),
+		"tokenizer.ggml.bos_token_id":    uint32(1),
+		"tokenizer.ggml.eos_token_id":    uint32(2),
+	}
+
+	for k, v := range want {
+		if kv[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, kv[k])
+		}
+	}
+
+	var names []string
+	for _, tensor := range tensors {
+		names = append(names, tensor.Name)
+	}
+
+	slices.Sort(names)
+	if wantNames := []string{
+		"blk.0.attn_k.weight",
+		"blk.0.attn_norm.weight",
+		"blk.0.attn_output.weight",
+		"blk.0.attn_q.weight",
+		"blk.0.attn_v.weight",
+		"blk.0.ffn_down.weight",
+		"blk.0.ffn_gate.weight",
+		"blk.0.ffn_norm.weight",
+		"blk.0.ffn_up.weight",
+		"output.weight",
+		"output_norm.weight",
+		"token_embd.weight",
+	}; !slices.Equal(names, wantNames) {
+		t.Fatalf("expected tensors %v, got %v", wantNames, names)
+	}
+}
+
+func TestConvertShardedSafetensors(t *testing.T) {
+	d := createTinyLlama(t)
+	if err := os.Remove(filepath.Join(d, "model.safetensors")); err != nil {
+		t.Fatal(err)
+	}
+
+	shards := map[string]map[string][]uint64{
+		"model-00001-of-00002.safetensors": {
+			"model.embed_tokens.weight":                      {4, 8},
+			"model.norm.weight":                              {8},
+			"lm_head.weight":                                 {4, 8},
+			"model.layers.0.input_layernorm.weight":          {8},
+			"model.layers.0.post_attention_layernorm.weight": {8},
+			"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		},
+		"model-00002-of-00002.safetensors": {
+			"model.layers.0.self_attn.k_proj.weight": {8, 8},
+			"model.layers.0.self_attn.v_proj.weight": {8, 8},
+			"model.layers.0.self_attn.o_proj.weight": {8, 8},
+			"model.layers.0.mlp.gate_proj.weight":    {16, 8},
+			"model.layers.0.mlp.up_proj.weight":      {16, 8},
+			"model.layers.0.mlp.down_proj.weight":    {8, 16},
+		},
+	}
+
+	// each tensor holds values unique to it which F16 represents exactly
+	weightMap := make(map[string]string)
+	values := make(map[string][]float32)
+	for shard, tensors := range shards {
+		for name, shape := range tensors {
+			weightMap[name] = shard
+			n := uint64(1)
+			for _, dim := range shape {
+				n *= dim
+			}
+
+			values[name] = make([]float32, n)
+			for i := range values[name] {
+				values[name][i] = float32(len(weightMap)) + float32(i%4)/4
+			}
+		}
+
+		writeSafetensors(t, filepath.Join(d, shard), tensors, values)
+	}
+
+	createJSON(t, filepath.Join(d, "model.safetensors.index.json"), map[string]any{
+		"metadata":   map[string]any{"total_size": 0},
+		"weight_map": weightMap,
+	})
+
+	// a shard the index doesn't name isn't converted
+	createSafetensors(t, filepath.Join(d, "model-extra.safetensors"), map[string][]uint64{
+		"model.layers.1.input_layernorm.weight": {8},
+	})
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	if n := len(ggml.Tensors()); n != 12 {
+		t.Fatalf("expected 12 tensors, got %d", n)
+	}
+
+	mf := &SafetensorFormat{}
+	for _, tensor := range ggml.Tensors() {
+		if strings.HasSuffix(tensor.Name, "attn_q.weight") || strings.HasSuffix(tensor.Name, "attn_k.weight") {
+			// permuted by the llama repack
+			continue
+		}
+
+		var source string
+		for name := range weightMap {
+			if layer, err := mf.GetLayerName(name); err == nil && layer == tensor.Name {
+				source = name
+			}
+		}
+
+		got, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(got, values[source]) {
+			t.Errorf("%s: expected the values of %s, got %v", tensor.Name, source, got)
+		}
+	}
+}
+
+func TestConvertMixedDTypes(t *testing.T) {
+	tensors := map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"lm_head.weight":                                 {4, 8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+	}
+
+	// writeMixed writes the weights as F16 and the norms as F32 with their
+	// data encoded in the dtype of their header. fn may change the headers.
+	writeMixed := func(t *testing.T, d string, fn func(map[string]safetensorMetadata)) {
+		t.Helper()
+
+		var names []string
+		for name := range tensors {
+			names = append(names, name)
+		}
+
+		slices.Sort(names)
+
+		headers := make(map[string]safetensorMetadata)
+		var data bytes.Buffer
+		for _, name := range names {
+			shape := tensors[name]
+			n := shape[0]
+			if len(shape) == 2 {
+				n *= shape[1]
+			}
+
+			dtype := "F16"
+			start := int64(data.Len())
+			for i := range n {
+				if len(shape) == 1 {
+					// a third isn't exact in F16 so only an F32 read keeps it
+					dtype = "F32"
+					binary.Write(&data, binary.LittleEndian, float32(i)+float32(1)/3)
+				} else {
+					binary.Write(&data, binary.LittleEndian, float16.Fromfloat32(float32(i%16)/4).Bits())
+				}
+			}
+
+			headers[name] = safetensorMetadata{Type: dtype, Shape: shape, Offsets: []int64{start, int64(data.Len())}}
+		}
+
+		if fn != nil {
+			fn(headers)
+		}
+
+		b, err := json.Marshal(headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var f bytes.Buffer
+		if err := binary.Write(&f, binary.LittleEndian, int64(len(b))); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write(b)
+		f.Write(data.Bytes())
+		if err := os.WriteFile(filepath.Join(d, "model.safetensors"), f.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		d := createTinyLlama(t)
+		writeMixed(t, d, nil)
+
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if _, err := ConvertToFile(d, p); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, data := decodeFile(t, p)
+		for _, tensor := range ggml.Tensors() {
+			var want []float32
+			switch tensor.Name {
+			case "output_norm.weight", "blk.0.attn_norm.weight":
+				for i := range 8 {
+					want = append(want, float32(i)+float32(1)/3)
+				}
+			case "blk.0.attn_v.weight":
+				for i := range 64 {
+					want = append(want, float32(i%16)/4)
+				}
+			default:
+				continue
+			}
+
+			got, err := llm.DequantizeTensor(tensor.Kind, data[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: expected %v, got %v", tensor.Name, want, got)
+			}
+		}
+	})
+
+	for name, fn := range map[string]func(map[string]safetensorMetadata){
+		"unsupported dtype": func(headers map[string]safetensorMetadata) {
+			h := headers["model.norm.weight"]
+			h.Type = "I8"
+			headers["model.norm.weight"] = h
+		},
+		// F32 norms declared F16 would be read as twice as many values
+		"size mismatch": func(headers map[string]safetensorMetadata) {
+			h := headers["model.norm.weight"]
+			h.Type = "F16"
+			headers["model.norm.weight"] = h
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := createTinyLlama(t)
+			writeMixed(t, d, fn)
+
+			if _, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf")); err == nil || !strings.Contains(err.Error(), "model.norm.weight") {
+				t.Fatalf("expected an error for model.norm.weight, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConvertCheckFinite(t *testing.T) {
+	shapes := map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"lm_head.weight":                                 {4, 8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+	}
+
+	values := make(map[string][]float32)
+	for name, shape := range shapes {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		values[name] = make([]float32, n)
+	}
+
+	// a corrupt shard with two NaNs and an infinity in the up projection
+	values["model.layers.0.mlp.up_proj.weight"][3] = float32(math.NaN())
+	values["model.layers.0.mlp.up_proj.weight"][17] = float32(math.NaN())
+	values["model.layers.0.mlp.up_proj.weight"][64] = float32(math.Inf(-1))
+
+	d := createTinyLlama(t)
+	writeSafetensors(t, filepath.Join(d, "model.safetensors"), shapes, values)
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatalf("expected the check to be off by default, got %v", err)
+	}
+
+	_, err := ConvertToFileWithOptions(d, p, Options{CheckFinite: true, MaxNonFinite: 2})
+	if !errors.Is(err, ErrNonFinite) {
+		t.Fatalf("expected ErrNonFinite, got %v", err)
+	} else if !strings.Contains(err.Error(), "blk.0.ffn_up.weight: 3 of 128") {
+		t.Errorf("expected the error to name the tensor, got %v", err)
+	}
+
+	if _, err := ConvertToFileWithOptions(d, p, Options{CheckFinite: true, MaxNonFinite: 3}); err != nil {
+		t.Errorf("expected a tensor within MaxNonFinite to convert, got %v", err)
+	}
+}
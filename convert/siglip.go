@@ -0,0 +1,208 @@
+package convert
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// VisionConfig is the vision_config block of a vision language model
+type VisionConfig struct {
+	HiddenSize       int     `json:"hidden_size"`
+	IntermediateSize int     `json:"intermediate_size"`
+	HiddenLayers     int     `json:"num_hidden_layers"`
+	AttentionHeads   int     `json:"num_attention_heads"`
+	ImageSize        int     `json:"image_size"`
+	PatchSize        int     `json:"patch_size"`
+	NormEPS          float64 `json:"layer_norm_eps"`
+	HiddenAct        string  `json:"hidden_act"`
+
+	// internvit
+	QKNormalization bool `json:"qk_normalization"`
+}
+
+// TextConfig is the text_config block of a vision language model. Only the
+// fields needed to project images into the text model are read.
+type TextConfig struct {
+	HiddenSize int `json:"hidden_size"`
+}
+
+// PerceiverConfig is the perceiver_config block of Idefics2
+type PerceiverConfig struct {
+	Latents     int `json:"resampler_n_latents"`
+	Depth       int `json:"resampler_depth"`
+	Heads       int `json:"resampler_n_heads"`
+	HeadDim     int `json:"resampler_head_dim"`
+	KeyValHeads int `json:"num_key_value_heads"`
+}
+
+// visionArchitectures only convert the vision tower of a checkpoint
+var visionArchitectures = []string{
+	"Idefics2ForConditionalGeneration",
+	"Idefics3ForConditionalGeneration",
+	"SiglipModel",
+	"SiglipVisionModel",
+	"CLIPModel",
+	"CLIPVisionModelWithProjection",
+	"InternVLChatModel",
+	"AyaVisionForConditionalGeneration",
+}
+
+// isVision reports whether the model converts to a vision tower rather than
+// a text model
+func (p *Params) isVision() bool {
+	return len(p.Architectures) > 0 && slices.Contains(visionArchitectures, p.Architectures[0])
+}
+
+// SiglipModel converts the SigLIP vision tower and connector of Idefics2,
+// Idefics3 and SmolVLM to a clip projector, the mmproj file loaded next to
+// the text model. Unlike CLIP, SigLIP has no class embedding or pre-layernorm,
+// its patch embedding has a bias and it ends with a post-layernorm. The
+// attention pooling head of standalone SigLIP models is only used for image
+// classification and is dropped.
+type SiglipModel struct {
+	ModelData
+}
+
+func (m *SiglipModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range t {
+		switch {
+		case strings.HasPrefix(l.Name, "v.head."):
+			slog.Debug("skipping pooling head tensor", "name", l.Name)
+		case strings.HasPrefix(l.Name, "v."), strings.HasPrefix(l.Name, "mm."):
+			m.Tensors = append(m.Tensors, l)
+		}
+	}
+
+	updateOffsets(m.Tensors)
+	return nil
+}
+
+// LoadVocab does nothing since the projector has no vocabulary of its own
+func (m *SiglipModel) LoadVocab() error {
+	m.Vocab = &Vocab{}
+	return nil
+}
+
+// readImageNorm reads the image mean and std from the preprocessor_config.json
+// in fsys. Missing values default to those of SigLIP or, for InternVL, those
+// of ImageNet.
+func readImageNorm(fsys fs.FS, params *Params) (mean, std []float32, err error) {
+	var config struct {
+		Mean []float32 `json:"image_mean"`
+		Std  []float32 `json:"image_std"`
+	}
+
+	b, err := fs.ReadFile(fsys, "preprocessor_config.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		// noop
+	} else if err != nil {
+		return nil, nil, err
+	} else if err := json.Unmarshal(b, &config); err != nil {
+		return nil, nil, err
+	}
+
+	defaultMean, defaultStd := []float32{0.5, 0.5, 0.5}, []float32{0.5, 0.5, 0.5}
+	if params.Architectures[0] == "InternVLChatModel" {
+		defaultMean, defaultStd = []float32{0.485, 0.456, 0.406}, []float32{0.229, 0.224, 0.225}
+	}
+
+	if config.Mean == nil {
+		config.Mean = defaultMean
+	}
+
+	if config.Std == nil {
+		config.Std = defaultStd
+	}
+
+	return config.Mean, config.Std, nil
+}
+
+// visionKV returns the metadata of the vision tower described by params
+// under arch with the image normalization of the preprocessor config in fsys
+func visionKV(arch string, params *Params, fsys fs.FS) (llm.KV, error) {
+	vision := params.VisionConfig
+	if vision == nil {
+		return nil, fmt.Errorf("%s: config is missing vision_config", arch)
+	}
+
+	mean, std, err := readImageNorm(fsys, params)
+	if err != nil {
+		return nil, err
+	}
+
+	return llm.KV{
+		arch + ".use_gelu":                            vision.HiddenAct != "quick_gelu",
+		arch + ".vision.image_size":                   uint32(vision.ImageSize),
+		arch + ".vision.patch_size":                   uint32(vision.PatchSize),
+		arch + ".vision.embedding_length":             uint32(vision.HiddenSize),
+		arch + ".vision.feed_forward_length":          uint32(vision.IntermediateSize),
+		arch + ".vision.block_count":                  uint32(vision.HiddenLayers),
+		arch + ".vision.attention.head_count":         uint32(vision.AttentionHeads),
+		arch + ".vision.attention.layer_norm_epsilon": float32(cmp.Or(vision.NormEPS, 1e-6)),
+		arch + ".vision.image_mean":                   mean,
+		arch + ".vision.image_std":                    std,
+	}, nil
+}
+
+func (m *SiglipModel) WriteGGUF(ws io.WriteSeeker) error {
+	kv, err := visionKV("clip", m.Params, m.FS)
+	if err != nil {
+		return err
+	}
+
+	kv["general.architecture"] = "clip"
+	kv["general.name"] = m.Name
+	kv["general.file_type"] = m.Params.fileType()
+	kv["clip.has_text_encoder"] = false
+	kv["clip.has_vision_encoder"] = true
+	kv["clip.has_llava_projector"] = false
+
+	if m.Params.TextConfig != nil {
+		kv["clip.vision.projection_dim"] = uint32(m.Params.TextConfig.HiddenSize)
+	}
+
+	if perceiver := m.Params.PerceiverConfig; perceiver != nil {
+		kv["clip.projector_type"] = "idefics2"
+		kv["clip.vision.perceiver.latents"] = uint32(perceiver.Latents)
+		kv["clip.vision.perceiver.block_count"] = uint32(perceiver.Depth)
+		kv["clip.vision.perceiver.head_count"] = uint32(perceiver.Heads)
+		kv["clip.vision.perceiver.head_count_kv"] = uint32(perceiver.KeyValHeads)
+		kv["clip.vision.perceiver.key_length"] = uint32(perceiver.HeadDim)
+	} else {
+		kv["clip.projector_type"] = "idefics3"
+		kv["clip.vision.projector.scale_factor"] = uint32(cmp.Or(m.Params.ScaleFactor, 1))
+	}
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks the vision tower and its connector were both found
+func (m *SiglipModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == "v.patch_embd.weight" }) {
+		return errors.New("siglip: vision tower not found")
+	}
+
+	if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return strings.HasPrefix(t.Name, "mm.") }) {
+		return errors.New("siglip: connector not found")
+	}
+
+	return nil
+}
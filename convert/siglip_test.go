@@ -0,0 +1,519 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func TestConvertSmolVLM(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures": []string{"Idefics3ForConditionalGeneration"},
+		"scale_factor":  4,
+		"vision_config": map[string]any{
+			"hidden_size":         8,
+			"intermediate_size":   16,
+			"num_hidden_layers":   1,
+			"num_attention_heads": 2,
+			"image_size":          8,
+			"patch_size":          2,
+		},
+		"text_config": map[string]any{
+			"hidden_size": 16,
+		},
+	})
+
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.vision_model.embeddings.patch_embedding.weight":          {8, 3, 2, 2},
+		"model.vision_model.embeddings.patch_embedding.bias":            {8},
+		"model.vision_model.embeddings.position_embedding.weight":       {16, 8},
+		"model.vision_model.encoder.layers.0.self_attn.q_proj.weight":   {8, 8},
+		"model.vision_model.encoder.layers.0.self_attn.q_proj.bias":     {8},
+		"model.vision_model.encoder.layers.0.self_attn.out_proj.weight": {8, 8},
+		"model.vision_model.encoder.layers.0.layer_norm1.weight":        {8},
+		"model.vision_model.encoder.layers.0.layer_norm2.weight":        {8},
+		"model.vision_model.encoder.layers.0.mlp.fc1.weight":            {16, 8},
+		"model.vision_model.encoder.layers.0.mlp.fc2.weight":            {8, 16},
+		"model.vision_model.post_layernorm.weight":                      {8},
+		"model.vision_model.head.probe":                                 {1, 1, 8},
+		"model.connector.modality_projection.proj.weight":               {16, 128},
+		"model.text_model.embed_tokens.weight":                          {4, 16},
+		"model.text_model.layers.0.self_attn.q_proj.weight":             {16, 16},
+		"lm_head.weight": {4, 16},
+	})
+
+	kv, tensors := convertDir(t, d, nil)
+	if kv.Architecture() != "clip" {
+		t.Fatalf("expected clip, got %s", kv.Architecture())
+	}
+
+	if kv["clip.projector_type"] != "idefics3" {
+		t.Fatalf("expected idefics3 projector, got %v", kv["clip.projector_type"])
+	}
+
+	if kv["clip.vision.projection_dim"] != uint32(16) {
+		t.Fatalf("expected projection_dim 16, got %v", kv["clip.vision.projection_dim"])
+	}
+
+	want := map[string]bool{
+		"v.patch_embd.weight":     true,
+		"v.patch_embd.bias":       true,
+		"v.position_embd.weight":  true,
+		"v.blk.0.attn_q.weight":   true,
+		"v.blk.0.attn_q.bias":     true,
+		"v.blk.0.attn_out.weight": true,
+		"v.blk.0.ln1.weight":      true,
+		"v.blk.0.ln2.weight":      true,
+		"v.blk.0.ffn_up.weight":   true,
+		"v.blk.0.ffn_down.weight": true,
+		"v.post_ln.weight":        true,
+		"mm.model.fc.weight":      true,
+	}
+
+	if len(tensors) != len(want) {
+		t.Fatalf("expected %d tensors, got %d", len(want), len(tensors))
+	}
+
+	for _, tensor := range tensors {
+		if !want[tensor.Name] {
+			t.Errorf("unexpected tensor %s", tensor.Name)
+		}
+
+		if strings.HasSuffix(tensor.Name, "patch_embd.weight") && len(tensor.Shape) != 4 {
+			t.Errorf("expected 4 dimensional patch embedding, got %v", tensor.Shape)
+		}
+	}
+}
+
+func TestConvertImageEmbedding(t *testing.T) {
+	vision := map[string][]uint64{
+		"vision_model.embeddings.patch_embedding.weight":        {8, 3, 2, 2},
+		"vision_model.embeddings.position_embedding.weight":     {16, 8},
+		"vision_model.encoder.layers.0.self_attn.q_proj.weight": {8, 8},
+		"vision_model.encoder.layers.0.layer_norm1.weight":      {8},
+		"vision_model.encoder.layers.0.mlp.fc1.weight":          {16, 8},
+		"vision_model.post_layernorm.weight":                    {8},
+		"text_model.embeddings.token_embedding.weight":          {4, 8},
+		"text_model.encoder.layers.0.self_attn.q_proj.weight":   {8, 8},
+		"logit_scale": {1},
+	}
+
+	cases := []struct {
+		architecture string
+		extra        map[string][]uint64
+		arch         string
+		head         string
+		projection   uint32
+	}{
+		{
+			architecture: "SiglipModel",
+			extra: map[string][]uint64{
+				"vision_model.head.probe":                     {1, 1, 8},
+				"vision_model.head.attention.in_proj_weight":  {24, 8},
+				"vision_model.head.attention.out_proj.weight": {8, 8},
+				"vision_model.head.layernorm.weight":          {8},
+				"vision_model.head.mlp.fc1.weight":            {16, 8},
+			},
+			arch:       "siglip",
+			head:       "v.head.probe",
+			projection: 8,
+		},
+		{
+			architecture: "CLIPModel",
+			extra: map[string][]uint64{
+				"vision_model.embeddings.class_embedding": {8},
+				"vision_model.pre_layrnorm.weight":        {8},
+				"visual_projection.weight":                {4, 8},
+			},
+			arch:       "clip",
+			head:       "v.proj.weight",
+			projection: 4,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.architecture, func(t *testing.T) {
+			d := t.TempDir()
+			createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+				"architectures":  []string{tt.architecture},
+				"projection_dim": 4,
+				"vision_config": map[string]any{
+					"hidden_size":         8,
+					"intermediate_size":   16,
+					"num_hidden_layers":   1,
+					"num_attention_heads": 2,
+					"image_size":          8,
+					"patch_size":          2,
+				},
+			})
+
+			tensors := maps.Clone(vision)
+			maps.Copy(tensors, tt.extra)
+			createSafetensors(t, filepath.Join(d, "model.safetensors"), tensors)
+
+			kv, ts := convertDir(t, d, nil)
+			if kv.Architecture() != tt.arch {
+				t.Fatalf("expected %s, got %s", tt.arch, kv.Architecture())
+			}
+
+			if kv["general.type"] != "image_embedding" {
+				t.Fatalf("expected image_embedding, got %v", kv["general.type"])
+			}
+
+			if got := kv[tt.arch+".vision.projection_dim"]; got != tt.projection {
+				t.Fatalf("expected projection_dim %d, got %v", tt.projection, got)
+			}
+
+			if len(ts) != 6+len(tt.extra) {
+				t.Fatalf("expected %d tensors, got %d", 6+len(tt.extra), len(ts))
+			}
+
+			var hasHead bool
+			for _, tensor := range ts {
+				if !strings.HasPrefix(tensor.Name, "v.") {
+					t.Errorf("unexpected tensor %s", tensor.Name)
+				}
+
+				hasHead = hasHead || tensor.Name == tt.head
+			}
+
+			if !hasHead {
+				t.Fatalf("expected %s", tt.head)
+			}
+		})
+	}
+}
+
+func TestConvertInternVL(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":    []string{"InternVLChatModel"},
+		"downsample_ratio": 0.5,
+		"vision_config": map[string]any{
+			"hidden_size":         8,
+			"intermediate_size":   16,
+			"num_hidden_layers":   1,
+			"num_attention_heads": 2,
+			"image_size":          8,
+			"patch_size":          2,
+			"qk_normalization":    true,
+		},
+		"llm_config": map[string]any{
+			"architectures": []string{"Qwen2ForCausalLM"},
+			"hidden_size":   16,
+		},
+	})
+
+	shapes := map[string][]uint64{
+		"vision_model.embeddings.class_embedding":          {1, 1, 8},
+		"vision_model.embeddings.patch_embedding.weight":   {8, 3, 2, 2},
+		"vision_model.embeddings.position_embedding":       {1, 17, 8},
+		"vision_model.encoder.layers.0.attn.qkv.weight":    {24, 8},
+		"vision_model.encoder.layers.0.attn.qkv.bias":      {24},
+		"vision_model.encoder.layers.0.attn.q_norm.weight": {8},
+		"vision_model.encoder.layers.0.attn.k_norm.weight": {8},
+		"vision_model.encoder.layers.0.attn.proj.weight":   {8, 8},
+		"vision_model.encoder.layers.0.norm1.weight":       {8},
+		"vision_model.encoder.layers.0.norm2.weight":       {8},
+		"vision_model.encoder.layers.0.mlp.fc1.weight":     {16, 8},
+		"vision_model.encoder.layers.0.mlp.fc2.weight":     {8, 16},
+		"vision_model.encoder.layers.0.ls1":                {8},
+		"vision_model.encoder.layers.0.ls2":                {8},
+		"mlp1.0.weight":                                    {32},
+		"mlp1.1.weight":                                    {16, 32},
+		"mlp1.3.weight":                                    {16, 16},
+		"language_model.model.embed_tokens.weight":         {4, 16},
+		"language_model.lm_head.weight":                    {4, 16},
+	}
+
+	values := make(map[string][]float32)
+	for name, shape := range shapes {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		values[name] = make([]float32, n)
+	}
+
+	// each of the query, key and value rows hold their index
+	for _, name := range []string{"vision_model.encoder.layers.0.attn.qkv.weight", "vision_model.encoder.layers.0.attn.qkv.bias"} {
+		for i := range values[name] {
+			values[name][i] = float32(i * 3 / len(values[name]))
+		}
+	}
+
+	writeSafetensors(t, filepath.Join(d, "model.safetensors"), shapes, values)
+
+	kv, tensors := convertDir(t, d, nil)
+	if kv.Architecture() != "clip" || kv["clip.projector_type"] != "internvl" {
+		t.Fatalf("expected internvl clip projector, got %s %v", kv.Architecture(), kv["clip.projector_type"])
+	}
+
+	if kv["clip.vision.projector.scale_factor"] != uint32(2) {
+		t.Fatalf("expected scale_factor 2, got %v", kv["clip.vision.projector.scale_factor"])
+	}
+
+	if kv["clip.vision.projection_dim"] != uint32(16) {
+		t.Fatalf("expected projection_dim 16, got %v", kv["clip.vision.projection_dim"])
+	}
+
+	if got := kv["clip.vision.image_mean"]; !reflect.DeepEqual(got, []any{float32(0.485), float32(0.456), float32(0.406)}) {
+		t.Fatalf("expected ImageNet mean, got %v", got)
+	}
+
+	want := map[string][]uint64{
+		"v.class_embd":               {8, 1, 1, 1},
+		"v.patch_embd.weight":        {2, 2, 3, 8},
+		"v.position_embd.weight":     {8, 17, 1, 1},
+		"v.blk.0.attn_q.weight":      {8, 8, 1, 1},
+		"v.blk.0.attn_k.weight":      {8, 8, 1, 1},
+		"v.blk.0.attn_v.weight":      {8, 8, 1, 1},
+		"v.blk.0.attn_q.bias":        {8, 1, 1, 1},
+		"v.blk.0.attn_k.bias":        {8, 1, 1, 1},
+		"v.blk.0.attn_v.bias":        {8, 1, 1, 1},
+		"v.blk.0.attn_q_norm.weight": {8, 1, 1, 1},
+		"v.blk.0.attn_k_norm.weight": {8, 1, 1, 1},
+		"v.blk.0.attn_out.weight":    {8, 8, 1, 1},
+		"v.blk.0.ln1.weight":         {8, 1, 1, 1},
+		"v.blk.0.ln2.weight":         {8, 1, 1, 1},
+		"v.blk.0.ffn_up.weight":      {8, 16, 1, 1},
+		"v.blk.0.ffn_down.weight":    {16, 8, 1, 1},
+		"v.blk.0.ls1.weight":         {8, 1, 1, 1},
+		"v.blk.0.ls2.weight":         {8, 1, 1, 1},
+		"mm.input_norm.weight":       {32, 1, 1, 1},
+		"mm.model.mlp.1.weight":      {32, 16, 1, 1},
+		"mm.model.mlp.3.weight":      {16, 16, 1, 1},
+	}
+
+	if len(tensors) != len(want) {
+		t.Fatalf("expected %d tensors, got %d", len(want), len(tensors))
+	}
+
+	for _, tensor := range tensors {
+		if shape, ok := want[tensor.Name]; !ok || !slices.Equal(tensor.Shape, shape) {
+			t.Errorf("unexpected tensor %s %v", tensor.Name, tensor.Shape)
+		}
+	}
+
+	mf := &SafetensorFormat{}
+	params, err := mf.GetParams(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch, err := mf.GetModelArch("", d, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tensor := range arch.(*InternVLModel).Tensors {
+		part := slices.IndexFunc([]string{"q", "k", "v"}, func(s string) bool {
+			return strings.HasPrefix(tensor.Name, "v.blk.0.attn_"+s+".")
+		})
+		if part < 0 {
+			continue
+		}
+
+		var b bytes.Buffer
+		if _, err := tensor.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		f32s := make([]float32, b.Len()/4)
+		if tensor.Kind == 1 {
+			u16s := make([]uint16, b.Len()/2)
+			if err := binary.Read(&b, binary.LittleEndian, u16s); err != nil {
+				t.Fatal(err)
+			}
+
+			f32s = f32s[:0]
+			for _, u := range u16s {
+				f32s = append(f32s, float16.Frombits(u).Float32())
+			}
+		} else if err := binary.Read(&b, binary.LittleEndian, f32s); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range f32s {
+			if f != float32(part) {
+				t.Fatalf("%s: expected %d, got %v", tensor.Name, part, f)
+			}
+		}
+	}
+}
+
+func TestConvertAyaVision(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":          []string{"AyaVisionForConditionalGeneration"},
+		"downsample_factor":      2,
+		"adapter_layer_norm_eps": 1e-5,
+		"vision_feature_layer":   -2,
+		"vision_config": map[string]any{
+			"hidden_size":         8,
+			"intermediate_size":   16,
+			"num_hidden_layers":   2,
+			"num_attention_heads": 2,
+			"image_size":          8,
+			"patch_size":          2,
+		},
+		"text_config": map[string]any{
+			"hidden_size": 16,
+		},
+	})
+
+	shapes := map[string][]uint64{
+		// a naflex linear patch embedding over 2x2 patches of 3 channels
+		"vision_tower.vision_model.embeddings.patch_embedding.weight":        {8, 12},
+		"vision_tower.vision_model.embeddings.patch_embedding.bias":          {8},
+		"vision_tower.vision_model.embeddings.position_embedding.weight":     {16, 8},
+		"vision_tower.vision_model.encoder.layers.0.self_attn.q_proj.weight": {8, 8},
+		"vision_tower.vision_model.encoder.layers.0.layer_norm1.weight":      {8},
+		"vision_tower.vision_model.encoder.layers.0.mlp.fc1.weight":          {16, 8},
+		"vision_tower.vision_model.encoder.layers.1.self_attn.q_proj.weight": {8, 8},
+		"vision_tower.vision_model.post_layernorm.weight":                    {8},
+		"multi_modal_projector.layernorm.weight":                             {32},
+		"multi_modal_projector.layernorm.bias":                               {32},
+		"multi_modal_projector.linear_1.weight":                              {32, 32},
+		"multi_modal_projector.linear_1.bias":                                {32},
+		"multi_modal_projector.linear_2.weight":                              {16, 16},
+		"language_model.model.embed_tokens.weight":                           {4, 16},
+	}
+
+	values := make(map[string][]float32)
+	for name, shape := range shapes {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		values[name] = make([]float32, n)
+		for i := range values[name] {
+			values[name][i] = float32(i)
+		}
+	}
+
+	writeSafetensors(t, filepath.Join(d, "model.safetensors"), shapes, values)
+
+	kv, tensors := convertDir(t, d, nil)
+	if kv.Architecture() != "clip" || kv["clip.projector_type"] != "aya_vision" {
+		t.Fatalf("expected aya_vision clip projector, got %s %v", kv.Architecture(), kv["clip.projector_type"])
+	}
+
+	for k, want := range map[string]any{
+		"clip.vision.block_count":                  uint32(1),
+		"clip.vision.projector.scale_factor":       uint32(2),
+		"clip.vision.projector.layer_norm_epsilon": float32(1e-5),
+		"clip.vision.projection_dim":               uint32(16),
+	} {
+		if kv[k] != want {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	want := map[string][]uint64{
+		"v.patch_embd.weight":    {2, 2, 3, 8},
+		"v.patch_embd.bias":      {8, 1, 1, 1},
+		"v.position_embd.weight": {8, 16, 1, 1},
+		"v.blk.0.attn_q.weight":  {8, 8, 1, 1},
+		"v.blk.0.ln1.weight":     {8, 1, 1, 1},
+		"v.blk.0.ffn_up.weight":  {8, 16, 1, 1},
+		"mm.input_norm.weight":   {32, 1, 1, 1},
+		"mm.input_norm.bias":     {32, 1, 1, 1},
+		"mm.ffn_up.weight":       {32, 16, 1, 1},
+		"mm.ffn_up.bias":         {16, 1, 1, 1},
+		"mm.ffn_gate.weight":     {32, 16, 1, 1},
+		"mm.ffn_gate.bias":       {16, 1, 1, 1},
+		"mm.ffn_down.weight":     {16, 16, 1, 1},
+	}
+
+	if len(tensors) != len(want) {
+		t.Fatalf("expected %d tensors, got %d", len(want), len(tensors))
+	}
+
+	for _, tensor := range tensors {
+		if shape, ok := want[tensor.Name]; !ok || !slices.Equal(tensor.Shape, shape) {
+			t.Errorf("unexpected tensor %s %v", tensor.Name, tensor.Shape)
+		}
+	}
+
+	mf := &SafetensorFormat{}
+	params, err := mf.GetParams(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch, err := mf.GetModelArch("", d, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) []float32 {
+		i := slices.IndexFunc(arch.(*AyaVisionModel).Tensors, func(t llm.Tensor) bool { return t.Name == name })
+		if i < 0 {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		tensor := arch.(*AyaVisionModel).Tensors[i]
+
+		var b bytes.Buffer
+		if _, err := tensor.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		f32s := make([]float32, b.Len()/4)
+		if tensor.Kind == 1 {
+			u16s := make([]uint16, b.Len()/2)
+			if err := binary.Read(&b, binary.LittleEndian, u16s); err != nil {
+				t.Fatal(err)
+			}
+
+			f32s = f32s[:0]
+			for _, u := range u16s {
+				f32s = append(f32s, float16.Frombits(u).Float32())
+			}
+		} else if err := binary.Read(&b, binary.LittleEndian, f32s); err != nil {
+			t.Fatal(err)
+		}
+
+		return f32s
+	}
+
+	// the first row of the convolution holds each channel of the pixels in
+	// turn rather than each pixel's channels
+	if got, want := read("v.patch_embd.weight")[:12], []float32{0, 3, 6, 9, 1, 4, 7, 10, 2, 5, 8, 11}; !slices.Equal(got, want) {
+		t.Fatalf("expected patch embedding %v, got %v", want, got)
+	}
+
+	// the first half of linear_1 is multiplied by the activated second half
+	if got := read("mm.ffn_up.bias"); got[0] != 0 || got[15] != 15 {
+		t.Fatalf("expected the first half of the bias, got %v", got)
+	}
+
+	if got := read("mm.ffn_gate.bias"); got[0] != 16 || got[15] != 31 {
+		t.Fatalf("expected the second half of the bias, got %v", got)
+	}
+
+	if got := read("mm.ffn_gate.weight"); got[0] != 16*32 {
+		t.Fatalf("expected the second half of the weight, got %v", got[:4])
+	}
+}
@@ -0,0 +1,189 @@
+package convert
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// StableLMModel converts Stability AI's StableLM. The layers are those of
+// llama with layer norms, which have biases, in place of RMS norms. Like
+// qwen2 the rotary embedding pairs dimensions half a head apart, so the query
+// and key aren't repacked, and only partial_rotary_factor of each head is
+// rotated. Models with qk_layernorm normalize each query and key head with a
+// norm of its own; those norms are stacked into one tensor per layer.
+type StableLMModel struct {
+	ModelData
+}
+
+// stableLMHeadNorm matches a per head norm, e.g. blk.0.attn_q_norm.3.weight
+var stableLMHeadNorm = regexp.MustCompile(`^(blk\.\d+\.attn_[qk]_norm)\.(\d+)\.weight$`)
+
+func (m *StableLMModel) GetTensors() error {
+	t, err := m.Format.GetTensorsFS(m.FS, m.Params)
+	if err != nil {
+		return err
+	}
+
+	norms := make(map[string][]llm.Tensor)
+	for _, l := range t {
+		match := stableLMHeadNorm.FindStringSubmatch(l.Name)
+		if match == nil {
+			m.Tensors = append(m.Tensors, l)
+			continue
+		}
+
+		head, err := strconv.Atoi(match[2])
+		if err != nil {
+			return err
+		}
+
+		heads := norms[match[1]]
+		if head >= len(heads) {
+			heads = append(heads, make([]llm.Tensor, head+1-len(heads))...)
+		}
+
+		heads[head] = l
+		norms[match[1]] = heads
+	}
+
+	var names []string
+	for name := range norms {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	for _, name := range names {
+		heads := norms[name]
+		for i, h := range heads {
+			if h.Name == "" {
+				return fmt.Errorf("stablelm: %s is missing the norm of head %d", name, i)
+			}
+
+			if !slices.Equal(h.Shape, heads[0].Shape) || len(h.Shape) != 1 {
+				return fmt.Errorf("stablelm: %s has head norms of shapes %v and %v", name, heads[0].Shape, h.Shape)
+			}
+		}
+
+		m.Tensors = append(m.Tensors, llm.Tensor{
+			Name:     name + ".weight",
+			Kind:     0,
+			Shape:    []uint64{uint64(len(heads)), heads[0].Shape[0]},
+			WriterTo: stackedWriterTo(heads),
+		})
+	}
+
+	updateOffsets(m.Tensors)
+	if m.Tensors, err = tieOutput(m.Tensors); err != nil {
+		return err
+	}
+
+	rope, err := m.Params.RopeScaling.Tensors(m.Params, nextOffset(m.Tensors))
+	if err != nil {
+		return err
+	}
+
+	m.Tensors = append(m.Tensors, rope...)
+	return nil
+}
+
+// stackedWriterTo writes the data of each tensor in turn, stacking tensors
+// of the same shape and kind along a new outermost dimension
+type stackedWriterTo []llm.Tensor
+
+func (ts stackedWriterTo) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, t := range ts {
+		m, err := t.WriteTo(w)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (m *StableLMModel) LoadVocab() error {
+	v, err := LoadBPETokensFS(m.tokenizerFS(), m.Params)
+	if err != nil {
+		return err
+	}
+
+	m.Vocab = v
+	return nil
+}
+
+func (m *StableLMModel) WriteGGUF(ws io.WriteSeeker) error {
+	headDim := m.Params.HiddenSize / m.Params.AttentionHeads
+
+	kv := llm.KV{
+		"general.architecture":                  "stablelm",
+		"general.name":                          m.Name,
+		"stablelm.vocab_size":                   uint32(len(m.Vocab.Tokens)),
+		"stablelm.context_length":               uint32(m.Params.contextLength()),
+		"stablelm.embedding_length":             uint32(m.Params.HiddenSize),
+		"stablelm.block_count":                  uint32(m.Params.HiddenLayers),
+		"stablelm.feed_forward_length":          uint32(m.Params.IntermediateSize),
+		"stablelm.rope.dimension_count":         uint32(float64(headDim) * cmp.Or(m.Params.PartialRotaryFactor, 0.25)),
+		"stablelm.rope.freq_base":               float32(cmp.Or(m.Params.RopeFrequencyBase, 10000)),
+		"stablelm.attention.head_count":         uint32(m.Params.AttentionHeads),
+		"stablelm.attention.head_count_kv":      uint32(m.Params.KeyValHeads),
+		"stablelm.attention.layer_norm_epsilon": float32(cmp.Or(m.Params.LayerNormEPS, 1e-5)),
+		"stablelm.use_parallel_residual":        m.Params.UseParallelResidual,
+		"general.file_type":                     m.Params.fileType(),
+		"tokenizer.ggml.model":                  m.Vocab.Model,
+		"tokenizer.ggml.pre":                    m.Params.PreTokenizer,
+		"tokenizer.ggml.tokens":                 m.Vocab.Tokens,
+		"tokenizer.ggml.token_type":             m.Vocab.Types,
+		"tokenizer.ggml.merges":                 m.Vocab.Merges,
+		"tokenizer.ggml.bos_token_id":           uint32(m.Params.BoSTokenID),
+		"tokenizer.ggml.eos_token_id":           uint32(m.Params.EoSTokenID),
+		"tokenizer.ggml.padding_token_id":       uint32(m.Params.PaddingTokenID),
+		"tokenizer.ggml.add_bos_token":          false,
+	}
+
+	maps.Copy(kv, m.Params.RopeScaling.KV("stablelm"))
+	maps.Copy(kv, m.Params.activationKV("stablelm", "silu"))
+
+	if err := m.Validate(kv, m.Tensors); err != nil {
+		return err
+	}
+
+	return m.Params.encodeGGUF(ws, kv, m.Tensors)
+}
+
+// Validate checks every layer has the norm biases and, when the config
+// enables them, the query, key and value biases and the query and key norms
+// stablelm runtimes expect
+func (m *StableLMModel) Validate(kv llm.KV, ts []llm.Tensor) error {
+	names := []string{"attn_norm.bias"}
+	if !m.Params.UseParallelResidual {
+		names = append(names, "ffn_norm.bias")
+	}
+
+	if m.Params.UseQKVBias {
+		names = append(names, "attn_q.bias", "attn_k.bias", "attn_v.bias")
+	}
+
+	if m.Params.QKLayerNorm {
+		names = append(names, "attn_q_norm.weight", "attn_k_norm.weight")
+	}
+
+	for i := range m.Params.HiddenLayers {
+		for _, name := range names {
+			name := fmt.Sprintf("blk.%d.%s", i, name)
+			if !slices.ContainsFunc(ts, func(t llm.Tensor) bool { return t.Name == name }) {
+				return fmt.Errorf("stablelm: %s not found", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// createTinyStableLM writes a single layer stablelm model with query, key
+// and value biases and per head query and key norms to a temporary directory
+func createTinyStableLM(t *testing.T) string {
+	t.Helper()
+
+	return createTinyModel(t, tinyModel{
+		config: map[string]any{
+			"architectures":           []string{"StableLmForCausalLM"},
+			"vocab_size":              4,
+			"hidden_size":             8,
+			"num_hidden_layers":       1,
+			"max_position_embeddings": 128,
+			"intermediate_size":       16,
+			"num_attention_heads":     2,
+			"num_key_value_heads":     1,
+			"layer_norm_eps":          1e-5,
+			"partial_rotary_factor":   0.5,
+			"rope_theta":              10000.0,
+			"use_qkv_bias":            true,
+			"qk_layernorm":            true,
+			"bos_token_id":            2,
+			"eos_token_id":            3,
+		},
+		tokenizer: tinyBPETokenizer("<|endoftext|>", "<|im_end|>"),
+		tensors: map[string][]uint64{
+			"model.embed_tokens.weight":                           {4, 8},
+			"model.norm.weight":                                   {8},
+			"model.norm.bias":                                     {8},
+			"lm_head.weight":                                      {4, 8},
+			"model.layers.0.input_layernorm.weight":               {8},
+			"model.layers.0.input_layernorm.bias":                 {8},
+			"model.layers.0.post_attention_layernorm.weight":      {8},
+			"model.layers.0.post_attention_layernorm.bias":        {8},
+			"model.layers.0.self_attn.q_proj.weight":              {8, 8},
+			"model.layers.0.self_attn.q_proj.bias":                {8},
+			"model.layers.0.self_attn.k_proj.weight":              {4, 8},
+			"model.layers.0.self_attn.k_proj.bias":                {4},
+			"model.layers.0.self_attn.v_proj.weight":              {4, 8},
+			"model.layers.0.self_attn.v_proj.bias":                {4},
+			"model.layers.0.self_attn.o_proj.weight":              {8, 8},
+			"model.layers.0.self_attn.q_layernorm.norms.0.weight": {4},
+			"model.layers.0.self_attn.q_layernorm.norms.1.weight": {4},
+			"model.layers.0.self_attn.k_layernorm.norms.0.weight": {4},
+			"model.layers.0.mlp.gate_proj.weight":                 {16, 8},
+			"model.layers.0.mlp.up_proj.weight":                   {16, 8},
+			"model.layers.0.mlp.down_proj.weight":                 {8, 16},
+		},
+		// the norm of each query head holds its head number
+		values: map[string]func(int) float32{
+			"model.layers.0.self_attn.q_layernorm.norms.0.weight": func(int) float32 { return 0 },
+			"model.layers.0.self_attn.q_layernorm.norms.1.weight": func(int) float32 { return 1 },
+		},
+	})
+}
+
+func TestConvertStableLM(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyStableLM(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+
+	for k, want := range map[string]any{
+		"general.architecture":                  "stablelm",
+		"stablelm.block_count":                  uint32(1),
+		"stablelm.attention.head_count":         uint32(2),
+		"stablelm.attention.head_count_kv":      uint32(1),
+		"stablelm.rope.dimension_count":         uint32(2),
+		"stablelm.attention.layer_norm_epsilon": float32(1e-5),
+		"stablelm.use_parallel_residual":        false,
+		"tokenizer.ggml.model":                  "gpt2",
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	tensors := make(map[string]*llm.Tensor)
+	for _, tensor := range ggml.Tensors() {
+		tensors[tensor.Name] = tensor
+	}
+
+	// shapes are innermost first
+	for name, want := range map[string][]uint64{
+		"output_norm.bias":         {8, 1, 1, 1},
+		"blk.0.attn_norm.bias":     {8, 1, 1, 1},
+		"blk.0.ffn_norm.bias":      {8, 1, 1, 1},
+		"blk.0.attn_q.bias":        {8, 1, 1, 1},
+		"blk.0.attn_q_norm.weight": {4, 2, 1, 1},
+		"blk.0.attn_k_norm.weight": {4, 1, 1, 1},
+	} {
+		tensor, ok := tensors[name]
+		if !ok {
+			t.Fatalf("expected tensor %s", name)
+		}
+
+		if !slices.Equal(tensor.Shape, want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, tensor.Shape)
+		}
+	}
+
+	for _, name := range []string{"blk.0.attn_q_norm.0.weight", "blk.0.attn_q_norm.1.weight", "blk.0.attn_k_norm.0.weight"} {
+		if _, ok := tensors[name]; ok {
+			t.Errorf("unexpected tensor %s", name)
+		}
+	}
+
+	norm := tensors["blk.0.attn_q_norm.weight"]
+	f32s, err := llm.DequantizeTensor(norm.Kind, data[norm.Offset:norm.Offset+norm.Size()], norm.Shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []float32{0, 0, 0, 0, 1, 1, 1, 1}; !slices.Equal(f32s, want) {
+		t.Fatalf("expected the head norms in order, got %v", f32s)
+	}
+
+	// pins the data of every converted tensor
+	if got, want := fmt.Sprintf("%x", sha256.Sum256(data)), "40e1c5169f2236dd4f2b7b24fe5e7abaadfdf4253359f7497fb2e1afb61bbf36"; got != want {
+		t.Fatalf("expected tensor data %s, got %s", want, got)
+	}
+}
+
+func TestConvertStableLMMissingHeadNorm(t *testing.T) {
+	d := createTinyStableLM(t)
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":                           {4, 8},
+		"model.layers.0.self_attn.q_layernorm.norms.1.weight": {4},
+	})
+
+	if _, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf")); err == nil || !strings.Contains(err.Error(), "missing the norm of head 0") {
+		t.Fatalf("expected missing head norm error, got %v", err)
+	}
+}
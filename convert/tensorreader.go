@@ -0,0 +1,204 @@
+package convert
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// TensorReader reads the tensors of a weight format other than safetensors
+// and torch checkpoints, e.g. an experimental container, so it can be
+// converted without changes to this package. The config.json and tokenizer of
+// the model are read as for a safetensors checkpoint, and tensors are named as
+// in a Hugging Face checkpoint, which are mapped to GGUF names as usual.
+type TensorReader interface {
+	// Match reports whether the files at the root of the model's directory
+	// are in the format of the reader
+	Match(files []string) bool
+
+	// ReadTensors returns the tensors of the model in fsys. Their data is
+	// only read when they are written.
+	ReadTensors(fsys fs.FS) ([]SourceTensor, error)
+}
+
+// SourceTensor is a tensor of a checkpoint read by a TensorReader
+type SourceTensor struct {
+	Name string
+
+	// Shape is outermost dimension first, as in a Hugging Face checkpoint
+	Shape []uint64
+
+	// Data returns the values of the tensor in the order of Shape in a slice
+	// the conversion may modify
+	Data func() ([]float32, error)
+}
+
+var (
+	tensorReadersMu sync.RWMutex
+	tensorReaders   = make(map[string]TensorReader)
+)
+
+// RegisterTensorReader makes the TensorReader r available under name.
+// GetModelFormat tries registered readers in the order of their names before
+// the safetensors and torch formats. It panics if name is already registered,
+// like database/sql.Register.
+func RegisterTensorReader(name string, r TensorReader) {
+	tensorReadersMu.Lock()
+	defer tensorReadersMu.Unlock()
+
+	if r == nil {
+		panic("convert: RegisterTensorReader reader is nil")
+	}
+
+	if _, ok := tensorReaders[name]; ok {
+		panic("convert: RegisterTensorReader called twice for reader " + name)
+	}
+
+	tensorReaders[name] = r
+}
+
+// matchTensorReader returns the first registered reader, in the order of
+// their names, which matches files
+func matchTensorReader(files []string) TensorReader {
+	tensorReadersMu.RLock()
+	defer tensorReadersMu.RUnlock()
+
+	names := make([]string, 0, len(tensorReaders))
+	for name := range tensorReaders {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	for _, name := range names {
+		if tensorReaders[name].Match(files) {
+			return tensorReaders[name]
+		}
+	}
+
+	return nil
+}
+
+// readerTensors returns the tensors of the reader of m named and typed as the
+// tensors of a safetensors checkpoint are
+func (m *SafetensorFormat) readerTensors(fsys fs.FS, params *Params) ([]llm.Tensor, error) {
+	sources, err := m.reader.ReadTensors(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	if !params.SourceOrder {
+		slices.SortStableFunc(sources, func(a, b SourceTensor) int { return strings.Compare(a.Name, b.Name) })
+	}
+
+	var offset uint64
+	var tensors []llm.Tensor
+	stripped := make(map[string]string)
+	for _, source := range sources {
+		var kind uint32
+		switch len(source.Shape) {
+		case 0:
+			params.skipTensor(source.Name)
+			continue
+		case 2:
+			if !params.F32 {
+				kind = 1
+			}
+		}
+
+		name, err := params.stripPrefix(source.Name, stripped)
+		if err != nil {
+			return nil, err
+		}
+
+		name, err = m.GetLayerName(name)
+		if err != nil && params.dryRun {
+			params.skipTensor(source.Name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		shape := slices.Clone(source.Shape)
+		kind, err = params.tensorKind(name, shape, kind)
+		if err != nil {
+			return nil, err
+		}
+
+		t := llm.Tensor{
+			Name:   name,
+			Kind:   kind,
+			Offset: offset,
+			Shape:  shape,
+		}
+
+		t.WriterTo = readerWriterTo{
+			t:      &t,
+			params: params,
+			bo:     params.ByteOrder,
+			data:   source.Data,
+		}
+
+		offset += t.Size()
+		tensors = append(tensors, t)
+	}
+
+	params.sortTensors(tensors)
+	return tensors, nil
+}
+
+// readerWriterTo writes the data of a tensor read by a TensorReader
+type readerWriterTo struct {
+	t *llm.Tensor
+
+	params *Params
+	bo     ByteOrder
+	data   func() ([]float32, error)
+
+	repacker func(string, []float32, []uint64) ([]float32, error)
+}
+
+// sameData reports whether o reads the same values as r. Repacked tensors
+// are never the same.
+func (r readerWriterTo) sameData(o io.WriterTo) (bool, error) {
+	s, ok := o.(readerWriterTo)
+	if !ok || r.repacker != nil || s.repacker != nil {
+		return false, nil
+	}
+
+	a, err := r.data()
+	if err != nil {
+		return false, err
+	}
+
+	b, err := s.data()
+	if err != nil {
+		return false, err
+	}
+
+	return equalFloats(a, b), nil
+}
+
+func (r readerWriterTo) WriteTo(w io.Writer) (int64, error) {
+	f32s, err := r.data()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", r.t.Name, err)
+	}
+
+	if err := r.params.checkFinite(r.t.Name, f32s); err != nil {
+		return 0, err
+	}
+
+	if r.repacker != nil {
+		f32s, err = r.repacker(r.t.Name, f32s, r.t.Shape)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, writeTensorData(w, r.bo, r.t.Kind, f32s)
+}
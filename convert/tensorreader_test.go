@@ -0,0 +1,136 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// jsonTensorReader reads tensors from model.json-tensors, a JSON object of
+// the shape and values of every tensor
+type jsonTensorReader struct{}
+
+func (jsonTensorReader) Match(files []string) bool {
+	return slices.Contains(files, "model.json-tensors")
+}
+
+func (jsonTensorReader) ReadTensors(fsys fs.FS) ([]SourceTensor, error) {
+	b, err := fs.ReadFile(fsys, "model.json-tensors")
+	if err != nil {
+		return nil, err
+	}
+
+	var tensors map[string]struct {
+		Shape  []uint64  `json:"shape"`
+		Values []float32 `json:"values"`
+	}
+
+	if err := json.Unmarshal(b, &tensors); err != nil {
+		return nil, err
+	}
+
+	var sources []SourceTensor
+	for name, t := range tensors {
+		sources = append(sources, SourceTensor{
+			Name:  name,
+			Shape: t.Shape,
+			Data:  func() ([]float32, error) { return slices.Clone(t.Values), nil },
+		})
+	}
+
+	return sources, nil
+}
+
+func init() {
+	RegisterTensorReader("json-tensors", jsonTensorReader{})
+}
+
+func TestTensorReader(t *testing.T) {
+	// the tensors of createTinyLlama
+	shapes := map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 8},
+		"model.norm.weight":                              {8},
+		"lm_head.weight":                                 {4, 8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.mlp.gate_proj.weight":            {16, 8},
+		"model.layers.0.mlp.up_proj.weight":              {16, 8},
+		"model.layers.0.mlp.down_proj.weight":            {8, 16},
+	}
+
+	values := make(map[string][]float32)
+	tensors := make(map[string]any)
+	for name, shape := range shapes {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		values[name] = make([]float32, n)
+		for i := range values[name] {
+			values[name][i] = float32(i%7) / 8
+		}
+
+		tensors[name] = map[string]any{"shape": shape, "values": values[name]}
+	}
+
+	safetensors := createTinyLlama(t)
+	writeSafetensors(t, filepath.Join(safetensors, "model.safetensors"), shapes, values)
+
+	d := createTinyLlama(t)
+	if err := os.Remove(filepath.Join(d, "model.safetensors")); err != nil {
+		t.Fatal(err)
+	}
+
+	createJSON(t, filepath.Join(d, "model.json-tensors"), tensors)
+
+	mf, err := GetModelFormat(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sf, ok := mf.(*SafetensorFormat); !ok || sf.reader == nil {
+		t.Fatalf("expected the registered reader, got %#v", mf)
+	}
+
+	// the same tensors convert the same, including the permuted query and key
+	want := filepath.Join(t.TempDir(), "want.gguf")
+	if _, err := ConvertToFile(safetensors, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got := filepath.Join(t.TempDir(), "got.gguf")
+	if _, err := ConvertToFile(d, got); err != nil {
+		t.Fatal(err)
+	}
+
+	wantBytes, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotBytes, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(gotBytes, wantBytes) {
+		t.Error("expected the registered reader to convert like safetensors")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a reader twice to panic")
+		}
+	}()
+
+	RegisterTensorReader("json-tensors", jsonTensorReader{})
+}
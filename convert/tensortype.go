@@ -0,0 +1,229 @@
+package convert
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/x448/float16"
+)
+
+// TensorTypes override the type tensors are written as by category. Each
+// type is one of F32, F16, Q8_0 or Q4_0. Categories left empty keep the
+// default of F32 for vectors and F16 for everything else.
+type TensorTypes struct {
+	// Embeddings is the type of token_embd
+	Embeddings string
+
+	// Attention is the type of the attention projections, attn_q, attn_k,
+	// attn_v and attn_output
+	Attention string
+
+	// FFN is the type of the feed forward network, including experts
+	FFN string
+
+	// Norms is the type of the norm weights and biases
+	Norms string
+
+	// Output is the type of output
+	Output string
+}
+
+// forName returns the type of the category of the tensor name
+func (tt TensorTypes) forName(name string) string {
+	switch {
+	case strings.HasPrefix(name, "token_embd."):
+		return tt.Embeddings
+	case strings.HasPrefix(name, "output."):
+		return tt.Output
+	case strings.Contains(name, "norm"):
+		return tt.Norms
+	case strings.Contains(name, ".attn_"):
+		return tt.Attention
+	case strings.Contains(name, ".ffn_"):
+		return tt.FFN
+	default:
+		return ""
+	}
+}
+
+// tensorKind returns the kind the tensor name with shape is written as. kind
+// is returned unless the category of name has a type of its own or kind is
+// F16 and the params quantize. Q8_0 and Q4_0 are quantized in blocks of 32
+// along the last dimension so tensors without a multiple of 32 there keep
+// kind.
+func (p *Params) tensorKind(name string, shape []uint64, kind uint32) (uint32, error) {
+	tt := p.TensorTypes.forName(name)
+	if tt == "" && kind == 1 {
+		tt = p.Quantize
+	}
+
+	switch tt {
+	case "":
+		return kind, nil
+	case "F32":
+		return 0, nil
+	case "F16":
+		return 1, nil
+	case "Q8_0", "Q4_0":
+		var last uint64
+		for _, dim := range shape {
+			if dim > 0 {
+				last = dim
+			}
+		}
+
+		if last%q8_0BlockSize != 0 {
+			p.warn("tensor can't be quantized to "+tt+", keeping its default type", "name", name, "shape", shape)
+			return kind, nil
+		}
+
+		if tt == "Q4_0" {
+			return 2, nil
+		}
+
+		return 8, nil
+	default:
+		return 0, fmt.Errorf("unsupported tensor type %q for %s", tt, name)
+	}
+}
+
+// q8_0BlockSize is the number of values sharing a scale in Q8_0
+const q8_0BlockSize = 32
+
+// q4_0BlockSize is the number of values sharing a scale in Q4_0
+const q4_0BlockSize = 32
+
+// writeTensorData writes f32s to w as kind
+func writeTensorData(w io.Writer, bo ByteOrder, kind uint32, f32s []float32) error {
+	switch kind {
+	case 0:
+		return binary.Write(w, bo, f32s)
+	case 1:
+		f16s := make([]uint16, len(f32s))
+		for i := range f32s {
+			f16s[i] = float16.Fromfloat32(f32s[i]).Bits()
+		}
+
+		return binary.Write(w, bo, f16s)
+	case 2, 8:
+		return writeQuantized(w, bo, kind, func(values []float32) error {
+			if len(f32s) < len(values) {
+				return io.EOF
+			}
+
+			f32s = f32s[copy(values, f32s):]
+			return nil
+		})
+	default:
+		return fmt.Errorf("unknown storage type: %d", kind)
+	}
+}
+
+// writeQuantized writes a tensor as kind, Q8_0 or Q4_0, one block at a time.
+// next fills values with the next block of the tensor and returns io.EOF
+// after the last one so only a single block is held in memory.
+func writeQuantized(w io.Writer, bo ByteOrder, kind uint32, next func(values []float32) error) error {
+	var block interface {
+		quantize([]float32)
+		appendBytes([]byte, ByteOrder) []byte
+	}
+
+	switch kind {
+	case 2:
+		block = &blockQ4_0{}
+	case 8:
+		block = &blockQ8_0{}
+	default:
+		return fmt.Errorf("storage type %d isn't quantized", kind)
+	}
+
+	values := make([]float32, q8_0BlockSize)
+	b := make([]byte, 0, 2+q8_0BlockSize)
+	for {
+		if err := next(values); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		block.quantize(values)
+		if _, err := w.Write(block.appendBytes(b[:0], bo)); err != nil {
+			return err
+		}
+	}
+}
+
+// blockQ8_0 is 32 values quantized to int8 with a shared F16 scale
+type blockQ8_0 struct {
+	D  uint16
+	Qs [q8_0BlockSize]int8
+}
+
+// quantize quantizes a block of values like ggml's reference implementation.
+// The block is scaled so its largest magnitude maps to 127.
+func (q *blockQ8_0) quantize(values []float32) {
+	var amax float32
+	for _, v := range values {
+		amax = max(amax, float32(math.Abs(float64(v))))
+	}
+
+	d := amax / 127
+	var id float32
+	if d != 0 {
+		id = 1 / d
+	}
+
+	q.D = float16.Fromfloat32(d).Bits()
+	for j, v := range values {
+		q.Qs[j] = int8(math.Round(float64(v * id)))
+	}
+}
+
+func (q *blockQ8_0) appendBytes(b []byte, bo ByteOrder) []byte {
+	b = bo.AppendUint16(b, q.D)
+	for _, v := range q.Qs {
+		b = append(b, byte(v))
+	}
+
+	return b
+}
+
+// blockQ4_0 is 32 values quantized to 4 bits with a shared F16 scale. The low
+// nibbles are the first half of the block.
+type blockQ4_0 struct {
+	D  uint16
+	Qs [q4_0BlockSize / 2]uint8
+}
+
+// quantize quantizes a block of values like ggml's reference implementation.
+// The block is scaled so the value of its largest magnitude maps to -8 and
+// the other values are rounded to the 16 levels from -8 to 7.
+func (q *blockQ4_0) quantize(values []float32) {
+	var amax, vmax float32
+	for _, v := range values {
+		if a := float32(math.Abs(float64(v))); a > amax {
+			amax, vmax = a, v
+		}
+	}
+
+	d := vmax / -8
+	var id float32
+	if d != 0 {
+		id = 1 / d
+	}
+
+	q.D = float16.Fromfloat32(d).Bits()
+	for j := range q4_0BlockSize / 2 {
+		x0 := min(15, int8(values[j]*id+8.5))
+		x1 := min(15, int8(values[j+q4_0BlockSize/2]*id+8.5))
+		q.Qs[j] = uint8(x0) | uint8(x1)<<4
+	}
+}
+
+func (q *blockQ4_0) appendBytes(b []byte, bo ByteOrder) []byte {
+	return append(bo.AppendUint16(b, q.D), q.Qs[:]...)
+}
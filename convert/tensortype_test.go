@@ -0,0 +1,408 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func TestConvertTensorTypes(t *testing.T) {
+	d := createTinyLlama(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"LlamaForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             32,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       64,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+	})
+
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 32},
+		"model.norm.weight":                              {32},
+		"lm_head.weight":                                 {4, 32},
+		"model.layers.0.input_layernorm.weight":          {32},
+		"model.layers.0.post_attention_layernorm.weight": {32},
+		"model.layers.0.self_attn.q_proj.weight":         {32, 32},
+		"model.layers.0.self_attn.k_proj.weight":         {32, 32},
+		"model.layers.0.self_attn.v_proj.weight":         {32, 32},
+		"model.layers.0.self_attn.o_proj.weight":         {32, 32},
+		"model.layers.0.mlp.gate_proj.weight":            {64, 32},
+		"model.layers.0.mlp.up_proj.weight":              {64, 32},
+		"model.layers.0.mlp.down_proj.weight":            {32, 64},
+	})
+
+	cases := []struct {
+		name  string
+		types TensorTypes
+		want  map[string]uint32
+	}{
+		{
+			name: "default",
+			want: map[string]uint32{
+				"token_embd.weight":        1,
+				"output.weight":            1,
+				"output_norm.weight":       0,
+				"blk.0.attn_norm.weight":   0,
+				"blk.0.ffn_norm.weight":    0,
+				"blk.0.attn_q.weight":      1,
+				"blk.0.attn_output.weight": 1,
+				"blk.0.ffn_gate.weight":    1,
+				"blk.0.ffn_down.weight":    1,
+			},
+		},
+		{
+			name: "categories",
+			types: TensorTypes{
+				Embeddings: "Q8_0",
+				Attention:  "F32",
+				FFN:        "Q8_0",
+				Norms:      "F16",
+				Output:     "F32",
+			},
+			want: map[string]uint32{
+				"token_embd.weight":        8,
+				"output.weight":            0,
+				"output_norm.weight":       1,
+				"blk.0.attn_norm.weight":   1,
+				"blk.0.ffn_norm.weight":    1,
+				"blk.0.attn_q.weight":      0,
+				"blk.0.attn_output.weight": 0,
+				"blk.0.ffn_gate.weight":    8,
+				"blk.0.ffn_down.weight":    8,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, tensors := convertDir(t, d, func(p *Params) { p.TensorTypes = tt.types })
+
+			got := make(map[string]uint32)
+			for _, tensor := range tensors {
+				got[tensor.Name] = tensor.Kind
+			}
+
+			for name, kind := range tt.want {
+				if got[name] != kind {
+					t.Errorf("%s: expected kind %d, got %d", name, kind, got[name])
+				}
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		mf := &SafetensorFormat{}
+		params, err := mf.GetParams(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params.TensorTypes = TensorTypes{FFN: "Q4_K"}
+		if _, err := mf.GetTensors(d, params); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestQuantizeQ8_0(t *testing.T) {
+	f32s := make([]float32, 2*q8_0BlockSize)
+	for i := range q8_0BlockSize {
+		f32s[i] = float32(i-16) / 4
+	}
+
+	var b bytes.Buffer
+	if err := writeTensorData(&b, binary.LittleEndian, 8, f32s); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Len() != 2*(2+q8_0BlockSize) {
+		t.Fatalf("expected %d bytes, got %d", 2*(2+q8_0BlockSize), b.Len())
+	}
+
+	blocks := make([]blockQ8_0, 2)
+	if err := binary.Read(&b, binary.LittleEndian, blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	d := float16.Frombits(blocks[0].D).Float32()
+	for i := range q8_0BlockSize {
+		if got := float32(blocks[0].Qs[i]) * d; got-f32s[i] > d/2 || f32s[i]-got > d/2 {
+			t.Fatalf("value %d: expected %v, got %v", i, f32s[i], got)
+		}
+	}
+
+	// a block of zeros has no scale
+	if blocks[1].D != 0 || blocks[1].Qs != [q8_0BlockSize]int8{} {
+		t.Fatalf("expected zero block, got %+v", blocks[1])
+	}
+}
+
+func TestQuantizeQ4_0(t *testing.T) {
+	f32s := make([]float32, 2*q4_0BlockSize)
+	for i := range q4_0BlockSize {
+		f32s[i] = float32(i-12) / 4
+	}
+
+	var b bytes.Buffer
+	if err := writeTensorData(&b, binary.LittleEndian, 2, f32s); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Len() != 2*(2+q4_0BlockSize/2) {
+		t.Fatalf("expected %d bytes, got %d", 2*(2+q4_0BlockSize/2), b.Len())
+	}
+
+	got, err := llm.DequantizeTensor(2, b.Bytes(), []uint64{uint64(len(f32s))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the largest magnitude is exact and the rest are within a step
+	if got[q4_0BlockSize-1] != f32s[q4_0BlockSize-1] {
+		t.Fatalf("expected %v, got %v", f32s[q4_0BlockSize-1], got[q4_0BlockSize-1])
+	}
+
+	step := f32s[q4_0BlockSize-1] / 8
+	for i := range q4_0BlockSize {
+		if diff := got[i] - f32s[i]; diff > step || -diff > step {
+			t.Fatalf("value %d: expected %v, got %v", i, f32s[i], got[i])
+		}
+	}
+
+	// a block of zeros has no scale
+	for i := q4_0BlockSize; i < len(got); i++ {
+		if got[i] != 0 {
+			t.Fatalf("value %d: expected 0, got %v", i, got[i])
+		}
+	}
+}
+
+func TestQuantizeStream(t *testing.T) {
+	f32s := make([]float32, 4*q8_0BlockSize)
+	for i := range f32s {
+		f32s[i] = float32(i%13-6) / 4
+	}
+
+	// the values are exact in every dtype so each must quantize like f32s
+	raw := map[string][]byte{}
+	for _, v := range f32s {
+		raw["F32"] = binary.LittleEndian.AppendUint32(raw["F32"], math.Float32bits(v))
+		raw["F16"] = binary.LittleEndian.AppendUint16(raw["F16"], float16.Fromfloat32(v).Bits())
+		raw["BF16"] = binary.LittleEndian.AppendUint16(raw["BF16"], uint16(math.Float32bits(v)>>16))
+	}
+
+	for _, kind := range []uint32{2, 8} {
+		var want bytes.Buffer
+		if err := writeTensorData(&want, binary.LittleEndian, kind, f32s); err != nil {
+			t.Fatal(err)
+		}
+
+		for dtype, b := range raw {
+			w := safetensorWriterTo{
+				t:        &llm.Tensor{Name: "blk.0.ffn_up.weight", Kind: kind},
+				params:   &Params{},
+				bo:       binary.LittleEndian,
+				fsys:     fstest.MapFS{"model.safetensors": {Data: append([]byte("header"), b...)}},
+				filename: "model.safetensors",
+				dtype:    dtype,
+				offset:   int64(len("header")),
+				size:     int64(len(b)),
+			}
+
+			var got bytes.Buffer
+			if _, err := w.WriteTo(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("kind %d from %s: expected the blocks of the whole tensor", kind, dtype)
+			}
+
+			// a tensor cut short fails rather than writing fewer blocks
+			w.fsys = fstest.MapFS{"model.safetensors": {Data: append([]byte("header"), b[:len(b)-1]...)}}
+			if _, err := w.WriteTo(io.Discard); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("kind %d from %s: expected %v, got %v", kind, dtype, io.ErrUnexpectedEOF, err)
+			}
+		}
+	}
+}
+
+func TestConvertWithQuantization(t *testing.T) {
+	d := createTinyLlama(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"LlamaForCausalLM"},
+		"vocab_size":              4,
+		"hidden_size":             32,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       64,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     2,
+		"rms_norm_eps":            1e-5,
+		"bos_token_id":            2,
+		"eos_token_id":            3,
+	})
+
+	tensors := map[string][]uint64{
+		"model.embed_tokens.weight":                      {4, 32},
+		"model.norm.weight":                              {32},
+		"lm_head.weight":                                 {4, 32},
+		"model.layers.0.input_layernorm.weight":          {32},
+		"model.layers.0.post_attention_layernorm.weight": {32},
+		"model.layers.0.self_attn.q_proj.weight":         {32, 32},
+		"model.layers.0.self_attn.k_proj.weight":         {32, 32},
+		"model.layers.0.self_attn.v_proj.weight":         {32, 32},
+		"model.layers.0.self_attn.o_proj.weight":         {32, 32},
+		"model.layers.0.mlp.gate_proj.weight":            {64, 32},
+		"model.layers.0.mlp.up_proj.weight":              {64, 32},
+		"model.layers.0.mlp.down_proj.weight":            {32, 64},
+	}
+
+	// signed values so Q4_0 uses both ends of its range
+	values := make(map[string][]float32)
+	for name, shape := range tensors {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		values[name] = make([]float32, n)
+		for i := range values[name] {
+			values[name][i] = float32(int(i*7+len(name))%23-11) / 16
+		}
+	}
+
+	writeSafetensors(t, filepath.Join(d, "model.safetensors"), tensors, values)
+
+	reference := filepath.Join(t.TempDir(), "model.gguf")
+	f, err := os.Create(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	mf, err := GetModelFormat(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := mf.GetParams(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params.F32 = true
+	arch, err := mf.GetModelArch("", d, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.GetTensors(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.LoadVocab(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := arch.WriteGGUF(f); err != nil {
+		t.Fatal(err)
+	}
+
+	want, wantData := decodeFile(t, reference)
+
+	cases := []struct {
+		name  string
+		ftype uint32
+		kind  uint32
+		// the largest error relative to the largest magnitude of a block
+		bound float32
+	}{
+		{"Q8_0", 7, 8, 1.0 / 127},
+		{"Q4_0", 2, 2, 1.0 / 8},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "model.gguf")
+			f, err := os.Create(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			if err := ConvertWithQuantization(d, f, tt.ftype); err != nil {
+				t.Fatal(err)
+			}
+
+			got, gotData := decodeFile(t, p)
+			if ft := got.KV().FileType().String(); ft != tt.name {
+				t.Fatalf("expected file type %s, got %s", tt.name, ft)
+			}
+
+			for i, tensor := range got.Tensors() {
+				ref := want.Tensors()[i]
+				if tensor.Name != ref.Name {
+					t.Fatalf("expected tensor %s, got %s", ref.Name, tensor.Name)
+				}
+
+				kind := tt.kind
+				if strings.Contains(tensor.Name, "norm") {
+					kind = 0
+				}
+
+				if tensor.Kind != kind {
+					t.Fatalf("%s: expected kind %d, got %d", tensor.Name, kind, tensor.Kind)
+				}
+
+				f32s, err := llm.DequantizeTensor(tensor.Kind, gotData[tensor.Offset:tensor.Offset+tensor.Size()], tensor.Shape)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				refs, err := llm.DequantizeTensor(ref.Kind, wantData[ref.Offset:ref.Offset+ref.Size()], ref.Shape)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for start := 0; start < len(refs); start += 32 {
+					block := refs[start:min(start+32, len(refs))]
+
+					var amax float32
+					for _, v := range block {
+						amax = max(amax, float32(math.Abs(float64(v))))
+					}
+
+					for j, v := range block {
+						// allow for the F16 rounding of the scale
+						if diff := math.Abs(float64(f32s[start+j] - v)); diff > float64(amax*tt.bound)*1.01 {
+							t.Fatalf("%s: value %d: expected %v, got %v", tensor.Name, start+j, v, f32s[start+j])
+						}
+					}
+				}
+			}
+		})
+	}
+
+	// the file type is checked before anything is written
+	if err := ConvertWithQuantization(d, nil, 1); err == nil {
+		t.Fatal("expected error for F16")
+	}
+}
@@ -1,15 +1,17 @@
 package convert
 
 import (
+	"bytes"
 	"cmp"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"slices"
-
-	"golang.org/x/exp/maps"
+	"strings"
 )
 
 type Tokenizer struct {
@@ -18,27 +20,123 @@ type Tokenizer struct {
 	Model       TokenizerModel `json:"model"`
 
 	PreTokenizer struct {
-		PreTokenizers []struct {
-			Type    string `json:"type"`
-			Pattern struct {
-				Regex string `json:"Regex"`
-			} `json:"pattern"`
-		} `json:"pretokenizers"`
+		PreTokenizer
+		PreTokenizers []PreTokenizer `json:"pretokenizers"`
 	} `json:"pre_tokenizer"`
 }
 
+// PreTokenizer is a step of the pre-tokenizer of tokenizer.json, which splits
+// text into the words tokens are merged within
+type PreTokenizer struct {
+	Type    string `json:"type"`
+	Pattern struct {
+		Regex string `json:"Regex"`
+	} `json:"pattern"`
+
+	// UseRegex is whether a ByteLevel step splits with the regex of GPT-2
+	UseRegex *bool `json:"use_regex"`
+
+	// IndividualDigits is whether a Digits step splits every digit
+	IndividualDigits bool `json:"individual_digits"`
+}
+
+// gpt2PreTokenizerRegex is the regex ByteLevel pre-tokenizers split text with
+const gpt2PreTokenizerRegex = `'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+`
+
+// preTokenizerRegexes returns the regexes t splits text with, in order. Digits
+// splitting every digit is written as the regex \p{N} as llama.cpp does. A
+// ByteLevel step splits with the regex of GPT-2 unless use_regex is false.
+// Older tokenizers omit use_regex, which is then only taken to be true when
+// no Split step splits with a regex of its own.
+func (t *Tokenizer) preTokenizerRegexes() []string {
+	steps := t.PreTokenizer.PreTokenizers
+	if t.PreTokenizer.Type != "Sequence" {
+		steps = []PreTokenizer{t.PreTokenizer.PreTokenizer}
+	}
+
+	split := slices.ContainsFunc(steps, func(pt PreTokenizer) bool { return pt.Type == "Split" && pt.Pattern.Regex != "" })
+
+	var regexes []string
+	for _, pt := range steps {
+		switch pt.Type {
+		case "Split":
+			if pt.Pattern.Regex != "" {
+				regexes = append(regexes, pt.Pattern.Regex)
+			}
+		case "Digits":
+			if pt.IndividualDigits {
+				regexes = append(regexes, `\p{N}`)
+			}
+		case "ByteLevel":
+			if pt.UseRegex != nil && *pt.UseRegex || pt.UseRegex == nil && !split {
+				regexes = append(regexes, gpt2PreTokenizerRegex)
+			}
+		}
+	}
+
+	return regexes
+}
+
+// preTokenizers are the tokenizer.ggml.pre of pre-tokenizers by the digest of
+// their regexes, see preTokenizerRegexes
+var preTokenizers = map[string]string{
+	"d98f9631be1e9607a9848c26c1f9eac1aa9fc21ac6ba82a2fc0741af9780a48f": "llama-bpe",
+	"03df5c5863ad70781dcfdef491ead25140f895fe8010964be0daefe27be32b02": "deepseek-llm",
+	"21cde974d587f0d54dc8d56b183cc1e6239600172035c68fbd6d4b9f8da0576e": "deepseek-coder",
+	"1ff7f41064896984db5d1bb6ff64fa4bc29007d08c1b439e505b7392777a319e": "qwen2",
+	"eeb55ba74cc544ae7067587b680d16521d9891de9e94c7ba9412c0e0e93b1c36": "gpt-2",
+	"d5d7e1b34b94ab2b4b788e47363cd60946d12cc6cd20bad41f9246f4756c3b37": "starcoder",
+}
+
 type TokenizerModel struct {
 	Type   string         `json:"type"`
 	Vocab  map[string]int `json:"vocab"`
-	Merges []string       `json:"merges"`
+	Merges Merges         `json:"merges"`
 	Tokens []Token
 }
 
+// Merges are the merges of a BPE tokenizer, each the left and right token
+// joined by a space as GGUF stores them. tokenizer.json stores merges either
+// this way or, in newer tokenizers, as pairs of tokens.
+type Merges []string
+
+func (m *Merges) UnmarshalJSON(b []byte) error {
+	var merges []string
+	if err := json.Unmarshal(b, &merges); err == nil {
+		*m = merges
+		return nil
+	}
+
+	var pairs [][]string
+	if err := json.Unmarshal(b, &pairs); err != nil {
+		return fmt.Errorf("merges must be strings or pairs of tokens: %w", err)
+	}
+
+	merges = make([]string, len(pairs))
+	for i, pair := range pairs {
+		if len(pair) != 2 {
+			return fmt.Errorf("merge %d has %d tokens, expected 2", i, len(pair))
+		}
+
+		// runtimes split a merge at the first space after its first
+		// character, so only the right token may contain other spaces
+		if left := pair[0]; len(left) > 1 && strings.Contains(left[1:], " ") {
+			return fmt.Errorf("merge %d can't be joined by a space since its left token %q contains one", i, left)
+		}
+
+		merges[i] = pair[0] + " " + pair[1]
+	}
+
+	*m = merges
+	return nil
+}
+
 type Token struct {
 	ID          int    `json:"id"`
 	Content     string `json:"content"`
 	Special     bool   `json:"special"`
 	UserDefined bool
+	Unused      bool
 }
 
 func (t *Token) Type() int32 {
@@ -47,29 +145,155 @@ func (t *Token) Type() int32 {
 		return tokenTypeControl
 	case t.UserDefined:
 		return tokenTypeUserDefined
+	case t.Unused:
+		return tokenTypeUnused
 	default:
 		return tokenTypeNormal
 	}
 }
 
 func (t *Tokenizer) maxID() int {
-	return max(
-		slices.Max(maps.Values(t.Model.Vocab)),
-		slices.MaxFunc(t.AddedTokens, func(a, b Token) int {
-			return cmp.Compare(a.ID, b.ID)
-		}).ID,
-	)
+	id := -1
+	for _, v := range t.Model.Vocab {
+		id = max(id, v)
+	}
+
+	// not every tokenizer has added tokens
+	for _, v := range t.AddedTokens {
+		id = max(id, v.ID)
+	}
+
+	return id
+}
+
+// LoadBPETokens reads a byte pair encoding vocabulary from the tokenizer.json
+// in dirpath and sets the pre-tokenizer in params. The vocabulary has no
+// scores since BPE ranks merges by their order in Merges rather than scoring
+// tokens, so gpt2 vocabularies are written without tokenizer.ggml.scores.
+func LoadBPETokens(dirpath string, params *Params) (*Vocab, error) {
+	return LoadBPETokensFS(os.DirFS(dirpath), params)
+}
+
+// LoadBPETokensFS reads a vocabulary like LoadBPETokens from the
+// tokenizer.json at the root of fsys
+func LoadBPETokensFS(fsys fs.FS, params *Params) (*Vocab, error) {
+	pre, ts, merges, err := parseTokens(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vocab{Model: "gpt2"}
+	for _, t := range ts {
+		v.Tokens = append(v.Tokens, t.Content)
+		v.Types = append(v.Types, t.Type())
+	}
+
+	v.Merges = merges
+	params.PreTokenizer = pre
+	return v, nil
+}
+
+// thinkTokens are the tokens reasoning models such as QwQ and DeepSeek-R1
+// open and close their reasoning with
+var thinkTokens = [2]string{"<think>", "</think>"}
+
+// resolveThinkTokens sets the IDs of the think tokens in params and marks the
+// tokens as control tokens. Tokenizers often list them as added tokens which
+// aren't special, so they'd otherwise be written as user defined. Nothing is
+// set unless the vocabulary has both tokens.
+func (m *ModelData) resolveThinkTokens() {
+	if m.Vocab == nil {
+		return
+	}
+
+	var ids []uint32
+	var missing []string
+	for _, token := range thinkTokens {
+		if id := slices.Index(m.Vocab.Tokens, token); id >= 0 {
+			ids = append(ids, uint32(id))
+		} else {
+			missing = append(missing, token)
+		}
+	}
+
+	if len(missing) > 0 {
+		if len(ids) > 0 {
+			m.Params.warn("vocabulary is missing a think token", "token", missing[0])
+		}
+
+		return
+	}
+
+	for _, id := range ids {
+		if int(id) < len(m.Vocab.Types) {
+			m.Vocab.Types[id] = tokenTypeControl
+		}
+	}
+
+	m.Params.ThinkTokenIDs = ids
+}
+
+// readChatTemplate returns the chat_template of the tokenizer_config.json in
+// fsys or an empty string if there is none. Configs with several
+// templates list them as objects with a name and a template, in which case
+// the one named default is used, or the first if none is.
+func readChatTemplate(fsys fs.FS) (string, error) {
+	b, err := fs.ReadFile(fsys, "tokenizer_config.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var config struct {
+		ChatTemplate json.RawMessage `json:"chat_template"`
+	}
+
+	if err := json.Unmarshal(trimBOM(b), &config); err != nil {
+		return "", err
+	}
+
+	if len(config.ChatTemplate) == 0 || string(config.ChatTemplate) == "null" {
+		return "", nil
+	}
+
+	var template string
+	if err := json.Unmarshal(config.ChatTemplate, &template); err == nil {
+		return template, nil
+	}
+
+	var templates []struct {
+		Name     string `json:"name"`
+		Template string `json:"template"`
+	}
+
+	if err := json.Unmarshal(config.ChatTemplate, &templates); err != nil {
+		return "", fmt.Errorf("tokenizer_config.json: chat_template must be a string or a list of named templates: %w", err)
+	}
+
+	if len(templates) == 0 {
+		return "", nil
+	}
+
+	for _, t := range templates {
+		if t.Name == "default" {
+			return t.Template, nil
+		}
+	}
+
+	return templates[0].Template, nil
 }
 
-func parseTokens(dirpath string) (pre string, tokens []Token, merges []string, err error) {
-	f, err := os.Open(dirpath)
+// parseTokens reads the tokens, merges and pre-tokenizer of the
+// tokenizer.json in fsys
+func parseTokens(fsys fs.FS) (pre string, tokens []Token, merges []string, err error) {
+	b, err := fs.ReadFile(fsys, "tokenizer.json")
 	if err != nil {
-		panic(err)
+		return "", nil, nil, err
 	}
-	defer f.Close()
 
 	var t Tokenizer
-	if err := json.NewDecoder(f).Decode(&t); err != nil {
+	if err := json.Unmarshal(trimBOM(b), &t); err != nil {
 		return "", nil, nil, err
 	}
 
@@ -78,32 +302,124 @@ func parseTokens(dirpath string) (pre string, tokens []Token, merges []string, e
 		tokens[v] = Token{ID: v, Content: k, Special: false, UserDefined: false}
 	}
 
+	// added tokens may redefine a token of the base vocabulary, in which case
+	// they replace it rather than taking another ID. One which moves a base
+	// token to another ID leaves a placeholder at its old ID so the vocabulary
+	// doesn't hold it twice.
 	for _, v := range t.AddedTokens {
+		if base := tokens[v.ID]; base.Content != "" && base.Content != v.Content {
+			slog.Warn("added token replaces a different base token", "id", v.ID, "base", base.Content, "added", v.Content)
+		}
+
+		if id, ok := t.Model.Vocab[v.Content]; ok && id != v.ID && tokens[id].Content == v.Content {
+			slog.Warn("added token moves a base token", "from", id, "to", v.ID, "content", v.Content)
+			tokens[id] = Token{ID: id, Content: fmt.Sprintf("<unused%05d>", id), Unused: true}
+		}
+
 		v.UserDefined = true
 		tokens[v.ID] = v
 	}
 
-	sha256sum := sha256.New()
-	for _, pt := range t.PreTokenizer.PreTokenizers {
-		switch pt.Type {
-		case "Split":
-			if pt.Pattern.Regex != "" {
-				sha256sum.Write([]byte(pt.Pattern.Regex))
+	// known vocabularies are matched before the pre-tokenizer regex
+	pre, ok := knownPreTokenizers[fingerprintTokens(tokens)]
+	if !ok {
+		sha256sum := sha256.New()
+		for _, regex := range t.preTokenizerRegexes() {
+			sha256sum.Write([]byte(regex))
+		}
+
+		digest := fmt.Sprintf("%x", sha256sum.Sum(nil))
+		if pre, ok = preTokenizers[digest]; !ok {
+			slog.Warn("unknown pretokenizer, using default", "digest", digest)
+			pre = "default"
+		}
+	}
+
+	merges = t.Model.Merges
+	if t.Model.Type == "BPE" && len(merges) == 0 {
+		merges = mergesFromRanks(t.Model.Vocab)
+		slog.Warn("tokenizer has no merges, reconstructed them from the token ranks", "merges", len(merges))
+	}
+
+	return pre, tokens, merges, nil
+}
+
+// fingerprintLength is the number of special tokens a fingerprint digests.
+// Byte-level BPE vocabularies all start with the same 256 single byte tokens
+// and fine-tunes often add merges or tokens of their own, but the first
+// special tokens of a vocabulary keep their IDs.
+const fingerprintLength = 2
+
+// knownPreTokenizers are the pre-tokenizers of known vocabularies by their
+// fingerprint. They are matched before the pre-tokenizer regex, which
+// fine-tunes often rewrite in ways that change its digest but not how text is
+// split.
+var knownPreTokenizers = map[string]string{
+	// <|begin_of_text|> and <|end_of_text|> at 128000
+	"66ded24dccab45ede839b227eb40da9855903935bf3fd6454ca5c8e64d8a2c24": "llama-bpe",
+	// <|endoftext|> and <|im_start|> at 151643
+	"184e32811e1f9f345110ab2d851e93c12f6a04e185c7064e9c3f7951e8e43141": "qwen2",
+}
+
+// fingerprintTokens returns the fingerprint of a vocabulary, the sha256 of
+// the ID and content of each of its first fingerprintLength special tokens
+// followed by NUL bytes, or an empty string if it has fewer
+func fingerprintTokens(tokens []Token) string {
+	h := sha256.New()
+	var n int
+	for _, t := range tokens {
+		if !t.Special {
+			continue
+		}
+
+		fmt.Fprintf(h, "%d\x00%s\x00", t.ID, t.Content)
+		if n++; n == fingerprintLength {
+			return fmt.Sprintf("%x", h.Sum(nil))
+		}
+	}
+
+	return ""
+}
+
+// mergesFromRanks reconstructs the merges of a BPE vocabulary which only
+// stores the rank of each token, e.g. one exported from tiktoken. Every split
+// of a token into two tokens of the vocabulary is a merge. Merges are ordered
+// by the rank of the token they produce, then by the ranks of the left and
+// right parts, which is the priority Hugging Face's converters give them.
+func mergesFromRanks(vocab map[string]int) []string {
+	type merge struct {
+		left, right               string
+		rank, leftRank, rightRank int
+	}
+
+	var ms []merge
+	for token, rank := range vocab {
+		runes := []rune(token)
+		for i := 1; i < len(runes); i++ {
+			left, right := string(runes[:i]), string(runes[i:])
+			l, lok := vocab[left]
+			r, rok := vocab[right]
+			if lok && rok {
+				ms = append(ms, merge{left, right, rank, l, r})
 			}
 		}
 	}
 
-	switch digest := fmt.Sprintf("%x", sha256sum.Sum(nil)); digest {
-	case "d98f9631be1e9607a9848c26c1f9eac1aa9fc21ac6ba82a2fc0741af9780a48f":
-		pre = "llama-bpe"
-	case "03df5c5863ad70781dcfdef491ead25140f895fe8010964be0daefe27be32b02":
-		pre = "deepseek-llm"
-	case "21cde974d587f0d54dc8d56b183cc1e6239600172035c68fbd6d4b9f8da0576e":
-		pre = "deepseek-coder"
-	default:
-		slog.Warn("unknown pretokenizer, using default", "digest", digest)
-		pre = "default"
+	slices.SortFunc(ms, func(a, b merge) int {
+		return cmp.Or(cmp.Compare(a.rank, b.rank), cmp.Compare(a.leftRank, b.leftRank), cmp.Compare(a.rightRank, b.rightRank))
+	})
+
+	merges := make([]string, len(ms))
+	for i, m := range ms {
+		merges[i] = m.left + " " + m.right
 	}
 
-	return pre, tokens, t.Model.Merges, nil
+	return merges
+}
+
+// trimBOM removes a UTF-8 byte order mark some editors write at the start of
+// JSON files, which encoding/json rejects. Tokens are left as they are, even
+// those starting with a byte order mark.
+func trimBOM(b []byte) []byte {
+	return bytes.TrimPrefix(b, []byte("\ufeff"))
 }
@@ -0,0 +1,772 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ollama/ollama/convert/sentencepiece"
+)
+
+func TestLoadBPETokensAddedTokens(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"a": 0, "b": 1, "<|end|>": 2},
+			"merges": []string{"a b"},
+		},
+		"added_tokens": []map[string]any{
+			// the same token as the base vocabulary
+			{"id": 2, "content": "<|end|>", "special": true},
+			// a different token than the base vocabulary
+			{"id": 1, "content": "<|sep|>", "special": true},
+			{"id": 3, "content": "<|pad|>", "special": false},
+		},
+	})
+
+	v, err := LoadBPETokens(d, &Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"a", "<|sep|>", "<|end|>", "<|pad|>"}; !slices.Equal(v.Tokens, want) {
+		t.Fatalf("expected tokens %v, got %v", want, v.Tokens)
+	}
+
+	if want := []int32{tokenTypeNormal, tokenTypeControl, tokenTypeControl, tokenTypeUserDefined}; !slices.Equal(v.Types, want) {
+		t.Fatalf("expected types %v, got %v", want, v.Types)
+	}
+}
+
+func TestConvertTokensUnchanged(t *testing.T) {
+	t.Run("bpe", func(t *testing.T) {
+		d := createTinyQwen2(t)
+		b, err := json.Marshal(map[string]any{
+			"model": map[string]any{
+				"type":   "BPE",
+				"vocab":  map[string]int{"▁a": 0, "\ufeffb": 1},
+				"merges": []string{"▁a \ufeffb"},
+			},
+			"added_tokens": []map[string]any{
+				{"id": 2, "content": "<|endoftext|>", "special": true},
+				{"id": 3, "content": "e\u0301", "special": false},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the file itself starts with a byte order mark
+		if err := os.WriteFile(filepath.Join(d, "tokenizer.json"), append([]byte("\ufeff"), b...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if _, err := ConvertToFile(d, p); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, _ := decodeFile(t, p)
+		if got, want := ggml.KV()["tokenizer.ggml.tokens"], []any{"▁a", "\ufeffb", "<|endoftext|>", "e\u0301"}; !equalValue(got, want) {
+			t.Fatalf("expected tokens %q, got %q", want, got)
+		}
+	})
+
+	t.Run("sentencepiece", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if _, err := ConvertToFile(createTinyPhi3(t), p); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, _ := decodeFile(t, p)
+		if got, want := ggml.KV()["tokenizer.ggml.tokens"], []any{"<unk>", "<s>", "</s>", "▁a"}; !equalValue(got, want) {
+			t.Fatalf("expected tokens %q, got %q", want, got)
+		}
+	})
+}
+
+func TestConvertTokenizerDir(t *testing.T) {
+	tokenizer := func(t *testing.T, vocab map[string]int) string {
+		d := t.TempDir()
+		createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+			"model": map[string]any{
+				"type":   "BPE",
+				"vocab":  vocab,
+				"merges": []string{"x y"},
+			},
+			"added_tokens": []map[string]any{
+				{"id": 3, "content": "<|eot|>", "special": true},
+			},
+		})
+		return d
+	}
+
+	weights := func(t *testing.T) string {
+		d := createTinyQwen2(t)
+		if err := os.Remove(filepath.Join(d, "tokenizer.json")); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if _, err := ConvertToFileWithOptions(weights(t), p, Options{TokenizerDir: tokenizer(t, map[string]int{"x": 0, "y": 1, "xy": 2})}); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, _ := decodeFile(t, p)
+		kv := ggml.KV()
+		if got, want := kv["tokenizer.ggml.tokens"], []any{"x", "y", "xy", "<|eot|>"}; !equalValue(got, want) {
+			t.Fatalf("expected tokens %q, got %q", want, got)
+		}
+
+		if got, want := kv["tokenizer.ggml.token_type"], []any{tokenTypeNormal, tokenTypeNormal, tokenTypeNormal, tokenTypeControl}; !equalValue(got, want) {
+			t.Fatalf("expected token types %v, got %v", want, got)
+		}
+
+		if got := kv["general.architecture"]; got != "qwen2" {
+			t.Fatalf("expected the config of the weights, got architecture %v", got)
+		}
+	})
+
+	t.Run("fs", func(t *testing.T) {
+		fsys := fstest.MapFS{}
+		for dir, prefix := range map[string]string{weights(t): "", tokenizer(t, map[string]int{"x": 0, "y": 1, "xy": 2}): "tokenizer/"} {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, e := range entries {
+				b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				fsys[prefix+e.Name()] = &fstest.MapFile{Data: b}
+			}
+		}
+
+		// the directory is looked up in fsys rather than the working directory
+		p := filepath.Join(t.TempDir(), "model.gguf")
+		if _, err := ConvertFS(fsys, p, Options{TokenizerDir: "tokenizer"}); err != nil {
+			t.Fatal(err)
+		}
+
+		ggml, _ := decodeFile(t, p)
+		if got, want := ggml.KV()["tokenizer.ggml.tokens"], []any{"x", "y", "xy", "<|eot|>"}; !equalValue(got, want) {
+			t.Fatalf("expected tokens %q, got %q", want, got)
+		}
+
+		if _, err := ConvertFS(fsys, p, Options{TokenizerDir: "../tokenizer"}); err == nil {
+			t.Fatal("expected an error for a directory outside of fsys")
+		}
+	})
+
+	t.Run("vocab size", func(t *testing.T) {
+		_, err := ConvertToFileWithOptions(weights(t), filepath.Join(t.TempDir(), "model.gguf"), Options{TokenizerDir: tokenizer(t, map[string]int{"x": 0, "y": 1, "xy": 2, "z": 4})})
+		if err == nil || !strings.Contains(err.Error(), "has 5 tokens but the token embeddings have 4") {
+			t.Fatalf("expected vocab size error, got %v", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		// llama converts without a vocabulary when it has no tokenizer
+		d := createTinyLlama(t)
+		if err := os.Remove(filepath.Join(d, "tokenizer.json")); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := ConvertToFileWithOptions(d, filepath.Join(t.TempDir(), "model.gguf"), Options{TokenizerDir: t.TempDir()})
+		if err == nil || !strings.Contains(err.Error(), "no tokenizer found") {
+			t.Fatalf("expected missing tokenizer error, got %v", err)
+		}
+	})
+}
+
+func TestConvertAddedTokens(t *testing.T) {
+	d := createTinyQwen2(t)
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"x": 0, "y": 1, "<|im_end|>": 2, "z": 3},
+			"merges": []string{"x y"},
+		},
+		"added_tokens": []map[string]any{
+			// moves <|im_end|> from 2 and replaces y
+			{"id": 1, "content": "<|im_end|>", "special": true},
+			// replaces z
+			{"id": 3, "content": "<|tool|>", "special": false},
+		},
+	})
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _ := decodeFile(t, p)
+	kv := ggml.KV()
+	if got, want := kv["tokenizer.ggml.tokens"], []any{"x", "<|im_end|>", "<unused00002>", "<|tool|>"}; !equalValue(got, want) {
+		t.Fatalf("expected tokens %q, got %q", want, got)
+	}
+
+	if got, want := kv["tokenizer.ggml.token_type"], []any{tokenTypeNormal, tokenTypeControl, tokenTypeUnused, tokenTypeUserDefined}; !equalValue(got, want) {
+		t.Fatalf("expected token types %v, got %v", want, got)
+	}
+}
+
+func TestLoadBPETokensMergesFromRanks(t *testing.T) {
+	d := t.TempDir()
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":  "BPE",
+			"vocab": map[string]int{"a": 0, "b": 1, "c": 2, "ab": 3, "bc": 4, "abc": 5, "Ġ": 6, "Ġa": 7},
+		},
+	})
+
+	v, err := LoadBPETokens(d, &Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a b", "b c", "a bc", "ab c", "Ġ a"}
+	if !slices.Equal(v.Merges, want) {
+		t.Fatalf("expected merges %q, got %q", want, v.Merges)
+	}
+
+	// merging the pair of highest priority until none is left encodes every
+	// token of the vocabulary as itself
+	ranks := make(map[string]int)
+	for i, merge := range v.Merges {
+		ranks[merge] = i
+	}
+
+	for _, token := range v.Tokens {
+		var parts []string
+		for _, r := range token {
+			parts = append(parts, string(r))
+		}
+
+		for {
+			best := -1
+			for i := range len(parts) - 1 {
+				if rank, ok := ranks[parts[i]+" "+parts[i+1]]; ok && (best < 0 || rank < ranks[parts[best]+" "+parts[best+1]]) {
+					best = i
+				}
+			}
+
+			if best < 0 {
+				break
+			}
+
+			parts = slices.Replace(parts, best, best+2, parts[best]+parts[best+1])
+		}
+
+		if len(parts) != 1 || parts[0] != token {
+			t.Errorf("%q: expected one token, got %q", token, parts)
+		}
+	}
+
+	// an explicit merges list is kept as it is
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"a": 0, "b": 1, "ab": 2},
+			"merges": []string{"a b"},
+		},
+	})
+
+	if v, err := LoadBPETokens(d, &Params{}); err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(v.Merges, []string{"a b"}) {
+		t.Fatalf("expected the explicit merges, got %q", v.Merges)
+	}
+}
+
+func TestLoadBPETokensMergePairs(t *testing.T) {
+	cases := []struct {
+		name   string
+		merges any
+		want   []string
+		err    bool
+	}{
+		{"strings", []string{"a b", "ab c"}, []string{"a b", "ab c"}, false},
+		{"pairs", [][]string{{"a", "b"}, {"ab", "c"}}, []string{"a b", "ab c"}, false},
+		// only the first space after the first character splits a merge
+		{"spaces", [][]string{{" ", "a"}, {"a", "b c"}}, []string{"  a", "a b c"}, false},
+		{"space in left token", [][]string{{"a b", "c"}}, nil, true},
+		{"three tokens", [][]string{{"a", "b", "c"}}, nil, true},
+		{"numbers", []int{1, 2}, nil, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := t.TempDir()
+			createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+				"model": map[string]any{
+					"type":   "BPE",
+					"vocab":  map[string]int{"a": 0, "b": 1, "c": 2, " ": 3},
+					"merges": tt.merges,
+				},
+			})
+
+			v, err := LoadBPETokens(d, &Params{})
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(v.Merges, tt.want) {
+				t.Fatalf("expected merges %q, got %q", tt.want, v.Merges)
+			}
+		})
+	}
+}
+
+// byteLevelVocab returns a vocabulary starting with the 256 single byte
+// tokens of byte-level BPE in GPT-2's order: the printable bytes as
+// themselves, then the others shifted past U+00FF
+func byteLevelVocab() map[string]int {
+	printable := func(b int) bool {
+		return b >= '!' && b <= '~' || b >= 0xa1 && b <= 0xac || b >= 0xae
+	}
+
+	vocab := make(map[string]int)
+	for b := range 256 {
+		if printable(b) {
+			vocab[string(rune(b))] = len(vocab)
+		}
+	}
+
+	shifted := 0
+	for b := range 256 {
+		if !printable(b) {
+			vocab[string(rune(256+shifted))] = len(vocab)
+			shifted++
+		}
+	}
+
+	return vocab
+}
+
+func TestLoadBPETokensFingerprint(t *testing.T) {
+	special := func(id int, content string) map[string]any {
+		return map[string]any{"id": id, "content": content, "special": true}
+	}
+
+	llama3 := []map[string]any{special(128000, "<|begin_of_text|>"), special(128001, "<|end_of_text|>")}
+	qwen2 := []map[string]any{special(151643, "<|endoftext|>"), special(151644, "<|im_start|>")}
+
+	cases := []struct {
+		name   string
+		added  []map[string]any
+		merges int
+		want   string
+	}{
+		{"llama3", llama3, 280147, "llama-bpe"},
+		{"qwen2", qwen2, 151387, "qwen2"},
+		// fine-tunes add merges and special tokens of their own
+		{"llama3 fine-tune", append(slices.Clone(llama3), special(128256, "<|tool|>")), 280148, "llama-bpe"},
+		// the merges count of a known vocabulary doesn't identify it
+		{"same merges", []map[string]any{special(128000, "<s>"), special(128001, "</s>")}, 280147, "default"},
+		{"unknown", nil, 3, "default"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			merges := make([]string, tt.merges)
+			for i := range merges {
+				merges[i] = fmt.Sprintf("m%d a", i)
+			}
+
+			// a rewritten regex doesn't hide a known vocabulary
+			d := t.TempDir()
+			createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+				"model": map[string]any{
+					"type":   "BPE",
+					"vocab":  byteLevelVocab(),
+					"merges": merges,
+				},
+				"added_tokens": tt.added,
+				"pre_tokenizer": map[string]any{
+					"type": "Sequence",
+					"pretokenizers": []map[string]any{
+						{"type": "Split", "pattern": map[string]any{"Regex": `\p{L}+`}},
+					},
+				},
+			})
+
+			var p Params
+			if _, err := LoadBPETokens(d, &p); err != nil {
+				t.Fatal(err)
+			}
+
+			if p.PreTokenizer != tt.want {
+				t.Fatalf("expected pre-tokenizer %q, got %q", tt.want, p.PreTokenizer)
+			}
+		})
+	}
+}
+
+func TestLoadBPETokensPreTokenizer(t *testing.T) {
+	gpt2 := `'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+`
+	llama3 := `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+
+	split := func(regex string) map[string]any {
+		return map[string]any{"type": "Split", "pattern": map[string]any{"Regex": regex}}
+	}
+
+	sequence := func(steps ...map[string]any) map[string]any {
+		return map[string]any{"type": "Sequence", "pretokenizers": steps}
+	}
+
+	cases := []struct {
+		name         string
+		preTokenizer any
+		want         string
+	}{
+		{"gpt-2", map[string]any{"type": "ByteLevel", "use_regex": true}, "gpt-2"},
+		// use_regex defaults to true in tokenizers which predate it
+		{"gpt-2 without use_regex", map[string]any{"type": "ByteLevel"}, "gpt-2"},
+		{"gpt-2 split", sequence(split(gpt2), map[string]any{"type": "ByteLevel", "use_regex": false}), "gpt-2"},
+		{"llama3", sequence(split(llama3), map[string]any{"type": "ByteLevel", "use_regex": false}), "llama-bpe"},
+		// a ByteLevel without use_regex after a Split doesn't split again
+		{"llama3 without use_regex", sequence(split(llama3), map[string]any{"type": "ByteLevel"}), "llama-bpe"},
+		{"starcoder", sequence(map[string]any{"type": "Digits", "individual_digits": true}, map[string]any{"type": "ByteLevel", "use_regex": true}), "starcoder"},
+		{"no regex", map[string]any{"type": "ByteLevel", "use_regex": false}, "default"},
+		{"unknown", sequence(split(`\p{L}+`)), "default"},
+		{"none", nil, "default"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := t.TempDir()
+			createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+				"model": map[string]any{
+					"type":   "BPE",
+					"vocab":  map[string]int{"a": 0, "b": 1, "ab": 2},
+					"merges": []string{"a b"},
+				},
+				"pre_tokenizer": tt.preTokenizer,
+			})
+
+			var p Params
+			if _, err := LoadBPETokens(d, &p); err != nil {
+				t.Fatal(err)
+			}
+
+			if p.PreTokenizer != tt.want {
+				t.Fatalf("expected pre-tokenizer %q, got %q", tt.want, p.PreTokenizer)
+			}
+		})
+	}
+}
+
+func TestLoadSentencePieceTokensTypes(t *testing.T) {
+	piece := func(s string, score float32, typ sentencepiece.ModelProto_SentencePiece_Type) *sentencepiece.ModelProto_SentencePiece {
+		return &sentencepiece.ModelProto_SentencePiece{Piece: proto.String(s), Score: proto.Float32(score), Type: typ.Enum()}
+	}
+
+	b, err := proto.Marshal(&sentencepiece.ModelProto{
+		TrainerSpec: &sentencepiece.TrainerSpec{
+			ModelType:    sentencepiece.TrainerSpec_UNIGRAM.Enum(),
+			ByteFallback: proto.Bool(true),
+		},
+		Pieces: []*sentencepiece.ModelProto_SentencePiece{
+			piece("<unk>", 0, sentencepiece.ModelProto_SentencePiece_UNKNOWN),
+			piece("<s>", 0, sentencepiece.ModelProto_SentencePiece_CONTROL),
+			piece("<0x0A>", 0, sentencepiece.ModelProto_SentencePiece_BYTE),
+			// byte pieces exported as normal ones
+			piece("<0xFF>", 0, sentencepiece.ModelProto_SentencePiece_NORMAL),
+			piece("<0xGG>", -1, sentencepiece.ModelProto_SentencePiece_NORMAL),
+			piece("<mask>", 0, sentencepiece.ModelProto_SentencePiece_USER_DEFINED),
+			piece("▁a", -2.5, sentencepiece.ModelProto_SentencePiece_NORMAL),
+			piece("▁b", -3.25, sentencepiece.ModelProto_SentencePiece_NORMAL),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := t.TempDir()
+	if err := os.WriteFile(filepath.Join(d, "tokenizer.model"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := LoadSentencePieceTokens(d, &Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int32{tokenTypeUnknown, tokenTypeControl, tokenTypeByte, tokenTypeByte, tokenTypeNormal, tokenTypeUserDefined, tokenTypeNormal, tokenTypeNormal}; !slices.Equal(v.Types, want) {
+		t.Fatalf("expected types %v, got %v", want, v.Types)
+	}
+
+	if want := []float32{0, 0, 0, 0, -1, 0, -2.5, -3.25}; !slices.Equal(v.Scores, want) {
+		t.Fatalf("expected scores %v, got %v", want, v.Scores)
+	}
+}
+
+func TestConvertBPEWithoutScores(t *testing.T) {
+	v, err := LoadBPETokens(createTinyQwen2(t), &Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// scores aren't made up from the token IDs
+	if v.Scores != nil {
+		t.Fatalf("expected no scores, got %v", v.Scores)
+	}
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyQwen2(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _ := decodeFile(t, p)
+	if scores, ok := ggml.KV()["tokenizer.ggml.scores"]; ok {
+		t.Fatalf("expected no tokenizer.ggml.scores, got %v", scores)
+	}
+}
+
+func TestConvertChatTemplate(t *testing.T) {
+	cases := []struct {
+		name     string
+		template any
+		want     any
+	}{
+		{"string", "{{ bos_token }}{{ messages }}", "{{ bos_token }}{{ messages }}"},
+		{
+			"named",
+			[]map[string]string{
+				{"name": "tool_use", "template": "{{ tools }}"},
+				{"name": "default", "template": "{{ messages }}"},
+			},
+			"{{ messages }}",
+		},
+		{"named without default", []map[string]string{{"name": "rag", "template": "{{ documents }}"}}, "{{ documents }}"},
+		{"null", nil, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			d := createTinyQwen2(t)
+			createJSON(t, filepath.Join(d, "tokenizer_config.json"), map[string]any{
+				"chat_template": tt.template,
+			})
+
+			p := filepath.Join(t.TempDir(), "model.gguf")
+			if _, err := ConvertToFile(d, p); err != nil {
+				t.Fatal(err)
+			}
+
+			ggml, _ := decodeFile(t, p)
+			if got := ggml.KV()["tokenizer.chat_template"]; got != tt.want {
+				t.Fatalf("expected chat template %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		d := createTinyQwen2(t)
+		createJSON(t, filepath.Join(d, "tokenizer_config.json"), map[string]any{"chat_template": 1})
+
+		if _, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf")); err == nil || !strings.Contains(err.Error(), "chat_template") {
+			t.Fatalf("expected chat_template error, got %v", err)
+		}
+	})
+}
+
+func TestConvertThinkTokens(t *testing.T) {
+	// the think tokens of R1 distills are added tokens which aren't special
+	d := createTinyQwen2(t)
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"a": 0},
+			"merges": []string{"a a"},
+		},
+		"added_tokens": []map[string]any{
+			{"id": 1, "content": "<｜end▁of▁sentence｜>", "special": true},
+			{"id": 2, "content": "<think>", "special": false},
+			{"id": 3, "content": "</think>", "special": false},
+		},
+	})
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(d, p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _ := decodeFile(t, p)
+	kv := ggml.KV()
+	for k, want := range map[string]any{
+		"tokenizer.ggml.think_start_token_id": uint32(2),
+		"tokenizer.ggml.think_end_token_id":   uint32(3),
+	} {
+		if !equalValue(kv[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	if got, want := kv["tokenizer.ggml.token_type"], []any{tokenTypeNormal, tokenTypeControl, tokenTypeControl, tokenTypeControl}; !equalValue(got, want) {
+		t.Errorf("expected token types %v, got %v", want, got)
+	}
+
+	// a vocabulary without them has no think token IDs
+	p = filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFile(createTinyQwen2(t), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _ = decodeFile(t, p)
+	if _, ok := ggml.KV()["tokenizer.ggml.think_start_token_id"]; ok {
+		t.Error("unexpected tokenizer.ggml.think_start_token_id")
+	}
+}
+
+func TestConvertBPEWithoutMerges(t *testing.T) {
+	// merges which aren't parsed leave none to reconstruct from a vocabulary
+	// of single characters
+	d := createTinyQwen2(t)
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  map[string]int{"a": 0, "b": 1},
+			"merges": []string{},
+		},
+	})
+
+	_, err := ConvertToFile(d, filepath.Join(t.TempDir(), "model.gguf"))
+	if err == nil || !strings.Contains(err.Error(), "tokenizer.ggml.merges is empty") {
+		t.Fatalf("expected an error for empty merges, got %v", err)
+	}
+}
+
+func TestConvertPadVocab(t *testing.T) {
+	d := createTinyQwen2(t)
+	createJSON(t, filepath.Join(d, "config.json"), map[string]any{
+		"architectures":           []string{"Qwen2ForCausalLM"},
+		"vocab_size":              50257,
+		"hidden_size":             8,
+		"num_hidden_layers":       1,
+		"max_position_embeddings": 128,
+		"intermediate_size":       16,
+		"num_attention_heads":     2,
+		"num_key_value_heads":     1,
+		"rms_norm_eps":            1e-6,
+		"bos_token_id":            50256,
+		"eos_token_id":            50256,
+	})
+
+	vocab := make(map[string]int)
+	for i := range 50256 {
+		vocab[fmt.Sprintf("t%d", i)] = i
+	}
+
+	createJSON(t, filepath.Join(d, "tokenizer.json"), map[string]any{
+		"model": map[string]any{
+			"type":   "BPE",
+			"vocab":  vocab,
+			"merges": []string{"t 1"},
+		},
+		"added_tokens": []map[string]any{
+			{"id": 50256, "content": "<|endoftext|>", "special": true},
+		},
+	})
+
+	createSafetensors(t, filepath.Join(d, "model.safetensors"), map[string][]uint64{
+		"model.embed_tokens.weight":                      {50257, 8},
+		"model.norm.weight":                              {8},
+		"lm_head.weight":                                 {50257, 8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.q_proj.bias":           {8},
+		"model.layers.0.self_attn.k_proj.weight":         {4, 8},
+		"model.layers.0.self_attn.k_proj.bias":           {4},
+		"model.layers.0.self_attn.v_proj.weight":         {4, 8},
+		"model.layers.0.self_attn.v_proj.bias":           {4},
+	})
+
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	if _, err := ConvertToFileWithOptions(d, p, Options{PadVocab: 64}); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, data := decodeFile(t, p)
+	kv := ggml.KV()
+	if got := kv["qwen2.vocab_size"]; got != uint32(50304) {
+		t.Fatalf("expected vocab_size 50304, got %v", got)
+	}
+
+	tokens := kv["tokenizer.ggml.tokens"].([]any)
+	if len(tokens) != 50304 || tokens[50256] != "<|endoftext|>" || kv["tokenizer.ggml.eos_token_id"] != uint32(50256) {
+		t.Fatalf("expected 50304 tokens keeping the special token IDs, got %d with %v at 50256", len(tokens), tokens[50256])
+	}
+
+	if types := kv["tokenizer.ggml.token_type"].([]any); types[50257] != tokenTypeUnused || types[50303] != tokenTypeUnused {
+		t.Fatalf("expected unused padding tokens, got %v", types[50257:])
+	}
+
+	for _, tensor := range ggml.Tensors() {
+		if tensor.Name != "token_embd.weight" && tensor.Name != "output.weight" {
+			continue
+		}
+
+		if tensor.Shape[1] != 50304 {
+			t.Fatalf("%s: expected 50304 rows, got %v", tensor.Name, tensor.Shape)
+		}
+
+		b := data[tensor.Offset : tensor.Offset+tensor.Size()]
+		row := tensor.Size() / 50304
+		if !slices.ContainsFunc(b[:50257*row], func(c byte) bool { return c != 0 }) || slices.ContainsFunc(b[50257*row:], func(c byte) bool { return c != 0 }) {
+			t.Fatalf("%s: expected the padded rows to be zeros", tensor.Name)
+		}
+	}
+}
+
+func TestConvertUnpaddedParameterCount(t *testing.T) {
+	d := createTinyLlama(t)
+
+	// 4 tokens padded to 8 add 4 rows of 8 to both the token embeddings and
+	// the output
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	padded, err := ConvertToFileWithOptions(d, p, Options{PadVocab: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unpadded, err := ConvertToFileWithOptions(d, p, Options{PadVocab: 8, UnpaddedParameterCount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := unpadded.ParameterCount, padded.ParameterCount-64; got != want {
+		t.Fatalf("expected %d parameters without padding, got %d", want, got)
+	}
+
+	ggml, _ := decodeFile(t, p)
+	kv := ggml.KV()
+	if got, _ := kv.Uint("general.unpadded_parameter_count"); got != unpadded.ParameterCount {
+		t.Errorf("expected general.unpadded_parameter_count %d, got %d", unpadded.ParameterCount, got)
+	}
+
+	if got := kv.ParameterCount(); got != padded.ParameterCount {
+		t.Errorf("expected general.parameter_count %d, got %d", padded.ParameterCount, got)
+	}
+}
@@ -3,17 +3,18 @@ package convert
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
-	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/nlpodyssey/gopickle/pytorch"
 	"github.com/nlpodyssey/gopickle/types"
-	"github.com/x448/float16"
 
 	"github.com/ollama/ollama/llm"
 )
@@ -30,19 +31,30 @@ type torchWriterTo struct {
 
 type TorchFormat struct{}
 
+// GetTensors reads the tensors of the model in the directory dirpath
 func (tf *TorchFormat) GetTensors(dirpath string, params *Params) ([]llm.Tensor, error) {
+	return tf.GetTensorsFS(os.DirFS(dirpath), params)
+}
+
+func (tf *TorchFormat) GetTensorsFS(fsys fs.FS, params *Params) ([]llm.Tensor, error) {
 	slog.Debug("getting torch tensors")
 
 	var files []string
-	if pt, _ := filepath.Glob(filepath.Join(dirpath, "consolidated*.pth")); len(pt) > 0 {
+	if pt, _ := fs.Glob(fsys, "consolidated*.pth"); len(pt) > 0 {
 		files = append(files, pt...)
-	} else if pt, _ := filepath.Glob(filepath.Join(dirpath, "pytorch_model*.pth")); len(pt) > 0 {
+	} else if pt, _ := fs.Glob(fsys, "pytorch_model*.pth"); len(pt) > 0 {
 		files = append(files, pt...)
 	}
 
 	var offset uint64
 	var tensors []llm.Tensor
+	stripped := make(map[string]string)
 	for _, fn := range files {
+		fn, err := torchFilename(fsys, fn)
+		if err != nil {
+			return nil, err
+		}
+
 		m, err := pytorch.Load(fn)
 		if err != nil {
 			slog.Error(fmt.Sprintf("error unpickling: %q", err))
@@ -50,30 +62,49 @@ func (tf *TorchFormat) GetTensors(dirpath string, params *Params) ([]llm.Tensor,
 		}
 
 		for _, k := range m.(*types.Dict).Keys() {
+			t, _ := m.(*types.Dict).Get(k)
 			if strings.HasSuffix(k.(string), "self_attn.rotary_emb.inv_freq") {
+				if s, ok := t.(*pytorch.Tensor).Source.(*pytorch.FloatStorage); ok && params.ropeFactors == nil {
+					params.setInvFreq(s.Data)
+				}
+
+				params.skipTensor(k.(string))
 				continue
 			}
 
-			t, _ := m.(*types.Dict).Get(k)
 			tshape := t.(*pytorch.Tensor).Size
 
 			var size uint64
 			var kind uint32
 			switch len(tshape) {
 			case 0:
+				params.skipTensor(k.(string))
 				continue
 			case 1:
 				// convert to float32
 				kind = 0
 				size = uint64(tshape[0] * 4)
 			case 2:
+				if params.F32 {
+					size = uint64(tshape[0] * tshape[1] * 4)
+					break
+				}
+
 				// convert to float16
 				kind = 1
 				size = uint64(tshape[0] * tshape[1] * 2)
 			}
 
-			ggufName, err := tf.GetLayerName(k.(string))
+			name, err := params.stripPrefix(k.(string), stripped)
 			if err != nil {
+				return nil, err
+			}
+
+			ggufName, err := tf.GetLayerName(name)
+			if err != nil && params.dryRun {
+				params.skipTensor(k.(string))
+				continue
+			} else if err != nil {
 				slog.Error(err.Error())
 				return nil, err
 			}
@@ -84,6 +115,14 @@ func (tf *TorchFormat) GetTensors(dirpath string, params *Params) ([]llm.Tensor,
 				shape[i] = uint64(tshape[i])
 			}
 
+			kind, err = params.tensorKind(ggufName, shape, kind)
+			if err != nil {
+				return nil, err
+			}
+
+			// the size above assumes F32 or F16
+			size = llm.Tensor{Kind: kind, Shape: shape[:len(tshape)]}.Size()
+
 			tensor := llm.Tensor{
 				Name:   ggufName,
 				Kind:   kind,
@@ -103,12 +142,30 @@ func (tf *TorchFormat) GetTensors(dirpath string, params *Params) ([]llm.Tensor,
 		}
 	}
 
+	params.sortTensors(tensors)
 	return tensors, nil
+}
+
+// torchFilename returns the path of name in fsys on disk since checkpoints
+// are unpickled from a path rather than a file. Only the files of a
+// directory, such as those of os.DirFS, have one.
+func torchFilename(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
 
+	osf, ok := f.(*os.File)
+	if !ok {
+		return "", fmt.Errorf("%s: torch checkpoints can only be converted from a directory", name)
+	}
+
+	return osf.Name(), nil
 }
 
-func getAltParams(dirpath string) (*Params, error) {
-	f, err := os.Open(filepath.Join(dirpath, "params.json"))
+func getAltParams(fsys fs.FS) (*Params, error) {
+	f, err := fsys.Open("params.json")
 	if err != nil {
 		slog.Error("no params.json")
 		return nil, err
@@ -139,6 +196,8 @@ func getAltParams(dirpath string) (*Params, error) {
 		KeyValHeads:    tparams.KeyValHeads,
 		HiddenLayers:   tparams.HiddenLayers,
 		NormEPS:        tparams.NormEPS,
+		BoSTokenID:     -1,
+		EoSTokenID:     -1,
 	}
 
 	switch {
@@ -153,28 +212,42 @@ func getAltParams(dirpath string) (*Params, error) {
 		params.ContextSize = 2048
 	}
 
+	params.setHeadCounts()
+	params.setSpecialTokenDefaults(fsys)
 	params.ByteOrder = binary.LittleEndian
 	return params, nil
 }
 
+// GetParams reads the config of the model in the directory dirpath
 func (m *TorchFormat) GetParams(dirpath string) (*Params, error) {
-	f, err := os.Open(filepath.Join(dirpath, "config.json"))
+	return m.GetParamsFS(os.DirFS(dirpath))
+}
+
+func (m *TorchFormat) GetParamsFS(fsys fs.FS) (*Params, error) {
+	f, err := fsys.Open("config.json")
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			// try params.json instead
-			return getAltParams(dirpath)
+			return getAltParams(fsys)
 		} else {
 			return nil, err
 		}
 	}
 
-	var params Params
+	params := Params{BoSTokenID: -1, EoSTokenID: -1}
 	d := json.NewDecoder(f)
 	err = d.Decode(&params)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	params.setHeadCounts()
+	params.setSpecialTokenDefaults(fsys)
+
 	params.ByteOrder = binary.LittleEndian
 	return &params, nil
 }
@@ -210,6 +283,9 @@ func (m *TorchFormat) GetLayerName(n string) (string, error) {
 		"model.layers.(\\d+).self_attn.o_proj.weight":         "blk.$1.attn_output.weight",
 		"model.layers.(\\d+).self_attn.q_proj.weight":         "blk.$1.attn_q.weight",
 		"model.layers.(\\d+).self_attn.v_proj.weight":         "blk.$1.attn_v.weight",
+		"model.layers.(\\d+).self_attn.(q|k|v)_proj.bias":     "blk.$1.attn_$2.bias",
+		"model.layers.(\\d+).self_attn.o_proj.bias":           "blk.$1.attn_output.bias",
+		"model.layers.(\\d+).mlp.(gate|up|down)_proj.bias":    "blk.$1.ffn_$2.bias",
 	}
 
 	v, ok := directMap[n]
@@ -229,42 +305,71 @@ func (m *TorchFormat) GetLayerName(n string) (string, error) {
 	return "", fmt.Errorf("couldn't find a layer name for '%s'", n)
 }
 
-func (r torchWriterTo) WriteTo(w io.Writer) (n int64, err error) {
-	var f32s []float32
+// data returns the values of the tensor's storage
+func (r torchWriterTo) data() ([]float32, error) {
 	switch s := r.storage.(type) {
 	case *pytorch.FloatStorage:
-		f32s = s.Data
+		return s.Data, nil
 	case *pytorch.HalfStorage:
-		f32s = s.Data
+		return s.Data, nil
 	case *pytorch.BFloat16Storage:
-		f32s = s.Data
+		return s.Data, nil
 	default:
-		return 0, fmt.Errorf("unknown data type: %T", s)
+		return nil, fmt.Errorf("unknown data type: %T", s)
+	}
+}
+
+// sameData reports whether o has the same storage type and values as r.
+// Repacked tensors are never the same.
+func (r torchWriterTo) sameData(o io.WriterTo) (bool, error) {
+	s, ok := o.(torchWriterTo)
+	if !ok || r.repacker != nil || s.repacker != nil || fmt.Sprintf("%T", r.storage) != fmt.Sprintf("%T", s.storage) {
+		return false, nil
+	}
+
+	a, err := r.data()
+	if err != nil {
+		return false, err
+	}
+
+	b, err := s.data()
+	if err != nil {
+		return false, err
+	}
+
+	return equalFloats(a, b), nil
+}
+
+func (r torchWriterTo) WriteTo(w io.Writer) (n int64, err error) {
+	f32s, err := r.data()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := r.params.checkFinite(r.t.Name, f32s); err != nil {
+		return 0, err
 	}
 
 	if r.repacker != nil {
-		f32s, err = r.repacker(r.t.Name, f32s, r.t.Shape)
+		// repackers may permute the data in place while the storage is
+		// shared with every tensor split from it
+		f32s, err = r.repacker(r.t.Name, slices.Clone(f32s), r.t.Shape)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	switch r.t.Kind {
-	case 0:
-		return 0, binary.Write(w, r.bo, f32s)
-	case 1:
-		f16s := make([]uint16, len(f32s))
-		for i := range f32s {
-			f16s[i] = float16.Fromfloat32(f32s[i]).Bits()
-		}
+	return 0, writeTensorData(w, r.bo, r.t.Kind, f32s)
+}
 
-		return 0, binary.Write(w, r.bo, f16s)
-	default:
-		return 0, fmt.Errorf("unknown storage type: %d", r.t.Kind)
-	}
+// GetModelArch returns the architecture of the model in the directory
+// dirpath
+func (m *TorchFormat) GetModelArch(name, dirpath string, params *Params) (ModelArch, error) {
+	return m.GetModelArchFS(name, os.DirFS(dirpath), params)
 }
 
-func (m *TorchFormat) GetModelArch(name, dirPath string, params *Params) (ModelArch, error) {
+func (m *TorchFormat) GetModelArchFS(name string, fsys fs.FS, params *Params) (ModelArch, error) {
+	params.forceArchitecture()
 	switch len(params.Architectures) {
 	case 0:
 		return nil, fmt.Errorf("No architecture specified to convert")
@@ -274,7 +379,7 @@ func (m *TorchFormat) GetModelArch(name, dirPath string, params *Params) (ModelA
 			return &LlamaModel{
 				ModelData{
 					Name:   name,
-					Path:   dirPath,
+					FS:     fsys,
 					Params: params,
 					Format: m,
 				},
@@ -0,0 +1,294 @@
+package llm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/d4l3k/go-bfloat16"
+	"github.com/x448/float16"
+)
+
+// DequantizeTensor converts the data of a tensor of kind to F32. shape is in
+// the order DecodeGGML returns, innermost dimension first, which is also the
+// dimension the blocks of quantized kinds run along. F32, F16, BF16, Q4_0,
+// Q4_1, Q5_0, Q5_1, Q8_0 and the 2 to 6 bit K-quants are supported.
+func DequantizeTensor(kind uint32, data []byte, shape []uint64) ([]float32, error) {
+	if len(shape) == 0 || slices.Contains(shape, 0) {
+		return nil, fmt.Errorf("dequantize: invalid shape %v", shape)
+	}
+
+	t := Tensor{Kind: kind, Shape: shape}
+	if t.Type() == GGMLTypeBF16 {
+		// BF16 is decoded all at once rather than by block
+		if uint64(len(data)) != t.Size() {
+			return nil, fmt.Errorf("dequantize: expected %d bytes of data, got %d", t.Size(), len(data))
+		}
+
+		return bfloat16.DecodeFloat32(data), nil
+	}
+
+	dequantize, ok := dequantizers[kind]
+	if !ok {
+		return nil, fmt.Errorf("dequantize: unsupported kind %d", kind)
+	}
+
+	if shape[0]%t.BlockSize() != 0 {
+		return nil, fmt.Errorf("dequantize: dimension %d isn't a multiple of the block size %d", shape[0], t.BlockSize())
+	}
+
+	if uint64(len(data)) != t.Size() {
+		return nil, fmt.Errorf("dequantize: expected %d bytes of data, got %d", t.Size(), len(data))
+	}
+
+	f32s := make([]float32, t.parameters())
+	bs, ts := int(t.BlockSize()), int(t.ElementSize())
+	for i := range len(f32s) / bs {
+		dequantize(data[i*ts:(i+1)*ts], f32s[i*bs:(i+1)*bs])
+	}
+
+	return f32s, nil
+}
+
+// dequantizers convert one block of each kind, following the reference
+// implementations in ggml-quants.c
+var dequantizers = map[uint32]func(b []byte, y []float32){
+	0:  dequantizeF32,
+	1:  dequantizeF16,
+	2:  dequantizeQ4_0,
+	3:  dequantizeQ4_1,
+	6:  dequantizeQ5_0,
+	7:  dequantizeQ5_1,
+	8:  dequantizeQ8_0,
+	10: dequantizeQ2_K,
+	11: dequantizeQ3_K,
+	12: dequantizeQ4_K,
+	13: dequantizeQ5_K,
+	14: dequantizeQ6_K,
+}
+
+func f16(b []byte) float32 {
+	return float16.Frombits(binary.LittleEndian.Uint16(b)).Float32()
+}
+
+func dequantizeF32(b []byte, y []float32) {
+	y[0] = math.Float32frombits(binary.LittleEndian.Uint32(b))
+}
+
+func dequantizeF16(b []byte, y []float32) {
+	y[0] = f16(b)
+}
+
+// dequantizeQ4_0 converts a block of an F16 scale and 32 4 bit values offset
+// by 8. The low nibbles are the first half of the block.
+func dequantizeQ4_0(b []byte, y []float32) {
+	d, qs := f16(b), b[2:]
+	for j := range 16 {
+		y[j] = float32(int(qs[j]&0xf)-8) * d
+		y[j+16] = float32(int(qs[j]>>4)-8) * d
+	}
+}
+
+// dequantizeQ4_1 is like dequantizeQ4_0 with an F16 minimum instead of an
+// offset
+func dequantizeQ4_1(b []byte, y []float32) {
+	d, m, qs := f16(b), f16(b[2:]), b[4:]
+	for j := range 16 {
+		y[j] = float32(qs[j]&0xf)*d + m
+		y[j+16] = float32(qs[j]>>4)*d + m
+	}
+}
+
+// dequantizeQ5_0 is like dequantizeQ4_0 with a fifth bit of each value
+// packed into 32 bits after the scale and an offset of 16
+func dequantizeQ5_0(b []byte, y []float32) {
+	d, qh, qs := f16(b), binary.LittleEndian.Uint32(b[2:]), b[6:]
+	for j := range 16 {
+		h0 := byte(qh>>j<<4) & 0x10
+		h1 := byte(qh>>(j+12)) & 0x10
+		y[j] = float32(int(qs[j]&0xf|h0)-16) * d
+		y[j+16] = float32(int(qs[j]>>4|h1)-16) * d
+	}
+}
+
+// dequantizeQ5_1 is like dequantizeQ5_0 with an F16 minimum instead of an
+// offset
+func dequantizeQ5_1(b []byte, y []float32) {
+	d, m, qh, qs := f16(b), f16(b[2:]), binary.LittleEndian.Uint32(b[4:]), b[8:]
+	for j := range 16 {
+		h0 := byte(qh>>j<<4) & 0x10
+		h1 := byte(qh>>(j+12)) & 0x10
+		y[j] = float32(qs[j]&0xf|h0)*d + m
+		y[j+16] = float32(qs[j]>>4|h1)*d + m
+	}
+}
+
+// dequantizeQ8_0 converts a block of an F16 scale and 32 int8 values
+func dequantizeQ8_0(b []byte, y []float32) {
+	d, qs := f16(b), b[2:]
+	for j := range 32 {
+		y[j] = float32(int8(qs[j])) * d
+	}
+}
+
+// dequantizeQ2_K converts a super block of 16 4 bit scales and minimums,
+// 256 2 bit values and the F16 scales of the scales and minimums
+func dequantizeQ2_K(b []byte, y []float32) {
+	scales, q := b[:16], b[16:80]
+	d, dmin := f16(b[80:]), f16(b[82:])
+
+	var is int
+	for n := 0; n < 256; n += 128 {
+		for shift := 0; shift < 8; shift += 2 {
+			for _, half := range []int{0, 16} {
+				sc := scales[is]
+				is++
+
+				dl, ml := d*float32(sc&0xf), dmin*float32(sc>>4)
+				for l := range 16 {
+					y[0] = dl*float32(q[l+half]>>shift&3) - ml
+					y = y[1:]
+				}
+			}
+		}
+
+		q = q[32:]
+	}
+}
+
+// dequantizeQ3_K converts a super block of the high bit of 256 3 bit values,
+// their low 2 bits, 16 6 bit scales and an F16 scale of the scales
+func dequantizeQ3_K(b []byte, y []float32) {
+	hm, q := b[:32], b[32:96]
+	d := f16(b[108:])
+
+	const kmask1, kmask2 = 0x03030303, 0x0f0f0f0f
+
+	var aux [4]uint32
+	for i := range 3 {
+		aux[i] = binary.LittleEndian.Uint32(b[96+4*i:])
+	}
+
+	tmp := aux[2]
+	aux[2] = aux[0]>>4&kmask2 | (tmp>>4&kmask1)<<4
+	aux[3] = aux[1]>>4&kmask2 | (tmp>>6&kmask1)<<4
+	aux[0] = aux[0]&kmask2 | (tmp&kmask1)<<4
+	aux[1] = aux[1]&kmask2 | (tmp>>2&kmask1)<<4
+
+	var scales [16]int8
+	for i := range scales {
+		scales[i] = int8(aux[i/4] >> (8 * (i % 4)))
+	}
+
+	var is int
+	m := byte(1)
+	for n := 0; n < 256; n += 128 {
+		for shift := 0; shift < 8; shift += 2 {
+			for _, half := range []int{0, 16} {
+				dl := d * float32(int(scales[is])-32)
+				is++
+
+				for l := range 16 {
+					v := int(q[l+half] >> shift & 3)
+					if hm[l+half]&m == 0 {
+						v -= 4
+					}
+
+					y[0] = dl * float32(v)
+					y = y[1:]
+				}
+			}
+
+			m <<= 1
+		}
+
+		q = q[32:]
+	}
+}
+
+// scaleMinK4 unpacks the jth 6 bit scale and minimum of a Q4_K or Q5_K
+// super block
+func scaleMinK4(j int, q []byte) (byte, byte) {
+	if j < 4 {
+		return q[j] & 63, q[j+4] & 63
+	}
+
+	return q[j+4]&0xf | q[j-4]>>6<<4, q[j+4]>>4 | q[j]>>6<<4
+}
+
+// dequantizeQ4_K converts a super block of the F16 scales of the scales and
+// minimums, 8 6 bit scales and minimums and 256 4 bit values
+func dequantizeQ4_K(b []byte, y []float32) {
+	d, dmin, scales, q := f16(b), f16(b[2:]), b[4:16], b[16:]
+
+	for is := 0; is < 8; is += 2 {
+		sc, m := scaleMinK4(is, scales)
+		d1, m1 := d*float32(sc), dmin*float32(m)
+		sc, m = scaleMinK4(is+1, scales)
+		d2, m2 := d*float32(sc), dmin*float32(m)
+
+		for l := range 32 {
+			y[l] = d1*float32(q[l]&0xf) - m1
+			y[l+32] = d2*float32(q[l]>>4) - m2
+		}
+
+		q, y = q[32:], y[64:]
+	}
+}
+
+// dequantizeQ5_K is like dequantizeQ4_K with a fifth bit of each value
+// packed before the low bits
+func dequantizeQ5_K(b []byte, y []float32) {
+	d, dmin, scales, qh, ql := f16(b), f16(b[2:]), b[4:16], b[16:48], b[48:]
+
+	u1, u2 := byte(1), byte(2)
+	for is := 0; is < 8; is += 2 {
+		sc, m := scaleMinK4(is, scales)
+		d1, m1 := d*float32(sc), dmin*float32(m)
+		sc, m = scaleMinK4(is+1, scales)
+		d2, m2 := d*float32(sc), dmin*float32(m)
+
+		for l := range 32 {
+			v1, v2 := ql[l]&0xf, ql[l]>>4
+			if qh[l]&u1 != 0 {
+				v1 += 16
+			}
+
+			if qh[l]&u2 != 0 {
+				v2 += 16
+			}
+
+			y[l] = d1*float32(v1) - m1
+			y[l+32] = d2*float32(v2) - m2
+		}
+
+		ql, y = ql[32:], y[64:]
+		u1, u2 = u1<<2, u2<<2
+	}
+}
+
+// dequantizeQ6_K converts a super block of the low 4 bits and high 2 bits of
+// 256 6 bit values offset by 32, 16 int8 scales and an F16 scale of the
+// scales
+func dequantizeQ6_K(b []byte, y []float32) {
+	ql, qh, sc := b[:128], b[128:192], b[192:208]
+	d := f16(b[208:])
+
+	for n := 0; n < 256; n += 128 {
+		for l := range 32 {
+			is := l / 16
+			q1 := int(ql[l]&0xf|(qh[l]&3)<<4) - 32
+			q2 := int(ql[l+32]&0xf|(qh[l]>>2&3)<<4) - 32
+			q3 := int(ql[l]>>4|(qh[l]>>4&3)<<4) - 32
+			q4 := int(ql[l+32]>>4|(qh[l]>>6&3)<<4) - 32
+
+			y[l] = d * float32(int8(sc[is])) * float32(q1)
+			y[l+32] = d * float32(int8(sc[is+2])) * float32(q2)
+			y[l+64] = d * float32(int8(sc[is+4])) * float32(q3)
+			y[l+96] = d * float32(int8(sc[is+6])) * float32(q4)
+		}
+
+		ql, qh, sc, y = ql[64:], qh[32:], sc[8:], y[128:]
+	}
+}
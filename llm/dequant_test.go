@@ -0,0 +1,101 @@
+package llm
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/x448/float16"
+)
+
+func TestDequantizeTensor(t *testing.T) {
+	t.Run("q8_0", func(t *testing.T) {
+		// a scale of 0.25 and values from -16 to 15
+		b := binary.LittleEndian.AppendUint16(nil, float16.Fromfloat32(0.25).Bits())
+		for i := range 32 {
+			b = append(b, byte(int8(i-16)))
+		}
+
+		got, err := DequantizeTensor(8, b, []uint64{32, 1, 1, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, v := range got {
+			if want := float32(i-16) / 4; math.Abs(float64(v-want)) > 1e-6 {
+				t.Fatalf("value %d: expected %v, got %v", i, want, v)
+			}
+		}
+	})
+
+	t.Run("q4_0", func(t *testing.T) {
+		// low nibbles are the first half of the block
+		b := binary.LittleEndian.AppendUint16(nil, float16.Fromfloat32(0.5).Bits())
+		for i := range 16 {
+			b = append(b, byte(i)|byte(15-i)<<4)
+		}
+
+		got, err := DequantizeTensor(2, b, []uint64{32})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 16 {
+			if want := float32(i-8) / 2; got[i] != want {
+				t.Fatalf("value %d: expected %v, got %v", i, want, got[i])
+			}
+
+			if want := float32(7-i) / 2; got[i+16] != want {
+				t.Fatalf("value %d: expected %v, got %v", i+16, want, got[i+16])
+			}
+		}
+	})
+
+	t.Run("f16", func(t *testing.T) {
+		var b []byte
+		for _, f := range []float32{1, -2, 0.5} {
+			b = binary.LittleEndian.AppendUint16(b, float16.Fromfloat32(f).Bits())
+		}
+
+		got, err := DequantizeTensor(1, b, []uint64{3})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := []float32{1, -2, 0.5}; !slices.Equal(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("q6_k zeros", func(t *testing.T) {
+		got, err := DequantizeTensor(14, make([]byte, 210), []uint64{256})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 256 || slices.ContainsFunc(got, func(f float32) bool { return f != 0 }) {
+			t.Fatalf("expected 256 zeros, got %v", got)
+		}
+	})
+
+	cases := []struct {
+		name  string
+		kind  uint32
+		data  []byte
+		shape []uint64
+	}{
+		{"short data", 8, make([]byte, 33), []uint64{32}},
+		{"partial block", 8, make([]byte, 34), []uint64{16, 2}},
+		{"unsupported", 16, make([]byte, 66), []uint64{256}},
+		{"empty shape", 0, nil, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DequantizeTensor(tt.kind, tt.data, tt.shape); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -178,3 +178,161 @@ func (t fileType) String() string {
 func (t fileType) Value() uint32 {
 	return uint32(t)
 }
+
+// FileType guesses the file type from the kinds of tensors in ts. Like
+// llama.cpp, the most common kind decides the file type. Vectors such as norms
+// are always F32 so only tensors with at least two dimensions are counted
+// unless there are none.
+func (ts Tensors) FileType() fileType {
+	counts := make(map[uint32]int)
+	for _, t := range ts {
+		if t.dims() > 1 {
+			counts[t.Kind]++
+		}
+	}
+
+	if len(counts) == 0 {
+		for _, t := range ts {
+			counts[t.Kind]++
+		}
+	}
+
+	kind, n := uint32(0), 0
+	for k, c := range counts {
+		if c > n || (c == n && k < kind) {
+			kind, n = k, c
+		}
+	}
+
+	switch kind {
+	case 0:
+		return fileTypeF32
+	case 1:
+		return fileTypeF16
+	case 2:
+		return fileTypeQ4_0
+	case 3:
+		return fileTypeQ4_1
+	case 6:
+		return fileTypeQ5_0
+	case 7:
+		return fileTypeQ5_1
+	case 8:
+		return fileTypeQ8_0
+	case 10:
+		return fileTypeQ2_K
+	case 11:
+		return fileTypeQ3_K_M
+	case 12:
+		return fileTypeQ4_K_M
+	case 13:
+		return fileTypeQ5_K_M
+	case 14:
+		return fileTypeQ6_K
+	case 16:
+		return fileTypeIQ2_XXS
+	case 17:
+		return fileTypeIQ2_XS
+	case 18:
+		return fileTypeIQ3_XXS
+	case 19:
+		return fileTypeIQ1_S
+	case 20:
+		return fileTypeIQ4_NL
+	case 21:
+		return fileTypeIQ3_S
+	case 22:
+		return fileTypeIQ2_S
+	case 23:
+		return fileTypeIQ4_XS
+	case 29:
+		return fileTypeIQ1_M
+	case 30:
+		return fileTypeBF16
+	default:
+		return fileTypeUnknown
+	}
+}
+
+// kind returns the kind of most tensors in a file of type t. Mixed types such
+// as the S, M and L K-quants keep some tensors at a higher precision but
+// still quantize most of them to the same kind.
+func (t fileType) kind() (uint32, bool) {
+	switch t {
+	case fileTypeF32:
+		return 0, true
+	case fileTypeF16:
+		return 1, true
+	case fileTypeQ4_0:
+		return 2, true
+	case fileTypeQ4_1, fileTypeQ4_1_F16:
+		return 3, true
+	case fileTypeQ5_0:
+		return 6, true
+	case fileTypeQ5_1:
+		return 7, true
+	case fileTypeQ8_0:
+		return 8, true
+	case fileTypeQ2_K, fileTypeQ2_K_S:
+		return 10, true
+	case fileTypeQ3_K_S, fileTypeQ3_K_M, fileTypeQ3_K_L:
+		return 11, true
+	case fileTypeQ4_K_S, fileTypeQ4_K_M:
+		return 12, true
+	case fileTypeQ5_K_S, fileTypeQ5_K_M:
+		return 13, true
+	case fileTypeQ6_K:
+		return 14, true
+	case fileTypeIQ2_XXS:
+		return 16, true
+	case fileTypeIQ2_XS:
+		return 17, true
+	case fileTypeIQ3_XXS:
+		return 18, true
+	case fileTypeIQ1_S:
+		return 19, true
+	case fileTypeIQ4_NL:
+		return 20, true
+	case fileTypeIQ3_S, fileTypeIQ3_XS:
+		return 21, true
+	case fileTypeIQ2_S, fileTypeIQ2_M:
+		return 22, true
+	case fileTypeIQ4_XS:
+		return 23, true
+	case fileTypeIQ1_M:
+		return 29, true
+	case fileTypeBF16:
+		return 30, true
+	default:
+		return 0, false
+	}
+}
+
+// CheckFileType returns an error when general.file_type in kv doesn't match
+// the kinds of tensors ts, e.g. a file labeled Q4_K_M which holds F16
+// tensors. Only the most common kind is compared, like the file type guessed
+// by Tensors.FileType, so files which keep some tensors at another kind
+// aren't flagged. Files without a file type or with a type or kinds this
+// doesn't know aren't checked.
+func CheckFileType(kv KV, ts Tensors) error {
+	if _, ok := kv["general.file_type"]; !ok {
+		return nil
+	}
+
+	declared, observed := kv.FileType(), ts.FileType()
+	want, ok := declared.kind()
+	if !ok {
+		return nil
+	}
+
+	got, ok := observed.kind()
+	if !ok {
+		return nil
+	}
+
+	if want != got {
+		return fmt.Errorf("general.file_type is %s but most tensors are %s", declared, observed)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package llm
+
+import "testing"
+
+func TestTensorsFileType(t *testing.T) {
+	tensor := func(kind uint32, shape ...uint64) *Tensor {
+		return &Tensor{Kind: kind, Shape: shape}
+	}
+
+	cases := []struct {
+		name    string
+		tensors Tensors
+		want    string
+	}{
+		{"f32", Tensors{tensor(0, 4096, 4096), tensor(0, 4096)}, "F32"},
+		{"f16", Tensors{tensor(1, 4096, 4096), tensor(1, 4096, 4096), tensor(0, 4096), tensor(0, 4096), tensor(0, 4096)}, "F16"},
+		{"q4_k_m", Tensors{tensor(12, 4096, 4096), tensor(12, 4096, 4096), tensor(14, 4096, 4096), tensor(0, 4096)}, "Q4_K_M"},
+		{"q8_0", Tensors{tensor(8, 4096, 4096), tensor(0, 4096)}, "Q8_0"},
+		{"vectors", Tensors{tensor(0, 4096), tensor(0, 4096)}, "F32"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tensors.FileType().String(); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckFileType(t *testing.T) {
+	tensor := func(kind uint32, shape ...uint64) *Tensor {
+		return &Tensor{Kind: kind, Shape: shape}
+	}
+
+	q4km := Tensors{tensor(12, 4096, 4096), tensor(12, 4096, 4096), tensor(14, 4096, 4096), tensor(0, 4096)}
+	f16 := Tensors{tensor(1, 4096, 4096), tensor(1, 4096, 4096), tensor(0, 4096)}
+
+	cases := []struct {
+		name    string
+		kv      KV
+		tensors Tensors
+		wantErr bool
+	}{
+		{"match", KV{"general.file_type": fileTypeQ4_K_M.Value()}, q4km, false},
+		{"variant", KV{"general.file_type": fileTypeQ4_K_S.Value()}, q4km, false},
+		{"f16", KV{"general.file_type": fileTypeF16.Value()}, f16, false},
+		{"mislabeled", KV{"general.file_type": fileTypeQ4_K_M.Value()}, f16, true},
+		{"mislabeled f16", KV{"general.file_type": fileTypeF16.Value()}, q4km, true},
+		{"missing", KV{}, f16, false},
+		{"unknown", KV{"general.file_type": fileTypeUnknown.Value()}, f16, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckFileType(tt.kv, tt.tensors); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
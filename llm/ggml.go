@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"path"
 	"strings"
 )
 
@@ -13,6 +15,16 @@ type GGML struct {
 	model
 }
 
+// ByteOrder returns the byte order of the file. Only GGUF files may be big
+// endian.
+func (m *GGML) ByteOrder() binary.ByteOrder {
+	if c, ok := m.container.(*containerGGUF); ok {
+		return c.ByteOrder
+	}
+
+	return binary.LittleEndian
+}
+
 type model interface {
 	KV() KV
 	Tensors() Tensors
@@ -21,33 +33,142 @@ type model interface {
 type KV map[string]any
 
 func (kv KV) u64(key string) uint64 {
+	v, _ := kv.Uint(key)
+	return v
+}
+
+// Uint returns the value at key as an unsigned integer. Values of any of the
+// integer types GGUF stores are accepted unless they're negative, as are
+// whole floats such as those of KVs decoded from JSON.
+func (kv KV) Uint(key string) (uint64, bool) {
 	switch v := kv[key].(type) {
-	case uint64:
-		return v
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
 	case uint32:
-		return uint64(v)
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int8:
+		if v >= 0 {
+			return uint64(v), true
+		}
+	case int16:
+		if v >= 0 {
+			return uint64(v), true
+		}
+	case int32:
+		if v >= 0 {
+			return uint64(v), true
+		}
+	case int64:
+		if v >= 0 {
+			return uint64(v), true
+		}
+	case float32:
+		if v >= 0 && v < 1<<64 && v == float32(math.Trunc(float64(v))) {
+			return uint64(v), true
+		}
 	case float64:
-		return uint64(v)
-	default:
-		return 0
+		if v >= 0 && v < 1<<64 && v == math.Trunc(v) {
+			return uint64(v), true
+		}
+	}
+
+	return 0, false
+}
+
+// Float returns the value at key as a float. Values of any of the integer
+// and float types GGUF stores are accepted.
+func (kv KV) Float(key string) (float64, bool) {
+	switch v := kv[key].(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
 	}
+
+	return 0, false
+}
+
+// String returns the string at key
+func (kv KV) String(key string) (string, bool) {
+	s, ok := kv[key].(string)
+	return s, ok
+}
+
+// Strings returns the array of strings at key. Arrays are decoded as []any
+// so each element must be a string.
+func (kv KV) Strings(key string) ([]string, bool) {
+	switch v := kv[key].(type) {
+	case []string:
+		return v, true
+	case []any:
+		s := make([]string, len(v))
+		for i := range v {
+			var ok bool
+			if s[i], ok = v[i].(string); !ok {
+				return nil, false
+			}
+		}
+
+		return s, true
+	}
+
+	return nil, false
 }
 
 func (kv KV) Architecture() string {
-	if s, ok := kv["general.architecture"].(string); ok {
+	if s, ok := kv.String("general.architecture"); ok {
 		return s
 	}
 
 	return "unknown"
 }
 
+// ModelName returns the name to display for the model. Files without
+// general.name are named by general.basename, with general.size_label when
+// both are set, and by their architecture otherwise.
+func (kv KV) ModelName() string {
+	if s, ok := kv.String("general.name"); ok && s != "" {
+		return s
+	}
+
+	if s, ok := kv.String("general.basename"); ok && s != "" {
+		if label, ok := kv.String("general.size_label"); ok && label != "" {
+			return s + " " + label
+		}
+
+		return s
+	}
+
+	return kv.Architecture()
+}
+
 func (kv KV) ParameterCount() uint64 {
 	return kv.u64("general.parameter_count")
 }
 
 func (kv KV) FileType() fileType {
-	if u64 := kv.u64("general.file_type"); u64 > 0 {
-		return fileType(uint32(u64))
+	if _, ok := kv["general.file_type"]; ok {
+		return fileType(uint32(kv.u64("general.file_type")))
 	}
 
 	return fileTypeUnknown
@@ -81,6 +202,74 @@ func (kv KV) ContextLength() uint64 {
 	return kv.u64(fmt.Sprintf("%s.context_length", kv.Architecture()))
 }
 
+// Tokenizer is the vocabulary of a model regardless of the keys it is
+// stored under
+type Tokenizer struct {
+	// Model is the tokenizer scheme, e.g. llama for SentencePiece, gpt2 for
+	// BPE or rwkv for the RWKV world tokenizer
+	Model string
+
+	Tokens []string
+
+	// Merges are only set for BPE. Tokenizers such as RWKV's, which matches
+	// tokens with a trie, have none.
+	Merges []string
+}
+
+// Tokenizer finds the vocabulary in kv. Most writers store it under
+// tokenizer.ggml with its scheme in tokenizer.ggml.model but some use keys
+// specific to their scheme such as tokenizer.ggml.rwkv.tokens.
+func (kv KV) Tokenizer() (*Tokenizer, error) {
+	model, _ := kv.String("tokenizer.ggml.model")
+
+	prefix := "tokenizer.ggml."
+	if _, ok := kv[prefix+"tokens"]; !ok {
+		var found string
+		for k := range kv {
+			rest, ok := strings.CutPrefix(k, "tokenizer.ggml.")
+			if !ok {
+				continue
+			}
+
+			scheme, ok := strings.CutSuffix(rest, ".tokens")
+			if !ok || strings.Contains(scheme, ".") || (model != "" && scheme != model) {
+				continue
+			}
+
+			if found != "" {
+				return nil, fmt.Errorf("tokenizer: found tokens of both %s and %s", found, scheme)
+			}
+
+			found = scheme
+		}
+
+		if found == "" {
+			return nil, errors.New("tokenizer: no tokens found")
+		}
+
+		model, prefix = found, "tokenizer.ggml."+found+"."
+	}
+
+	if model == "" {
+		return nil, errors.New("tokenizer: tokenizer.ggml.model not found")
+	}
+
+	tokens, ok := kv.Strings(prefix + "tokens")
+	if !ok {
+		return nil, fmt.Errorf("tokenizer: %stokens is not an array of strings", prefix)
+	}
+
+	// merges are optional but must be strings if present
+	var merges []string
+	if _, ok := kv[prefix+"merges"]; ok {
+		if merges, ok = kv.Strings(prefix + "merges"); !ok {
+			return nil, fmt.Errorf("tokenizer: %smerges is not an array of strings", prefix)
+		}
+	}
+
+	return &Tokenizer{Model: model, Tokens: tokens, Merges: merges}, nil
+}
+
 type Tensors []*Tensor
 
 func (ts Tensors) Layers() map[string]Layer {
@@ -102,6 +291,47 @@ func (ts Tensors) Layers() map[string]Layer {
 	return layers
 }
 
+// TotalSize returns the size of the tensor data of a GGUF holding ts in order
+// with the default alignment of 32. Each tensor but the last is padded to the
+// alignment so the next one starts aligned, as Encode writes them.
+func (ts Tensors) TotalSize() uint64 {
+	return ts.alignedSize(32)
+}
+
+// alignedSize returns the size of the data of ts with the padding alignment
+// puts between tensors
+func (ts Tensors) alignedSize(alignment uint64) uint64 {
+	var size uint64
+	for i, t := range ts {
+		size += t.Size()
+		if i < len(ts)-1 {
+			size += (alignment - size%alignment) % alignment
+		}
+	}
+
+	return size
+}
+
+// CheckSize checks a GGUF of fileSize bytes whose tensor data starts at
+// dataOffset holds all of the data of ts, aligned to alignment or the default
+// of 32 when it is 0. It catches a truncated download without reading the
+// data and returns an ErrTruncatedGGUF error naming the missing bytes.
+func (ts Tensors) CheckSize(fileSize, dataOffset int64, alignment uint64) error {
+	if alignment == 0 {
+		alignment = 32
+	}
+
+	if dataOffset < 0 || dataOffset > fileSize {
+		return fmt.Errorf("tensor data starts at offset %d past the end of the file at %d: %w", dataOffset, fileSize, ErrTruncatedGGUF)
+	}
+
+	if size := ts.alignedSize(alignment); size > uint64(fileSize-dataOffset) {
+		return fmt.Errorf("tensor data of %d bytes at offset %d ends past the end of the file at %d, %d bytes are missing: %w", size, dataOffset, fileSize, size-uint64(fileSize-dataOffset), ErrTruncatedGGUF)
+	}
+
+	return nil
+}
+
 type Layer map[string]*Tensor
 
 func (l Layer) size() (size uint64) {
@@ -123,80 +353,32 @@ type Tensor struct {
 	io.WriterTo `json:"-"`
 }
 
-func (t Tensor) blockSize() uint64 {
-	switch t.Kind {
-	case 0, 1, 24, 25, 26, 27, 28, 30: // F32, F16, I8, I16, I32, I64, F64, BF16
-		return 1
-	case 2, 3, 4, 5, 6, 7, 8, 9, 20: // Q4_0, Q4_1, Q5_0, Q5_1, Q8_0, Q8_1, IQ4_NL
-		return 32
-	default: // All others
-		return 256
-	}
-}
-
-func (t Tensor) typeSize() uint64 {
-	blockSize := t.blockSize()
-
-	switch t.Kind {
-	case 0: // FP32
-		return 4
-	case 1: // FP16
-		return 2
-	case 2: // Q4_0
-		return 2 + blockSize/2
-	case 3: // Q4_1
-		return 2 + 2 + blockSize/2
-	case 6: // Q5_0
-		return 2 + 4 + blockSize/2
-	case 7: // Q5_1
-		return 2 + 2 + 4 + blockSize/2
-	case 8: // Q8_0
-		return 2 + blockSize
-	case 9: // Q8_1
-		return 4 + 4 + blockSize
-	case 10: // Q2_K
-		return blockSize/16 + blockSize/4 + 2 + 2
-	case 11: // Q3_K
-		return blockSize/8 + blockSize/4 + 12 + 2
-	case 12: // Q4_K
-		return 2 + 2 + 12 + blockSize/2
-	case 13: // Q5_K
-		return 2 + 2 + 12 + blockSize/8 + blockSize/2
-	case 14: // Q6_K
-		return blockSize/2 + blockSize/4 + blockSize/16 + 2
-	case 15: // Q8_K
-		return 2 + blockSize + 2*blockSize/16
-	case 16: // IQ2_XXS
-		return 2 + 2*blockSize/8
-	case 17: // IQ2_XS
-		return 2 + 2*blockSize/8 + blockSize/32
-	case 18: // IQ3_XXS
-		return 2 + blockSize/4 + blockSize/8
-	case 19: // IQ1_S
-		return 2 + blockSize/8 + blockSize/16
-	case 20: // IQ4_NL
-		return 2 + blockSize/2
-	case 21: // IQ3_S
-		return 2 + blockSize/4 + blockSize/8 + blockSize/32 + 4
-	case 22: // IQ2_S
-		return 2 + blockSize/4 + blockSize/16
-	case 23: // IQ4_XS
-		return 2 + 2 + blockSize/2 + blockSize/64
-	case 24: // I8
-		return 1
-	case 25: // I16
-		return 2
-	case 26: // I32
-		return 4
-	case 27: // I64
-		return 8
-	case 28: // F64
-		return 8
-	case 29: // IQ1_M
-		return blockSize/8 + blockSize/16 + blockSize/32
-	default:
-		return 0
+// Type returns the type of the data of t
+func (t Tensor) Type() GGMLType {
+	return GGMLType(t.Kind)
+}
+
+// BlockSize returns the number of elements of t quantized together
+func (t Tensor) BlockSize() uint64 {
+	return t.Type().BlockSize()
+}
+
+// ElementSize returns the number of bytes of a block of BlockSize elements
+// of t, or 0 if its type is unknown
+func (t Tensor) ElementSize() uint64 {
+	return t.Type().TypeSize()
+}
+
+// dims returns the number of dimensions with more than one element
+func (t Tensor) dims() int {
+	var n int
+	for _, dim := range t.Shape {
+		if dim > 1 {
+			n++
+		}
 	}
+
+	return n
 }
 
 func (t Tensor) parameters() uint64 {
@@ -207,8 +389,10 @@ func (t Tensor) parameters() uint64 {
 	return count
 }
 
+// Size returns the number of bytes of the data of t, a block of ElementSize
+// bytes for every BlockSize elements
 func (t Tensor) Size() uint64 {
-	return t.parameters() * t.typeSize() / t.blockSize()
+	return t.parameters() / t.BlockSize() * t.ElementSize()
 }
 
 type container interface {
@@ -249,7 +433,38 @@ func DetectGGMLType(b []byte) string {
 	}
 }
 
+// Limits bound the work done when decoding an untrusted file. Zero values
+// are unlimited.
+type Limits struct {
+	// MaxKV is the maximum number of key-values
+	MaxKV uint64
+
+	// MaxTensors is the maximum number of tensors
+	MaxTensors uint64
+
+	// MaxBytes is the maximum number of bytes read. Tensor data is skipped
+	// rather than read so it does not count towards the budget.
+	MaxBytes int64
+
+	// LenientArrays decodes empty arrays with an invalid element type, which
+	// some writers emit, to empty slices rather than failing. Arrays with
+	// elements still fail since their size is unknown.
+	LenientArrays bool
+}
+
+var ErrLimitExceeded = errors.New("decode limit exceeded")
+
 func DecodeGGML(rs io.ReadSeeker) (*GGML, int64, error) {
+	return DecodeGGMLWithLimits(rs, Limits{})
+}
+
+// DecodeGGMLWithLimits decodes like DecodeGGML but returns ErrLimitExceeded
+// as soon as the file exceeds any of limits.
+func DecodeGGMLWithLimits(rs io.ReadSeeker, limits Limits) (*GGML, int64, error) {
+	if limits.MaxBytes > 0 {
+		rs = &budgetReadSeeker{ReadSeeker: rs, max: limits.MaxBytes, remaining: limits.MaxBytes}
+	}
+
 	var magic uint32
 	if err := binary.Read(rs, binary.LittleEndian, &magic); err != nil {
 		return nil, 0, err
@@ -262,9 +477,9 @@ func DecodeGGML(rs io.ReadSeeker) (*GGML, int64, error) {
 	case FILE_MAGIC_GGLA:
 		c = &containerGGLA{}
 	case FILE_MAGIC_GGUF_LE:
-		c = &containerGGUF{ByteOrder: binary.LittleEndian}
+		c = &containerGGUF{ByteOrder: binary.LittleEndian, limits: limits}
 	case FILE_MAGIC_GGUF_BE:
-		c = &containerGGUF{ByteOrder: binary.BigEndian}
+		c = &containerGGUF{ByteOrder: binary.BigEndian, limits: limits}
 	default:
 		return nil, 0, errors.New("invalid file magic")
 	}
@@ -288,11 +503,128 @@ func DecodeGGML(rs io.ReadSeeker) (*GGML, int64, error) {
 	}, offset, nil
 }
 
+// DecodeGGMLMetadata decodes the header, key-values and tensor infos of the
+// GGUF read from r without reading any tensor data, e.g. to inspect the
+// architecture of a remote model from the start of its download. r is never
+// seeked so it may be a stream such as an HTTP response body, and it is left
+// just after the tensor infos. Tensor offsets are relative to the start of the
+// tensor data, which follows once aligned to general.alignment.
+func DecodeGGMLMetadata(r io.Reader) (*GGML, error) {
+	model, sr, err := decodeGGUFStream(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := model.decodeMetadata(sr); err != nil {
+		return nil, err
+	}
+
+	return &GGML{container: model.containerGGUF, model: model}, nil
+}
+
+// DecodeGGMLKeys decodes only the key-values of the GGUF read from r whose
+// keys match a pattern of keys, e.g. general.architecture and
+// *.context_length, where patterns are those of path.Match. Other values are
+// skipped rather than decoded, reading stops as soon as every pattern has
+// matched a key and tensor infos are never read, so it's much cheaper than
+// DecodeGGMLMetadata for large vocabularies. Like DecodeGGMLMetadata, r may be
+// a stream. Keys the file doesn't have are absent from the result.
+func DecodeGGMLKeys(r io.Reader, keys []string) (KV, error) {
+	for _, pattern := range keys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%w: %q", err, pattern)
+		}
+	}
+
+	model, sr, err := decodeGGUFStream(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := model.decodeKeys(sr, keys); err != nil {
+		return nil, err
+	}
+
+	return model.kv, nil
+}
+
+// decodeGGUFStream decodes the magic and header of the GGUF read from r and
+// returns a model to decode the rest of it with from the returned reader
+func decodeGGUFStream(r io.Reader) (*gguf, *streamReader, error) {
+	sr := &streamReader{Reader: r}
+
+	var magic uint32
+	if err := binary.Read(sr, binary.LittleEndian, &magic); err != nil {
+		return nil, nil, err
+	}
+
+	var c *containerGGUF
+	switch magic {
+	case FILE_MAGIC_GGUF_LE:
+		c = &containerGGUF{ByteOrder: binary.LittleEndian}
+	case FILE_MAGIC_GGUF_BE:
+		c = &containerGGUF{ByteOrder: binary.BigEndian}
+	case FILE_MAGIC_GGML, FILE_MAGIC_GGMF, FILE_MAGIC_GGJT, FILE_MAGIC_GGLA:
+		return nil, nil, ErrUnsupportedFormat
+	default:
+		return nil, nil, errors.New("invalid file magic")
+	}
+
+	model, err := c.decodeHeader(sr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return model, sr, nil
+}
+
+// streamReader reads a stream which can't seek. It only reports the offset
+// read to, which is all decoding the metadata seeks for.
+type streamReader struct {
+	io.Reader
+	offset int64
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return r.offset, errors.New("can't seek while decoding metadata from a stream")
+	}
+
+	return r.offset, nil
+}
+
+// budgetReadSeeker fails reads once more than max bytes have been read
+type budgetReadSeeker struct {
+	io.ReadSeeker
+	max, remaining int64
+}
+
+func (r *budgetReadSeeker) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, fmt.Errorf("%w: read more than %d bytes", ErrLimitExceeded, r.max)
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.ReadSeeker.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
 func (llm GGML) GraphSize(context, batch uint64) (partialOffload, fullOffload uint64) {
 	embedding := llm.KV().EmbeddingLength()
 	heads := llm.KV().HeadCount()
 	headsKV := llm.KV().HeadCountKV()
-	vocab := uint64(len(llm.KV()["tokenizer.ggml.tokens"].([]any)))
+	tokens, _ := llm.KV().Strings("tokenizer.ggml.tokens")
+	vocab := uint64(len(tokens))
 
 	layers := llm.Tensors().Layers()
 
@@ -308,7 +640,7 @@ func (llm GGML) GraphSize(context, batch uint64) (partialOffload, fullOffload ui
 
 		if ffnGateExpsWeight, ok := layers["blk.0"]["ffn_gate_exps.weight"]; ok {
 			// mixtral 8x22b
-			ff := uint64(llm.KV()["llama.feed_forward_length"].(uint32))
+			ff := llm.KV().u64("llama.feed_forward_length")
 			partialOffload = max(
 				3*ffnGateExpsWeight.Size()+4*batch*(2*ff+headsKV+embedding+context+embedding/heads*headsKV),
 				4*(context*batch*heads+context*embedding/heads*headsKV+batch*1024+embedding/heads*headsKV*batch),
@@ -0,0 +1,189 @@
+package llm
+
+import "fmt"
+
+// GGMLType is the type of the data of a tensor, the Kind it is stored with
+type GGMLType uint32
+
+const (
+	GGMLTypeF32 GGMLType = iota
+	GGMLTypeF16
+	GGMLTypeQ4_0
+	GGMLTypeQ4_1
+	_ // Q4_2, removed
+	_ // Q4_3, removed
+	GGMLTypeQ5_0
+	GGMLTypeQ5_1
+	GGMLTypeQ8_0
+	GGMLTypeQ8_1
+	GGMLTypeQ2_K
+	GGMLTypeQ3_K
+	GGMLTypeQ4_K
+	GGMLTypeQ5_K
+	GGMLTypeQ6_K
+	GGMLTypeQ8_K
+	GGMLTypeIQ2_XXS
+	GGMLTypeIQ2_XS
+	GGMLTypeIQ3_XXS
+	GGMLTypeIQ1_S
+	GGMLTypeIQ4_NL
+	GGMLTypeIQ3_S
+	GGMLTypeIQ2_S
+	GGMLTypeIQ4_XS
+	GGMLTypeI8
+	GGMLTypeI16
+	GGMLTypeI32
+	GGMLTypeI64
+	GGMLTypeF64
+	GGMLTypeIQ1_M
+	GGMLTypeBF16
+)
+
+func (t GGMLType) String() string {
+	switch t {
+	case GGMLTypeF32:
+		return "F32"
+	case GGMLTypeF16:
+		return "F16"
+	case GGMLTypeQ4_0:
+		return "Q4_0"
+	case GGMLTypeQ4_1:
+		return "Q4_1"
+	case GGMLTypeQ5_0:
+		return "Q5_0"
+	case GGMLTypeQ5_1:
+		return "Q5_1"
+	case GGMLTypeQ8_0:
+		return "Q8_0"
+	case GGMLTypeQ8_1:
+		return "Q8_1"
+	case GGMLTypeQ2_K:
+		return "Q2_K"
+	case GGMLTypeQ3_K:
+		return "Q3_K"
+	case GGMLTypeQ4_K:
+		return "Q4_K"
+	case GGMLTypeQ5_K:
+		return "Q5_K"
+	case GGMLTypeQ6_K:
+		return "Q6_K"
+	case GGMLTypeQ8_K:
+		return "Q8_K"
+	case GGMLTypeIQ2_XXS:
+		return "IQ2_XXS"
+	case GGMLTypeIQ2_XS:
+		return "IQ2_XS"
+	case GGMLTypeIQ3_XXS:
+		return "IQ3_XXS"
+	case GGMLTypeIQ1_S:
+		return "IQ1_S"
+	case GGMLTypeIQ4_NL:
+		return "IQ4_NL"
+	case GGMLTypeIQ3_S:
+		return "IQ3_S"
+	case GGMLTypeIQ2_S:
+		return "IQ2_S"
+	case GGMLTypeIQ4_XS:
+		return "IQ4_XS"
+	case GGMLTypeI8:
+		return "I8"
+	case GGMLTypeI16:
+		return "I16"
+	case GGMLTypeI32:
+		return "I32"
+	case GGMLTypeI64:
+		return "I64"
+	case GGMLTypeF64:
+		return "F64"
+	case GGMLTypeIQ1_M:
+		return "IQ1_M"
+	case GGMLTypeBF16:
+		return "BF16"
+	default:
+		return fmt.Sprintf("unknown type %d", uint32(t))
+	}
+}
+
+// BlockSize returns the number of elements t quantizes together, 1 for types
+// that aren't quantized
+func (t GGMLType) BlockSize() uint64 {
+	switch t {
+	case GGMLTypeF32, GGMLTypeF16, GGMLTypeI8, GGMLTypeI16, GGMLTypeI32, GGMLTypeI64, GGMLTypeF64, GGMLTypeBF16:
+		return 1
+	case GGMLTypeQ4_0, GGMLTypeQ4_1, GGMLTypeQ5_0, GGMLTypeQ5_1, GGMLTypeQ8_0, GGMLTypeQ8_1, GGMLTypeIQ4_NL:
+		return 32
+	default: // the K-quants and the other I-quants
+		return 256
+	}
+}
+
+// TypeSize returns the number of bytes of a block of t following the block
+// layouts of ggml-common.h, or 0 if t is unknown
+func (t GGMLType) TypeSize() uint64 {
+	blockSize := t.BlockSize()
+
+	switch t {
+	case GGMLTypeF32:
+		return 4
+	case GGMLTypeF16:
+		return 2
+	case GGMLTypeQ4_0:
+		return 2 + blockSize/2
+	case GGMLTypeQ4_1:
+		return 2 + 2 + blockSize/2
+	case GGMLTypeQ5_0:
+		return 2 + 4 + blockSize/2
+	case GGMLTypeQ5_1:
+		return 2 + 2 + 4 + blockSize/2
+	case GGMLTypeQ8_0:
+		return 2 + blockSize
+	case GGMLTypeQ8_1:
+		// the scale and the sum of the block are both halves
+		return 2 + 2 + blockSize
+	case GGMLTypeQ2_K:
+		return blockSize/16 + blockSize/4 + 2 + 2
+	case GGMLTypeQ3_K:
+		return blockSize/8 + blockSize/4 + 12 + 2
+	case GGMLTypeQ4_K:
+		return 2 + 2 + 12 + blockSize/2
+	case GGMLTypeQ5_K:
+		return 2 + 2 + 12 + blockSize/8 + blockSize/2
+	case GGMLTypeQ6_K:
+		return blockSize/2 + blockSize/4 + blockSize/16 + 2
+	case GGMLTypeQ8_K:
+		// unlike the other K-quants the scale is a float
+		return 4 + blockSize + 2*blockSize/16
+	case GGMLTypeIQ2_XXS:
+		return 2 + 2*blockSize/8
+	case GGMLTypeIQ2_XS:
+		return 2 + 2*blockSize/8 + blockSize/32
+	case GGMLTypeIQ3_XXS:
+		return 2 + blockSize/4 + blockSize/8
+	case GGMLTypeIQ1_S:
+		return 2 + blockSize/8 + blockSize/16
+	case GGMLTypeIQ4_NL:
+		return 2 + blockSize/2
+	case GGMLTypeIQ3_S:
+		return 2 + blockSize/4 + blockSize/8 + blockSize/32 + 4
+	case GGMLTypeIQ2_S:
+		return 2 + blockSize/4 + blockSize/16
+	case GGMLTypeIQ4_XS:
+		return 2 + 2 + blockSize/2 + blockSize/64
+	case GGMLTypeI8:
+		return 1
+	case GGMLTypeI16:
+		return 2
+	case GGMLTypeI32:
+		return 4
+	case GGMLTypeI64:
+		return 8
+	case GGMLTypeF64:
+		return 8
+	case GGMLTypeIQ1_M:
+		return blockSize/8 + blockSize/16 + blockSize/32
+	case GGMLTypeBF16:
+		return 2
+	default:
+		return 0
+	}
+}
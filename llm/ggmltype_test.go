@@ -0,0 +1,75 @@
+package llm
+
+import "testing"
+
+func TestTensorType(t *testing.T) {
+	// sizes are those of the blocks of ggml-common.h
+	cases := []struct {
+		kind      uint32
+		name      string
+		blockSize uint64
+		typeSize  uint64
+	}{
+		{0, "F32", 1, 4},
+		{1, "F16", 1, 2},
+		{2, "Q4_0", 32, 18},
+		{3, "Q4_1", 32, 20},
+		{6, "Q5_0", 32, 22},
+		{7, "Q5_1", 32, 24},
+		{8, "Q8_0", 32, 34},
+		{9, "Q8_1", 32, 36},
+		{10, "Q2_K", 256, 84},
+		{11, "Q3_K", 256, 110},
+		{12, "Q4_K", 256, 144},
+		{13, "Q5_K", 256, 176},
+		{14, "Q6_K", 256, 210},
+		{15, "Q8_K", 256, 292},
+		{16, "IQ2_XXS", 256, 66},
+		{17, "IQ2_XS", 256, 74},
+		{18, "IQ3_XXS", 256, 98},
+		{19, "IQ1_S", 256, 50},
+		{20, "IQ4_NL", 32, 18},
+		{21, "IQ3_S", 256, 110},
+		{22, "IQ2_S", 256, 82},
+		{23, "IQ4_XS", 256, 136},
+		{24, "I8", 1, 1},
+		{25, "I16", 1, 2},
+		{26, "I32", 1, 4},
+		{27, "I64", 1, 8},
+		{28, "F64", 1, 8},
+		{29, "IQ1_M", 256, 56},
+		{30, "BF16", 1, 2},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tensor := Tensor{Kind: tt.kind, Shape: []uint64{512, 3}}
+			if got := tensor.Type().String(); got != tt.name {
+				t.Errorf("expected type %s, got %s", tt.name, got)
+			}
+
+			if got := tensor.BlockSize(); got != tt.blockSize {
+				t.Errorf("expected block size %d, got %d", tt.blockSize, got)
+			}
+
+			if got := tensor.ElementSize(); got != tt.typeSize {
+				t.Errorf("expected element size %d, got %d", tt.typeSize, got)
+			}
+
+			if want := 512 * 3 / tt.blockSize * tt.typeSize; tensor.Size() != want {
+				t.Errorf("expected size %d, got %d", want, tensor.Size())
+			}
+		})
+	}
+}
+
+func TestTensorTypeUnknown(t *testing.T) {
+	tensor := Tensor{Kind: 4, Shape: []uint64{256}}
+	if got := tensor.Type().String(); got != "unknown type 4" {
+		t.Errorf("expected unknown type 4, got %s", got)
+	}
+
+	if got := tensor.Size(); got != 0 {
+		t.Errorf("expected size 0, got %d", got)
+	}
+}
@@ -2,10 +2,17 @@ package llm
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/bits"
+	"path"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 
 	"log/slog"
 )
@@ -13,6 +20,8 @@ import (
 type containerGGUF struct {
 	ByteOrder binary.ByteOrder
 
+	limits Limits
+
 	Version uint32
 
 	V1 struct {
@@ -36,10 +45,36 @@ func (c *containerGGUF) Name() string {
 }
 
 func (c *containerGGUF) Decode(rs io.ReadSeeker) (model, error) {
-	if err := binary.Read(rs, c.ByteOrder, &c.Version); err != nil {
+	model, err := c.decodeHeader(rs)
+	if err != nil {
 		return nil, err
 	}
 
+	if err := model.Decode(rs); err != nil {
+		return nil, err
+	}
+
+	return model, nil
+}
+
+// decodeHeader decodes the version and counts of the GGUF and returns a
+// model to decode the rest of it with
+func (c *containerGGUF) decodeHeader(rs io.ReadSeeker) (*gguf, error) {
+	if err := binary.Read(rs, c.ByteOrder, &c.Version); err != nil {
+		return nil, decodeError(rs, err, "decoding version")
+	}
+
+	// writers store the magic as the bytes "GGUF" in either byte order so a
+	// file in the other byte order is only detectable from its version
+	if c.Version&0xffff == 0 {
+		c.Version = bits.ReverseBytes32(c.Version)
+		if c.ByteOrder == binary.ByteOrder(binary.LittleEndian) {
+			c.ByteOrder = binary.BigEndian
+		} else {
+			c.ByteOrder = binary.LittleEndian
+		}
+	}
+
 	var err error
 	switch c.Version {
 	case 1:
@@ -50,13 +85,18 @@ func (c *containerGGUF) Decode(rs io.ReadSeeker) (model, error) {
 		err = binary.Read(rs, c.ByteOrder, &c.V3)
 	}
 	if err != nil {
-		return nil, err
+		return nil, decodeError(rs, err, "decoding counts")
 	}
 
 	model := newGGUF(c)
 	slog.Debug(fmt.Sprintf("model = %#v", model))
-	if err := model.Decode(rs); err != nil {
-		return nil, err
+
+	if c.limits.MaxKV > 0 && model.numKV() > c.limits.MaxKV {
+		return nil, fmt.Errorf("%w: %d key-values is more than %d", ErrLimitExceeded, model.numKV(), c.limits.MaxKV)
+	}
+
+	if c.limits.MaxTensors > 0 && model.numTensor() > c.limits.MaxTensors {
+		return nil, fmt.Errorf("%w: %d tensors is more than %d", ErrLimitExceeded, model.numTensor(), c.limits.MaxTensors)
 	}
 
 	return model, nil
@@ -85,6 +125,17 @@ type gguf struct {
 	tensors []*Tensor
 
 	parameters uint64
+
+	// parallel is the number of tensors Encode produces the data of at once,
+	// see SetParallel
+	parallel int
+
+	// ctx cancels Encode, see SetContext
+	ctx context.Context
+
+	// offsets are the tensor offsets Encode checks its own against, see
+	// SetOffsets
+	offsets map[string]int64
 }
 
 func newGGUF(container *containerGGUF) *gguf {
@@ -95,7 +146,65 @@ func newGGUF(container *containerGGUF) *gguf {
 }
 
 func NewGGUFV3(bo binary.ByteOrder) *gguf {
-	return newGGUF(&containerGGUF{ByteOrder: bo, Version: 3})
+	return NewGGUF(bo, 3)
+}
+
+// NewGGUF returns a GGUF which encodes files of version in byte order bo.
+// Versions 2 and 3 share a layout so older readers which only accept version
+// 2 can be given one. Version 1 isn't supported by Encode.
+func NewGGUF(bo binary.ByteOrder, version uint32) *gguf {
+	return newGGUF(&containerGGUF{ByteOrder: bo, Version: version})
+}
+
+// SetParallel sets the number of tensors Encode produces the data of at
+// once. The data of each tensor is buffered in memory until it is written so
+// up to n tensors are held at a time. It is capped by GOMAXPROCS and defaults
+// to 1, which writes each tensor straight to the output.
+func (llm *gguf) SetParallel(n int) *gguf {
+	llm.parallel = n
+	return llm
+}
+
+// SetContext sets the context which cancels Encode, nil for none. It is
+// checked before each tensor and on each write of tensor data, so Encode
+// returns ctx.Err() soon after ctx is done even while a large tensor is
+// being produced.
+func (llm *gguf) SetContext(ctx context.Context) *gguf {
+	llm.ctx = ctx
+	return llm
+}
+
+// SetOffsets sets the offsets of the tensors of a known good GGUF, relative
+// to the start of its tensor data, nil for none. Encode then checks the
+// offset of each tensor against them before writing anything and returns an
+// ErrOffsetMismatch error naming the first tensor which differs. This pins
+// down regressions in the order or alignment of tensors.
+func (llm *gguf) SetOffsets(offsets map[string]int64) *gguf {
+	llm.offsets = offsets
+	return llm
+}
+
+// context returns the context set by SetContext or the background context
+func (llm *gguf) context() context.Context {
+	if llm.ctx == nil {
+		return context.Background()
+	}
+
+	return llm.ctx
+}
+
+// ctxWriter fails writes once its context is done
+type ctxWriter struct {
+	ctx context.Context
+	io.Writer
+}
+
+func (w ctxWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return w.Writer.Write(b)
 }
 
 func (llm *gguf) KV() KV {
@@ -129,52 +238,61 @@ func (llm *gguf) numKV() uint64 {
 }
 
 func (llm *gguf) Decode(rs io.ReadSeeker) error {
+	if err := llm.decodeMetadata(rs); err != nil {
+		return err
+	}
+
+	alignment := llm.alignment()
+	if alignment == 0 {
+		return errors.New("general.alignment must not be 0")
+	}
+
+	offset, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	padding := llm.padding(offset, int64(alignment))
+	if err := llm.validateTensors(rs, offset+padding, int64(alignment)); err != nil {
+		return err
+	}
+
+	if _, err := rs.Seek(offset+padding, io.SeekStart); err != nil {
+		return err
+	}
+
+	for _, tensor := range llm.tensors {
+		if _, err := rs.Seek(int64(tensor.Size()), io.SeekCurrent); err != nil {
+			return err
+		}
+
+		padding := llm.padding(int64(tensor.Size()), int64(alignment))
+		if _, err := rs.Seek(padding, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeMetadata decodes the key-values and tensor infos which follow the
+// header. The only seek is for the offset of a failure.
+func (llm *gguf) decodeMetadata(rs io.ReadSeeker) error {
 	// decode key-values
 	for i := 0; uint64(i) < llm.numKV(); i++ {
 		k, err := readGGUFString(llm, rs)
 		if err != nil {
-			return err
+			return decodeError(rs, err, "decoding key-value %d key", i)
 		}
 
 		t, err := readGGUF[uint32](llm, rs)
 		if err != nil {
-			return err
-		}
-
-		var v any
-		switch t {
-		case ggufTypeUint8:
-			v, err = readGGUF[uint8](llm, rs)
-		case ggufTypeInt8:
-			v, err = readGGUF[int8](llm, rs)
-		case ggufTypeUint16:
-			v, err = readGGUF[uint16](llm, rs)
-		case ggufTypeInt16:
-			v, err = readGGUF[int16](llm, rs)
-		case ggufTypeUint32:
-			v, err = readGGUF[uint32](llm, rs)
-		case ggufTypeInt32:
-			v, err = readGGUF[int32](llm, rs)
-		case ggufTypeUint64:
-			v, err = readGGUF[uint64](llm, rs)
-		case ggufTypeInt64:
-			v, err = readGGUF[int64](llm, rs)
-		case ggufTypeFloat32:
-			v, err = readGGUF[float32](llm, rs)
-		case ggufTypeFloat64:
-			v, err = readGGUF[float64](llm, rs)
-		case ggufTypeBool:
-			v, err = readGGUF[bool](llm, rs)
-		case ggufTypeString:
-			v, err = readGGUFString(llm, rs)
-		case ggufTypeArray:
-			v, err = readGGUFArray(llm, rs)
-		default:
-			return fmt.Errorf("invalid type: %d", t)
+			return decodeError(rs, err, "decoding key-value %d (%q) type", i, k)
 		}
 
+		v, err := readGGUFValue(llm, rs, t)
 		if err != nil {
-			return err
+			return decodeError(rs, err, "decoding key-value %d (%q) value", i, k)
 		}
 
 		llm.kv[k] = v
@@ -184,31 +302,35 @@ func (llm *gguf) Decode(rs io.ReadSeeker) error {
 	for i := 0; uint64(i) < llm.numTensor(); i++ {
 		name, err := readGGUFString(llm, rs)
 		if err != nil {
-			return err
+			return decodeError(rs, err, "decoding tensor %d name", i)
 		}
 
 		// dims is the number of dimensions in the tensor
 		dims, err := readGGUF[uint32](llm, rs)
 		if err != nil {
-			return err
+			return decodeError(rs, err, "decoding tensor %d (%q) dimensions", i, name)
 		}
 
 		shape := [4]uint64{1, 1, 1, 1}
-		for i := 0; uint32(i) < dims; i++ {
-			shape[i], err = readGGUF[uint64](llm, rs)
+		if dims > uint32(len(shape)) {
+			return decodeError(rs, fmt.Errorf("%d dimensions is more than %d", dims, len(shape)), "decoding tensor %d (%q) dimensions", i, name)
+		}
+
+		for j := 0; uint32(j) < dims; j++ {
+			shape[j], err = readGGUF[uint64](llm, rs)
 			if err != nil {
-				return err
+				return decodeError(rs, err, "decoding tensor %d (%q) shape", i, name)
 			}
 		}
 
 		kind, err := readGGUF[uint32](llm, rs)
 		if err != nil {
-			return err
+			return decodeError(rs, err, "decoding tensor %d (%q) kind", i, name)
 		}
 
 		offset, err := readGGUF[uint64](llm, rs)
 		if err != nil {
-			return err
+			return decodeError(rs, err, "decoding tensor %d (%q) offset", i, name)
 		}
 
 		tensor := Tensor{
@@ -225,35 +347,168 @@ func (llm *gguf) Decode(rs io.ReadSeeker) error {
 	// patch KV with parameter count
 	llm.kv["general.parameter_count"] = llm.parameters
 
-	alignment, ok := llm.kv["general.alignment"].(uint32)
-	if !ok {
-		alignment = 32
+	return nil
+}
+
+// decodeKeys decodes the key-values which follow the header like
+// decodeMetadata but only keeps those matching a pattern of keys, skipping the
+// values of the rest. It returns once each pattern has matched a key or all
+// key-values are read, without decoding any tensor infos.
+func (llm *gguf) decodeKeys(rs io.ReadSeeker, keys []string) error {
+	remaining := slices.Clone(keys)
+	for i := 0; uint64(i) < llm.numKV() && len(remaining) > 0; i++ {
+		k, err := readGGUFString(llm, rs)
+		if err != nil {
+			return decodeError(rs, err, "decoding key-value %d key", i)
+		}
+
+		t, err := readGGUF[uint32](llm, rs)
+		if err != nil {
+			return decodeError(rs, err, "decoding key-value %d (%q) type", i, k)
+		}
+
+		match := func(pattern string) bool {
+			ok, _ := path.Match(pattern, k)
+			return ok
+		}
+
+		matched := slices.ContainsFunc(keys, match)
+		remaining = slices.DeleteFunc(remaining, match)
+
+		if !matched {
+			if err := skipGGUFValue(llm, rs, t); err != nil {
+				return decodeError(rs, err, "skipping key-value %d (%q) value", i, k)
+			}
+
+			continue
+		}
+
+		v, err := readGGUFValue(llm, rs, t)
+		if err != nil {
+			return decodeError(rs, err, "decoding key-value %d (%q) value", i, k)
+		}
+
+		llm.kv[k] = v
 	}
 
-	offset, err := rs.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
+	return nil
+}
+
+// alignment returns the general.alignment of the metadata or the default of
+// 32 when it isn't set
+func (llm *gguf) alignment() uint32 {
+	if alignment, ok := llm.kv["general.alignment"].(uint32); ok {
+		return alignment
 	}
 
-	padding := llm.padding(offset, int64(alignment))
-	if _, err := rs.Seek(padding, io.SeekCurrent); err != nil {
+	return 32
+}
+
+// ErrTruncatedGGUF is returned when a GGUF file ends before its key-values,
+// tensor infos or tensor data do, e.g. after an interrupted download
+var ErrTruncatedGGUF = errors.New("truncated gguf")
+
+// ErrOffsetMismatch is returned by Encode when the offsets of its tensors
+// differ from those set by SetOffsets
+var ErrOffsetMismatch = errors.New("tensor offsets don't match")
+
+// tensorOffsets returns the offset of the data of each tensor relative to
+// the start of the tensor data, with the data of each tensor aligned
+func (llm *gguf) tensorOffsets(tensors []Tensor, alignment int64) []uint64 {
+	offsets := make([]uint64, len(tensors))
+	var offset uint64
+	for i, tensor := range tensors {
+		offsets[i] = offset
+		offset += tensor.Size()
+		offset += uint64(llm.padding(int64(offset), alignment))
+	}
+
+	return offsets
+}
+
+// checkOffsets compares offsets, those of tensors, to the offsets set by
+// SetOffsets and reports the first tensor, in the order tensors are written,
+// whose offset differs or which only one of them has
+func (llm *gguf) checkOffsets(tensors []Tensor, offsets []uint64) error {
+	for i, tensor := range tensors {
+		want, ok := llm.offsets[tensor.Name]
+		if !ok {
+			return fmt.Errorf("tensor %d (%q) at offset %d isn't in the reference: %w", i, tensor.Name, offsets[i], ErrOffsetMismatch)
+		}
+
+		if want != int64(offsets[i]) {
+			var after string
+			if i > 0 {
+				after = fmt.Sprintf(" after %q of %d bytes", tensors[i-1].Name, tensors[i-1].Size())
+			}
+
+			return fmt.Errorf("tensor %d (%q) is at offset %d%s, expected %d: %w", i, tensor.Name, offsets[i], after, want, ErrOffsetMismatch)
+		}
+	}
+
+	if len(llm.offsets) > len(tensors) {
+		var missing []string
+		for name := range llm.offsets {
+			if !slices.ContainsFunc(tensors, func(t Tensor) bool { return t.Name == name }) {
+				missing = append(missing, name)
+			}
+		}
+
+		slices.Sort(missing)
+		return fmt.Errorf("tensor %q of the reference at offset %d wasn't written: %w", missing[0], llm.offsets[missing[0]], ErrOffsetMismatch)
+	}
+
+	return nil
+}
+
+// validateTensors checks the offsets of the tensors are aligned, never go
+// backwards or into the data of the previous tensor, and that the data of
+// every tensor, which starts at data in rs, ends within rs. Tensor data is
+// skipped rather than read so nothing else notices a file which ends early.
+// The sizes are those of the block layout of each type so a size which is
+// wrong for a quantized type is caught here rather than by a later seek.
+func (llm *gguf) validateTensors(rs io.Seeker, data, alignment int64) error {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
 		return err
 	}
 
-	for _, tensor := range llm.tensors {
-		if _, err := rs.Seek(int64(tensor.Size()), io.SeekCurrent); err != nil {
-			return err
+	var prev, prevEnd uint64
+	for i, t := range llm.tensors {
+		if t.Offset%uint64(alignment) != 0 {
+			return fmt.Errorf("tensor %d (%q) offset %d isn't a multiple of the alignment %d", i, t.Name, t.Offset, alignment)
 		}
 
-		padding := llm.padding(int64(tensor.Size()), int64(alignment))
-		if _, err := rs.Seek(padding, io.SeekCurrent); err != nil {
-			return err
+		if t.Offset < prev {
+			return fmt.Errorf("tensor %d (%q) offset %d is before the offset %d of the previous tensor", i, t.Name, t.Offset, prev)
+		}
+
+		if t.Offset < prevEnd {
+			return fmt.Errorf("tensor %d (%q) offset %d is within the data of the previous tensor, which ends at %d", i, t.Name, t.Offset, prevEnd)
 		}
+
+		if end := data + int64(t.Offset) + int64(t.Size()); end > size || end < data {
+			return fmt.Errorf("tensor %d (%q) data ends at offset %d past the end of the file at %d: %w", i, t.Name, end, size, ErrTruncatedGGUF)
+		}
+
+		prev, prevEnd = t.Offset, t.Offset+t.Size()
 	}
 
 	return nil
 }
 
+// decodeError adds what was being decoded and the offset of rs to err. Reads
+// which ran out of data are reported as ErrTruncatedGGUF rather than io.EOF,
+// which DecodeGGML treats as the end of a stream of models.
+func decodeError(rs io.Seeker, err error, format string, args ...any) error {
+	offset, _ := rs.Seek(0, io.SeekCurrent)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = ErrTruncatedGGUF
+	}
+
+	return fmt.Errorf(format+" at offset %d: %w", append(args, offset, err)...)
+}
+
 func readGGUF[T any](llm *gguf, r io.Reader) (T, error) {
 	var t T
 	err := binary.Read(r, llm.ByteOrder, &t)
@@ -268,18 +523,136 @@ func writeGGUF[V any](llm *gguf, w io.Writer, t uint32, v V) error {
 	return binary.Write(w, llm.ByteOrder, v)
 }
 
+// readGGUFValue reads a value of type t
+func readGGUFValue(llm *gguf, r io.Reader, t uint32) (any, error) {
+	switch t {
+	case ggufTypeUint8:
+		return readGGUF[uint8](llm, r)
+	case ggufTypeInt8:
+		return readGGUF[int8](llm, r)
+	case ggufTypeUint16:
+		return readGGUF[uint16](llm, r)
+	case ggufTypeInt16:
+		return readGGUF[int16](llm, r)
+	case ggufTypeUint32:
+		return readGGUF[uint32](llm, r)
+	case ggufTypeInt32:
+		return readGGUF[int32](llm, r)
+	case ggufTypeUint64:
+		return readGGUF[uint64](llm, r)
+	case ggufTypeInt64:
+		return readGGUF[int64](llm, r)
+	case ggufTypeFloat32:
+		return readGGUF[float32](llm, r)
+	case ggufTypeFloat64:
+		return readGGUF[float64](llm, r)
+	case ggufTypeBool:
+		return readGGUF[bool](llm, r)
+	case ggufTypeString:
+		return readGGUFString(llm, r)
+	case ggufTypeArray:
+		return readGGUFArray(llm, r)
+	default:
+		return nil, fmt.Errorf("invalid type: %d", t)
+	}
+}
+
+// ggufTypeSize returns the size of a value of type t, or 0 for strings and
+// arrays whose size depends on their length
+func ggufTypeSize(t uint32) int64 {
+	switch t {
+	case ggufTypeUint8, ggufTypeInt8, ggufTypeBool:
+		return 1
+	case ggufTypeUint16, ggufTypeInt16:
+		return 2
+	case ggufTypeUint32, ggufTypeInt32, ggufTypeFloat32:
+		return 4
+	case ggufTypeUint64, ggufTypeInt64, ggufTypeFloat64:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// skipGGUFValue reads past a value of type t without decoding it. Arrays of
+// fixed size elements are skipped all at once.
+func skipGGUFValue(llm *gguf, r io.Reader, t uint32) error {
+	if size := ggufTypeSize(t); size > 0 {
+		_, err := io.CopyN(io.Discard, r, size)
+		return err
+	}
+
+	length := func() (uint64, error) {
+		if llm.Version == 1 {
+			n, err := readGGUF[uint32](llm, r)
+			return uint64(n), err
+		}
+
+		return readGGUF[uint64](llm, r)
+	}
+
+	switch t {
+	case ggufTypeString:
+		// the length of strings is 64 bit in every version
+		n, err := readGGUF[uint64](llm, r)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyN(io.Discard, r, int64(n))
+		return err
+	case ggufTypeArray:
+		et, err := readGGUF[uint32](llm, r)
+		if err != nil {
+			return err
+		}
+
+		n, err := length()
+		if err != nil {
+			return err
+		}
+
+		if !isGGUFArrayType(et) {
+			if n == 0 && llm.limits.LenientArrays {
+				return nil
+			}
+
+			return fmt.Errorf("invalid array type: %d", et)
+		}
+
+		if size := ggufTypeSize(et); size > 0 {
+			_, err := io.CopyN(io.Discard, r, int64(n)*size)
+			return err
+		}
+
+		for range n {
+			if err := skipGGUFValue(llm, r, et); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("invalid type: %d", t)
+	}
+}
+
 func readGGUFV1String(llm *gguf, r io.Reader) (string, error) {
 	var length uint64
 	if err := binary.Read(r, llm.ByteOrder, &length); err != nil {
 		return "", err
 	}
 
+	// gguf v1 strings are null-terminated so their length includes the null
+	if length == 0 {
+		return "", errors.New("gguf v1 string is missing its null terminator")
+	}
+
 	var b bytes.Buffer
 	if _, err := io.CopyN(&b, r, int64(length)); err != nil {
 		return "", err
 	}
 
-	// gguf v1 strings are null-terminated
 	b.Truncate(b.Len() - 1)
 
 	return b.String(), nil
@@ -327,6 +700,14 @@ func readGGUFV1Array(llm *gguf, r io.Reader) (a []any, err error) {
 		return nil, err
 	}
 
+	if !isGGUFArrayType(t) {
+		if n == 0 && llm.limits.LenientArrays {
+			return []any{}, nil
+		}
+
+		return nil, fmt.Errorf("invalid array type: %d", t)
+	}
+
 	for i := 0; uint32(i) < n; i++ {
 		var e any
 		switch t {
@@ -354,6 +735,8 @@ func readGGUFV1Array(llm *gguf, r io.Reader) (a []any, err error) {
 			e, err = readGGUF[bool](llm, r)
 		case ggufTypeString:
 			e, err = readGGUFV1String(llm, r)
+		case ggufTypeArray:
+			e, err = readGGUFV1Array(llm, r)
 		default:
 			return nil, fmt.Errorf("invalid array type: %d", t)
 		}
@@ -382,6 +765,14 @@ func readGGUFArray(llm *gguf, r io.Reader) (a []any, err error) {
 		return nil, err
 	}
 
+	if !isGGUFArrayType(t) {
+		if n == 0 && llm.limits.LenientArrays {
+			return []any{}, nil
+		}
+
+		return nil, fmt.Errorf("invalid array type: %d", t)
+	}
+
 	for i := 0; uint64(i) < n; i++ {
 		var e any
 		switch t {
@@ -409,6 +800,8 @@ func readGGUFArray(llm *gguf, r io.Reader) (a []any, err error) {
 			e, err = readGGUF[bool](llm, r)
 		case ggufTypeString:
 			e, err = readGGUFString(llm, r)
+		case ggufTypeArray:
+			e, err = readGGUFArray(llm, r)
 		default:
 			return nil, fmt.Errorf("invalid array type: %d", t)
 		}
@@ -422,6 +815,12 @@ func readGGUFArray(llm *gguf, r io.Reader) (a []any, err error) {
 	return
 }
 
+// isGGUFArrayType reports whether t is a valid type for the elements of an
+// array. Arrays of arrays are decoded to nested []any.
+func isGGUFArrayType(t uint32) bool {
+	return t <= ggufTypeFloat64
+}
+
 func writeGGUFArray[S ~[]E, E any](llm *gguf, w io.Writer, t uint32, s S) error {
 	if err := binary.Write(w, llm.ByteOrder, ggufTypeArray); err != nil {
 		return err
@@ -444,6 +843,144 @@ func writeGGUFArray[S ~[]E, E any](llm *gguf, w io.Writer, t uint32, s S) error
 	return nil
 }
 
+// ggufElementType returns the GGUF type of v as an element of an array
+// written by writeGGUFElement
+func ggufElementType(v any) (uint32, bool) {
+	switch v.(type) {
+	case uint8:
+		return ggufTypeUint8, true
+	case int8:
+		return ggufTypeInt8, true
+	case uint16:
+		return ggufTypeUint16, true
+	case int16:
+		return ggufTypeInt16, true
+	case uint32:
+		return ggufTypeUint32, true
+	case int32:
+		return ggufTypeInt32, true
+	case uint64:
+		return ggufTypeUint64, true
+	case int64:
+		return ggufTypeInt64, true
+	case float32:
+		return ggufTypeFloat32, true
+	case float64:
+		return ggufTypeFloat64, true
+	case bool:
+		return ggufTypeBool, true
+	case string:
+		return ggufTypeString, true
+	case []int32, []uint32, []float32, []bool, []string, [][]int32, []any:
+		return ggufTypeArray, true
+	default:
+		return 0, false
+	}
+}
+
+// writeGGUFElement writes v without its type as arrays store their elements.
+// Arrays are written as their element type, length and elements, so arrays of
+// arrays nest. The elements of a []any must share a type, which is taken from
+// the first one; an empty []any is written as an array of strings.
+func writeGGUFElement(llm *gguf, w io.Writer, v any) error {
+	array := func(t uint32, n int) error {
+		if err := binary.Write(w, llm.ByteOrder, t); err != nil {
+			return err
+		}
+
+		return binary.Write(w, llm.ByteOrder, uint64(n))
+	}
+
+	switch v := v.(type) {
+	case string:
+		if err := binary.Write(w, llm.ByteOrder, uint64(len(v))); err != nil {
+			return err
+		}
+
+		return binary.Write(w, llm.ByteOrder, []byte(v))
+	case []int32:
+		if err := array(ggufTypeInt32, len(v)); err != nil {
+			return err
+		}
+
+		return binary.Write(w, llm.ByteOrder, v)
+	case []uint32:
+		if err := array(ggufTypeUint32, len(v)); err != nil {
+			return err
+		}
+
+		return binary.Write(w, llm.ByteOrder, v)
+	case []float32:
+		if err := array(ggufTypeFloat32, len(v)); err != nil {
+			return err
+		}
+
+		return binary.Write(w, llm.ByteOrder, v)
+	case []bool:
+		if err := array(ggufTypeBool, len(v)); err != nil {
+			return err
+		}
+
+		return binary.Write(w, llm.ByteOrder, v)
+	case []string:
+		if err := array(ggufTypeString, len(v)); err != nil {
+			return err
+		}
+
+		for _, e := range v {
+			if err := writeGGUFElement(llm, w, e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case [][]int32:
+		if err := array(ggufTypeArray, len(v)); err != nil {
+			return err
+		}
+
+		for _, e := range v {
+			if err := writeGGUFElement(llm, w, e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case []any:
+		t := ggufTypeString
+		for i, e := range v {
+			et, ok := ggufElementType(e)
+			if !ok {
+				return fmt.Errorf("improper array element type %T", e)
+			}
+
+			if i == 0 {
+				t = et
+			} else if et != t {
+				return fmt.Errorf("array mixes elements of %T and %T", v[0], e)
+			}
+		}
+
+		if err := array(t, len(v)); err != nil {
+			return err
+		}
+
+		for _, e := range v {
+			if err := writeGGUFElement(llm, w, e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		if _, ok := ggufElementType(v); !ok {
+			return fmt.Errorf("improper array element type %T", v)
+		}
+
+		return binary.Write(w, llm.ByteOrder, v)
+	}
+}
+
 var ggufKVOrder = map[string][]string{
 	"llama": {
 		"general.architecture",
@@ -486,8 +1023,24 @@ var ggufKVOrder = map[string][]string{
 	},
 }
 
+// Encode writes kv and tensors to ws. Tensor data is aligned to
+// general.alignment when kv sets it and to the default of 32 otherwise, so
+// readers always agree with the writer. Tensor offsets are computed from the
+// sizes of the tensors and the alignment and checked against those set by
+// SetOffsets.
 func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 	switch llm.Version {
+	case 1:
+		// strings are null terminated and counts are 32 bits
+		return errors.New("ggufv1 isn't supported, use version 2 or 3")
+	case 2:
+		// big endian files were only introduced with version 3
+		if llm.ByteOrder != binary.ByteOrder(binary.LittleEndian) {
+			return errors.New("ggufv2 must be little endian")
+		}
+
+		llm.V2.NumTensor = uint64(len(tensors))
+		llm.V2.NumKV = uint64(len(kv))
 	case 3:
 		llm.V3.NumTensor = uint64(len(tensors))
 		llm.V3.NumKV = uint64(len(kv))
@@ -495,6 +1048,23 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		return fmt.Errorf("not implemented: ggufv%d", llm.Version)
 	}
 
+	var alignment int64 = 32
+	if v, ok := kv["general.alignment"]; ok {
+		a, ok := v.(uint32)
+		if !ok || a == 0 || a%8 != 0 {
+			return fmt.Errorf("general.alignment must be a uint32 multiple of 8, got %v", v)
+		}
+
+		alignment = int64(a)
+	}
+
+	offsets := llm.tensorOffsets(tensors, alignment)
+	if llm.offsets != nil {
+		if err := llm.checkOffsets(tensors, offsets); err != nil {
+			return err
+		}
+	}
+
 	if err := binary.Write(ws, llm.ByteOrder, []byte("GGUF")); err != nil {
 		return err
 	}
@@ -511,17 +1081,24 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		return err
 	}
 
-	kvCheck := make(map[string]bool)
+	keys := slices.Clone(ggufKVOrder["llama"])
+
+	// keys without a well-known position are written after the ordered keys
+	var extra []string
 	for k := range kv {
-		kvCheck[k] = false
+		if !slices.Contains(keys, k) {
+			extra = append(extra, k)
+		}
 	}
 
-	for _, k := range ggufKVOrder["llama"] {
+	slices.Sort(extra)
+	keys = append(keys, extra...)
+
+	for _, k := range keys {
 		v, ok := kv[k]
 		if !ok {
 			continue
 		}
-		kvCheck[k] = true
 
 		if err := binary.Write(ws, llm.ByteOrder, uint64(len(k))); err != nil {
 			return err
@@ -535,6 +1112,8 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		switch v := v.(type) {
 		case uint32:
 			err = writeGGUF(llm, ws, ggufTypeUint32, v)
+		case uint64:
+			err = writeGGUF(llm, ws, ggufTypeUint64, v)
 		case float32:
 			err = writeGGUF(llm, ws, ggufTypeFloat32, v)
 		case bool:
@@ -547,6 +1126,8 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 			err = writeGGUFArray(llm, ws, ggufTypeUint32, v)
 		case []float32:
 			err = writeGGUFArray(llm, ws, ggufTypeFloat32, v)
+		case []bool:
+			err = writeGGUFArray(llm, ws, ggufTypeBool, v)
 		case []string:
 			if err := binary.Write(ws, llm.ByteOrder, ggufTypeArray); err != nil {
 				return err
@@ -569,6 +1150,14 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 					return err
 				}
 			}
+		case [][]int32, []any:
+			if err := binary.Write(ws, llm.ByteOrder, ggufTypeArray); err != nil {
+				return err
+			}
+
+			if err := writeGGUFElement(llm, ws, v); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
 		default:
 			return fmt.Errorf("improper type for '%s'", k)
 		}
@@ -577,13 +1166,7 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		}
 	}
 
-	for k, v := range kvCheck {
-		if !v {
-			return fmt.Errorf("Didn't know how to write kv %s", k)
-		}
-	}
-
-	for _, tensor := range tensors {
+	for i, tensor := range tensors {
 		if err := binary.Write(ws, llm.ByteOrder, uint64(len(tensor.Name))); err != nil {
 			return err
 		}
@@ -613,7 +1196,7 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 			return err
 		}
 
-		if err := binary.Write(ws, llm.ByteOrder, tensor.Offset); err != nil {
+		if err := binary.Write(ws, llm.ByteOrder, offsets[i]); err != nil {
 			return err
 		}
 	}
@@ -623,31 +1206,121 @@ func (llm *gguf) Encode(ws io.WriteSeeker, kv KV, tensors []Tensor) error {
 		return err
 	}
 
-	var alignment int64 = 32
 	padding := llm.padding(offset, alignment)
 	if err := binary.Write(ws, llm.ByteOrder, bytes.Repeat([]byte{0}, int(padding))); err != nil {
 		return err
 	}
 
-	for _, tensor := range tensors {
-		if _, err := tensor.WriteTo(ws); err != nil {
-			return err
+	parallel := 1
+	if llm.parallel > 1 {
+		parallel = min(llm.parallel, runtime.GOMAXPROCS(0))
+	}
+
+	ctx := llm.context()
+	if parallel == 1 {
+		for _, tensor := range tensors {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if _, err := tensor.WriteTo(ctxWriter{ctx, ws}); err != nil {
+				return err
+			}
+
+			if err := llm.writePadding(ws, alignment); err != nil {
+				return err
+			}
 		}
 
-		offset, err := ws.Seek(0, io.SeekCurrent)
-		if err != nil {
+		return nil
+	}
+
+	return llm.encodeTensorsParallel(ctx, ws, tensors, alignment, parallel)
+}
+
+// encodeTensorsParallel writes the data of tensors in order while up to
+// parallel of them are produced concurrently, e.g. to repack or quantize
+// the tensors of a large model on every core
+func (llm *gguf) encodeTensorsParallel(ctx context.Context, ws io.WriteSeeker, tensors []Tensor, alignment int64, parallel int) error {
+	type result struct {
+		b   bytes.Buffer
+		err error
+	}
+
+	results := make([]chan *result, len(tensors))
+	for i := range results {
+		results[i] = make(chan *result, 1)
+	}
+
+	// returning early cancels the tensors still being produced and waits for
+	// them so none outlive Encode
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// sem holds a slot for each tensor produced but not yet written which
+	// bounds the data buffered at once
+	sem := make(chan struct{}, parallel)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, tensor := range tensors {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var r result
+				_, r.err = tensor.WriteTo(ctxWriter{ctx, &r.b})
+				results[i] <- &r
+			}()
+		}
+	}()
+
+	for i := range tensors {
+		var r *result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if r.err != nil {
+			return r.err
+		}
+
+		if _, err := r.b.WriteTo(ws); err != nil {
 			return err
 		}
 
-		padding := llm.padding(offset, alignment)
-		if err := binary.Write(ws, llm.ByteOrder, bytes.Repeat([]byte{0}, int(padding))); err != nil {
+		if err := llm.writePadding(ws, alignment); err != nil {
 			return err
 		}
+
+		<-sem
 	}
 
 	return nil
 }
 
+// writePadding pads ws with zeros to the next multiple of alignment
+func (llm *gguf) writePadding(ws io.WriteSeeker, alignment int64) error {
+	offset, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	padding := llm.padding(offset, alignment)
+	return binary.Write(ws, llm.ByteOrder, bytes.Repeat([]byte{0}, int(padding)))
+}
+
 func (gguf) padding(offset, align int64) int64 {
 	return (align - offset%align) % align
 }
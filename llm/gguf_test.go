@@ -0,0 +1,1227 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createGGUF encodes kv and tensors in byte order bo to a temporary file which
+// is returned seeked to the start
+func createGGUF(t *testing.T, bo binary.ByteOrder, kv KV, tensors []Tensor) *os.File {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	if err := NewGGUFV3(bo).Encode(f, kv, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestDecodeGGMLWithLimits(t *testing.T) {
+	kv := KV{
+		"general.architecture": "llama",
+		"general.name":         "test",
+		"llama.block_count":    uint32(1),
+	}
+
+	// readers are drained by encoding so each file gets its own
+	tensors := func() []Tensor {
+		return []Tensor{
+			{Name: "blk.0.attn_norm.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))},
+			{Name: "blk.0.ffn_norm.weight", Kind: 0, Shape: []uint64{8}, Offset: 32, WriterTo: bytes.NewReader(make([]byte, 32))},
+		}
+	}
+
+	cases := []struct {
+		name   string
+		limits Limits
+		err    error
+	}{
+		{"unlimited", Limits{}, nil},
+		{"within", Limits{MaxKV: 3, MaxTensors: 2, MaxBytes: 1 << 10}, nil},
+		{"kv", Limits{MaxKV: 2}, ErrLimitExceeded},
+		{"tensors", Limits{MaxTensors: 1}, ErrLimitExceeded},
+		{"bytes", Limits{MaxBytes: 64}, ErrLimitExceeded},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createGGUF(t, binary.LittleEndian, kv, tensors())
+			if _, _, err := DecodeGGMLWithLimits(f, tt.limits); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestDecodeGGMLByteOrder(t *testing.T) {
+	kv := KV{
+		"general.architecture":      "llama",
+		"general.name":              "test",
+		"llama.block_count":         uint32(1),
+		"llama.rope.freq_base":      float32(10000),
+		"tokenizer.ggml.token_type": []int32{1, 2, 3},
+	}
+
+	tensors := func() []Tensor {
+		return []Tensor{
+			{Name: "blk.0.attn_norm.weight", Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))},
+			{Name: "blk.0.attn_q.weight", Kind: 0, Shape: []uint64{4, 2}, Offset: 32, WriterTo: bytes.NewReader(make([]byte, 32))},
+		}
+	}
+
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(bo.String(), func(t *testing.T) {
+			m, _, err := DecodeGGML(createGGUF(t, bo, kv, tensors()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := m.KV()
+			if got.BlockCount() != 1 {
+				t.Fatalf("expected 1 block, got %d", got.BlockCount())
+			}
+
+			if got["llama.rope.freq_base"] != float32(10000) {
+				t.Fatalf("expected freq_base 10000, got %v", got["llama.rope.freq_base"])
+			}
+
+			if types, ok := got["tokenizer.ggml.token_type"].([]any); !ok || len(types) != 3 || types[2] != int32(3) {
+				t.Fatalf("expected token types [1 2 3], got %v", got["tokenizer.ggml.token_type"])
+			}
+
+			ts := m.Tensors()
+			if len(ts) != 2 || ts[1].Offset != 32 || ts[1].Shape[0] != 2 || ts[1].Shape[1] != 4 {
+				t.Fatalf("unexpected tensors %+v", ts)
+			}
+		})
+	}
+}
+
+func TestGGUFBuilder(t *testing.T) {
+	norm := bytes.Repeat([]byte{1, 2, 3, 4}, 4)
+	embd := bytes.Repeat([]byte{5, 6}, 16)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = NewGGUFBuilder().
+		SetKV("general.architecture", "llama").
+		SetKV("llama.block_count", uint32(1)).
+		SetKV("tokenizer.ggml.tokens", []string{"a", "b"}).
+		AddTensor("output_norm.weight", []uint64{4}, 0, norm).
+		AddTensor("token_embd.weight", []uint64{8, 2}, 1, embd).
+		Write(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, end, err := DecodeGGML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := ggml.KV()
+	if kv.Architecture() != "llama" || kv.BlockCount() != 1 || !reflect.DeepEqual(kv["tokenizer.ggml.tokens"], []any{"a", "b"}) {
+		t.Fatalf("unexpected kv %v", kv)
+	}
+
+	tensors := ggml.Tensors()
+	if len(tensors) != 2 {
+		t.Fatalf("expected 2 tensors, got %d", len(tensors))
+	}
+
+	want := []Tensor{
+		{Name: "output_norm.weight", Kind: 0, Offset: 0, Shape: []uint64{4, 1, 1, 1}},
+		{Name: "token_embd.weight", Kind: 1, Offset: 32, Shape: []uint64{8, 2, 1, 1}},
+	}
+
+	for i, tensor := range tensors {
+		if tensor.Name != want[i].Name || tensor.Kind != want[i].Kind || tensor.Offset != want[i].Offset || !slices.Equal(tensor.Shape, want[i].Shape) {
+			t.Fatalf("expected tensor %+v, got %+v", want[i], *tensor)
+		}
+	}
+
+	// the data section is the padded norm followed by the embedding
+	data := make([]byte, 64)
+	if _, err := f.ReadAt(data, end-64); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data[:16], norm) || !bytes.Equal(data[32:], embd) {
+		t.Fatalf("unexpected tensor data %v", data)
+	}
+}
+
+func TestEncodeAlignment(t *testing.T) {
+	norm := bytes.Repeat([]byte{1, 2, 3, 4}, 4)
+	embd := bytes.Repeat([]byte{5, 6}, 16)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = NewGGUFBuilder().
+		SetKV("general.architecture", "llama").
+		SetKV("general.alignment", uint32(64)).
+		AddTensor("output_norm.weight", []uint64{4}, 0, norm).
+		AddTensor("token_embd.weight", []uint64{8, 2}, 1, embd).
+		Write(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, end, err := DecodeGGML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ggml.KV()["general.alignment"]; got != uint32(64) {
+		t.Fatalf("expected general.alignment 64, got %v", got)
+	}
+
+	if offset := ggml.Tensors()[1].Offset; offset != 64 {
+		t.Fatalf("expected offset 64, got %d", offset)
+	}
+
+	// each tensor is padded to 64 bytes
+	data := make([]byte, 128)
+	if _, err := f.ReadAt(data, end-128); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data[:16], norm) || !bytes.Equal(data[64:96], embd) {
+		t.Fatalf("unexpected tensor data %v", data)
+	}
+
+	for _, alignment := range []any{uint32(12), uint32(0), "64"} {
+		var b bytes.Buffer
+		if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{Buffer: &b}, KV{"general.alignment": alignment}, nil); err == nil {
+			t.Fatalf("expected error for alignment %v", alignment)
+		}
+	}
+}
+
+func TestGGUFBuilderInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		fn   func(*GGUFBuilder) *GGUFBuilder
+	}{
+		{"type", func(b *GGUFBuilder) *GGUFBuilder { return b.SetKV("llama.block_count", 1) }},
+		{"key", func(b *GGUFBuilder) *GGUFBuilder { return b.SetKV("", "llama") }},
+		{"name", func(b *GGUFBuilder) *GGUFBuilder { return b.AddTensor("", []uint64{4}, 0, make([]byte, 16)) }},
+		{"duplicate", func(b *GGUFBuilder) *GGUFBuilder {
+			return b.AddTensor("a", []uint64{4}, 0, make([]byte, 16)).AddTensor("a", []uint64{4}, 0, make([]byte, 16))
+		}},
+		{"shape", func(b *GGUFBuilder) *GGUFBuilder { return b.AddTensor("a", []uint64{4, 0}, 0, make([]byte, 16)) }},
+		{"kind", func(b *GGUFBuilder) *GGUFBuilder { return b.AddTensor("a", []uint64{4}, 99, make([]byte, 16)) }},
+		{"block", func(b *GGUFBuilder) *GGUFBuilder { return b.AddTensor("a", []uint64{16}, 8, make([]byte, 17)) }},
+		{"data", func(b *GGUFBuilder) *GGUFBuilder { return b.AddTensor("a", []uint64{4}, 0, make([]byte, 8)) }},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			ws := &seekBuffer{Buffer: &b}
+			if err := tt.fn(NewGGUFBuilder()).Write(ws); err == nil {
+				t.Fatal("expected error")
+			}
+
+			if b.Len() > 0 {
+				t.Fatal("expected nothing to be written")
+			}
+		})
+	}
+}
+
+// seekBuffer is a write only io.WriteSeeker over a bytes.Buffer
+type seekBuffer struct {
+	*bytes.Buffer
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	return int64(b.Len()), nil
+}
+
+func TestDecodeGGMLLenientArrays(t *testing.T) {
+	// bogusArray returns a GGUF with a single array of n uint32 elements
+	// whose element type is invalid
+	bogusArray := func(n uint64) *bytes.Reader {
+		var b bytes.Buffer
+		b.WriteString("GGUF")
+		for _, v := range []any{uint32(3), uint64(0), uint64(1), uint64(len("a")), []byte("a"), ggufTypeArray, uint32(99), n} {
+			if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for range n {
+			if err := binary.Write(&b, binary.LittleEndian, uint32(0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return bytes.NewReader(b.Bytes())
+	}
+
+	if _, _, err := DecodeGGML(bogusArray(0)); err == nil {
+		t.Fatal("expected error")
+	}
+
+	ggml, _, err := DecodeGGMLWithLimits(bogusArray(0), Limits{LenientArrays: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, ok := ggml.KV()["a"].([]any); !ok || a == nil || len(a) != 0 {
+		t.Fatalf("expected empty array, got %#v", ggml.KV()["a"])
+	}
+
+	// arrays with elements can't be skipped without knowing their size
+	if _, _, err := DecodeGGMLWithLimits(bogusArray(2), Limits{LenientArrays: true}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestKVTokenizer(t *testing.T) {
+	cases := []struct {
+		name string
+		kv   KV
+		want *Tokenizer
+	}{
+		{
+			name: "standard",
+			kv: KV{
+				"tokenizer.ggml.model":  "gpt2",
+				"tokenizer.ggml.tokens": []string{"a", "b", "ab"},
+				"tokenizer.ggml.merges": []string{"a b"},
+			},
+			want: &Tokenizer{Model: "gpt2", Tokens: []string{"a", "b", "ab"}, Merges: []string{"a b"}},
+		},
+		{
+			name: "rwkv",
+			kv: KV{
+				"tokenizer.ggml.model":  "rwkv",
+				"tokenizer.ggml.tokens": []string{"a", "b"},
+			},
+			want: &Tokenizer{Model: "rwkv", Tokens: []string{"a", "b"}},
+		},
+		{
+			name: "rwkv keys",
+			kv: KV{
+				"tokenizer.ggml.rwkv.tokens": []string{"a", "b"},
+			},
+			want: &Tokenizer{Model: "rwkv", Tokens: []string{"a", "b"}},
+		},
+		{
+			name: "missing",
+			kv:   KV{"tokenizer.ggml.model": "llama"},
+		},
+		{
+			name: "merges type",
+			kv: KV{
+				"tokenizer.ggml.model":  "gpt2",
+				"tokenizer.ggml.tokens": []string{"a", "b"},
+				"tokenizer.ggml.merges": uint32(1),
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.kv["general.architecture"] = "llama"
+			ggml, _, err := DecodeGGML(createGGUF(t, binary.LittleEndian, tt.kv, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ggml.KV().Tokenizer()
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEncodeV2(t *testing.T) {
+	kv := KV{"general.architecture": "llama", "llama.block_count": uint32(1), "tokenizer.ggml.tokens": []string{"a", "b"}}
+	tensors := []Tensor{
+		{Name: "output_norm.weight", Kind: 0, Shape: []uint64{4}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{1, 2, 3, 4}, 4))},
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := NewGGUF(binary.LittleEndian, 2).Encode(f, kv, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _, err := DecodeGGML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version := ggml.container.(*containerGGUF).Version; version != 2 {
+		t.Fatalf("expected version 2, got %d", version)
+	}
+
+	if got := ggml.KV()["llama.block_count"]; got != uint32(1) {
+		t.Fatalf("expected llama.block_count 1, got %v", got)
+	}
+
+	if got := ggml.KV()["tokenizer.ggml.tokens"]; !reflect.DeepEqual(got, []any{"a", "b"}) {
+		t.Fatalf("expected tokens [a b], got %v", got)
+	}
+
+	if len(ggml.Tensors()) != 1 || ggml.Tensors()[0].Name != "output_norm.weight" {
+		t.Fatalf("expected output_norm.weight, got %v", ggml.Tensors())
+	}
+
+	for _, tt := range []struct {
+		bo      binary.ByteOrder
+		version uint32
+	}{
+		{binary.LittleEndian, 1},
+		{binary.BigEndian, 2},
+		{binary.LittleEndian, 4},
+	} {
+		var b bytes.Buffer
+		if err := NewGGUF(tt.bo, tt.version).Encode(&seekBuffer{Buffer: &b}, kv, tensors); err == nil {
+			t.Fatalf("expected error for %v version %d", tt.bo, tt.version)
+		}
+	}
+}
+
+// hashWriterTo writes n bytes derived from seed by rehashing it, standing in
+// for a tensor which is expensive to repack or quantize
+type hashWriterTo struct {
+	seed byte
+	n    int
+	err  error
+}
+
+func (w hashWriterTo) WriteTo(ww io.Writer) (int64, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	sum := sha256.Sum256([]byte{w.seed})
+	b := make([]byte, 0, w.n)
+	for len(b) < w.n {
+		sum = sha256.Sum256(sum[:])
+		b = append(b, sum[:]...)
+	}
+
+	n, err := ww.Write(b[:w.n])
+	return int64(n), err
+}
+
+func hashTensors(n int) []Tensor {
+	tensors := make([]Tensor, n)
+	for i := range tensors {
+		tensors[i] = Tensor{Name: fmt.Sprintf("blk.%d.ffn_up.weight", i), Kind: 0, Shape: []uint64{uint64(i + 1), 1024}, WriterTo: hashWriterTo{byte(i), (i + 1) * 4096, nil}}
+	}
+
+	return tensors
+}
+
+func TestEncodeParallel(t *testing.T) {
+	kv := KV{"general.architecture": "llama"}
+	tensors := hashTensors(16)
+
+	var want bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).SetParallel(1).Encode(&seekBuffer{&want}, kv, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{0, 2, 64} {
+		var got bytes.Buffer
+		if err := NewGGUFV3(binary.LittleEndian).SetParallel(n).Encode(&seekBuffer{&got}, kv, tensors); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("parallel %d: expected the output of writing one tensor at a time", n)
+		}
+	}
+
+	failed := errors.New("failed")
+	tensors[5].WriterTo = hashWriterTo{err: failed}
+	for _, n := range []int{1, 4} {
+		if err := NewGGUFV3(binary.LittleEndian).SetParallel(n).Encode(&seekBuffer{&bytes.Buffer{}}, kv, tensors); !errors.Is(err, failed) {
+			t.Fatalf("parallel %d: expected %v, got %v", n, failed, err)
+		}
+	}
+}
+
+// cancelWriterTo cancels its context and then writes until a write fails as
+// a tensor of unbounded size would
+type cancelWriterTo struct {
+	cancel context.CancelFunc
+}
+
+func (w cancelWriterTo) WriteTo(ww io.Writer) (int64, error) {
+	w.cancel()
+
+	var n int64
+	b := make([]byte, 1024)
+	for {
+		m, err := ww.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func TestEncodeContext(t *testing.T) {
+	kv := KV{"general.architecture": "llama"}
+	for _, n := range []int{1, 4} {
+		t.Run(fmt.Sprintf("parallel=%d", n), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tensors := hashTensors(8)
+			tensors[3].WriterTo = cancelWriterTo{cancel}
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- NewGGUFV3(binary.LittleEndian).SetParallel(n).SetContext(ctx).Encode(&seekBuffer{&bytes.Buffer{}}, kv, tensors)
+			}()
+
+			select {
+			case err := <-errc:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("expected %v, got %v", context.Canceled, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("encode didn't return once its context was cancelled")
+			}
+		})
+	}
+}
+
+// busyWriterTo writes until a write fails as a tensor of unbounded size
+// would, counting the writers still running
+type busyWriterTo struct {
+	running *atomic.Int32
+}
+
+func (w busyWriterTo) WriteTo(ww io.Writer) (int64, error) {
+	w.running.Add(1)
+	defer w.running.Add(-1)
+
+	var n int64
+	b := make([]byte, 1024)
+	for {
+		m, err := ww.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func TestEncodeParallelError(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	var running atomic.Int32
+	tensors := hashTensors(8)
+	for i := range tensors {
+		tensors[i].WriterTo = busyWriterTo{&running}
+	}
+
+	// the first tensor fails while those after it are still being produced
+	failed := errors.New("failed")
+	tensors[0].WriterTo = hashWriterTo{err: failed}
+
+	kv := KV{"general.architecture": "llama"}
+	if err := NewGGUFV3(binary.LittleEndian).SetParallel(4).Encode(&seekBuffer{&bytes.Buffer{}}, kv, tensors); !errors.Is(err, failed) {
+		t.Fatalf("expected %v, got %v", failed, err)
+	}
+
+	if n := running.Load(); n != 0 {
+		t.Fatalf("expected no tensors still being produced, got %d", n)
+	}
+}
+
+func TestEncodeOffsets(t *testing.T) {
+	kv := KV{"general.architecture": "llama"}
+	tensors := func(rows uint64) []Tensor {
+		return []Tensor{
+			{Name: "token_embd.weight", Kind: 0, Shape: []uint64{4, rows}, WriterTo: bytes.NewReader(make([]byte, 16*rows))},
+			{Name: "blk.0.attn_norm.weight", Kind: 0, Shape: []uint64{4}, WriterTo: bytes.NewReader(make([]byte, 16))},
+			{Name: "output_norm.weight", Kind: 0, Shape: []uint64{4}, WriterTo: bytes.NewReader(make([]byte, 16))},
+		}
+	}
+
+	var b bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, kv, tensors(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _, err := DecodeGGML(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := make(map[string]int64)
+	for _, tensor := range ggml.Tensors() {
+		manifest[tensor.Name] = int64(tensor.Offset)
+	}
+
+	var got bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).SetOffsets(manifest).Encode(&seekBuffer{&got}, kv, tensors(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Bytes(), b.Bytes()) {
+		t.Fatal("checking offsets changed the output")
+	}
+
+	// a fifth row of the embedding pushes the next tensor past the alignment
+	got.Reset()
+	err = NewGGUFV3(binary.LittleEndian).SetOffsets(manifest).Encode(&seekBuffer{&got}, kv, tensors(5))
+	if !errors.Is(err, ErrOffsetMismatch) {
+		t.Fatalf("expected %v, got %v", ErrOffsetMismatch, err)
+	}
+
+	if want := `tensor 1 ("blk.0.attn_norm.weight") is at offset 96 after "token_embd.weight" of 80 bytes, expected 64`; !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected %q, got %q", want, err)
+	}
+
+	if got.Len() > 0 {
+		t.Fatalf("expected nothing written, got %d bytes", got.Len())
+	}
+
+	delete(manifest, "output_norm.weight")
+	if err := NewGGUFV3(binary.LittleEndian).SetOffsets(manifest).Encode(&seekBuffer{&bytes.Buffer{}}, kv, tensors(4)); !errors.Is(err, ErrOffsetMismatch) || !strings.Contains(err.Error(), "output_norm.weight") {
+		t.Fatalf("expected a mismatch of output_norm.weight, got %v", err)
+	}
+}
+
+func BenchmarkEncodeParallel(b *testing.B) {
+	kv := KV{"general.architecture": "llama"}
+	tensors := hashTensors(32)
+
+	for _, n := range slices.Compact([]int{1, runtime.GOMAXPROCS(0)}) {
+		b.Run(fmt.Sprintf("parallel=%d", n), func(b *testing.B) {
+			for range b.N {
+				if err := NewGGUFV3(binary.LittleEndian).SetParallel(n).Encode(&seekBuffer{&bytes.Buffer{}}, kv, tensors); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeGGMLTruncated(t *testing.T) {
+	var b bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, KV{
+		"general.architecture":  "llama",
+		"llama.block_count":     uint32(1),
+		"tokenizer.ggml.tokens": []string{"a", "b"},
+	}, []Tensor{
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 2}, WriterTo: bytes.NewReader(make([]byte, 16))},
+		{Name: "output_norm.weight", Kind: 0, Shape: []uint64{2}, WriterTo: bytes.NewReader(make([]byte, 8))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every prefix past the magic fails as truncated until the data of the
+	// last tensor is complete, leaving out only its padding
+	for n := 4; n <= b.Len(); n++ {
+		ggml, _, err := DecodeGGML(bytes.NewReader(b.Bytes()[:n]))
+		if n >= b.Len()-24 {
+			if err != nil {
+				t.Fatalf("%d bytes: expected no error, got %v", n, err)
+			} else if len(ggml.Tensors()) != 2 {
+				t.Fatalf("%d bytes: expected 2 tensors, got %d", n, len(ggml.Tensors()))
+			}
+		} else if !errors.Is(err, ErrTruncatedGGUF) {
+			t.Fatalf("%d bytes: expected %v, got %v", n, ErrTruncatedGGUF, err)
+		}
+	}
+
+	// the error names what was being decoded
+	end := bytes.Index(b.Bytes(), []byte("output_norm.weight")) + len("output_norm.weight") + 2
+	_, _, err := DecodeGGML(bytes.NewReader(b.Bytes()[:end]))
+	if want := `decoding tensor 1 ("output_norm.weight") dimensions at offset`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected %q, got %v", want, err)
+	}
+}
+
+func TestDecodeGGMLMalformed(t *testing.T) {
+	t.Run("dimensions", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, KV{
+			"general.architecture": "llama",
+		}, []Tensor{
+			{Name: "output_norm.weight", Kind: 0, Shape: []uint64{2}, WriterTo: bytes.NewReader(make([]byte, 8))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the dimensions follow the name of the tensor
+		dims := bytes.Index(b.Bytes(), []byte("output_norm.weight")) + len("output_norm.weight")
+		binary.LittleEndian.PutUint32(b.Bytes()[dims:], 5)
+
+		_, _, err := DecodeGGML(bytes.NewReader(b.Bytes()))
+		if want := `decoding tensor 0 ("output_norm.weight") dimensions`; err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q, got %v", want, err)
+		}
+	})
+
+	t.Run("v1 string", func(t *testing.T) {
+		var b bytes.Buffer
+		for _, v := range []any{
+			[]byte("GGUF"), uint32(1),
+			// the tensor and key-value counts
+			uint32(0), uint32(1),
+			// a key-value whose key is an empty string without its null
+			uint64(0), uint32(ggufTypeString), uint64(0),
+		} {
+			if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, _, err := DecodeGGML(bytes.NewReader(b.Bytes()))
+		if want := "missing its null terminator"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q, got %v", want, err)
+		}
+	})
+}
+
+func TestDecodeGGMLTensorOffsets(t *testing.T) {
+	encode := func(t *testing.T, kv KV) []byte {
+		t.Helper()
+
+		var b bytes.Buffer
+		if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, kv, []Tensor{
+			{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 2}, WriterTo: bytes.NewReader(make([]byte, 16))},
+			{Name: "output_norm.weight", Kind: 0, Shape: []uint64{2}, WriterTo: bytes.NewReader(make([]byte, 8))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return b.Bytes()
+	}
+
+	// setOffset overwrites the offset of the tensor named name with dims
+	// dimensions, which follows its name, dimension count, shape and kind
+	setOffset := func(b []byte, name string, dims int, offset uint64) []byte {
+		i := bytes.Index(b, []byte(name)) + len(name) + 4 + 8*dims + 4
+		binary.LittleEndian.PutUint64(b[i:], offset)
+		return b
+	}
+
+	llama := KV{"general.architecture": "llama"}
+	aligned8 := KV{"general.architecture": "llama", "general.alignment": uint32(8)}
+
+	cases := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"past the end", setOffset(encode(t, llama), "output_norm.weight", 1, 1<<20), `tensor 1 ("output_norm.weight") data ends at offset`},
+		{"overflow", setOffset(encode(t, llama), "output_norm.weight", 1, 1<<63), `tensor 1 ("output_norm.weight") data ends at offset`},
+		{"misaligned", setOffset(encode(t, llama), "output_norm.weight", 1, 16), "isn't a multiple of the alignment 32"},
+		{"backwards", setOffset(setOffset(encode(t, aligned8), "token_embd.weight", 2, 8), "output_norm.weight", 1, 0), "offset 0 is before the offset 8 of the previous tensor"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeGGML(bytes.NewReader(tt.b))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if _, _, err := DecodeGGML(bytes.NewReader(encode(t, llama))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeGGMLQuantizedOffsets(t *testing.T) {
+	// 2 rows of 2 Q4_0 blocks of 18 bytes and 2 rows of a Q6_K block of 210
+	// bytes, neither a whole number of bytes per element
+	q4 := bytes.Repeat([]byte{1}, 4*18)
+	q6 := bytes.Repeat([]byte{2}, 2*210)
+	norm := bytes.Repeat([]byte{3}, 4*64)
+
+	var b bytes.Buffer
+	if err := NewGGUFBuilder().
+		SetKV("general.architecture", "llama").
+		AddTensor("blk.0.attn_q.weight", []uint64{64, 2}, 2, q4).
+		AddTensor("blk.0.ffn_down.weight", []uint64{256, 2}, 14, q6).
+		AddTensor("output_norm.weight", []uint64{64}, 0, norm).
+		Write(&seekBuffer{Buffer: &b}); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, end, err := DecodeGGML(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if end != int64(b.Len()) {
+		t.Fatalf("expected decoding to end at %d, got %d", b.Len(), end)
+	}
+
+	// each tensor starts at the end of the previous one's blocks, aligned
+	want := []struct {
+		offset, size uint64
+	}{{0, 72}, {96, 420}, {544, 256}}
+
+	tensors := ggml.Tensors()
+	for i, tensor := range tensors {
+		if tensor.Offset != want[i].offset || tensor.Size() != want[i].size {
+			t.Errorf("%s: expected offset %d and size %d, got %d and %d", tensor.Name, want[i].offset, want[i].size, tensor.Offset, tensor.Size())
+		}
+	}
+
+	data := b.Bytes()[end-int64(tensors.TotalSize()):]
+	for i, d := range [][]byte{q4, q6, norm} {
+		if got := data[tensors[i].Offset : tensors[i].Offset+tensors[i].Size()]; !bytes.Equal(got, d) {
+			t.Errorf("%s: unexpected data", tensors[i].Name)
+		}
+	}
+
+	// a tensor which starts within the blocks of the previous one
+	i := bytes.Index(b.Bytes(), []byte("blk.0.ffn_down.weight")) + len("blk.0.ffn_down.weight") + 4 + 8*2 + 4
+	broken := slices.Clone(b.Bytes())
+	binary.LittleEndian.PutUint64(broken[i:], 64)
+	if _, _, err := DecodeGGML(bytes.NewReader(broken)); err == nil || !strings.Contains(err.Error(), "within the data of the previous tensor, which ends at 72") {
+		t.Fatalf("expected an overlapping tensor error, got %v", err)
+	}
+}
+
+// streamOnly hides every method of its reader but Read, like an HTTP
+// response body
+type streamOnly struct {
+	io.Reader
+}
+
+func TestDecodeGGMLMetadata(t *testing.T) {
+	var b bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, KV{
+		"general.architecture":  "llama",
+		"llama.block_count":     uint32(1),
+		"tokenizer.ggml.tokens": []string{"a", "b"},
+	}, []Tensor{
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 2}, WriterTo: bytes.NewReader(make([]byte, 16))},
+		{Name: "output_norm.weight", Kind: 0, Shape: []uint64{2}, WriterTo: bytes.NewReader(make([]byte, 8))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _, err := DecodeGGML(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(b.Bytes())
+	got, err := DecodeGGMLMetadata(streamOnly{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got.KV(), want.KV()) {
+		t.Errorf("expected kv %v, got %v", want.KV(), got.KV())
+	}
+
+	if !reflect.DeepEqual(got.Tensors(), want.Tensors()) {
+		t.Errorf("expected tensors %+v, got %+v", want.Tensors(), got.Tensors())
+	}
+
+	// the reader stops at the end of the tensor infos, which are followed by
+	// padding to the alignment and the data of both tensors padded to 32
+	read := r.Size() - int64(r.Len())
+	if rest := int64(r.Len()) - (32-read%32)%32; rest != 64 {
+		t.Errorf("expected 64 bytes of tensor data left after the metadata, got %d", rest)
+	}
+
+	// a truncated stream fails with the offset it was read to
+	_, err = DecodeGGMLMetadata(streamOnly{bytes.NewReader(b.Bytes()[:40])})
+	if !errors.Is(err, ErrTruncatedGGUF) || !strings.Contains(err.Error(), "at offset") {
+		t.Fatalf("expected %v, got %v", ErrTruncatedGGUF, err)
+	}
+}
+
+func TestDecodeGGMLKeys(t *testing.T) {
+	var b bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, KV{
+		"general.architecture":  "llama",
+		"llama.context_length":  uint32(4096),
+		"llama.block_count":     uint32(1),
+		"tokenizer.ggml.tokens": []string{"a", "b"},
+		"tokenizer.ggml.scores": []float32{0, 1},
+	}, []Tensor{
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 2}, WriterTo: bytes.NewReader(make([]byte, 16))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tokenizer is written last so it isn't read once the keys before it
+	// are found
+	r := bytes.NewReader(b.Bytes())
+	kv, err := DecodeGGMLKeys(streamOnly{r}, []string{"general.architecture", "*.context_length"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (KV{"general.architecture": "llama", "llama.context_length": uint32(4096)}); !reflect.DeepEqual(kv, want) {
+		t.Errorf("expected kv %v, got %v", want, kv)
+	}
+
+	if tokens := bytes.Index(b.Bytes(), []byte("tokenizer.ggml.tokens")); r.Len() < b.Len()-tokens {
+		t.Errorf("expected the tokenizer to be left unread, %d bytes are left", r.Len())
+	}
+
+	// a missing key is absent, with every other value skipped
+	r = bytes.NewReader(b.Bytes())
+	kv, err = DecodeGGMLKeys(streamOnly{r}, []string{"tokenizer.ggml.scores", "llama.rope.freq_base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (KV{"tokenizer.ggml.scores": []any{float32(0), float32(1)}}); !reflect.DeepEqual(kv, want) {
+		t.Errorf("expected kv %v, got %v", want, kv)
+	}
+
+	// listing every key decodes what DecodeGGML does, less the parameter count
+	// it counts from the tensor infos
+	want, _, err := DecodeGGML(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delete(want.KV(), "general.parameter_count")
+	if kv, err := DecodeGGMLKeys(bytes.NewReader(b.Bytes()), []string{"general.architecture", "llama.context_length", "llama.block_count", "tokenizer.ggml.tokens", "tokenizer.ggml.scores"}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(kv, want.KV()) {
+		t.Errorf("expected kv %v, got %v", want.KV(), kv)
+	}
+
+	// a pattern is found by the first key it matches
+	if kv, err := DecodeGGMLKeys(bytes.NewReader(b.Bytes()), []string{"*"}); err != nil {
+		t.Fatal(err)
+	} else if want := (KV{"general.architecture": "llama"}); !reflect.DeepEqual(kv, want) {
+		t.Errorf("expected kv %v, got %v", want, kv)
+	}
+
+	if _, err := DecodeGGMLKeys(bytes.NewReader(b.Bytes()), []string{"general.["}); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("expected %v, got %v", path.ErrBadPattern, err)
+	}
+}
+
+// BenchmarkDecodeGGMLKeys compares looking up the architecture of a model with
+// a large vocabulary and many tensors to decoding all of its metadata
+func BenchmarkDecodeGGMLKeys(b *testing.B) {
+	tokens := make([]string, 256_000)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token%d", i)
+	}
+
+	tensors := make([]Tensor, 4096)
+	for i := range tensors {
+		tensors[i] = Tensor{Name: fmt.Sprintf("blk.%d.weight", i), Kind: 0, Shape: []uint64{8}, WriterTo: bytes.NewReader(make([]byte, 32))}
+	}
+
+	var buf bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&buf}, KV{
+		"general.architecture":  "llama",
+		"llama.context_length":  uint32(4096),
+		"tokenizer.ggml.tokens": tokens,
+		"tokenizer.ggml.scores": make([]float32, len(tokens)),
+	}, tensors); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("keys", func(b *testing.B) {
+		for range b.N {
+			if _, err := DecodeGGMLKeys(bytes.NewReader(buf.Bytes()), []string{"general.architecture", "*.context_length"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("missing", func(b *testing.B) {
+		for range b.N {
+			if _, err := DecodeGGMLKeys(bytes.NewReader(buf.Bytes()), []string{"general.architecture", "llama.rope.freq_base"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("full", func(b *testing.B) {
+		for range b.N {
+			if _, _, err := DecodeGGML(bytes.NewReader(buf.Bytes())); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTensorsCheckSize(t *testing.T) {
+	var b bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, KV{"general.architecture": "llama"}, []Tensor{
+		{Name: "token_embd.weight", Kind: 0, Shape: []uint64{2, 2}, WriterTo: bytes.NewReader(make([]byte, 16))},
+		{Name: "output_norm.weight", Kind: 0, Shape: []uint64{2}, WriterTo: bytes.NewReader(make([]byte, 8))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, err := DecodeGGMLMetadata(streamOnly{bytes.NewReader(b.Bytes())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 16 bytes padded to 32 and then 8 bytes
+	ts := ggml.Tensors()
+	if got := ts.TotalSize(); got != 40 {
+		t.Fatalf("expected a total size of 40, got %d", got)
+	}
+
+	if got := ts.alignedSize(8); got != 24 {
+		t.Fatalf("expected a total size of 24 aligned to 8, got %d", got)
+	}
+
+	// the data is followed by the 24 bytes padding the last tensor
+	size := int64(b.Len())
+	data := size - 64
+	for _, tt := range []struct {
+		size int64
+		err  error
+	}{
+		{size, nil},
+		{size - 24, nil},
+		{size - 25, ErrTruncatedGGUF},
+		{data, ErrTruncatedGGUF},
+		{data - 1, ErrTruncatedGGUF},
+	} {
+		if err := ts.CheckSize(tt.size, data, 0); !errors.Is(err, tt.err) {
+			t.Errorf("%d bytes: expected %v, got %v", tt.size, tt.err, err)
+		}
+	}
+}
+
+func TestEncodeNestedArrays(t *testing.T) {
+	kv := KV{
+		"general.architecture":   "llama",
+		"clip.vision.grid":       [][]int32{{1, 2}, {3}},
+		"clip.vision.names":      []any{[]any{"a", "b"}, []any{[]any{uint64(1)}}},
+		"clip.vision.pinpoints":  []any{[]int32{336, 672}, []int32{672, 336}},
+		"clip.vision.mean_stack": []any{float32(0.5), float32(0.25)},
+	}
+
+	var b bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&b}, kv, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _, err := DecodeGGML(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ggml.KV()
+	for k, want := range map[string]any{
+		"clip.vision.grid":       []any{[]any{int32(1), int32(2)}, []any{int32(3)}},
+		"clip.vision.names":      []any{[]any{"a", "b"}, []any{[]any{uint64(1)}}},
+		"clip.vision.pinpoints":  []any{[]any{int32(336), int32(672)}, []any{int32(672), int32(336)}},
+		"clip.vision.mean_stack": []any{float32(0.5), float32(0.25)},
+	} {
+		if !reflect.DeepEqual(got[k], want) {
+			t.Errorf("%s: expected %v, got %v", k, want, got[k])
+		}
+	}
+
+	// the decoded arrays encode to the same bytes
+	decoded := make(KV)
+	for k, v := range got {
+		if k != "general.parameter_count" {
+			decoded[k] = v
+		}
+	}
+
+	var again bytes.Buffer
+	if err := NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&again}, decoded, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(again.Bytes(), b.Bytes()) {
+		t.Error("expected the decoded nested arrays to encode like the originals")
+	}
+
+	// every element of an array has the type of the first
+	err = NewGGUFV3(binary.LittleEndian).Encode(&seekBuffer{&bytes.Buffer{}}, KV{"general.architecture": "llama", "mixed": []any{int32(1), "a"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "mixes") {
+		t.Fatalf("expected mixed array error, got %v", err)
+	}
+}
+
+func TestKVGetters(t *testing.T) {
+	kv := KV{
+		"uint8":    uint8(8),
+		"uint16":   uint16(16),
+		"uint32":   uint32(32),
+		"uint64":   uint64(64),
+		"int8":     int8(-8),
+		"int16":    int16(16),
+		"int32":    int32(32),
+		"int64":    int64(-64),
+		"float32":  float32(1.5),
+		"float64":  float64(128),
+		"negative": float64(-1),
+		"huge":     float64(1 << 64),
+		"bool":     true,
+		"string":   "llama",
+		"strings":  []any{"a", "b"},
+		"typed":    []string{"c"},
+		"mixed":    []any{"a", uint32(1)},
+	}
+
+	for key, want := range map[string]struct {
+		v  uint64
+		ok bool
+	}{
+		"uint8":    {8, true},
+		"uint16":   {16, true},
+		"uint32":   {32, true},
+		"uint64":   {64, true},
+		"int8":     {0, false},
+		"int16":    {16, true},
+		"int32":    {32, true},
+		"int64":    {0, false},
+		"float32":  {0, false},
+		"float64":  {128, true},
+		"negative": {0, false},
+		"huge":     {0, false},
+		"bool":     {0, false},
+		"string":   {0, false},
+		"missing":  {0, false},
+	} {
+		if v, ok := kv.Uint(key); v != want.v || ok != want.ok {
+			t.Errorf("Uint(%q): expected %d, %t, got %d, %t", key, want.v, want.ok, v, ok)
+		}
+	}
+
+	for key, want := range map[string]struct {
+		v  float64
+		ok bool
+	}{
+		"uint8":   {8, true},
+		"uint16":  {16, true},
+		"uint32":  {32, true},
+		"uint64":  {64, true},
+		"int8":    {-8, true},
+		"int16":   {16, true},
+		"int32":   {32, true},
+		"int64":   {-64, true},
+		"float32": {1.5, true},
+		"float64": {128, true},
+		"bool":    {0, false},
+		"string":  {0, false},
+		"missing": {0, false},
+	} {
+		if v, ok := kv.Float(key); v != want.v || ok != want.ok {
+			t.Errorf("Float(%q): expected %v, %t, got %v, %t", key, want.v, want.ok, v, ok)
+		}
+	}
+
+	if s, ok := kv.String("string"); s != "llama" || !ok {
+		t.Errorf("String: expected llama, got %q, %t", s, ok)
+	}
+
+	if _, ok := kv.String("uint32"); ok {
+		t.Error("String: expected a number not to be a string")
+	}
+
+	for key, want := range map[string][]string{"strings": {"a", "b"}, "typed": {"c"}, "mixed": nil, "string": nil, "missing": nil} {
+		if s, ok := kv.Strings(key); !slices.Equal(s, want) || ok != (want != nil) {
+			t.Errorf("Strings(%q): expected %q, got %q, %t", key, want, s, ok)
+		}
+	}
+
+	// lookups by architecture accept any integer type
+	kv = KV{"general.architecture": "llama", "llama.context_length": int32(4096)}
+	if got := kv.ContextLength(); got != 4096 {
+		t.Errorf("expected context length 4096, got %d", got)
+	}
+}
+
+func TestKVModelName(t *testing.T) {
+	for _, tt := range []struct {
+		kv   KV
+		want string
+	}{
+		{KV{"general.name": "Llama 3", "general.basename": "llama", "general.size_label": "8B", "general.architecture": "llama"}, "Llama 3"},
+		{KV{"general.basename": "llama", "general.size_label": "8B", "general.architecture": "llama"}, "llama 8B"},
+		{KV{"general.basename": "llama", "general.architecture": "llama"}, "llama"},
+		{KV{"general.name": "", "general.basename": "llama"}, "llama"},
+		{KV{"general.size_label": "8B", "general.architecture": "qwen2"}, "qwen2"},
+		{KV{"general.architecture": "qwen2"}, "qwen2"},
+		{KV{}, "unknown"},
+	} {
+		if got := tt.kv.ModelName(); got != tt.want {
+			t.Errorf("%v: expected %q, got %q", tt.kv, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// GGUFBuilder builds small GGUF files in code, e.g. as fixtures for testing
+// loaders. Each method checks its arguments and the first error is returned
+// by Write so calls can be chained.
+type GGUFBuilder struct {
+	kv      KV
+	tensors []Tensor
+	data    [][]byte
+
+	err error
+}
+
+func NewGGUFBuilder() *GGUFBuilder {
+	return &GGUFBuilder{kv: make(KV)}
+}
+
+// SetKV sets key to value. value must be one of the types Encode writes:
+// uint32, float32, bool, string, []int32, []uint32, []float32, []bool or
+// []string.
+func (b *GGUFBuilder) SetKV(key string, value any) *GGUFBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if key == "" {
+		b.err = errors.New("gguf builder: empty key")
+		return b
+	}
+
+	switch value.(type) {
+	case uint32, float32, bool, string, []int32, []uint32, []float32, []bool, []string:
+	default:
+		b.err = fmt.Errorf("gguf builder: unsupported type %T for %s", value, key)
+		return b
+	}
+
+	b.kv[key] = value
+	return b
+}
+
+// AddTensor adds a tensor of kind with data already encoded as that kind.
+// shape is in the order it is written to the file, innermost dimension first,
+// which is also the order DecodeGGML returns.
+func (b *GGUFBuilder) AddTensor(name string, shape []uint64, kind uint32, data []byte) *GGUFBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	if name == "" {
+		b.err = errors.New("gguf builder: empty tensor name")
+		return b
+	}
+
+	if slices.ContainsFunc(b.tensors, func(t Tensor) bool { return t.Name == name }) {
+		b.err = fmt.Errorf("gguf builder: duplicate tensor %s", name)
+		return b
+	}
+
+	if len(shape) == 0 || len(shape) > 4 || slices.Contains(shape, 0) {
+		b.err = fmt.Errorf("gguf builder: %s: invalid shape %v", name, shape)
+		return b
+	}
+
+	// Encode takes the shape outermost dimension first
+	t := Tensor{Name: name, Kind: kind, Shape: slices.Clone(shape)}
+	slices.Reverse(t.Shape)
+
+	if t.ElementSize() == 0 {
+		b.err = fmt.Errorf("gguf builder: %s: unknown kind %d", name, kind)
+		return b
+	}
+
+	if shape[0]%t.BlockSize() != 0 {
+		b.err = fmt.Errorf("gguf builder: %s: dimension %d isn't a multiple of the block size %d", name, shape[0], t.BlockSize())
+		return b
+	}
+
+	if uint64(len(data)) != t.Size() {
+		b.err = fmt.Errorf("gguf builder: %s: expected %d bytes of data, got %d", name, t.Size(), len(data))
+		return b
+	}
+
+	b.tensors = append(b.tensors, t)
+	b.data = append(b.data, data)
+	return b
+}
+
+// Write encodes the GGUF to ws in little endian
+func (b *GGUFBuilder) Write(ws io.WriteSeeker) error {
+	if b.err != nil {
+		return b.err
+	}
+
+	tensors := slices.Clone(b.tensors)
+	for i := range tensors {
+		tensors[i].WriterTo = bytes.NewReader(b.data[i])
+	}
+
+	return NewGGUFV3(binary.LittleEndian).Encode(ws, b.kv, tensors)
+}